@@ -31,16 +31,18 @@ import (
 	"github.com/writeas/web-core/log"
 	"github.com/writefreely/writefreely/author"
 	"github.com/writefreely/writefreely/config"
+	"github.com/writefreely/writefreely/i18n"
 	"github.com/writefreely/writefreely/page"
 )
 
 type (
 	userSettings struct {
-		Username string `schema:"username" json:"username"`
-		Email    string `schema:"email" json:"email"`
-		NewPass  string `schema:"new-pass" json:"new_pass"`
-		OldPass  string `schema:"current-pass" json:"current_pass"`
-		IsLogOut bool   `schema:"logout" json:"logout"`
+		Username string  `schema:"username" json:"username"`
+		Email    string  `schema:"email" json:"email"`
+		NewPass  string  `schema:"new-pass" json:"new_pass"`
+		OldPass  string  `schema:"current-pass" json:"current_pass"`
+		IsLogOut bool    `schema:"logout" json:"logout"`
+		Locale   *string `schema:"locale" json:"locale"`
 	}
 
 	UserPage struct {
@@ -590,12 +592,60 @@ func getVerboseAuthUser(app *App, token string, u *User, verbose bool) *AuthUser
 
 func viewExportOptions(app *App, u *User, w http.ResponseWriter, r *http.Request) error {
 	// Fetch extra user data
-	p := NewUserPage(app, r, u, "Export", nil)
+	flashes, _ := getSessionFlashes(app, w, r, nil)
+	p := NewUserPage(app, r, u, "Export", flashes)
+
+	jobs, err := app.db.GetUserJobs(u.ID, jobTypeExport, jobTypeExportStatic, jobTypeExportEPUB)
+	if err != nil {
+		return err
+	}
+	c, err := app.db.GetCollections(u, app.cfg.App.Host)
+	if err != nil {
+		return err
+	}
+
+	d := struct {
+		*UserPage
+		Collections *[]Collection
+		Jobs        *[]Job
+	}{
+		UserPage:    p,
+		Collections: c,
+		Jobs:        jobs,
+	}
 
-	showUserPage(w, "export", p)
+	showUserPage(w, "export", d)
 	return nil
 }
 
+// viewExportFull sends requests for the old /me/export.json download to the
+// export page, where a full export can be started.
+func viewExportFull(app *App, u *User, w http.ResponseWriter, r *http.Request) error {
+	return impart.HTTPError{http.StatusFound, "/me/export"}
+}
+
+// handleExportFull starts a job that compiles a full export of the user's
+// account, to be downloaded once it's ready.
+func handleExportFull(app *App, u *User, w http.ResponseWriter, r *http.Request) error {
+	j, err := newJob(app, u.ID, jobTypeExport)
+	if err != nil {
+		return err
+	}
+	if r.FormValue("pretty") == "1" {
+		j.Input = `{"pretty":true}`
+	}
+	err = app.jobs.enqueue(j)
+	if err != nil {
+		return err
+	}
+	if IsJSON(r) {
+		return impart.WriteSuccess(w, j, http.StatusAccepted)
+	}
+
+	_ = addSessionFlash(app, w, r, "Your export has started. It'll be ready to download below shortly.", nil)
+	return impart.HTTPError{http.StatusFound, "/me/export"}
+}
+
 func viewExportPosts(app *App, w http.ResponseWriter, r *http.Request) ([]byte, string, error) {
 	var filename string
 	var u = &User{}
@@ -660,24 +710,35 @@ func viewExportPosts(app *App, w http.ResponseWriter, r *http.Request) ([]byte,
 	return data, filename, err
 }
 
-func viewExportFull(app *App, w http.ResponseWriter, r *http.Request) ([]byte, string, error) {
-	var err error
-	filename := ""
-	u := getUserSession(app, r)
-	if u == nil {
-		return nil, filename, ErrNotLoggedIn
+// handleExportCollectionBook starts a job that exports one of the user's
+// collections, or only the posts in it with a given tag, as an EPUB book. It
+// also handles the old /me/c/{collection}/export.epub download URL.
+func handleExportCollectionBook(app *App, u *User, w http.ResponseWriter, r *http.Request) error {
+	alias := mux.Vars(r)["collection"]
+	if alias == "" {
+		alias = r.FormValue("collection")
+	}
+	c, err := app.db.GetCollection(alias)
+	if err != nil {
+		return err
+	}
+	if c.OwnerID != u.ID {
+		return ErrCollectionNotFound
 	}
-	filename = u.Username + "-" + time.Now().Truncate(time.Second).UTC().Format("200601021504")
-
-	exportUser := compileFullExport(app, u)
 
-	var data []byte
-	if r.FormValue("pretty") == "1" {
-		data, err = json.MarshalIndent(exportUser, "", "\t")
-	} else {
-		data, err = json.Marshal(exportUser)
+	j, err := newJob(app, u.ID, jobTypeExportEPUB)
+	if err != nil {
+		return err
 	}
-	return data, filename, err
+	input, _ := json.Marshal(epubJobInput{Collection: c.Alias, Tag: r.FormValue("tag")})
+	j.Input = string(input)
+	err = app.jobs.enqueue(j)
+	if err != nil {
+		return err
+	}
+
+	_ = addSessionFlash(app, w, r, fmt.Sprintf("Your book of %s has started. It'll be ready to download below shortly.", c.DisplayTitle()), nil)
+	return impart.HTTPError{http.StatusFound, "/me/export"}
 }
 
 func viewMeAPI(app *App, w http.ResponseWriter, r *http.Request) error {
@@ -785,20 +846,34 @@ func viewArticles(app *App, u *User, w http.ResponseWriter, r *http.Request) err
 		log.Error("unable to fetch collections: %v", err)
 	}
 
+	// Get team blogs drafts can be submitted to for review
+	mc, err := app.db.GetMemberCollections(u, roleContributor, app.cfg.App.Host)
+	if err != nil {
+		log.Error("unable to fetch member collections: %v", err)
+	}
+	reviews, err := app.db.GetUserPostReviews(u.ID, app.cfg.App.Host)
+	if err != nil {
+		log.Error("unable to fetch post reviews: %v", err)
+	}
+
 	silenced, err := app.db.IsUserSilenced(u.ID)
 	if err != nil {
 		log.Error("view articles: %v", err)
 	}
 	d := struct {
 		*UserPage
-		AnonymousPosts *[]PublicPost
-		Collections    *[]Collection
-		Silenced       bool
+		AnonymousPosts    *[]PublicPost
+		Collections       *[]Collection
+		ReviewCollections *[]Collection
+		Reviews           map[string]*PostReview
+		Silenced          bool
 	}{
-		UserPage:       NewUserPage(app, r, u, u.Username+"'s Posts", f),
-		AnonymousPosts: p,
-		Collections:    c,
-		Silenced:       silenced,
+		UserPage:          NewUserPage(app, r, u, u.Username+"'s Posts", f),
+		AnonymousPosts:    p,
+		Collections:       c,
+		ReviewCollections: mc,
+		Reviews:           reviews,
+		Silenced:          silenced,
 	}
 	d.UserPage.SetMessaging(u)
 	w.Header().Set("Cache-Control", "no-cache, no-store, must-revalidate")
@@ -825,20 +900,35 @@ func viewCollections(app *App, u *User, w http.ResponseWriter, r *http.Request)
 		log.Error("view collections %v", err)
 		return fmt.Errorf("view collections: %v", err)
 	}
+	mc, err := app.db.GetMemberCollections(u, roleContributor, app.cfg.App.Host)
+	if err != nil {
+		log.Error("view collections: %v", err)
+	}
+	reviewable := map[int64]bool{}
+	if mc != nil {
+		for i := range *mc {
+			reviewable[(*mc)[i].ID] = app.db.collectionRole(&(*mc)[i], u.ID).CanEditAll()
+		}
+	}
+
 	d := struct {
 		*UserPage
-		Collections *[]Collection
+		Collections       *[]Collection
+		MemberCollections *[]Collection
+		Reviewable        map[int64]bool
 
 		UsedCollections, TotalCollections int
 
 		NewBlogsDisabled bool
 		Silenced         bool
 	}{
-		UserPage:         NewUserPage(app, r, u, u.Username+"'s Blogs", f),
-		Collections:      c,
-		UsedCollections:  int(uc),
-		NewBlogsDisabled: !app.cfg.App.CanCreateBlogs(uc),
-		Silenced:         silenced,
+		UserPage:          NewUserPage(app, r, u, u.Username+"'s Blogs", f),
+		Collections:       c,
+		MemberCollections: mc,
+		Reviewable:        reviewable,
+		UsedCollections:   int(uc),
+		NewBlogsDisabled:  !app.cfg.App.CanCreateBlogs(uc),
+		Silenced:          silenced,
 	}
 	d.UserPage.SetMessaging(u)
 	showUserPage(w, "collections", d)
@@ -864,15 +954,25 @@ func viewEditCollection(app *App, u *User, w http.ResponseWriter, r *http.Reques
 		log.Error("view edit collection %v", err)
 		return fmt.Errorf("view edit collection: %v", err)
 	}
+	domain, err := app.db.GetCollectionDomain(c.ID)
+	if err != nil {
+		log.Error("view edit collection %v", err)
+	}
 	flashes, _ := getSessionFlashes(app, w, r, nil)
 	obj := struct {
 		*UserPage
 		*Collection
-		Silenced bool
+		Silenced     bool
+		CodeThemes   []string
+		Themes       []*Theme
+		CustomDomain *CustomDomain
 	}{
-		UserPage:   NewUserPage(app, r, u, "Edit "+c.DisplayTitle(), flashes),
-		Collection: c,
-		Silenced:   silenced,
+		UserPage:     NewUserPage(app, r, u, "Edit "+c.DisplayTitle(), flashes),
+		Collection:   c,
+		Silenced:     silenced,
+		CodeThemes:   codeThemes(),
+		Themes:       installedThemes(),
+		CustomDomain: domain,
 	}
 	obj.UserPage.CollAlias = c.Alias
 
@@ -1048,14 +1148,47 @@ func viewStats(app *App, u *User, w http.ResponseWriter, r *http.Request) error
 		TopPosts    *[]PublicPost
 		APFollowers int
 		Silenced    bool
+
+		Post       *PublicPost
+		StatsDays  int
+		DailyViews []DailyViews
+		Sources    []ViewCount
+		Referrers  []ViewCount
 	}{
 		UserPage:   NewUserPage(app, r, u, titleStats+"Stats", flashes),
 		VisitsBlog: alias,
 		Collection: c,
 		TopPosts:   topPosts,
 		Silenced:   silenced,
+		StatsDays:  statsDays,
 	}
 	obj.UserPage.CollAlias = c.Alias
+
+	postID := r.FormValue("post")
+	if postID != "" {
+		obj.Post, err = app.db.GetPost(postID, 0)
+		if err != nil {
+			return err
+		}
+		if obj.Post.CollectionID.Int64 != c.ID {
+			return ErrPostNotFound
+		}
+		obj.Post.Collection = &CollectionObj{Collection: *c}
+	}
+	since := statsSince()
+	daily, err := app.db.GetDailyViews(c.ID, postID, since)
+	if err != nil {
+		return err
+	}
+	obj.DailyViews = fillDailyViews(daily, since)
+	obj.Sources, err = app.db.GetViewSources(c.ID, postID, since)
+	if err != nil {
+		return err
+	}
+	obj.Referrers, err = app.db.GetTopReferrers(c.ID, postID, since)
+	if err != nil {
+		return err
+	}
 	if app.cfg.App.Federation {
 		folls, err := app.db.GetAPFollowers(c)
 		if err != nil {
@@ -1130,6 +1263,8 @@ func viewSettings(app *App, u *User, w http.ResponseWriter, r *http.Request) err
 		OauthGenericDisplayName string
 		OauthGitea              bool
 		GiteaDisplayName        string
+		Languages               []i18n.Language
+		UserLocale              string
 	}{
 		UserPage:                NewUserPage(app, r, u, "Account Settings", flashes),
 		Email:                   fullUser.EmailClear(app.keys),
@@ -1147,6 +1282,8 @@ func viewSettings(app *App, u *User, w http.ResponseWriter, r *http.Request) err
 		OauthGenericDisplayName: config.OrDefaultString(app.Config().GenericOauth.DisplayName, genericOauthDisplayName),
 		OauthGitea:              enableOauthGitea,
 		GiteaDisplayName:        config.OrDefaultString(app.Config().GiteaOauth.DisplayName, giteaDisplayName),
+		Languages:               locales.Languages(),
+		UserLocale:              app.db.GetUserAttribute(u.ID, "locale"),
 	}
 
 	showUserPage(w, "settings", obj)
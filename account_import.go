@@ -1,6 +1,7 @@
 package writefreely
 
 import (
+	"database/sql"
 	"encoding/json"
 	"fmt"
 	"html/template"
@@ -9,15 +10,32 @@ import (
 	"net/http"
 	"os"
 	"path/filepath"
+	"regexp"
 	"strings"
 	"time"
 
 	"github.com/hashicorp/go-multierror"
 	"github.com/writeas/impart"
 	wfimport "github.com/writeas/import"
+	"github.com/writeas/web-core/converter"
+	"github.com/writeas/web-core/id"
 	"github.com/writeas/web-core/log"
+	"github.com/writefreely/writefreely/author"
 )
 
+var validPostIDReg = regexp.MustCompile("^[a-zA-Z0-9]{10}$")
+
+// fullImportFile is the name an uploaded export is saved under, in a full
+// import job's input directory.
+const fullImportFile = "export.json"
+
+// fullImportResult holds the outcome of importing a full WriteFreely export.
+type fullImportResult struct {
+	Collections int
+	Posts       int
+	Errs        []error
+}
+
 func viewImport(app *App, u *User, w http.ResponseWriter, r *http.Request) error {
 	// Fetch extra user data
 	p := NewUserPage(app, r, u, "Import Posts", nil)
@@ -27,15 +45,28 @@ func viewImport(app *App, u *User, w http.ResponseWriter, r *http.Request) error
 		return impart.HTTPError{http.StatusInternalServerError, fmt.Sprintf("unable to fetch collections: %v", err)}
 	}
 
+	jobs, err := app.db.GetUserJobs(u.ID, jobTypeImport)
+	if err != nil {
+		return err
+	}
+	fullJobs, err := app.db.GetUserJobs(u.ID, jobTypeImportFull)
+	if err != nil {
+		return err
+	}
+
 	d := struct {
 		*UserPage
 		Collections *[]Collection
+		Jobs        *[]Job
+		FullJobs    *[]Job
 		Flashes     []template.HTML
 		Message     string
 		InfoMsg     bool
 	}{
 		UserPage:    p,
 		Collections: c,
+		Jobs:        jobs,
+		FullJobs:    fullJobs,
 		Flashes:     []template.HTML{},
 	}
 
@@ -55,17 +86,27 @@ func viewImport(app *App, u *User, w http.ResponseWriter, r *http.Request) error
 	return nil
 }
 
+// importJobInput describes the files uploaded for a text file import job.
+type importJobInput struct {
+	Collection string          `json:"collection"`
+	Files      []importJobFile `json:"files"`
+}
+
+type importJobFile struct {
+	// Name is the file's original name
+	Name string `json:"name"`
+	// Path is where the file was saved, relative to the job's input directory
+	Path string `json:"path"`
+	Date int64  `json:"date"`
+}
+
 func handleImport(app *App, u *User, w http.ResponseWriter, r *http.Request) error {
 	// limit 10MB per submission
 	r.ParseMultipartForm(10 << 20)
 
 	collAlias := r.PostFormValue("collection")
-	coll := &Collection{
-		ID: 0,
-	}
-	var err error
 	if collAlias != "" {
-		coll, err = app.db.GetCollection(collAlias)
+		coll, err := app.db.GetCollection(collAlias)
 		if err != nil {
 			log.Error("Unable to get collection for import: %s", err)
 			return err
@@ -76,21 +117,30 @@ func handleImport(app *App, u *User, w http.ResponseWriter, r *http.Request) err
 			_ = addSessionFlash(app, w, r, err.Message, nil)
 			return err
 		}
-		coll.hostName = app.cfg.App.Host
 	}
 
 	fileDates := make(map[string]int64)
-	err = json.Unmarshal([]byte(r.FormValue("fileDates")), &fileDates)
+	err := json.Unmarshal([]byte(r.FormValue("fileDates")), &fileDates)
 	if err != nil {
 		log.Error("invalid form data for file dates: %v", err)
 		return impart.HTTPError{http.StatusBadRequest, "form data for file dates was invalid"}
 	}
 	files := r.MultipartForm.File["files"]
+	if len(files) == 0 {
+		_ = addSessionFlash(app, w, r, "Select some files to import.", nil)
+		return impart.HTTPError{http.StatusFound, "/me/import"}
+	}
+
+	j, err := newJob(app, u.ID, jobTypeImport)
+	if err != nil {
+		return err
+	}
+	input := importJobInput{
+		Collection: collAlias,
+	}
 	var fileErrs []error
-	filesSubmitted := len(files)
-	var filesImported int
-	for _, formFile := range files {
-		fname := ""
+	for i, formFile := range files {
+		fname := fmt.Sprintf("%d.txt", i)
 		ok := func() bool {
 			file, err := formFile.Open()
 			if err != nil {
@@ -100,96 +150,455 @@ func handleImport(app *App, u *User, w http.ResponseWriter, r *http.Request) err
 			}
 			defer file.Close()
 
-			tempFile, err := ioutil.TempFile("", "post-upload-*.txt")
+			jobFile, err := os.Create(filepath.Join(j.inputDir(app), fname))
 			if err != nil {
 				fileErrs = append(fileErrs, fmt.Errorf("Internal error for %s", formFile.Filename))
-				log.Error("import file: create temp file %s: %v", formFile.Filename, err)
+				log.Error("import file: create job file %s: %v", formFile.Filename, err)
 				return false
 			}
-			defer tempFile.Close()
+			defer jobFile.Close()
 
-			_, err = io.Copy(tempFile, file)
+			_, err = io.Copy(jobFile, file)
 			if err != nil {
 				fileErrs = append(fileErrs, fmt.Errorf("Internal error for %s", formFile.Filename))
-				log.Error("import file: copy to temp location %s: %v", formFile.Filename, err)
+				log.Error("import file: copy to job location %s: %v", formFile.Filename, err)
 				return false
 			}
-
-			info, err := tempFile.Stat()
-			if err != nil {
-				fileErrs = append(fileErrs, fmt.Errorf("Internal error for %s", formFile.Filename))
-				log.Error("import file: stat temp file %s: %v", formFile.Filename, err)
-				return false
-			}
-			fname = info.Name()
 			return true
 		}()
 		if !ok {
 			continue
 		}
+		input.Files = append(input.Files, importJobFile{
+			Name: formFile.Filename,
+			Path: fname,
+			Date: fileDates[formFile.Filename],
+		})
+	}
+	if len(fileErrs) != 0 {
+		_ = addSessionFlash(app, w, r, multierror.ListFormatFunc(fileErrs), nil)
+	}
+	if len(input.Files) == 0 {
+		os.RemoveAll(j.dir(app))
+		return impart.HTTPError{http.StatusFound, "/me/import"}
+	}
 
-		post, err := wfimport.FromFile(filepath.Join(os.TempDir(), fname))
-		if err == wfimport.ErrEmptyFile {
-			// not a real error so don't log
-			_ = addSessionFlash(app, w, r, fmt.Sprintf("%s was empty, import skipped", formFile.Filename), nil)
-			continue
-		} else if err == wfimport.ErrInvalidContentType {
-			// same as above
-			_ = addSessionFlash(app, w, r, fmt.Sprintf("%s is not a supported post file", formFile.Filename), nil)
-			continue
-		} else if err != nil {
-			fileErrs = append(fileErrs, fmt.Errorf("failed to read copy of %s", formFile.Filename))
-			log.Error("import textfile: file to post: %v", err)
-			continue
+	data, err := json.Marshal(input)
+	if err != nil {
+		log.Error("import file: marshal job input: %v", err)
+		return impart.HTTPError{http.StatusInternalServerError, "Couldn't start import."}
+	}
+	j.Input = string(data)
+	err = app.jobs.enqueue(j)
+	if err != nil {
+		return err
+	}
+
+	_ = addSessionFlash(app, w, r, "INFO: Your import has started. You can follow its progress below.", nil)
+	return impart.HTTPError{http.StatusFound, "/me/import"}
+}
+
+// runImportJob creates posts from the text files uploaded with an import job.
+// When a job is resumed, files that were already imported are skipped.
+func runImportJob(app *App, j *Job, progress progressFunc) (string, string, error) {
+	input := importJobInput{}
+	err := json.Unmarshal([]byte(j.Input), &input)
+	if err != nil {
+		log.Error("import job: unmarshal input: %v", err)
+		return "", "", fmt.Errorf("Unable to read uploaded files.")
+	}
+
+	u, err := app.db.GetUserByID(j.UserID)
+	if err != nil {
+		return "", "", fmt.Errorf("Unable to find user.")
+	}
+	coll := &Collection{
+		ID: 0,
+	}
+	if input.Collection != "" {
+		coll, err = app.db.GetCollection(input.Collection)
+		if err != nil {
+			log.Error("Unable to get collection for import: %s", err)
+			return "", "", fmt.Errorf("Unable to find blog %s.", input.Collection)
+		}
+		coll.hostName = app.cfg.App.Host
+	}
+
+	// Each file that failed to import left a note, so anything else that was
+	// done before the job was interrupted was imported
+	notes := j.MessageLines()
+	filesSubmitted := len(input.Files)
+	filesImported := j.Progress - len(notes)
+	if err = progress(j.Progress, filesSubmitted, notes...); err != nil {
+		return "", "", err
+	}
+	for i := j.Progress; i < filesSubmitted; i++ {
+		f := input.Files[i]
+		err = importTextFile(app, u, coll, filepath.Join(j.inputDir(app), f.Path), f.Name, f.Date)
+		if err != nil {
+			notes = append(notes, err.Error())
+		} else {
+			filesImported++
 		}
 
-		if collAlias != "" {
-			post.Collection = collAlias
+		if err = progress(i+1, filesSubmitted, notes...); err != nil {
+			return "", "", err
+		}
+	}
+
+	verb := "posts"
+	if filesImported == 1 {
+		verb = "post"
+	}
+	msg := fmt.Sprintf("Import complete, %d %s imported.", filesImported, verb)
+	if filesImported != filesSubmitted {
+		msg = fmt.Sprintf("%d of %d posts imported.", filesImported, filesSubmitted)
+	}
+	return "", strings.Join(append([]string{msg}, notes...), "\n"), nil
+}
+
+// importTextFile creates a post from the given plain text or Markdown file,
+// in the given collection, federating it if necessary. Any error returned is
+// suitable for displaying to the user.
+func importTextFile(app *App, u *User, coll *Collection, path, name string, date int64) error {
+	post, err := wfimport.FromFile(path)
+	if err == wfimport.ErrEmptyFile {
+		// not a real error so don't log
+		return fmt.Errorf("%s was empty, import skipped", name)
+	} else if err == wfimport.ErrInvalidContentType {
+		// same as above
+		return fmt.Errorf("%s is not a supported post file", name)
+	} else if err != nil {
+		log.Error("import textfile: file to post: %v", err)
+		return fmt.Errorf("failed to read copy of %s", name)
+	}
+
+	if coll.ID > 0 {
+		post.Collection = coll.Alias
+	}
+	dateTime := time.Unix(date, 0)
+	post.Created = &dateTime
+	created := post.Created.Format("2006-01-02T15:04:05Z")
+	submittedPost := SubmittedPost{
+		Title:   &post.Title,
+		Content: &post.Content,
+		Font:    "norm",
+		Created: &created,
+	}
+	rp, err := app.db.CreatePost(u.ID, coll.ID, &submittedPost)
+	if err != nil {
+		log.Error("import textfile: create db post: %v", err)
+		return fmt.Errorf("failed to create post from %s", name)
+	}
+	if coll.ID > 0 {
+		app.pages.invalidate(coll.ID)
+		app.related.queue(coll.ID)
+	}
+
+	// Federate post, if necessary
+	if app.cfg.App.Federation && coll.ID > 0 {
+		go federatePost(
+			app,
+			&PublicPost{
+				Post: rp,
+				Collection: &CollectionObj{
+					Collection: *coll,
+				},
+			},
+			coll.ID,
+			false,
+		)
+	}
+	return nil
+}
+
+func handleImportFull(app *App, u *User, w http.ResponseWriter, r *http.Request) error {
+	// limit 10MB per submission
+	r.ParseMultipartForm(10 << 20)
+
+	file, _, err := r.FormFile("export")
+	if err != nil {
+		_ = addSessionFlash(app, w, r, "Select a WriteFreely export (.json) file to import.", nil)
+		return impart.HTTPError{http.StatusFound, "/me/import"}
+	}
+	defer file.Close()
+
+	j, err := newJob(app, u.ID, jobTypeImportFull)
+	if err != nil {
+		return err
+	}
+	jobFile, err := os.Create(filepath.Join(j.inputDir(app), fullImportFile))
+	if err != nil {
+		log.Error("import export: create job file: %v", err)
+		return impart.HTTPError{http.StatusInternalServerError, "Couldn't start import."}
+	}
+	defer jobFile.Close()
+	_, err = io.Copy(jobFile, file)
+	if err != nil {
+		log.Error("import export: copy to job location: %v", err)
+		_ = addSessionFlash(app, w, r, "Unable to read export file.", nil)
+		return impart.HTTPError{http.StatusFound, "/me/import"}
+	}
+
+	err = app.jobs.enqueue(j)
+	if err != nil {
+		return err
+	}
+
+	_ = addSessionFlash(app, w, r, "INFO: Your import has started. You can follow its progress below.", nil)
+	return impart.HTTPError{http.StatusFound, "/me/import"}
+}
+
+// runImportFullJob imports the export file uploaded with a full import job.
+func runImportFullJob(app *App, j *Job, progress progressFunc) (string, string, error) {
+	u, err := app.db.GetUserByID(j.UserID)
+	if err != nil {
+		return "", "", fmt.Errorf("Unable to find user.")
+	}
+
+	data, err := ioutil.ReadFile(filepath.Join(j.inputDir(app), fullImportFile))
+	if err != nil {
+		log.Error("import export: read job file: %v", err)
+		return "", "", fmt.Errorf("Unable to read export file.")
+	}
+
+	res, err := importFullExport(app, u, data, progress)
+	if err != nil {
+		return "", "", err
+	}
+
+	lines := []string{fmt.Sprintf("Import complete, %d blogs and %d posts imported.", res.Collections, res.Posts)}
+	for _, e := range res.Errs {
+		lines = append(lines, e.Error())
+	}
+	return "", strings.Join(lines, "\n"), nil
+}
+
+// importFullExport recreates the collections and posts in the given full JSON
+// export, as generated by compileFullExport, under the given user's account.
+// Posts that were already imported are skipped. Imported posts aren't
+// federated, so followers aren't flooded with old posts. If given, progress is
+// reported after each post.
+func importFullExport(app *App, u *User, data []byte, progress progressFunc) (*fullImportResult, error) {
+	exp := &ExportUser{}
+	err := json.Unmarshal(data, exp)
+	if err != nil {
+		log.Error("import export: unmarshal: %v", err)
+		return nil, fmt.Errorf("This doesn't look like a valid WriteFreely export file.")
+	}
+	if exp.Collections == nil && exp.AnonymousPosts == nil {
+		return nil, fmt.Errorf("This export file doesn't contain any blogs or posts.")
+	}
+
+	total := len(exp.AnonymousPosts)
+	if exp.Collections != nil {
+		for _, ec := range *exp.Collections {
+			if ec.Posts != nil {
+				total += len(*ec.Posts)
+			}
 		}
-		dateTime := time.Unix(fileDates[formFile.Filename], 0)
-		post.Created = &dateTime
-		created := post.Created.Format("2006-01-02T15:04:05Z")
-		submittedPost := SubmittedPost{
-			Title:   &post.Title,
-			Content: &post.Content,
-			Font:    "norm",
-			Created: &created,
+	}
+	done := 0
+	reportProgress := func() error {
+		if progress == nil {
+			return nil
+		}
+		return progress(done, total)
+	}
+
+	if err = reportProgress(); err != nil {
+		return nil, err
+	}
+
+	res := &fullImportResult{}
+	if exp.Collections != nil {
+		for i := range *exp.Collections {
+			ec := &(*exp.Collections)[i]
+			coll, err := importCollection(app, u, ec, res)
+			if err != nil {
+				res.Errs = append(res.Errs, fmt.Errorf("Unable to import blog %s: %v", ec.Alias, err))
+				continue
+			}
+			res.Collections++
+
+			// Keep track of new post IDs, so pinned posts can be restored
+			newIDs := map[string]string{}
+			if ec.Posts != nil {
+				for j := range *ec.Posts {
+					p := &(*ec.Posts)[j]
+					newID, created, err := importPost(app, u, coll, p)
+					if err != nil {
+						res.Errs = append(res.Errs, fmt.Errorf("Unable to import post %s: %v", p.ID, err))
+					} else {
+						newIDs[p.ID] = newID
+						if created {
+							res.Posts++
+						}
+					}
+
+					done++
+					if err = reportProgress(); err != nil {
+						return nil, err
+					}
+				}
+			}
+			for pos, pID := range ec.PinnedPosts {
+				newID, ok := newIDs[pID]
+				if !ok {
+					continue
+				}
+				err = app.db.UpdatePostPinState(true, newID, coll.ID, u.ID, int64(pos+1))
+				if err != nil {
+					res.Errs = append(res.Errs, fmt.Errorf("Unable to pin post %s", newID))
+				}
+			}
 		}
-		rp, err := app.db.CreatePost(u.ID, coll.ID, &submittedPost)
+	}
+
+	for i := range exp.AnonymousPosts {
+		p := &exp.AnonymousPosts[i]
+		_, created, err := importPost(app, u, nil, p)
 		if err != nil {
-			fileErrs = append(fileErrs, fmt.Errorf("failed to create post from %s", formFile.Filename))
-			log.Error("import textfile: create db post: %v", err)
-			continue
+			res.Errs = append(res.Errs, fmt.Errorf("Unable to import post %s: %v", p.ID, err))
+		} else if created {
+			res.Posts++
 		}
 
-		// Federate post, if necessary
-		if app.cfg.App.Federation && coll.ID > 0 {
-			go federatePost(
-				app,
-				&PublicPost{
-					Post: rp,
-					Collection: &CollectionObj{
-						Collection: *coll,
-					},
-				},
-				coll.ID,
-				false,
-			)
+		done++
+		if err = reportProgress(); err != nil {
+			return nil, err
 		}
-		filesImported++
 	}
-	if len(fileErrs) != 0 {
-		_ = addSessionFlash(app, w, r, multierror.ListFormatFunc(fileErrs), nil)
+
+	return res, nil
+}
+
+// importCollection finds or creates the user's collection with the exported
+// collection's alias, and applies the exported settings to it.
+func importCollection(app *App, u *User, ec *exportCollection, res *fullImportResult) (*Collection, error) {
+	coll, err := app.db.GetCollection(ec.Alias)
+	if err != nil {
+		if err, ok := err.(impart.HTTPError); !ok || err.Status != http.StatusNotFound {
+			return nil, err
+		}
+		if !author.IsValidUsername(app.cfg, ec.Alias) {
+			return nil, fmt.Errorf("alias isn't valid on this instance")
+		}
+		collCount, err := app.db.GetUserCollectionCount(u.ID)
+		if err != nil {
+			return nil, err
+		}
+		if !app.cfg.App.CanCreateBlogs(collCount) {
+			return nil, fmt.Errorf("you've reached the maximum number of blogs allowed")
+		}
+		coll, err = app.db.CreateCollection(app.cfg, ec.Alias, ec.Title, u.ID)
+		if err != nil {
+			return nil, err
+		}
+	} else if coll.OwnerID != u.ID {
+		return nil, fmt.Errorf("alias is already taken")
+	}
+	coll.hostName = app.cfg.App.Host
+
+	visibility := int(ec.Visibility)
+	if ec.Public {
+		visibility |= int(CollPublic)
+	}
+	if collVisibility(visibility)&CollProtected != 0 {
+		// Passwords aren't exported, so keep the blog private until its owner sets a new one
+		visibility = int(CollPrivate)
+		res.Errs = append(res.Errs, fmt.Errorf("Blog %s was password-protected, so it was imported as private. Set a new password in its settings.", ec.Alias))
+	}
+
+	sc := &SubmittedCollection{
+		OwnerID:     uint64(u.ID),
+		Title:       &ec.Title,
+		Description: &ec.Description,
+		StyleSheet:  &sql.NullString{String: ec.StyleSheet, Valid: ec.StyleSheet != ""},
+		Script:      &sql.NullString{String: ec.Script, Valid: ec.Script != ""},
+		Signature:   &sql.NullString{String: ec.Signature, Valid: ec.Signature != ""},
+		Visibility:  &visibility,
+		MathJax:     ec.MathJax,
+	}
+	if ec.Collection.Format != "" {
+		sc.Format = &sql.NullString{String: ec.Collection.Format, Valid: true}
+	}
+	if ec.Monetization != "" {
+		sc.Monetization = &ec.Monetization
+	}
+	err = app.db.UpdateCollection(sc, coll.Alias)
+	if err != nil {
+		log.Error("import export: update collection %s: %v", coll.Alias, err)
+		return nil, fmt.Errorf("couldn't apply blog settings")
 	}
 
-	if filesImported == filesSubmitted {
-		verb := "posts"
-		if filesSubmitted == 1 {
-			verb = "post"
+	return coll, nil
+}
+
+// importPost creates the given exported post under the user's account, and
+// in the given collection, if one is supplied. It keeps the post's original ID
+// when possible, and returns the ID the post ended up with, along with whether
+// or not it was newly created.
+func importPost(app *App, u *User, coll *Collection, p *PublicPost) (string, bool, error) {
+	if p.Post == nil {
+		return "", false, fmt.Errorf("missing post data")
+	}
+
+	var collID int64
+	if coll != nil {
+		collID = coll.ID
+	}
+
+	postID := p.ID
+	if !validPostIDReg.MatchString(postID) || app.db.PostIDExists(postID) {
+		if _, err := app.db.GetOwnedPost(postID, u.ID); err == nil {
+			// This post was already imported
+			return postID, false, nil
 		}
-		_ = addSessionFlash(app, w, r, fmt.Sprintf("SUCCESS: Import complete, %d %s imported.", filesImported, verb), nil)
-	} else if filesImported > 0 {
-		_ = addSessionFlash(app, w, r, fmt.Sprintf("INFO: %d of %d posts imported, see details below.", filesImported, filesSubmitted), nil)
+		// The post might have been imported under a new ID before
+		dupID, err := app.db.GetDuplicatePostID(u.ID, collID, p.Slug.String, p.Created, p.Content)
+		if err != nil {
+			return "", false, fmt.Errorf("couldn't check for an existing copy")
+		}
+		if dupID != "" {
+			return dupID, false, nil
+		}
+		postID = id.GenerateFriendlyRandomString(postIDLen)
 	}
-	return impart.HTTPError{http.StatusFound, "/me/import"}
+
+	title := p.Title.String
+	created := p.Created.UTC().Format("2006-01-02T15:04:05Z")
+	sp := &SubmittedPost{
+		Title:    &title,
+		Content:  &p.Content,
+		Font:     p.Font,
+		IsRTL:    converter.NullJSONBool{sql.NullBool{Bool: p.RTL.Bool, Valid: p.RTL.Valid}},
+		Language: converter.NullJSONString{sql.NullString{String: p.Language.String, Valid: p.Language.Valid}},
+		Created:  &created,
+	}
+	if !sp.isFontValid() {
+		sp.Font = "norm"
+	}
+
+	if collID > 0 && p.Slug.String != "" {
+		slug := p.Slug.String
+		sp.Slug = &slug
+	}
+
+	_, err := app.db.createPost(postID, u.ID, collID, sp)
+	if err != nil {
+		log.Error("import export: create post %s: %v", p.ID, err)
+		return "", false, fmt.Errorf("couldn't create post")
+	}
+	if collID > 0 {
+		app.pages.invalidate(collID)
+		app.related.queue(collID)
+	}
+
+	if !p.Updated.IsZero() {
+		// Not fatal; the post just shows as updated now
+		_ = app.db.SetPostUpdated(postID, p.Updated)
+	}
+
+	return postID, true, nil
 }
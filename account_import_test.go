@@ -0,0 +1,106 @@
+package writefreely
+
+import (
+	"database/sql"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/writefreely/writefreely/config"
+)
+
+func TestFullExportRoundTrip(t *testing.T) {
+	if !runMySQLTests() {
+		t.Skip("skipping mysql tests")
+	}
+	cfg := config.New()
+	cfg.App.Host = "http://localhost"
+	cfg.Server.PagesParentDir = "."
+
+	created := time.Date(2019, 3, 14, 15, 9, 26, 0, time.UTC)
+	posts := []struct {
+		id, title string
+		inColl    bool
+	}{
+		{"firstpost1", "First post", true},
+		{"secondpst2", "Second post", true},
+		{"mydraft003", "A draft", false},
+	}
+
+	// Export a blog, its posts, and a draft from one instance...
+	var data []byte
+	withTestDB(t, func(db *sql.DB) {
+		app := &App{cfg: cfg, db: &datastore{DB: db}}
+		u := &User{Username: "exporter", HashedPass: []byte("x")}
+		assert.NoError(t, app.db.CreateUser(cfg, u, "", ""))
+		coll, err := app.db.GetCollection(u.Username)
+		assert.NoError(t, err)
+
+		for i, p := range posts {
+			title, content := p.title, "Hello"
+			ts := created.Add(time.Duration(i) * time.Hour).Format("2006-01-02T15:04:05Z")
+			var collID int64
+			if p.inColl {
+				collID = coll.ID
+			}
+			_, err = app.db.createPost(p.id, u.ID, collID, &SubmittedPost{Title: &title, Content: &content, Created: &ts})
+			assert.NoError(t, err)
+		}
+		assert.NoError(t, app.db.UpdatePostPinState(true, "secondpst2", coll.ID, u.ID, 1))
+
+		exp, err := compileFullExport(app, u, nil)
+		assert.NoError(t, err)
+		data, err = json.Marshal(exp)
+		assert.NoError(t, err)
+	})
+
+	// ...and import it into another
+	withTestDB(t, func(db *sql.DB) {
+		app := &App{cfg: cfg, db: &datastore{DB: db}}
+		u := &User{Username: "importer", HashedPass: []byte("x")}
+		assert.NoError(t, app.db.CreateUser(cfg, u, "", ""))
+
+		res, err := importFullExport(app, u, data, nil)
+		assert.NoError(t, err)
+		assert.Empty(t, res.Errs)
+		assert.Equal(t, 1, res.Collections)
+		assert.Equal(t, 3, res.Posts)
+
+		coll, err := app.db.GetCollection("exporter")
+		assert.NoError(t, err)
+		assert.Equal(t, u.ID, coll.OwnerID)
+		collPosts, err := app.db.GetPosts(cfg, coll, 0, true, false, true)
+		assert.NoError(t, err)
+		byID := map[string]PublicPost{}
+		for _, p := range *collPosts {
+			byID[p.ID] = p
+		}
+		assert.Len(t, byID, 2)
+		first, second := byID["firstpost1"], byID["secondpst2"]
+		if assert.NotNil(t, first.Post) && assert.NotNil(t, second.Post) {
+			assert.Equal(t, "first-post", first.Slug.String)
+			assert.Equal(t, "second-post", second.Slug.String)
+			assert.True(t, first.Created.Equal(created), "first post created %s", first.Created)
+			assert.True(t, second.Created.Equal(created.Add(time.Hour)), "second post created %s", second.Created)
+			assert.False(t, first.PinnedPosition.Valid)
+			assert.Equal(t, int64(1), second.PinnedPosition.Int64)
+		}
+
+		draft, err := app.db.GetOwnedPost("mydraft003", u.ID)
+		assert.NoError(t, err)
+		assert.False(t, draft.CollectionID.Valid)
+
+		// Posts that were already imported are skipped the next time
+		res, err = importFullExport(app, u, data, nil)
+		assert.NoError(t, err)
+		assert.Empty(t, res.Errs)
+		assert.Equal(t, 0, res.Posts)
+		collPosts, err = app.db.GetPosts(cfg, coll, 0, true, false, true)
+		assert.NoError(t, err)
+		assert.Len(t, *collPosts, 2)
+		anonPosts, err := app.db.GetAnonymousPosts(u, 0)
+		assert.NoError(t, err)
+		assert.Len(t, *anonPosts, 1)
+	})
+}
@@ -178,10 +178,11 @@ func handleFetchCollectionOutbox(app *App, w http.ResponseWriter, r *http.Reques
 	ocp.OrderedItems = []interface{}{}
 
 	posts, err := app.db.GetPosts(app.cfg, c, p, false, true, false)
+	app.db.GetPostAuthors(c, posts)
 	for _, pp := range *posts {
 		pp.Collection = res
-		o := pp.ActivityObject(app)
-		a := activitystreams.NewCreateActivity(o)
+		o := pp.articleObject(app)
+		a := newArticleActivity(activitystreams.NewCreateActivity(o.Object), o)
 		a.Context = nil
 		ocp.OrderedItems = append(ocp.OrderedItems, *a)
 	}
@@ -672,6 +673,12 @@ func federatePost(app *App, p *PublicPost, collID int64, isUpdate bool) error {
 		return nil
 	}
 
+	// Pages aren't part of a blog's stream of posts, so they aren't federated
+	if p.IsPage {
+		return nil
+	}
+	p.loadAuthor(app, &p.Collection.Collection)
+
 	if debugging {
 		if isUpdate {
 			log.Info("Federating updated post!")
@@ -681,7 +688,7 @@ func federatePost(app *App, p *PublicPost, collID int64, isUpdate bool) error {
 	}
 
 	actor := p.Collection.PersonObject(collID)
-	na := p.ActivityObject(app)
+	na := p.articleObject(app)
 
 	// Add followers
 	p.Collection.ID = collID
@@ -707,7 +714,7 @@ func federatePost(app *App, p *PublicPost, collID int64, isUpdate bool) error {
 		}
 	}
 
-	var activity *activitystreams.Activity
+	var activity *articleActivity
 	// for each one of the shared inboxes
 	for si, instFolls := range inboxes {
 		// add all followers from that instance
@@ -719,9 +726,9 @@ func federatePost(app *App, p *PublicPost, collID int64, isUpdate bool) error {
 		// create a new "Create" activity
 		// with our article as object
 		if isUpdate {
-			activity = activitystreams.NewUpdateActivity(na)
+			activity = newArticleActivity(activitystreams.NewUpdateActivity(na.Object), na)
 		} else {
-			activity = activitystreams.NewCreateActivity(na)
+			activity = newArticleActivity(activitystreams.NewCreateActivity(na.Object), na)
 			activity.To = na.To
 			activity.CC = na.CC
 		}
@@ -736,10 +743,10 @@ func federatePost(app *App, p *PublicPost, collID int64, isUpdate bool) error {
 	// the mentioned users. This might seem wasteful but the code is
 	// cleaner than adding the mentioned users to CC here instead of
 	// in p.ActivityObject()
-	na = p.ActivityObject(app)
+	na = p.articleObject(app)
 	for _, tag := range na.Tag {
 		if tag.Type == "Mention" {
-			activity = activitystreams.NewCreateActivity(na)
+			activity = newArticleActivity(activitystreams.NewCreateActivity(na.Object), na)
 			activity.To = na.To
 			activity.CC = na.CC
 			// This here might be redundant in some cases as we might have already
@@ -0,0 +1,215 @@
+/*
+ * Copyright © 2021 A Bunch Tell LLC.
+ *
+ * This file is part of WriteFreely.
+ *
+ * WriteFreely is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License, included
+ * in the LICENSE file in this source code package.
+ */
+
+package writefreely
+
+import (
+	"bytes"
+	"encoding/csv"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/writeas/web-core/bots"
+	"github.com/writeas/web-core/log"
+)
+
+// statsDays is the number of days of post views shown on the stats page.
+const statsDays = 30
+
+// viewSource is where a post view came from. Views are only ever stored as
+// daily counts per post, source, and referring domain, so no IP addresses or
+// cookies are needed to record them.
+type viewSource int
+
+const (
+	// sourceDirect views have no referrer, e.g. from bookmarks, apps, or
+	// browsers that don't send one.
+	sourceDirect viewSource = iota + 1
+	// sourceWeb views came from a link on some other website.
+	sourceWeb
+	// sourceReader views came from this instance's Reader.
+	sourceReader
+	// sourceFediverse views came from a link on a fediverse instance that
+	// we've federated with.
+	sourceFediverse
+)
+
+var viewSourceNames = map[viewSource]string{
+	sourceDirect:    "direct",
+	sourceWeb:       "web",
+	sourceReader:    "reader",
+	sourceFediverse: "fediverse",
+}
+
+func (s viewSource) String() string {
+	return viewSourceNames[s]
+}
+
+// botUserAgentHints are substrings of user agents that belong to crawlers,
+// link preview fetchers, and scripts, but which bots.IsBot doesn't catch.
+var botUserAgentHints = []string{
+	"bot", "crawl", "spider", "slurp", "scrape", "preview", "fetch",
+	"curl/", "wget/", "python", "go-http-client", "java/", "okhttp", "libwww", "httpclient",
+	"headless", "phantomjs", "lighthouse",
+	// Fediverse servers fetching link previews
+	"http.rb", "mastodon/", "pleroma", "akkoma", "misskey", "friendica",
+}
+
+// isBotRequest returns whether the given request looks like it came from a
+// bot rather than a human reader.
+func isBotRequest(r *http.Request) bool {
+	if r.Method == "HEAD" {
+		return true
+	}
+	ua := r.UserAgent()
+	if ua == "" || bots.IsBot(ua) {
+		return true
+	}
+	ua = strings.ToLower(ua)
+	for _, h := range botUserAgentHints {
+		if strings.Contains(ua, h) {
+			return true
+		}
+	}
+	return false
+}
+
+// referrerDomain returns the domain that referred the given request, if any,
+// and what kind of source it is. Only the domain is kept, never the full URL.
+// Views from other websites are all sourceWeb here; the ones from fediverse
+// instances are picked out when the views are flushed.
+func referrerDomain(app *App, r *http.Request) (string, viewSource) {
+	ref := r.Referer()
+	if ref == "" {
+		return "", sourceDirect
+	}
+	refURL, err := url.Parse(ref)
+	if err != nil || refURL.Hostname() == "" {
+		return "", sourceDirect
+	}
+	domain := strings.TrimPrefix(strings.ToLower(refURL.Hostname()), "www.")
+	if len(domain) > 255 {
+		domain = domain[:255]
+	}
+
+	if hostURL, err := url.Parse(app.cfg.App.Host); err == nil && strings.EqualFold(refURL.Hostname(), hostURL.Hostname()) {
+		if refURL.Path == "/read" || strings.HasPrefix(refURL.Path, "/read/") {
+			return domain, sourceReader
+		}
+		return domain, sourceWeb
+	}
+	return domain, sourceWeb
+}
+
+// recordPostView counts a view of the given post, and adds it to the post's
+// daily stats.
+func recordPostView(app *App, postID string, r *http.Request) {
+	if !app.views.addPostView(r, postID) {
+		return
+	}
+	domain, src := referrerDomain(app, r)
+	app.views.addPostStats(postID, time.Now(), src, domain)
+}
+
+// DailyViews is the number of views on a single day.
+type DailyViews struct {
+	Day   time.Time
+	Views int64
+
+	// Percent of the day with the most views, for charts
+	Percent int
+}
+
+// ViewCount is the number of views from a single source or referrer.
+type ViewCount struct {
+	Name  string
+	Views int64
+}
+
+// PostView is a row of a collection's daily view stats.
+type PostView struct {
+	PostID   string
+	Day      time.Time
+	Source   viewSource
+	Referrer string
+	Views    int64
+}
+
+// fillDailyViews returns a view count for every day from since until today,
+// including days without any views.
+func fillDailyViews(views []DailyViews, since time.Time) []DailyViews {
+	byDay := map[string]int64{}
+	var max int64
+	for _, v := range views {
+		byDay[v.Day.Format("2006-01-02")] += v.Views
+	}
+	days := []DailyViews{}
+	today := time.Now().UTC()
+	for d := since; !d.After(today); d = d.AddDate(0, 0, 1) {
+		n := byDay[d.Format("2006-01-02")]
+		if n > max {
+			max = n
+		}
+		days = append(days, DailyViews{Day: d, Views: n})
+	}
+	if max > 0 {
+		for i := range days {
+			days[i].Percent = int(days[i].Views * 100 / max)
+		}
+	}
+	return days
+}
+
+// statsSince returns the first day shown on the stats page.
+func statsSince() time.Time {
+	return time.Now().UTC().Truncate(24*time.Hour).AddDate(0, 0, -(statsDays - 1))
+}
+
+func viewExportStats(app *App, w http.ResponseWriter, r *http.Request) ([]byte, string, error) {
+	var filename string
+	u := getUserSession(app, r)
+	if u == nil {
+		return nil, filename, ErrNotLoggedIn
+	}
+
+	c, err := app.db.GetCollection(mux.Vars(r)["collection"])
+	if err != nil {
+		return nil, filename, err
+	}
+	if c.OwnerID != u.ID {
+		return nil, filename, ErrCollectionNotFound
+	}
+
+	views, err := app.db.GetPostViews(c.ID, r.FormValue("post"), time.Time{})
+	if err != nil {
+		return nil, filename, err
+	}
+
+	rows := [][]string{
+		{"day", "post_id", "source", "referrer", "views"},
+	}
+	for _, v := range views {
+		rows = append(rows, []string{v.Day.Format("2006-01-02"), v.PostID, v.Source.String(), v.Referrer, strconv.FormatInt(v.Views, 10)})
+	}
+
+	var b bytes.Buffer
+	cw := csv.NewWriter(&b)
+	cw.WriteAll(rows) // calls Flush internally
+	if err := cw.Error(); err != nil {
+		log.Error("Unable to write stats CSV: %v", err)
+	}
+
+	filename = c.Alias + "-stats-" + time.Now().Truncate(time.Second).UTC().Format("200601021504")
+	return b.Bytes(), filename, nil
+}
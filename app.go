@@ -75,6 +75,11 @@ type App struct {
 	updates      *updatesCache
 
 	timeline *localTimeline
+	jobs     *jobQueue
+	views    *viewCounter
+	pages    *pageCache
+	related  *relatedIndexer
+	embeds   *embedFetcher
 }
 
 // DB returns the App's datastore
@@ -377,6 +382,12 @@ func pageForReq(app *App, r *http.Request) page.StaticPage {
 		}
 	}
 	p.CanViewReader = !app.cfg.App.Private || u != nil
+	p.Locale = localeForReq(app, r, u)
+	// Collections on their own domains are shown as if they were the only
+	// blog on the instance.
+	if mux.Vars(r)["domain"] != "" {
+		p.SingleUser = true
+	}
 
 	return p
 }
@@ -395,6 +406,14 @@ func Initialize(apper Apper, debug bool) (*App, error) {
 	if err != nil {
 		return nil, fmt.Errorf("load templates: %s", err)
 	}
+	err = InitThemes(apper.App().Config())
+	if err != nil {
+		return nil, fmt.Errorf("load themes: %s", err)
+	}
+	err = InitLocales(apper.App().Config())
+	if err != nil {
+		return nil, fmt.Errorf("load locales: %s", err)
+	}
 
 	// Load keys and set up session
 	initKeyPaths(apper.App()) // TODO: find a better way to do this, since it's unneeded in all Apper implementations
@@ -421,6 +440,13 @@ func Initialize(apper Apper, debug bool) (*App, error) {
 		initLocalTimeline(apper.App())
 	}
 
+	initJobQueue(apper.App())
+	initViewCounter(apper.App())
+	initPageCache(apper.App())
+	initCustomDomains(apper.App())
+	initRelatedIndexer(apper.App())
+	initEmbedFetcher(apper.App())
+
 	return apper.App(), nil
 }
 
@@ -446,6 +472,11 @@ func Serve(app *App, r *mux.Router) {
 		go initGopher(app)
 	}
 
+	// Start gemini server
+	if app.cfg.Server.GeminiPort > 0 && !app.cfg.App.Private {
+		go initGemini(app)
+	}
+
 	// Start web application server
 	var bindAddress = app.cfg.Server.Bind
 	if bindAddress == "" {
@@ -467,8 +498,8 @@ incorrect host name, and cause you to reach the CA's rate limit for certificate
 requests. We recommend supplying a valid host name.`)
 				log.Info("Using autocert on ANY host")
 			} else {
-				log.Info("Using autocert on host %s", host.Host)
-				m.HostPolicy = autocert.HostWhitelist(host.Host)
+				log.Info("Using autocert on host %s and verified custom domains", host.Host)
+				m.HostPolicy = customDomainHostPolicy(host.Hostname())
 			}
 			s := &http.Server{
 				Addr:    ":https",
@@ -779,6 +810,110 @@ func DoDeleteAccount(apper Apper, username string) error {
 	return nil
 }
 
+// ImportUserExport imports the blogs and posts in the given full JSON export
+// file into the given user's account.
+func ImportUserExport(apper Apper, username, filename string) error {
+	// Connect to the database
+	apper.LoadConfig()
+	connectToDatabase(apper.App())
+	defer shutdown(apper.App())
+
+	u, err := apper.App().db.GetUserForAuth(username)
+	if err != nil {
+		return fmt.Errorf("Unable to get user %s: %s", username, err)
+	}
+
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return fmt.Errorf("Unable to read export file: %s", err)
+	}
+
+	log.Info("Importing %s for user %s...", filename, u.Username)
+	res, err := importFullExport(apper.App(), u, data, nil)
+	if err != nil {
+		return err
+	}
+	for _, e := range res.Errs {
+		log.Error("%s", e)
+	}
+	log.Info("Imported %d blogs and %d posts.", res.Collections, res.Posts)
+	return nil
+}
+
+// ExportStaticCollection renders the collection with the given alias as a
+// static HTML site in the given directory. Feed and sitemap links point to
+// baseURL, if given, or the collection's current URL otherwise.
+func ExportStaticCollection(apper Apper, alias, dir, baseURL string) error {
+	apper.LoadConfig()
+	isSingleUser = apper.App().cfg.App.SingleUser
+
+	err := InitTemplates(apper.App().cfg)
+	if err != nil {
+		return fmt.Errorf("load templates: %s", err)
+	}
+	err = InitThemes(apper.App().cfg)
+	if err != nil {
+		return fmt.Errorf("load themes: %s", err)
+	}
+	err = InitLocales(apper.App().cfg)
+	if err != nil {
+		return fmt.Errorf("load locales: %s", err)
+	}
+
+	connectToDatabase(apper.App())
+	defer shutdown(apper.App())
+
+	var c *Collection
+	if isSingleUser {
+		c, err = apper.App().db.GetCollectionByID(1)
+	} else {
+		c, err = apper.App().db.GetCollection(alias)
+	}
+	if err != nil {
+		return fmt.Errorf("Unable to get collection %s: %s", alias, err)
+	}
+
+	log.Info("Exporting %s to %s...", c.Alias, dir)
+	err = exportStaticCollection(apper.App(), c, dir, baseURL, nil)
+	if err != nil {
+		return err
+	}
+	log.Info("Done.")
+	return nil
+}
+
+// SyncCollection mirrors the collection with the given alias to dir, a
+// directory of Markdown files, publishing any local changes. When commit is
+// true and dir is in a git working tree, the result is committed.
+func SyncCollection(apper Apper, alias, dir string, commit bool) error {
+	apper.LoadConfig()
+	isSingleUser = apper.App().cfg.App.SingleUser
+	connectToDatabase(apper.App())
+	defer shutdown(apper.App())
+
+	var c *Collection
+	var err error
+	if isSingleUser {
+		c, err = apper.App().db.GetCollectionByID(1)
+	} else {
+		c, err = apper.App().db.GetCollection(alias)
+	}
+	if err != nil {
+		return fmt.Errorf("Unable to get collection %s: %s", alias, err)
+	}
+
+	log.Info("Syncing %s with %s...", c.Alias, dir)
+	res, err := syncCollection(apper.App(), c, dir, commit)
+	if err != nil {
+		return err
+	}
+	for _, msg := range res.Conflicts {
+		log.Error("Conflict: %s", msg)
+	}
+	log.Info("Done. %d created, %d updated, %d pulled, %d removed, %d conflicts.", res.Created, res.Updated, res.Pulled, res.Removed, len(res.Conflicts))
+	return nil
+}
+
 func connectToDatabase(app *App) {
 	log.Info("Connecting to %s database...", app.cfg.Database.Type)
 
@@ -810,6 +945,19 @@ func connectToDatabase(app *App) {
 }
 
 func shutdown(app *App) {
+	if app.jobs != nil {
+		app.jobs.stop()
+	}
+	if app.views != nil {
+		app.views.stop()
+	}
+	if app.related != nil {
+		app.related.stop()
+	}
+	if app.embeds != nil {
+		app.embeds.stop()
+	}
+
 	log.Info("Closing database connection...")
 	app.db.Close()
 }
@@ -1,5 +1,5 @@
 /*
- * Copyright © 2018 A Bunch Tell LLC.
+ * Copyright © 2018-2021 A Bunch Tell LLC.
  *
  * This file is part of WriteFreely.
  *
@@ -11,8 +11,17 @@
 package writefreely
 
 import (
+	"bytes"
+	"container/list"
+	"crypto/sha256"
+	"encoding/gob"
+	"fmt"
+	"net/http"
+	"strconv"
 	"sync"
 	"time"
+
+	"github.com/writeas/web-core/log"
 )
 
 const (
@@ -67,3 +76,212 @@ func GetPostsCache(userID int64) *[]PublicPost {
 	}
 	return pci.Posts
 }
+
+// Cache stores data that's expensive to generate, like rendered pages, for a
+// limited time.
+type Cache interface {
+	// Get returns the value stored under key, and whether it was found.
+	Get(key string) ([]byte, bool)
+	// Set stores val under key. A ttl of 0 means it won't expire, though it
+	// can still be evicted.
+	Set(key string, val []byte, ttl time.Duration) error
+	Delete(key string) error
+}
+
+type memoryCacheItem struct {
+	key    string
+	val    []byte
+	expire time.Time
+}
+
+// memoryCache is an in-memory Cache that evicts its least recently used items
+// once it's full.
+type memoryCache struct {
+	mu    sync.Mutex
+	size  int
+	items map[string]*list.Element
+	lru   *list.List
+}
+
+func newMemoryCache(size int) *memoryCache {
+	return &memoryCache{
+		size:  size,
+		items: map[string]*list.Element{},
+		lru:   list.New(),
+	}
+}
+
+func (c *memoryCache) Get(key string) ([]byte, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	el, ok := c.items[key]
+	if !ok {
+		return nil, false
+	}
+	item := el.Value.(*memoryCacheItem)
+	if !item.expire.IsZero() && item.expire.Before(time.Now()) {
+		c.remove(el)
+		return nil, false
+	}
+	c.lru.MoveToFront(el)
+	return item.val, true
+}
+
+func (c *memoryCache) Set(key string, val []byte, ttl time.Duration) error {
+	item := &memoryCacheItem{key: key, val: val}
+	if ttl > 0 {
+		item.expire = time.Now().Add(ttl)
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if el, ok := c.items[key]; ok {
+		el.Value = item
+		c.lru.MoveToFront(el)
+		return nil
+	}
+	c.items[key] = c.lru.PushFront(item)
+	for c.lru.Len() > c.size {
+		c.remove(c.lru.Back())
+	}
+	return nil
+}
+
+func (c *memoryCache) Delete(key string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if el, ok := c.items[key]; ok {
+		c.remove(el)
+	}
+	return nil
+}
+
+func (c *memoryCache) remove(el *list.Element) {
+	c.lru.Remove(el)
+	delete(c.items, el.Value.(*memoryCacheItem).key)
+}
+
+const (
+	defaultPageCacheSize = 1000
+	pageCacheTime        = 10 * time.Minute
+)
+
+// cachedPage is a rendered public page, stored so it can be served to readers
+// who aren't logged in without hitting the database.
+type cachedPage struct {
+	ContentType string
+	Body        []byte
+	Modified    time.Time
+	ETag        string
+	// PostID is the post shown on the page, if any, so views can still be
+	// counted.
+	PostID string
+}
+
+// pageCache caches rendered collection pages, post pages, and feeds. Each
+// collection's pages are stored under a generation that's replaced whenever
+// the collection or its posts change, which invalidates all of them at once.
+//
+// A nil *pageCache caches nothing.
+type pageCache struct {
+	c Cache
+}
+
+func initPageCache(app *App) {
+	cfg := app.cfg.Server
+	switch cfg.PageCache {
+	case "none":
+		log.Info("Page cache disabled.")
+		return
+	case "redis":
+		log.Info("Using Redis page cache at %s", cfg.PageCacheAddress)
+		app.pages = &pageCache{c: newRedisCache(cfg.PageCacheAddress)}
+	default:
+		size := cfg.PageCacheSize
+		if size <= 0 {
+			size = defaultPageCacheSize
+		}
+		app.pages = &pageCache{c: newMemoryCache(size)}
+	}
+}
+
+func (pc *pageCache) generationKey(collID int64) string {
+	return "gen:" + strconv.FormatInt(collID, 10)
+}
+
+// generation returns the current generation of the collection's pages.
+func (pc *pageCache) generation(collID int64) string {
+	if gen, ok := pc.c.Get(pc.generationKey(collID)); ok {
+		return string(gen)
+	}
+	// Either nothing's been cached yet, or the generation was evicted, so
+	// start a new one that can't match any pages cached before.
+	gen := []byte(strconv.FormatInt(time.Now().UnixNano(), 36))
+	pc.c.Set(pc.generationKey(collID), gen, 0)
+	return string(gen)
+}
+
+// key returns the cache key for a page of the given kind in the collection.
+// The request's host and path tell apart pages of the same kind.
+func (pc *pageCache) key(collID int64, kind string, r *http.Request) string {
+	if pc == nil {
+		return ""
+	}
+	return fmt.Sprintf("page:%d:%s:%s:%s%s", collID, pc.generation(collID), kind, r.Host, r.URL.Path)
+}
+
+// get returns the page cached under key, or nil.
+func (pc *pageCache) get(key string) *cachedPage {
+	if pc == nil || key == "" {
+		return nil
+	}
+	data, ok := pc.c.Get(key)
+	if !ok {
+		return nil
+	}
+	p := &cachedPage{}
+	err := gob.NewDecoder(bytes.NewReader(data)).Decode(p)
+	if err != nil {
+		log.Error("Unable to decode cached page: %v", err)
+		return nil
+	}
+	return p
+}
+
+// set caches the given page under key, filling in its ETag.
+func (pc *pageCache) set(key string, p *cachedPage) {
+	p.ETag = fmt.Sprintf(`"%x"`, sha256.Sum256(p.Body))
+	if pc == nil || key == "" {
+		return
+	}
+	var buf bytes.Buffer
+	err := gob.NewEncoder(&buf).Encode(p)
+	if err != nil {
+		log.Error("Unable to encode cached page: %v", err)
+		return
+	}
+	err = pc.c.Set(key, buf.Bytes(), pageCacheTime)
+	if err != nil {
+		log.Error("Unable to cache page: %v", err)
+	}
+}
+
+// invalidate removes all cached pages of the given collection.
+func (pc *pageCache) invalidate(collID int64) {
+	if pc == nil {
+		return
+	}
+	err := pc.c.Delete(pc.generationKey(collID))
+	if err != nil {
+		log.Error("Unable to invalidate cached pages: %v", err)
+	}
+}
+
+// serve writes the page, or a 304 response if the reader already has the
+// current version of it.
+func (p *cachedPage) serve(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", p.ContentType)
+	w.Header().Set("ETag", p.ETag)
+	w.Header().Set("Cache-Control", "public, no-cache")
+	http.ServeContent(w, r, "", p.Modified, bytes.NewReader(p.Body))
+}
@@ -0,0 +1,164 @@
+/*
+ * Copyright © 2021 A Bunch Tell LLC.
+ *
+ * This file is part of WriteFreely.
+ *
+ * WriteFreely is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License, included
+ * in the LICENSE file in this source code package.
+ */
+
+package writefreely
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"time"
+)
+
+const (
+	defaultRedisAddress = "127.0.0.1:6379"
+	redisTimeout        = 2 * time.Second
+	redisMaxIdle        = 4
+)
+
+// redisCache is a Cache backed by a Redis-compatible server, like Redis,
+// KeyDB, or Valkey, typically running on the same machine. It speaks just
+// enough of the protocol for GET, SET, and DEL.
+type redisCache struct {
+	addr string
+	idle chan *redisConn
+}
+
+type redisConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func newRedisCache(addr string) *redisCache {
+	if addr == "" {
+		addr = defaultRedisAddress
+	}
+	return &redisCache{
+		addr: addr,
+		idle: make(chan *redisConn, redisMaxIdle),
+	}
+}
+
+func (c *redisCache) Get(key string) ([]byte, bool) {
+	res, err := c.do("GET", key)
+	if err != nil || res == nil {
+		return nil, false
+	}
+	return res, true
+}
+
+func (c *redisCache) Set(key string, val []byte, ttl time.Duration) error {
+	args := []string{"SET", key, string(val)}
+	if ttl > 0 {
+		args = append(args, "PX", strconv.FormatInt(ttl.Milliseconds(), 10))
+	}
+	_, err := c.do(args...)
+	return err
+}
+
+func (c *redisCache) Delete(key string) error {
+	_, err := c.do("DEL", key)
+	return err
+}
+
+func (c *redisCache) conn() (*redisConn, error) {
+	select {
+	case rc := <-c.idle:
+		return rc, nil
+	default:
+	}
+	conn, err := net.DialTimeout("tcp", c.addr, redisTimeout)
+	if err != nil {
+		return nil, err
+	}
+	return &redisConn{Conn: conn, r: bufio.NewReader(conn)}, nil
+}
+
+// do sends the given command and returns its reply, which is nil for a nil
+// reply.
+func (c *redisCache) do(args ...string) ([]byte, error) {
+	rc, err := c.conn()
+	if err != nil {
+		return nil, err
+	}
+	rc.SetDeadline(time.Now().Add(redisTimeout))
+
+	res, err := rc.do(args...)
+	if err != nil {
+		// Don't reuse a connection that may be out of sync
+		rc.Close()
+		if _, ok := err.(redisError); ok {
+			return nil, err
+		}
+		return nil, fmt.Errorf("redis: %v", err)
+	}
+
+	select {
+	case c.idle <- rc:
+	default:
+		rc.Close()
+	}
+	return res, nil
+}
+
+type redisError string
+
+func (e redisError) Error() string {
+	return "redis: " + string(e)
+}
+
+func (rc *redisConn) do(args ...string) ([]byte, error) {
+	cmd := fmt.Sprintf("*%d\r\n", len(args))
+	for _, a := range args {
+		cmd += fmt.Sprintf("$%d\r\n%s\r\n", len(a), a)
+	}
+	_, err := io.WriteString(rc, cmd)
+	if err != nil {
+		return nil, err
+	}
+	return readRedisReply(rc.r)
+}
+
+// readRedisReply reads a single reply that isn't an array.
+func readRedisReply(r *bufio.Reader) ([]byte, error) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	if len(line) < 3 || line[len(line)-2] != '\r' {
+		return nil, errors.New("malformed reply")
+	}
+	line = line[:len(line)-2]
+
+	switch line[0] {
+	case '+', ':':
+		return []byte(line[1:]), nil
+	case '-':
+		return nil, redisError(line[1:])
+	case '$':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil {
+			return nil, errors.New("malformed bulk reply")
+		}
+		if n < 0 {
+			return nil, nil
+		}
+		buf := make([]byte, n+2)
+		_, err = io.ReadFull(r, buf)
+		if err != nil {
+			return nil, err
+		}
+		return buf[:n], nil
+	}
+	return nil, fmt.Errorf("unexpected reply %q", line)
+}
@@ -0,0 +1,222 @@
+/*
+ * Copyright © 2021 A Bunch Tell LLC.
+ *
+ * This file is part of WriteFreely.
+ *
+ * WriteFreely is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License, included
+ * in the LICENSE file in this source code package.
+ */
+
+package writefreely
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMemoryCacheEvictsLeastRecentlyUsed(t *testing.T) {
+	c := newMemoryCache(2)
+	c.Set("a", []byte("1"), 0)
+	c.Set("b", []byte("2"), 0)
+	c.Get("a")
+	c.Set("c", []byte("3"), 0)
+
+	if _, ok := c.Get("b"); ok {
+		t.Error("expected b to be evicted")
+	}
+	if v, ok := c.Get("a"); !ok || string(v) != "1" {
+		t.Errorf("a = %q, %t; want 1, true", v, ok)
+	}
+	if v, ok := c.Get("c"); !ok || string(v) != "3" {
+		t.Errorf("c = %q, %t; want 3, true", v, ok)
+	}
+}
+
+func TestMemoryCacheExpires(t *testing.T) {
+	c := newMemoryCache(2)
+	c.Set("a", []byte("1"), time.Millisecond)
+	time.Sleep(5 * time.Millisecond)
+	if _, ok := c.Get("a"); ok {
+		t.Error("expected a to expire")
+	}
+}
+
+func TestPageCacheInvalidate(t *testing.T) {
+	pc := &pageCache{c: newMemoryCache(10)}
+	r := httptest.NewRequest("GET", "http://example.com/blog/", nil)
+
+	key := pc.key(1, "index", r)
+	pc.set(key, &cachedPage{ContentType: "text/html", Body: []byte("<p>Hi</p>")})
+	if p := pc.get(pc.key(1, "index", r)); p == nil || string(p.Body) != "<p>Hi</p>" {
+		t.Fatalf("cached page = %+v", p)
+	}
+
+	pc.invalidate(2)
+	if pc.get(pc.key(1, "index", r)) == nil {
+		t.Error("invalidating another collection removed the page")
+	}
+	pc.invalidate(1)
+	if p := pc.get(pc.key(1, "index", r)); p != nil {
+		t.Errorf("page still cached after invalidation: %+v", p)
+	}
+}
+
+func TestNilPageCache(t *testing.T) {
+	var pc *pageCache
+	r := httptest.NewRequest("GET", "http://example.com/blog/", nil)
+	key := pc.key(1, "index", r)
+	p := &cachedPage{Body: []byte("hi")}
+	pc.set(key, p)
+	if p.ETag == "" {
+		t.Error("expected ETag to be set")
+	}
+	if pc.get(key) != nil {
+		t.Error("nil page cache returned a page")
+	}
+	pc.invalidate(1)
+}
+
+func TestCachedPageNotModified(t *testing.T) {
+	p := &cachedPage{
+		ContentType: "text/html; charset=utf-8",
+		Body:        []byte("<p>Hi</p>"),
+		Modified:    time.Date(2021, 3, 4, 5, 6, 7, 0, time.UTC),
+	}
+	(*pageCache)(nil).set("", p)
+
+	rec := httptest.NewRecorder()
+	p.serve(rec, httptest.NewRequest("GET", "/", nil))
+	if rec.Code != http.StatusOK || rec.Body.String() != "<p>Hi</p>" {
+		t.Fatalf("got %d %q", rec.Code, rec.Body.String())
+	}
+	if rec.Header().Get("ETag") != p.ETag || rec.Header().Get("Last-Modified") == "" {
+		t.Errorf("missing validators in %v", rec.Header())
+	}
+
+	r := httptest.NewRequest("GET", "/", nil)
+	r.Header.Set("If-None-Match", p.ETag)
+	rec = httptest.NewRecorder()
+	p.serve(rec, r)
+	if rec.Code != http.StatusNotModified {
+		t.Errorf("If-None-Match: got %d, want 304", rec.Code)
+	}
+
+	r = httptest.NewRequest("GET", "/", nil)
+	r.Header.Set("If-Modified-Since", p.Modified.Add(time.Hour).Format(http.TimeFormat))
+	rec = httptest.NewRecorder()
+	p.serve(rec, r)
+	if rec.Code != http.StatusNotModified {
+		t.Errorf("If-Modified-Since: got %d, want 304", rec.Code)
+	}
+}
+
+func TestReadRedisReply(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    string
+		wantNil bool
+		wantErr bool
+	}{
+		{"+OK\r\n", "OK", false, false},
+		{":1\r\n", "1", false, false},
+		{"$5\r\nhello\r\n", "hello", false, false},
+		{"$-1\r\n", "", true, false},
+		{"-ERR wrong\r\n", "", true, true},
+		{"*1\r\n", "", true, true},
+	}
+	for _, test := range tests {
+		res, err := readRedisReply(bufio.NewReader(strings.NewReader(test.in)))
+		if (err != nil) != test.wantErr {
+			t.Errorf("%q: err = %v", test.in, err)
+			continue
+		}
+		if test.wantNil && res != nil {
+			t.Errorf("%q: got %q, want nil", test.in, res)
+		} else if string(res) != test.want {
+			t.Errorf("%q: got %q, want %q", test.in, res, test.want)
+		}
+	}
+}
+
+// fakeRedis serves GET, SET, and DEL from a map, for a single connection at a
+// time.
+func fakeRedis(t *testing.T) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Skipf("can't listen: %v", err)
+	}
+	t.Cleanup(func() { l.Close() })
+
+	data := map[string]string{}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			r := bufio.NewReader(conn)
+			for {
+				line, err := r.ReadString('\n')
+				if err != nil {
+					break
+				}
+				var n int
+				if _, err := fmt.Sscanf(line, "*%d\r\n", &n); err != nil {
+					break
+				}
+				args := make([]string, n)
+				for i := range args {
+					r.ReadString('\n')
+					arg, _ := r.ReadString('\n')
+					args[i] = strings.TrimSuffix(arg, "\r\n")
+				}
+				switch strings.ToUpper(args[0]) {
+				case "GET":
+					if v, ok := data[args[1]]; ok {
+						conn.Write([]byte("$" + strconv.Itoa(len(v)) + "\r\n" + v + "\r\n"))
+					} else {
+						conn.Write([]byte("$-1\r\n"))
+					}
+				case "SET":
+					data[args[1]] = args[2]
+					conn.Write([]byte("+OK\r\n"))
+				case "DEL":
+					delete(data, args[1])
+					conn.Write([]byte(":1\r\n"))
+				default:
+					conn.Write([]byte("-ERR unknown command\r\n"))
+				}
+			}
+			conn.Close()
+		}
+	}()
+	return l.Addr().String()
+}
+
+func TestRedisCache(t *testing.T) {
+	c := newRedisCache(fakeRedis(t))
+
+	if _, ok := c.Get("a"); ok {
+		t.Error("got value for missing key")
+	}
+	if err := c.Set("a", []byte("1"), time.Minute); err != nil {
+		t.Fatalf("set: %v", err)
+	}
+	if v, ok := c.Get("a"); !ok || string(v) != "1" {
+		t.Errorf("a = %q, %t; want 1, true", v, ok)
+	}
+	if err := c.Delete("a"); err != nil {
+		t.Fatalf("delete: %v", err)
+	}
+	if _, ok := c.Get("a"); ok {
+		t.Error("got value for deleted key")
+	}
+}
@@ -0,0 +1,70 @@
+/*
+ * Copyright © 2021 A Bunch Tell LLC.
+ *
+ * This file is part of WriteFreely.
+ *
+ * WriteFreely is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License, included
+ * in the LICENSE file in this source code package.
+ */
+
+package main
+
+import (
+	"fmt"
+
+	"github.com/urfave/cli/v2"
+	"github.com/writefreely/writefreely"
+)
+
+var (
+	cmdCollection cli.Command = cli.Command{
+		Name:    "collection",
+		Usage:   "collection management tools",
+		Aliases: []string{"blog"},
+		Subcommands: []*cli.Command{
+			&cmdExportStatic,
+			&cmdSyncCollection,
+		},
+	}
+
+	cmdExportStatic cli.Command = cli.Command{
+		Name:  "export-static",
+		Usage: "Export a collection as a static HTML site",
+		Flags: []cli.Flag{
+			&cli.StringFlag{
+				Name:  "base-url",
+				Usage: "URL the exported site will be hosted at, used in its feed and sitemap",
+			},
+		},
+		Action: exportStaticAction,
+	}
+
+	cmdSyncCollection cli.Command = cli.Command{
+		Name:  "sync",
+		Usage: "Sync a collection with a directory of Markdown files",
+		Flags: []cli.Flag{
+			&cli.BoolFlag{
+				Name:  "commit",
+				Usage: "Commit the synced files, if the directory is in a git repository",
+			},
+		},
+		Action: syncCollectionAction,
+	}
+)
+
+func exportStaticAction(c *cli.Context) error {
+	if c.NArg() < 2 {
+		return fmt.Errorf("No collection or directory passed. Example: writefreely collection export-static [ALIAS] [DIR]")
+	}
+	app := writefreely.NewApp(c.String("c"))
+	return writefreely.ExportStaticCollection(app, c.Args().Get(0), c.Args().Get(1), c.String("base-url"))
+}
+
+func syncCollectionAction(c *cli.Context) error {
+	if c.NArg() < 2 {
+		return fmt.Errorf("No collection or directory passed. Example: writefreely collection sync [ALIAS] [DIR]")
+	}
+	app := writefreely.NewApp(c.String("c"))
+	return writefreely.SyncCollection(app, c.Args().Get(0), c.Args().Get(1), c.Bool("commit"))
+}
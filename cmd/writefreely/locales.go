@@ -0,0 +1,38 @@
+/*
+ * Copyright © 2021 A Bunch Tell LLC.
+ *
+ * This file is part of WriteFreely.
+ *
+ * WriteFreely is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License, included
+ * in the LICENSE file in this source code package.
+ */
+
+package main
+
+import (
+	"github.com/urfave/cli/v2"
+	"github.com/writefreely/writefreely"
+)
+
+var (
+	cmdLocales cli.Command = cli.Command{
+		Name:  "locales",
+		Usage: "interface translation tools",
+		Subcommands: []*cli.Command{
+			&cmdMissingTranslations,
+		},
+	}
+
+	cmdMissingTranslations cli.Command = cli.Command{
+		Name:      "missing",
+		Usage:     "List interface messages that aren't translated yet",
+		ArgsUsage: "[LANG...]",
+		Action:    missingTranslationsAction,
+	}
+)
+
+func missingTranslationsAction(c *cli.Context) error {
+	app := writefreely.NewApp(c.String("c"))
+	return writefreely.FindMissingTranslations(app, c.Args().Slice())
+}
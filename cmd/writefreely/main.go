@@ -109,9 +109,11 @@ func main() {
 
 	app.Commands = []*cli.Command{
 		&cmdUser,
+		&cmdCollection,
 		&cmdDB,
 		&cmdConfig,
 		&cmdKeys,
+		&cmdLocales,
 		&cmdServe,
 	}
 
@@ -25,6 +25,7 @@ var (
 			&cmdAddUser,
 			&cmdDelUser,
 			&cmdResetPass,
+			&cmdImportUser,
 			// TODO: possibly add a user list command
 		},
 	}
@@ -56,6 +57,12 @@ var (
 		Aliases: []string{"resetpass", "reset"},
 		Action:  resetPassAction,
 	}
+
+	cmdImportUser cli.Command = cli.Command{
+		Name:   "import",
+		Usage:  "Import blogs and posts from a WriteFreely JSON export",
+		Action: importUserAction,
+	}
 )
 
 func addUserAction(c *cli.Context) error {
@@ -94,3 +101,11 @@ func resetPassAction(c *cli.Context) error {
 	app := writefreely.NewApp(c.String("c"))
 	return writefreely.ResetPassword(app, username)
 }
+
+func importUserAction(c *cli.Context) error {
+	if c.NArg() < 2 {
+		return fmt.Errorf("No user or file passed. Example: writefreely user import [USER] [FILE]")
+	}
+	app := writefreely.NewApp(c.String("c"))
+	return writefreely.ImportUserExport(app, c.Args().Get(0), c.Args().Get(1))
+}
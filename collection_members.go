@@ -0,0 +1,416 @@
+/*
+ * Copyright © 2021 A Bunch Tell LLC.
+ *
+ * This file is part of WriteFreely.
+ *
+ * WriteFreely is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License, included
+ * in the LICENSE file in this source code package.
+ */
+
+package writefreely
+
+import (
+	"database/sql"
+	"fmt"
+	"html/template"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/writeas/impart"
+	"github.com/writeas/web-core/id"
+	"github.com/writeas/web-core/log"
+)
+
+// collRole is a user's role in a collection. Roles are ordered, so each one
+// has all the permissions of the roles below it.
+type collRole int
+
+const (
+	roleNone collRole = iota
+	// roleContributor can read the collection, even when it's private.
+	roleContributor
+	// roleAuthor can publish posts to the collection, and edit and delete
+	// their own.
+	roleAuthor
+	// roleEditor can edit, delete, and pin any post in the collection.
+	roleEditor
+	// roleOwner is the collection's owner, who can also change its settings
+	// and manage its members. It's never stored as a member's role.
+	roleOwner
+)
+
+const (
+	collInviteIDLen      = 12
+	collInviteExpiryDays = 7
+)
+
+var collRoleNames = map[collRole]string{
+	roleContributor: "contributor",
+	roleAuthor:      "author",
+	roleEditor:      "editor",
+	roleOwner:       "owner",
+}
+
+// memberRoles are the roles that can be given to collection members.
+var memberRoles = []collRole{roleEditor, roleAuthor, roleContributor}
+
+func (r collRole) String() string {
+	return collRoleNames[r]
+}
+
+// WithArticle returns the role's name prefixed with "a" or "an".
+func (r collRole) WithArticle() string {
+	s := r.String()
+	if s != "" && strings.ContainsRune("aeiou", rune(s[0])) {
+		return "an " + s
+	}
+	return "a " + s
+}
+
+// CanRead returns whether the role can read the collection while it's private.
+func (r collRole) CanRead() bool {
+	return r >= roleContributor
+}
+
+// CanPost returns whether the role can publish posts to the collection.
+func (r collRole) CanPost() bool {
+	return r >= roleAuthor
+}
+
+// CanEditAll returns whether the role can edit others' posts.
+func (r collRole) CanEditAll() bool {
+	return r >= roleEditor
+}
+
+// CanSubmitForReview returns whether the role can submit drafts to the
+// collection for an editor to review.
+func (r collRole) CanSubmitForReview() bool {
+	return r.CanRead()
+}
+
+// CanReview returns whether the role can approve or reject drafts submitted to
+// the collection.
+func (r collRole) CanReview() bool {
+	return r.CanEditAll()
+}
+
+// CanModifyPost returns whether the role can edit or delete a post in the
+// collection, given whether the user with the role wrote it.
+func (r collRole) CanModifyPost(isAuthor bool) bool {
+	return r.CanEditAll() || (isAuthor && r.CanPost())
+}
+
+// parseMemberRole returns the member role with the given name, or roleNone.
+func parseMemberRole(s string) collRole {
+	for _, r := range memberRoles {
+		if r.String() == s {
+			return r
+		}
+	}
+	return roleNone
+}
+
+type (
+	// CollectionMember is a user who has been given a role in a collection
+	// they don't own.
+	CollectionMember struct {
+		User    *User
+		Role    collRole
+		Created time.Time
+	}
+
+	// CollectionInvite lets the first user who accepts it join a collection
+	// with the given role.
+	CollectionInvite struct {
+		ID           string
+		CollectionID int64
+		Role         collRole
+		OwnerID      int64
+		Created      time.Time
+		Expires      time.Time
+	}
+)
+
+func (i CollectionInvite) Expired() bool {
+	return i.Expires.Before(time.Now())
+}
+
+func (i CollectionInvite) ExpiresFriendly() string {
+	return i.Expires.Format("January 2, 2006, 3:04 PM")
+}
+
+// collectionRole returns the given user's role in the collection.
+func (db *datastore) collectionRole(c *Collection, userID int64) collRole {
+	if userID <= 0 {
+		return roleNone
+	}
+	if userID == c.OwnerID {
+		return roleOwner
+	}
+	role, err := db.GetCollectionMemberRole(c.ID, userID)
+	if err != nil {
+		return roleNone
+	}
+	return role
+}
+
+// postEditorOwnerID returns the ID of the user that owns the given post, if
+// the given user is allowed to edit it as a member of the post's collection.
+// Otherwise it returns userID, so callers can treat the result as the owner
+// ID to modify the post as.
+func (db *datastore) postEditorOwnerID(postID string, userID int64) int64 {
+	var ownerID, collID sql.NullInt64
+	err := db.QueryRow("SELECT owner_id, collection_id FROM posts WHERE id = ?", postID).Scan(&ownerID, &collID)
+	if err != nil || !ownerID.Valid || !collID.Valid || ownerID.Int64 == userID {
+		return userID
+	}
+	role, err := db.GetCollectionMemberRole(collID.Int64, userID)
+	if err != nil {
+		return userID
+	}
+	isAuthor := false
+	if role.CanPost() && !role.CanEditAll() {
+		a, _ := db.GetPostAuthor(postID)
+		isAuthor = a != nil && a.ID == userID
+	}
+	if role.CanModifyPost(isAuthor) {
+		return ownerID.Int64
+	}
+	return userID
+}
+
+// canEditPost returns whether the given user can edit the post owned by
+// ownerID, either as its owner or as a member of its collection.
+func (db *datastore) canEditPost(postID string, ownerID, userID int64) bool {
+	return db.postEditorOwnerID(postID, userID) == ownerID
+}
+
+// getOwnedCollection returns the collection with the alias in the request,
+// if it's owned by the given user.
+func getOwnedCollection(app *App, u *User, r *http.Request) (*Collection, error) {
+	c, err := app.db.GetCollection(mux.Vars(r)["collection"])
+	if err != nil {
+		return nil, err
+	}
+	if c.OwnerID != u.ID {
+		return nil, ErrCollectionNotFound
+	}
+	c.hostName = app.cfg.App.Host
+	return c, nil
+}
+
+func viewCollectionMembers(app *App, u *User, w http.ResponseWriter, r *http.Request) error {
+	c, err := getOwnedCollection(app, u, r)
+	if err != nil {
+		return err
+	}
+
+	flashes, _ := getSessionFlashes(app, w, r, nil)
+	p := struct {
+		*UserPage
+		Collection *Collection
+		Members    *[]CollectionMember
+		Invites    *[]CollectionInvite
+		Roles      []collRole
+		Silenced   bool
+	}{
+		UserPage:   NewUserPage(app, r, u, "Members", flashes),
+		Collection: c,
+		Roles:      memberRoles,
+	}
+	p.Silenced, err = app.db.IsUserSilenced(u.ID)
+	if err != nil {
+		log.Error("view collection members: %v", err)
+	}
+	p.Members, err = app.db.GetCollectionMembers(c.ID)
+	if err != nil {
+		return err
+	}
+	p.Invites, err = app.db.GetCollectionInvites(c.ID)
+	if err != nil {
+		return err
+	}
+
+	showUserPage(w, "members", p)
+	return nil
+}
+
+func handleCreateCollectionInvite(app *App, u *User, w http.ResponseWriter, r *http.Request) error {
+	if u.IsSilenced() {
+		return ErrUserSilenced
+	}
+	c, err := getOwnedCollection(app, u, r)
+	if err != nil {
+		return err
+	}
+
+	role := parseMemberRole(r.FormValue("role"))
+	if role == roleNone {
+		return impart.HTTPError{http.StatusBadRequest, "Invalid role."}
+	}
+
+	i := &CollectionInvite{
+		ID:           id.GenerateFriendlyRandomString(collInviteIDLen),
+		CollectionID: c.ID,
+		Role:         role,
+		OwnerID:      u.ID,
+		Expires:      time.Now().Add(collInviteExpiryDays * 24 * time.Hour),
+	}
+	err = app.db.CreateCollectionInvite(i)
+	if err != nil {
+		return err
+	}
+
+	return impart.HTTPError{http.StatusFound, "/me/c/" + c.Alias + "/members"}
+}
+
+func handleDeleteCollectionInvite(app *App, u *User, w http.ResponseWriter, r *http.Request) error {
+	c, err := getOwnedCollection(app, u, r)
+	if err != nil {
+		return err
+	}
+	i, err := app.db.GetCollectionInvite(mux.Vars(r)["code"])
+	if err != nil {
+		return err
+	}
+	if i.CollectionID != c.ID {
+		return impart.HTTPError{http.StatusNotFound, "Invite doesn't exist."}
+	}
+	err = app.db.DeleteCollectionInvite(i.ID)
+	if err != nil {
+		return err
+	}
+
+	return impart.HTTPError{http.StatusFound, "/me/c/" + c.Alias + "/members"}
+}
+
+// handleUpdateCollectionMember changes a member's role, or removes them from
+// the collection. Members can also remove themselves.
+func handleUpdateCollectionMember(app *App, u *User, w http.ResponseWriter, r *http.Request) error {
+	vars := mux.Vars(r)
+	c, err := app.db.GetCollection(vars["collection"])
+	if err != nil {
+		return err
+	}
+	member, err := app.db.GetUserForAuth(vars["username"])
+	if err != nil {
+		return err
+	}
+	isOwner := c.OwnerID == u.ID
+	if !isOwner && member.ID != u.ID {
+		return ErrCollectionNotFound
+	}
+	curRole, err := app.db.GetCollectionMemberRole(c.ID, member.ID)
+	if err != nil {
+		return err
+	}
+	if curRole == roleNone {
+		return impart.HTTPError{http.StatusNotFound, "Member doesn't exist."}
+	}
+
+	if r.FormValue("action") == "remove" {
+		err = app.db.RemoveCollectionMember(c.ID, member.ID)
+		if err != nil {
+			return err
+		}
+		if !isOwner {
+			addSessionFlash(app, w, r, fmt.Sprintf("You've left %s.", c.DisplayTitle()), nil)
+			return impart.HTTPError{http.StatusFound, "/me/c/"}
+		}
+		return impart.HTTPError{http.StatusFound, "/me/c/" + c.Alias + "/members"}
+	}
+
+	if !isOwner {
+		return ErrCollectionNotFound
+	}
+	role := parseMemberRole(r.FormValue("role"))
+	if role == roleNone {
+		return impart.HTTPError{http.StatusBadRequest, "Invalid role."}
+	}
+	err = app.db.SetCollectionMember(c.ID, member.ID, role)
+	if err != nil {
+		return err
+	}
+
+	return impart.HTTPError{http.StatusFound, "/me/c/" + c.Alias + "/members"}
+}
+
+func viewCollectionInvite(app *App, u *User, w http.ResponseWriter, r *http.Request) error {
+	i, err := app.db.GetCollectionInvite(mux.Vars(r)["code"])
+	if err != nil {
+		return err
+	}
+	c, err := app.db.GetCollectionByID(i.CollectionID)
+	if err != nil {
+		return err
+	}
+	c.hostName = app.cfg.App.Host
+
+	// Tell search engines not to index invite links
+	w.Header().Set("X-Robots-Tag", "noindex")
+
+	p := struct {
+		*UserPage
+		Invite     *CollectionInvite
+		Collection *Collection
+		Role       collRole
+	}{
+		UserPage:   NewUserPage(app, r, u, "Join "+c.DisplayTitle(), nil),
+		Invite:     i,
+		Collection: c,
+		Role:       app.db.collectionRole(c, u.ID),
+	}
+	showUserPage(w, "join", p)
+	return nil
+}
+
+func handleJoinCollection(app *App, u *User, w http.ResponseWriter, r *http.Request) error {
+	i, err := app.db.GetCollectionInvite(mux.Vars(r)["code"])
+	if err != nil {
+		return err
+	}
+	if i.Expired() {
+		return impart.HTTPError{http.StatusGone, "This invite link has expired."}
+	}
+	c, err := app.db.GetCollectionByID(i.CollectionID)
+	if err != nil {
+		return err
+	}
+	if c.OwnerID == u.ID {
+		addSessionFlash(app, w, r, fmt.Sprintf("You already own %s.", c.DisplayTitle()), nil)
+		return impart.HTTPError{http.StatusFound, "/me/c/"}
+	}
+
+	err = app.db.SetCollectionMember(c.ID, u.ID, i.Role)
+	if err != nil {
+		return err
+	}
+	err = app.db.DeleteCollectionInvite(i.ID)
+	if err != nil {
+		log.Error("join collection: %v", err)
+	}
+
+	addSessionFlash(app, w, r, fmt.Sprintf("You joined %s as %s.", c.DisplayTitle(), i.Role.WithArticle()), nil)
+	return impart.HTTPError{http.StatusFound, "/me/c/"}
+}
+
+// loadAuthor fills in the author of the given post from the collection, if
+// the collection has members to tell apart.
+func (p *PublicPost) loadAuthor(app *App, c *Collection) {
+	ps := []PublicPost{*p}
+	app.db.GetPostAuthors(c, &ps)
+	p.Author = ps[0].Author
+}
+
+// authorByline returns a line naming the post's author, to follow its content
+// when it's federated, since the post itself is attributed to its collection.
+// It's empty unless the post's author has been loaded.
+func (p *PublicPost) authorByline() string {
+	if p.Author == nil || p.Author.Username == "" {
+		return ""
+	}
+	return fmt.Sprintf(`<p class="author">— %s</p>`, template.HTMLEscapeString(p.Author.Username))
+}
@@ -0,0 +1,79 @@
+/*
+ * Copyright © 2021 A Bunch Tell LLC.
+ *
+ * This file is part of WriteFreely.
+ *
+ * WriteFreely is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License, included
+ * in the LICENSE file in this source code package.
+ */
+
+package writefreely
+
+import (
+	"testing"
+	"time"
+)
+
+func TestCollRolePermissions(t *testing.T) {
+	tests := []struct {
+		role collRole
+		// newPost is whether the role can publish to the collection
+		newPost bool
+		// ownPost is whether the role can edit or delete a post they wrote
+		ownPost bool
+		// otherPost is whether the role can edit or delete someone else's
+		// post
+		otherPost bool
+	}{
+		{roleNone, false, false, false},
+		{roleContributor, false, false, false},
+		{roleAuthor, true, true, false},
+		{roleEditor, true, true, true},
+		{roleOwner, true, true, true},
+	}
+	for _, test := range tests {
+		if got := test.role.CanPost(); got != test.newPost {
+			t.Errorf("%q newPost = %t, want %t", test.role, got, test.newPost)
+		}
+		// Editing and deleting an existing post are allowed under the same
+		// rule, in postEditorOwnerID
+		if got := test.role.CanModifyPost(true); got != test.ownPost {
+			t.Errorf("%q existingPost/deletePost (own) = %t, want %t", test.role, got, test.ownPost)
+		}
+		if got := test.role.CanModifyPost(false); got != test.otherPost {
+			t.Errorf("%q existingPost/deletePost (other's) = %t, want %t", test.role, got, test.otherPost)
+		}
+		if got, want := test.role.CanRead(), test.role != roleNone; got != want {
+			t.Errorf("%q CanRead = %t, want %t", test.role, got, want)
+		}
+	}
+}
+
+func TestParseMemberRole(t *testing.T) {
+	tests := map[string]collRole{
+		"contributor": roleContributor,
+		"author":      roleAuthor,
+		"editor":      roleEditor,
+		// Ownership can't be handed out with an invite
+		"owner": roleNone,
+		"":      roleNone,
+		"admin": roleNone,
+	}
+	for s, want := range tests {
+		if got := parseMemberRole(s); got != want {
+			t.Errorf("parseMemberRole(%q) = %q, want %q", s, got, want)
+		}
+	}
+}
+
+func TestCollectionInviteExpired(t *testing.T) {
+	i := CollectionInvite{Expires: time.Now().Add(time.Hour)}
+	if i.Expired() {
+		t.Error("Expected invite to be valid before it expires")
+	}
+	i.Expires = time.Now().Add(-time.Minute)
+	if !i.Expired() {
+		t.Error("Expected invite to be expired")
+	}
+}
@@ -0,0 +1,88 @@
+/*
+ * Copyright © 2021 A Bunch Tell LLC.
+ *
+ * This file is part of WriteFreely.
+ *
+ * WriteFreely is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License, included
+ * in the LICENSE file in this source code package.
+ */
+
+package writefreely
+
+import (
+	"net/http"
+
+	"github.com/gorilla/mux"
+	"github.com/writeas/impart"
+)
+
+// pagePosition returns the place among its collection's pages that a
+// submitted post should have, or 0 if it wasn't given.
+func pagePosition(p *SubmittedPost) int {
+	if p.PagePosition == nil {
+		return 0
+	}
+	return *p.PagePosition
+}
+
+// pageMenuItems returns menu items for the given pages, leaving out any that
+// the collection's menu already links to.
+func pageMenuItems(pages *[]PublicPost, menu []MenuItem) []MenuItem {
+	items := []MenuItem{}
+	for _, p := range *pages {
+		linked := false
+		for _, i := range menu {
+			if i.Type == menuItemPage && i.Target == p.Slug.String {
+				linked = true
+				break
+			}
+		}
+		if !linked {
+			items = append(items, MenuItem{Type: menuItemPage, Title: p.PlainDisplayTitle(), Target: p.Slug.String})
+		}
+	}
+	return items
+}
+
+// fetchCollectionPages handles an API endpoint for retrieving a collection's
+// pages, in order.
+func fetchCollectionPages(app *App, w http.ResponseWriter, r *http.Request) error {
+	c, err := app.db.GetCollection(mux.Vars(r)["alias"])
+	if err != nil {
+		return err
+	}
+	c.hostName = app.cfg.App.Host
+
+	userID, err := apiCheckCollectionPermissions(app, r, c)
+	if err != nil {
+		return err
+	}
+
+	pages, err := app.db.GetCollectionPages(app.cfg, c, userID == c.OwnerID)
+	if err != nil {
+		return err
+	}
+	if r.FormValue("body") == "html" {
+		baseURL := c.CanonicalURL()
+		for i := range *pages {
+			(*pages)[i].Content = applyCollectionMarkdown([]byte((*pages)[i].Content), baseURL, app.cfg, c)
+		}
+	}
+	return impart.WriteSuccess(w, pages, http.StatusOK)
+}
+
+// getPagePosition returns the place of the given post among its collection's
+// pages, counting from 1, or 0 if it isn't one.
+func getPagePosition(app *App, c *Collection, postID string) int {
+	pages, err := app.db.GetCollectionPages(app.cfg, c, true)
+	if err != nil {
+		return 0
+	}
+	for i, p := range *pages {
+		if p.ID == postID {
+			return i + 1
+		}
+	}
+	return 0
+}
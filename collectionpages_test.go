@@ -0,0 +1,36 @@
+/*
+ * Copyright © 2021 A Bunch Tell LLC.
+ *
+ * This file is part of WriteFreely.
+ *
+ * WriteFreely is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License, included
+ * in the LICENSE file in this source code package.
+ */
+
+package writefreely
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/guregu/null"
+	"github.com/guregu/null/zero"
+)
+
+func TestPageMenuItems(t *testing.T) {
+	pages := &[]PublicPost{
+		{Post: &Post{ID: "a", Slug: null.StringFrom("about"), Title: zero.StringFrom("About")}},
+		{Post: &Post{ID: "b", Slug: null.StringFrom("contact"), Title: zero.StringFrom("Contact")}},
+	}
+	menu := []MenuItem{
+		{Type: menuItemPage, Title: "Get in touch", Target: "contact"},
+		{Type: menuItemTag, Title: "#about", Target: "about"},
+	}
+	want := []MenuItem{
+		{Type: menuItemPage, Title: "About", Target: "about"},
+	}
+	if got := pageMenuItems(pages, menu); !reflect.DeepEqual(got, want) {
+		t.Errorf("pageMenuItems() = %v, want %v", got, want)
+	}
+}
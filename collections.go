@@ -11,6 +11,7 @@
 package writefreely
 
 import (
+	"bytes"
 	"database/sql"
 	"encoding/json"
 	"fmt"
@@ -21,13 +22,13 @@ import (
 	"regexp"
 	"strconv"
 	"strings"
+	"time"
 	"unicode"
 
 	"github.com/gorilla/mux"
 	"github.com/writeas/impart"
 	"github.com/writeas/web-core/activitystreams"
 	"github.com/writeas/web-core/auth"
-	"github.com/writeas/web-core/bots"
 	"github.com/writeas/web-core/log"
 	waposts "github.com/writeas/web-core/posts"
 	"github.com/writefreely/writefreely/author"
@@ -68,6 +69,8 @@ type (
 		Owner      *User         `json:"owner,omitempty"`
 		Posts      *[]PublicPost `json:"posts,omitempty"`
 		Format     *CollectionFormat
+		Menu       []MenuItem `json:"menu,omitempty"`
+		Categories []string   `json:"categories,omitempty"`
 	}
 	DisplayCollection struct {
 		*CollectionObj
@@ -87,6 +90,7 @@ type (
 		Privacy   int    `schema:"privacy" json:"privacy"`
 		Pass      string `schema:"password" json:"password"`
 		MathJax   bool   `schema:"mathjax" json:"mathjax"`
+		TOC       bool   `schema:"toc" json:"toc"`
 		Handle    string `schema:"handle" json:"handle"`
 
 		// Actual collection values updated in the DB
@@ -97,6 +101,9 @@ type (
 		Script       *sql.NullString `schema:"script" json:"script"`
 		Signature    *sql.NullString `schema:"signature" json:"signature"`
 		Monetization *string         `schema:"monetization_pointer" json:"monetization_pointer"`
+		ReadNext     *int            `schema:"read_next" json:"read_next"`
+		CodeTheme    *string         `schema:"code_theme" json:"code_theme"`
+		Theme        *string         `schema:"theme" json:"theme"`
 		Visibility   *int            `schema:"visibility" json:"public"`
 		Format       *sql.NullString `schema:"format" json:"format"`
 	}
@@ -111,6 +118,7 @@ type (
 
 		// User-related fields
 		isCollOwner bool
+		role        collRole
 
 		isAuthorized bool
 	}
@@ -252,6 +260,14 @@ func (c *Collection) RedirectingCanonicalURL(isRedir bool) string {
 	if isSingleUser {
 		return c.hostName + "/"
 	}
+	if d := c.Domain(); d != "" {
+		// Serve the custom domain over the same scheme as the instance
+		scheme := "https"
+		if strings.HasPrefix(c.hostName, "http://") {
+			scheme = "http"
+		}
+		return scheme + "://" + d + "/"
+	}
 
 	return fmt.Sprintf("%s/%s/", c.hostName, c.Alias)
 }
@@ -460,8 +476,7 @@ func apiCheckCollectionPermissions(app *App, r *http.Request, c *Collection) (in
 	if accessToken != "" {
 		userID = app.db.GetUserID(accessToken)
 	}
-	isCollOwner := userID == c.OwnerID
-	if c.IsPrivate() && !isCollOwner {
+	if c.IsPrivate() && !app.db.collectionRole(c, userID).CanRead() {
 		// Collection is private, but user isn't authenticated
 		return -1, ErrCollectionNotFound
 	}
@@ -517,6 +532,8 @@ func fetchCollection(app *App, w http.ResponseWriter, r *http.Request) error {
 	}
 	// TODO: check status for silenced
 	app.db.GetPostsCount(res, isCollOwner)
+	res.Menu = getCollectionMenu(app, c)
+	res.Categories, _ = app.db.GetCollectionCategories(c.ID)
 	// Strip non-public information
 	res.Collection.ForPublic()
 
@@ -622,6 +639,8 @@ func (c *CollectionObj) CanShowScript() bool {
 func processCollectionRequest(cr *collectionReq, vars map[string]string, w http.ResponseWriter, r *http.Request) error {
 	cr.prefix = vars["prefix"]
 	cr.alias = vars["collection"]
+	cr.domain = vars["domain"]
+	cr.isCustomDomain = cr.domain != ""
 	// Normalize the URL, redirecting user to consistent post URL
 	if cr.alias != strings.ToLower(cr.alias) {
 		return impart.HTTPError{http.StatusMovedPermanently, fmt.Sprintf("/%s/", strings.ToLower(cr.alias))}
@@ -675,11 +694,18 @@ func processCollectionPermissions(app *App, cr *collectionReq, u *User, w http.R
 	}
 	c.hostName = app.cfg.App.Host
 
+	if err = customDomainRedirect(c, cr, u, r); err != nil {
+		return nil, err
+	}
+
 	// Update CollectionRequest to reflect owner status
 	cr.isCollOwner = u != nil && u.ID == c.OwnerID
+	if u != nil {
+		cr.role = app.db.collectionRole(c, u.ID)
+	}
 
 	// Check permissions
-	if !cr.isCollOwner {
+	if !cr.role.CanRead() {
 		if c.IsPrivate() {
 			return nil, ErrCollectionNotFound
 		} else if c.IsProtected() {
@@ -748,7 +774,7 @@ func newDisplayCollection(c *Collection, cr *collectionReq, page int) *DisplayCo
 		CollectionObj: NewCollectionObj(c),
 		CurrentPage:   page,
 		Prefix:        cr.prefix,
-		IsTopLevel:    isSingleUser,
+		IsTopLevel:    isSingleUser || cr.isCustomDomain,
 	}
 	c.db.GetPostsCount(coll.CollectionObj, cr.isCollOwner)
 	return coll
@@ -801,6 +827,18 @@ func handleViewCollection(app *App, w http.ResponseWriter, r *http.Request) erro
 		return impart.RenderActivityJSON(w, ac, http.StatusOK)
 	}
 
+	// Serve a cached page to readers who aren't logged in
+	cacheable := u == nil && c.IsPublic() && !silenced && r.FormValue("greeting") == ""
+	var cacheKey string
+	if cacheable {
+		cacheKey = app.pages.key(c.ID, "index", r)
+		if cp := app.pages.get(cacheKey); cp != nil {
+			countCollectionView(app, u, c, r)
+			cp.serve(w, r)
+			return nil
+		}
+	}
+
 	// Fetch extra data about the Collection
 	// TODO: refactor out this logic, shared in collection.go:fetchCollection()
 	coll := newDisplayCollection(c, cr, page)
@@ -808,13 +846,14 @@ func handleViewCollection(app *App, w http.ResponseWriter, r *http.Request) erro
 	coll.TotalPages = int(math.Ceil(float64(coll.TotalPosts) / float64(coll.Format.PostsPerPage())))
 	if coll.TotalPages > 0 && page > coll.TotalPages {
 		redirURL := fmt.Sprintf("/page/%d", coll.TotalPages)
-		if !app.cfg.App.SingleUser {
+		if !app.cfg.App.SingleUser && !cr.isCustomDomain {
 			redirURL = fmt.Sprintf("/%s%s%s", cr.prefix, coll.Alias, redirURL)
 		}
 		return impart.HTTPError{http.StatusFound, redirURL}
 	}
 
 	coll.Posts, _ = app.db.GetPosts(app.cfg, c, page, cr.isCollOwner, false, false)
+	app.db.GetPostAuthors(c, coll.Posts)
 
 	// Serve collection
 	displayPage := CollectionPage{
@@ -862,37 +901,68 @@ func handleViewCollection(app *App, w http.ResponseWriter, r *http.Request) erro
 	// Add more data
 	// TODO: fix this mess of collections inside collections
 	displayPage.PinnedPosts, _ = app.db.GetPinnedPosts(coll.CollectionObj, isOwner)
+	coll.Menu = getCollectionMenu(app, c)
 	displayPage.Monetization = app.db.GetCollectionAttribute(coll.ID, "monetization_pointer")
 
 	collTmpl := "collection"
 	if app.cfg.App.Chorus {
 		collTmpl = "chorus-collection"
 	}
-	err = templates[collTmpl].ExecuteTemplate(w, "collection", displayPage)
-	if err != nil {
-		log.Error("Unable to render collection index: %v", err)
-	}
-
-	// Update collection view count
-	go func() {
-		// Don't update if owner is viewing the collection.
-		if u != nil && u.ID == coll.OwnerID {
-			return
-		}
-		// Only update for human views
-		if r.Method == "HEAD" || bots.IsBot(r.UserAgent()) {
-			return
+	if cacheable {
+		var buf bytes.Buffer
+		err = collectionTemplate(c, collTmpl).ExecuteTemplate(&buf, "collection", displayPage)
+		if err != nil {
+			log.Error("Unable to render collection index: %v", err)
+		} else {
+			cp := &cachedPage{
+				ContentType: "text/html; charset=utf-8",
+				Body:        buf.Bytes(),
+				Modified:    postsLastModified(coll.Posts, displayPage.PinnedPosts),
+			}
+			app.pages.set(cacheKey, cp)
+			cp.serve(w, r)
 		}
-
-		_, err := app.db.Exec("UPDATE collections SET view_count = view_count + 1 WHERE id = ?", coll.ID)
+	} else {
+		err = collectionTemplate(c, collTmpl).ExecuteTemplate(w, "collection", displayPage)
 		if err != nil {
-			log.Error("Unable to update collections count: %v", err)
+			log.Error("Unable to render collection index: %v", err)
 		}
-	}()
+	}
+
+	countCollectionView(app, u, c, r)
 
 	return err
 }
 
+// countCollectionView counts a view of the collection, unless it's by the
+// collection's owner or a bot.
+func countCollectionView(app *App, u *User, c *Collection, r *http.Request) {
+	if u != nil && u.ID == c.OwnerID {
+		return
+	}
+	if isBotRequest(r) {
+		return
+	}
+	app.views.addCollectionView(r, c.ID)
+}
+
+// postsLastModified returns when the most recently updated of the given posts
+// was last updated.
+func postsLastModified(posts ...*[]PublicPost) time.Time {
+	var t time.Time
+	for _, ps := range posts {
+		if ps == nil {
+			continue
+		}
+		for _, p := range *ps {
+			if p.Updated.After(t) {
+				t = p.Updated
+			}
+		}
+	}
+	return t
+}
+
 func handleViewMention(app *App, w http.ResponseWriter, r *http.Request) error {
 	vars := mux.Vars(r)
 	handle := vars["handle"]
@@ -931,6 +1001,7 @@ func handleViewCollectionTag(app *App, w http.ResponseWriter, r *http.Request) e
 	coll := newDisplayCollection(c, cr, page)
 
 	coll.Posts, _ = app.db.GetPostsTagged(app.cfg, c, tag, page, cr.isCollOwner)
+	app.db.GetPostAuthors(c, coll.Posts)
 	if coll.Posts != nil && len(*coll.Posts) == 0 {
 		return ErrCollectionPageNotFound
 	}
@@ -938,14 +1009,16 @@ func handleViewCollectionTag(app *App, w http.ResponseWriter, r *http.Request) e
 	// Serve collection
 	displayPage := struct {
 		CollectionPage
-		Tag string
+		Tag            string
+		TagDescription string
 	}{
 		CollectionPage: CollectionPage{
 			DisplayCollection: coll,
 			StaticPage:        pageForReq(app, r),
 			IsCustomDomain:    cr.isCustomDomain,
 		},
-		Tag: tag,
+		Tag:            tag,
+		TagDescription: app.db.GetCollectionTagDescription(c.ID, tag),
 	}
 	var owner *User
 	if u != nil {
@@ -981,6 +1054,7 @@ func handleViewCollectionTag(app *App, w http.ResponseWriter, r *http.Request) e
 	// Add more data
 	// TODO: fix this mess of collections inside collections
 	displayPage.PinnedPosts, _ = app.db.GetPinnedPosts(coll.CollectionObj, isOwner)
+	coll.Menu = getCollectionMenu(app, c)
 	displayPage.Monetization = app.db.GetCollectionAttribute(coll.ID, "monetization_pointer")
 
 	err = templates["collection-tags"].ExecuteTemplate(w, "collection-tags", displayPage)
@@ -1003,7 +1077,7 @@ func handleCollectionPostRedirect(app *App, w http.ResponseWriter, r *http.Reque
 
 	// Normalize the URL, redirecting user to consistent post URL
 	loc := fmt.Sprintf("/%s", slug)
-	if !app.cfg.App.SingleUser {
+	if !app.cfg.App.SingleUser && !cr.isCustomDomain {
 		loc = fmt.Sprintf("/%s/%s", cr.alias, slug)
 	}
 	return impart.HTTPError{http.StatusFound, loc}
@@ -1088,6 +1162,9 @@ func existingCollection(app *App, w http.ResponseWriter, r *http.Request) error
 			return err
 		}
 	}
+	if coll, err := app.db.GetCollection(collAlias); err == nil {
+		app.pages.invalidate(coll.ID)
+	}
 
 	if reqJSON {
 		return impart.WriteSuccess(w, struct {
@@ -1173,7 +1250,7 @@ func handleWebCollectionUnlock(app *App, w http.ResponseWriter, r *http.Request)
 	}
 
 	next := "/" + readReq.Next
-	if !app.cfg.App.SingleUser {
+	if !app.cfg.App.SingleUser && customDomains.collection(hostWithoutPort(r.Host)) == 0 {
 		next = "/" + readReq.Alias + next
 	}
 	return impart.HTTPError{http.StatusFound, next}
@@ -45,11 +45,35 @@ type (
 		StaticParentDir    string `ini:"static_parent_dir"`
 		PagesParentDir     string `ini:"pages_parent_dir"`
 		KeysParentDir      string `ini:"keys_parent_dir"`
+		JobsParentDir      string `ini:"jobs_parent_dir"`
+		CacheParentDir     string `ini:"cache_parent_dir"`
+		ThemesParentDir    string `ini:"themes_parent_dir"`
 
 		HashSeed string `ini:"hash_seed"`
 
 		GopherPort int `ini:"gopher_port"`
 
+		// GeminiPort is where the Gemini server listens, if set. Unless a
+		// certificate is given, a self-signed one is generated.
+		GeminiPort     int    `ini:"gemini_port"`
+		GeminiCertPath string `ini:"gemini_cert_path"`
+		GeminiKeyPath  string `ini:"gemini_key_path"`
+
+		JobWorkers int `ini:"job_workers"`
+
+		// PageCache is where rendered public pages are cached: "memory" (the
+		// default), "redis", or "none"
+		PageCache        string `ini:"page_cache"`
+		PageCacheSize    int    `ini:"page_cache_size"`
+		PageCacheAddress string `ini:"page_cache_address"`
+
+		// TrustProxy is whether requests come through a reverse proxy whose
+		// X-Real-IP or X-Forwarded-For headers give the client's address. It
+		// should be set whenever WriteFreely runs behind a proxy like nginx,
+		// or every reader looks like the same visitor, and left off otherwise,
+		// since anyone can send those headers.
+		TrustProxy bool `ini:"trust_proxy"`
+
 		Dev bool `ini:"-"`
 	}
 
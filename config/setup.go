@@ -81,6 +81,7 @@ func Configure(fname string, configSections string) (*SetupData, error) {
 		isStandalone := envType == "Production, standalone"
 
 		data.Config.Server.Dev = isDevEnv
+		data.Config.Server.TrustProxy = envType == "Production, behind reverse proxy"
 
 		if isDevEnv || !isStandalone {
 			// Running in dev environment or behind reverse proxy; ask for port
@@ -17,6 +17,7 @@ import (
 	"github.com/writeas/web-core/silobridge"
 	wf_db "github.com/writefreely/writefreely/db"
 	"net/http"
+	"strconv"
 	"strings"
 	"time"
 
@@ -85,6 +86,8 @@ type writestore interface {
 	UpdateOwnedPost(post *AuthenticatedPost, userID int64) error
 	GetEditablePost(id, editToken string) (*PublicPost, error)
 	PostIDExists(id string) bool
+	GetDuplicatePostID(ownerID, collID int64, slug string, created time.Time, content string) (string, error)
+	SetPostUpdated(id string, updated time.Time) error
 	GetPost(id string, collectionID int64) (*PublicPost, error)
 	GetOwnedPost(id string, ownerID int64) (*PublicPost, error)
 	GetPostProperty(id string, collectionID int64, property string) (interface{}, error)
@@ -101,6 +104,8 @@ type writestore interface {
 	UpdatePostPinState(pinned bool, postID string, collID, ownerID, pos int64) error
 	GetLastPinnedPostPos(collID int64) int64
 	GetPinnedPosts(coll *CollectionObj, includeFuture bool) (*[]PublicPost, error)
+	SetPostPage(postID string, collID int64, page bool, pos int) error
+	GetCollectionPages(cfg *config.Config, c *Collection, includeFuture bool) (*[]PublicPost, error)
 	RemoveCollectionRedirect(t *sql.Tx, alias string) error
 	GetCollectionRedirect(alias string) (new string)
 	IsCollectionAttributeOn(id int64, attr string) bool
@@ -137,6 +142,75 @@ type writestore interface {
 	GetOauthAccounts(ctx context.Context, userID int64) ([]oauthAccountInfo, error)
 	RemoveOauth(ctx context.Context, userID int64, provider string, clientID string, remoteUserID string) error
 
+	CreateJob(j *Job) error
+	GetJob(id string) (*Job, error)
+	GetUserJobs(userID int64, types ...jobType) (*[]Job, error)
+	ClaimNextJob() (*Job, error)
+	UpdateJobProgress(id string, progress, total int, message string) (bool, error)
+	FinishJob(id string, status jobStatus, result, message string) error
+	RequeueJob(id string) error
+	RequeueInterruptedJobs() (int64, error)
+	CancelJob(id string, userID int64) (bool, error)
+	GetExpiredJobs(days int) ([]string, error)
+	DeleteJob(id string) error
+
+	GetCollectionMemberRole(collID, userID int64) (collRole, error)
+	GetCollectionMembers(collID int64) (*[]CollectionMember, error)
+	GetMemberCollections(u *User, minRole collRole, hostName string) (*[]Collection, error)
+	SetCollectionMember(collID, userID int64, role collRole) error
+	RemoveCollectionMember(collID, userID int64) error
+	CreateCollectionInvite(i *CollectionInvite) error
+	GetCollectionInvite(id string) (*CollectionInvite, error)
+	GetCollectionInvites(collID int64) (*[]CollectionInvite, error)
+	DeleteCollectionInvite(id string) error
+	SetPostAuthor(postID string, userID int64) error
+	GetPostAuthor(postID string) (*User, error)
+	GetPostAuthors(c *Collection, posts *[]PublicPost) error
+
+	SubmitPostForReview(postID string, collID, authorID int64) error
+	GetPostReview(postID string) (*PostReview, error)
+	GetPostReviews(collID int64, status reviewStatus) (*[]PostReview, error)
+	GetUserPostReviews(userID int64, hostName string) (map[string]*PostReview, error)
+	ApprovePostReview(r *PostReview, c *Collection, reviewerID int64, comment string) error
+	RejectPostReview(postID string, reviewerID int64, comment string) error
+
+	AddViews(b *viewBatch) error
+	IsFediverseHost(host string) bool
+	GetPostViews(collID int64, postID string, since time.Time) ([]PostView, error)
+	GetDailyViews(collID int64, postID string, since time.Time) ([]DailyViews, error)
+	GetViewSources(collID int64, postID string, since time.Time) ([]ViewCount, error)
+	GetTopReferrers(collID int64, postID string, since time.Time) ([]ViewCount, error)
+
+	GetCollectionTags(collID int64, includeFuture bool) ([]CollectionTag, error)
+	GetCollectionTagDescription(collID int64, tag string) string
+	SetCollectionTagDescription(collID int64, tag, desc string) error
+	RenameCollectionTag(collID int64, from, to string) (int, error)
+	SetCollectionTagCategory(collID int64, tag string, category bool) error
+	GetCollectionCategories(collID int64) ([]string, error)
+	GetCollectionMenu(collID int64) ([]MenuItem, error)
+	SetCollectionMenu(collID int64, items []MenuItem) error
+
+	SetPostSeries(postID string, collID int64, title string, part int) error
+	GetPostSeries(postID string) (*Series, error)
+	GetSeries(collID int64, slug string) (*Series, error)
+	GetSeriesPosts(cfg *config.Config, c *Collection, slug string, includeFuture bool) (*[]PublicPost, error)
+
+	GetRelatedDocs(collID int64) ([]relatedDoc, error)
+	SetRelatedPosts(collID int64, related map[string][]string) error
+	GetRelatedPosts(c *Collection, postID string, limit int, includeFuture bool) ([]RelatedPost, error)
+	GetUnindexedCollections() ([]int64, error)
+
+	GetLinkEmbed(u string) (*linkEmbed, error)
+	QueueLinkEmbed(u string) error
+	GetQueuedLinkEmbeds(limit int) ([]string, error)
+	SetLinkEmbed(u, kind, html string) error
+
+	GetCollectionDomain(collID int64) (*CustomDomain, error)
+	GetVerifiedDomains() ([]CustomDomain, error)
+	SetCollectionDomain(collID int64, host, token string) error
+	VerifyCollectionDomain(collID int64) error
+	RemoveCollectionDomain(collID int64) error
+
 	DatabaseInitialized() bool
 }
 
@@ -591,7 +665,7 @@ func (db *datastore) CreateOwnedPost(post *SubmittedPost, accessToken, collAlias
 				return nil, err
 			}
 			coll.hostName = hostName
-			if coll.OwnerID != userID {
+			if !db.collectionRole(coll, userID).CanPost() {
 				return nil, ErrForbiddenCollection
 			}
 			collID = coll.ID
@@ -599,11 +673,17 @@ func (db *datastore) CreateOwnedPost(post *SubmittedPost, accessToken, collAlias
 	}
 
 	rp := &PublicPost{}
-	rp.Post, err = db.CreatePost(userID, collID, post)
+	if coll != nil {
+		// Posts in a collection belong to its owner, even when a member wrote them
+		rp.Post, err = db.CreatePost(coll.OwnerID, collID, post)
+	} else {
+		rp.Post, err = db.CreatePost(userID, collID, post)
+	}
 	if err != nil {
 		return rp, err
 	}
 	if coll != nil {
+		db.SetPostAuthor(rp.ID, userID)
 		coll.ForPublic()
 		rp.Collection = &CollectionObj{Collection: *coll}
 	}
@@ -611,9 +691,12 @@ func (db *datastore) CreateOwnedPost(post *SubmittedPost, accessToken, collAlias
 }
 
 func (db *datastore) CreatePost(userID, collID int64, post *SubmittedPost) (*Post, error) {
-	idLen := postIDLen
-	friendlyID := id.GenerateFriendlyRandomString(idLen)
+	return db.createPost(id.GenerateFriendlyRandomString(postIDLen), userID, collID, post)
+}
 
+// createPost creates a new post with the given friendly ID. Callers are
+// responsible for ensuring the ID isn't already in use.
+func (db *datastore) createPost(friendlyID string, userID, collID int64, post *SubmittedPost) (*Post, error) {
 	// Handle appearance / font face
 	appearance := post.Font
 	if !post.isFontValid() {
@@ -692,6 +775,9 @@ func (db *datastore) CreatePost(userID, collID int64, post *SubmittedPost) (*Pos
 			return nil, handleFailedPostInsert(err)
 		}
 	}
+	if ownerCollID.Valid {
+		db.updatePostTags(friendlyID)
+	}
 
 	// TODO: return Created field in proper format
 	return &Post{
@@ -762,10 +848,12 @@ func (db *datastore) UpdateOwnedPost(post *AuthenticatedPost, userID int64) erro
 	authCondition = "(owner_id = ?)"
 	params = append(params, userID)
 
-	if queryUpdates == "" {
+	if queryUpdates == "" && post.Series == nil && post.Page == nil {
 		return ErrPostNoUpdatableVals
 	}
 
+	// Always touch the post, which also checks ownership when only its series
+	// or page state is changing
 	queryUpdates += sep + "updated = " + db.now()
 
 	res, err := db.Exec("UPDATE posts SET "+queryUpdates+" WHERE id = ? AND "+authCondition, params...)
@@ -788,6 +876,10 @@ func (db *datastore) UpdateOwnedPost(post *AuthenticatedPost, userID int64) erro
 		return nil
 	}
 
+	if post.Content != nil {
+		db.updatePostTags(post.ID)
+	}
+
 	return nil
 }
 
@@ -846,8 +938,10 @@ func (db *datastore) GetCollectionByID(id int64) (*Collection, error) {
 	return db.GetCollectionBy("id = ?", id)
 }
 
+// GetCollectionFromDomain returns the collection that the given custom domain
+// has been verified for.
 func (db *datastore) GetCollectionFromDomain(host string) (*Collection, error) {
-	return db.GetCollectionBy("host = ?", host)
+	return db.GetCollectionBy("id = (SELECT collection_id FROM collectiondomains WHERE verified_host = ?)", host)
 }
 
 func (db *datastore) UpdateCollection(c *SubmittedCollection, alias string) error {
@@ -876,7 +970,7 @@ func (db *datastore) UpdateCollection(c *SubmittedCollection, alias string) erro
 	// WHERE values
 	q.Where("alias = ? AND owner_id = ?", alias, c.OwnerID)
 
-	if q.Updates == "" && c.Monetization == nil {
+	if q.Updates == "" && c.Monetization == nil && c.ReadNext == nil && c.CodeTheme == nil && c.Theme == nil {
 		return ErrPostNoUpdatableVals
 	}
 
@@ -909,6 +1003,25 @@ func (db *datastore) UpdateCollection(c *SubmittedCollection, alias string) erro
 		}
 	}
 
+	// Update table of contents value
+	if c.TOC {
+		if db.driverName == driverSQLite {
+			_, err = db.Exec("INSERT OR REPLACE INTO collectionattributes (collection_id, attribute, value) VALUES (?, ?, ?)", collID, "show_toc", "1")
+		} else {
+			_, err = db.Exec("INSERT INTO collectionattributes (collection_id, attribute, value) VALUES (?, ?, ?) "+db.upsert("collection_id", "attribute")+" value = ?", collID, "show_toc", "1", "1")
+		}
+		if err != nil {
+			log.Error("Unable to insert show_toc value: %v", err)
+			return err
+		}
+	} else {
+		_, err = db.Exec("DELETE FROM collectionattributes WHERE collection_id = ? AND attribute = ?", collID, "show_toc")
+		if err != nil {
+			log.Error("Unable to delete show_toc value: %v", err)
+			return err
+		}
+	}
+
 	// Update Monetization value
 	if c.Monetization != nil {
 		skipUpdate := false
@@ -932,6 +1045,55 @@ func (db *datastore) UpdateCollection(c *SubmittedCollection, alias string) erro
 		}
 	}
 
+	// Update number of related posts shown after each post
+	if c.ReadNext != nil {
+		n := *c.ReadNext
+		if n < 0 {
+			n = 0
+		} else if n > maxReadNext {
+			n = maxReadNext
+		}
+		if db.driverName == driverSQLite {
+			_, err = db.Exec("INSERT OR REPLACE INTO collectionattributes (collection_id, attribute, value) VALUES (?, ?, ?)", collID, "read_next", strconv.Itoa(n))
+		} else {
+			_, err = db.Exec("INSERT INTO collectionattributes (collection_id, attribute, value) VALUES (?, ?, ?) "+db.upsert("collection_id", "attribute")+" value = ?", collID, "read_next", strconv.Itoa(n), strconv.Itoa(n))
+		}
+		if err != nil {
+			log.Error("Unable to insert read_next value: %v", err)
+			return err
+		}
+	}
+
+	// Update theme for highlighted code
+	if c.CodeTheme != nil && isCodeTheme(*c.CodeTheme) {
+		if db.driverName == driverSQLite {
+			_, err = db.Exec("INSERT OR REPLACE INTO collectionattributes (collection_id, attribute, value) VALUES (?, ?, ?)", collID, "code_theme", *c.CodeTheme)
+		} else {
+			_, err = db.Exec("INSERT INTO collectionattributes (collection_id, attribute, value) VALUES (?, ?, ?) "+db.upsert("collection_id", "attribute")+" value = ?", collID, "code_theme", *c.CodeTheme, *c.CodeTheme)
+		}
+		if err != nil {
+			log.Error("Unable to insert code_theme value: %v", err)
+			return err
+		}
+	}
+
+	// Update collection theme
+	if c.Theme != nil {
+		if *c.Theme == "" {
+			_, err = db.Exec("DELETE FROM collectionattributes WHERE collection_id = ? AND attribute = ?", collID, "theme")
+		} else if getTheme(*c.Theme) == nil {
+			return impart.HTTPError{http.StatusBadRequest, "Theme isn't installed."}
+		} else if db.driverName == driverSQLite {
+			_, err = db.Exec("INSERT OR REPLACE INTO collectionattributes (collection_id, attribute, value) VALUES (?, ?, ?)", collID, "theme", *c.Theme)
+		} else {
+			_, err = db.Exec("INSERT INTO collectionattributes (collection_id, attribute, value) VALUES (?, ?, ?) "+db.upsert("collection_id", "attribute")+" value = ?", collID, "theme", *c.Theme, *c.Theme)
+		}
+		if err != nil {
+			log.Error("Unable to update theme value: %v", err)
+			return err
+		}
+	}
+
 	// Update rest of the collection data
 	if q.Updates != "" {
 		res, err = db.Exec("UPDATE collections SET "+q.Updates+" WHERE "+q.Conditions, q.Params...)
@@ -976,7 +1138,7 @@ func (db *datastore) UpdateCollection(c *SubmittedCollection, alias string) erro
 	return nil
 }
 
-const postCols = "id, slug, text_appearance, language, rtl, privacy, owner_id, collection_id, pinned_position, created, updated, view_count, title, content"
+const postCols = "id, slug, text_appearance, language, rtl, privacy, owner_id, collection_id, pinned_position, page_position, created, updated, view_count, title, content"
 
 // getEditablePost returns a PublicPost with the given ID only if the given
 // edit token is valid for the post.
@@ -987,7 +1149,7 @@ func (db *datastore) GetEditablePost(id, editToken string) (*PublicPost, error)
 	p := &Post{}
 
 	row := db.QueryRow("SELECT "+postCols+", (SELECT username FROM users WHERE users.id = posts.owner_id) AS username FROM posts WHERE id = ? LIMIT 1", id)
-	err := row.Scan(&p.ID, &p.Slug, &p.Font, &p.Language, &p.RTL, &p.Privacy, &p.OwnerID, &p.CollectionID, &p.PinnedPosition, &p.Created, &p.Updated, &p.ViewCount, &p.Title, &p.Content, &ownerName)
+	err := row.Scan(&p.ID, &p.Slug, &p.Font, &p.Language, &p.RTL, &p.Privacy, &p.OwnerID, &p.CollectionID, &p.PinnedPosition, &p.PagePosition, &p.Created, &p.Updated, &p.ViewCount, &p.Title, &p.Content, &ownerName)
 	switch {
 	case err == sql.ErrNoRows:
 		return nil, ErrPostNotFound
@@ -1014,6 +1176,50 @@ func (db *datastore) PostIDExists(id string) bool {
 	return err == nil && dummy
 }
 
+// GetDuplicatePostID returns the ID of the owner's post in the given
+// collection, or among their drafts if collID is 0, that has the same slug,
+// creation time and content as the one given, or an empty string if there
+// isn't one. It's used to avoid creating the same post twice on import.
+func (db *datastore) GetDuplicatePostID(ownerID, collID int64, slug string, created time.Time, content string) (string, error) {
+	where := "owner_id = ? AND content = ? AND collection_id IS NULL"
+	params := []interface{}{ownerID, content}
+	if collID > 0 {
+		where = "owner_id = ? AND content = ? AND collection_id = ? AND slug = ?"
+		params = append(params, collID, slug)
+	}
+	rows, err := db.Query("SELECT id, created FROM posts WHERE "+where, params...)
+	if err != nil {
+		log.Error("Failed selecting duplicate posts: %v", err)
+		return "", err
+	}
+	defer rows.Close()
+
+	created = created.UTC().Truncate(time.Second)
+	for rows.Next() {
+		var id string
+		var c time.Time
+		if err = rows.Scan(&id, &c); err != nil {
+			log.Error("Failed scanning duplicate post: %v", err)
+			return "", err
+		}
+		if c.UTC().Truncate(time.Second).Equal(created) {
+			return id, nil
+		}
+	}
+	return "", rows.Err()
+}
+
+// SetPostUpdated sets the time the given post was last updated, e.g. to keep
+// the original date of an imported post.
+func (db *datastore) SetPostUpdated(id string, updated time.Time) error {
+	_, err := db.Exec("UPDATE posts SET updated = ? WHERE id = ?", updated.UTC(), id)
+	if err != nil {
+		log.Error("Unable to update post %s updated date: %v", id, err)
+		return err
+	}
+	return nil
+}
+
 // GetPost gets a public-facing post object from the database. If collectionID
 // is > 0, the post will be retrieved by slug and collection ID, rather than
 // post ID.
@@ -1034,7 +1240,7 @@ func (db *datastore) GetPost(id string, collectionID int64) (*PublicPost, error)
 		where = "id = ?"
 	}
 	row = db.QueryRow("SELECT "+postCols+", (SELECT username FROM users WHERE users.id = posts.owner_id) AS username FROM posts WHERE "+where+" LIMIT 1", params...)
-	err := row.Scan(&p.ID, &p.Slug, &p.Font, &p.Language, &p.RTL, &p.Privacy, &p.OwnerID, &p.CollectionID, &p.PinnedPosition, &p.Created, &p.Updated, &p.ViewCount, &p.Title, &p.Content, &ownerName)
+	err := row.Scan(&p.ID, &p.Slug, &p.Font, &p.Language, &p.RTL, &p.Privacy, &p.OwnerID, &p.CollectionID, &p.PinnedPosition, &p.PagePosition, &p.Created, &p.Updated, &p.ViewCount, &p.Title, &p.Content, &ownerName)
 	switch {
 	case err == sql.ErrNoRows:
 		if collectionID > 0 {
@@ -1066,7 +1272,7 @@ func (db *datastore) GetOwnedPost(id string, ownerID int64) (*PublicPost, error)
 	where := "id = ? AND owner_id = ?"
 	params := []interface{}{id, ownerID}
 	row = db.QueryRow("SELECT "+postCols+" FROM posts WHERE "+where+" LIMIT 1", params...)
-	err := row.Scan(&p.ID, &p.Slug, &p.Font, &p.Language, &p.RTL, &p.Privacy, &p.OwnerID, &p.CollectionID, &p.PinnedPosition, &p.Created, &p.Updated, &p.ViewCount, &p.Title, &p.Content)
+	err := row.Scan(&p.ID, &p.Slug, &p.Font, &p.Language, &p.RTL, &p.Privacy, &p.OwnerID, &p.CollectionID, &p.PinnedPosition, &p.PagePosition, &p.Created, &p.Updated, &p.ViewCount, &p.Title, &p.Content)
 	switch {
 	case err == sql.ErrNoRows:
 		return nil, ErrPostNotFound
@@ -1113,7 +1319,7 @@ func (db *datastore) GetPostProperty(id string, collectionID int64, property str
 }
 
 // GetPostsCount modifies the CollectionObj to include the correct number of
-// standard (non-pinned) posts. It will return future posts if `includeFuture`
+// standard (non-pinned, non-page) posts. It will return future posts if `includeFuture`
 // is true.
 func (db *datastore) GetPostsCount(c *CollectionObj, includeFuture bool) {
 	var count int64
@@ -1121,7 +1327,7 @@ func (db *datastore) GetPostsCount(c *CollectionObj, includeFuture bool) {
 	if !includeFuture {
 		timeCondition = "AND created <= " + db.now()
 	}
-	err := db.QueryRow("SELECT COUNT(*) FROM posts WHERE collection_id = ? AND pinned_position IS NULL "+timeCondition, c.ID).Scan(&count)
+	err := db.QueryRow("SELECT COUNT(*) FROM posts WHERE collection_id = ? AND pinned_position IS NULL AND page_position IS NULL "+timeCondition, c.ID).Scan(&count)
 	switch {
 	case err == sql.ErrNoRows:
 		c.TotalPosts = 0
@@ -1135,7 +1341,7 @@ func (db *datastore) GetPostsCount(c *CollectionObj, includeFuture bool) {
 
 // GetPosts retrieves all posts for the given Collection.
 // It will return future posts if `includeFuture` is true.
-// It will include only standard (non-pinned) posts unless `includePinned` is true.
+// It will include only standard (non-pinned, non-page) posts unless `includePinned` is true.
 // TODO: change includeFuture to isOwner, since that's how it's used
 func (db *datastore) GetPosts(cfg *config.Config, c *Collection, page int, includeFuture, forceRecentFirst, includePinned bool) (*[]PublicPost, error) {
 	collID := c.ID
@@ -1163,7 +1369,7 @@ func (db *datastore) GetPosts(cfg *config.Config, c *Collection, page int, inclu
 	}
 	pinnedCondition := ""
 	if !includePinned {
-		pinnedCondition = "AND pinned_position IS NULL"
+		pinnedCondition = "AND pinned_position IS NULL AND page_position IS NULL"
 	}
 	rows, err := db.Query("SELECT "+postCols+" FROM posts WHERE collection_id = ? "+pinnedCondition+" "+timeCondition+" ORDER BY created "+order+limitStr, collID)
 	if err != nil {
@@ -1176,7 +1382,7 @@ func (db *datastore) GetPosts(cfg *config.Config, c *Collection, page int, inclu
 	posts := []PublicPost{}
 	for rows.Next() {
 		p := &Post{}
-		err = rows.Scan(&p.ID, &p.Slug, &p.Font, &p.Language, &p.RTL, &p.Privacy, &p.OwnerID, &p.CollectionID, &p.PinnedPosition, &p.Created, &p.Updated, &p.ViewCount, &p.Title, &p.Content)
+		err = rows.Scan(&p.ID, &p.Slug, &p.Font, &p.Language, &p.RTL, &p.Privacy, &p.OwnerID, &p.CollectionID, &p.PinnedPosition, &p.PagePosition, &p.Created, &p.Updated, &p.ViewCount, &p.Title, &p.Content)
 		if err != nil {
 			log.Error("Failed scanning row: %v", err)
 			break
@@ -1221,16 +1427,11 @@ func (db *datastore) GetPostsTagged(cfg *config.Config, c *Collection, tag strin
 	}
 	timeCondition := ""
 	if !includeFuture {
-		timeCondition = "AND created <= " + db.now()
+		timeCondition = "AND p.created <= " + db.now()
 	}
 
-	var rows *sql.Rows
-	var err error
-	if db.driverName == driverSQLite {
-		rows, err = db.Query("SELECT "+postCols+" FROM posts WHERE collection_id = ? AND LOWER(content) regexp ? "+timeCondition+" ORDER BY created "+order+limitStr, collID, `.*#`+strings.ToLower(tag)+`\b.*`)
-	} else {
-		rows, err = db.Query("SELECT "+postCols+" FROM posts WHERE collection_id = ? AND LOWER(content) RLIKE ? "+timeCondition+" ORDER BY created "+order+limitStr, collID, "#"+strings.ToLower(tag)+"[[:>:]]")
-	}
+	cols := "p." + strings.Replace(postCols, ", ", ", p.", -1)
+	rows, err := db.Query("SELECT "+cols+" FROM posttags t INNER JOIN posts p ON p.id = t.post_id WHERE t.collection_id = ? AND t.tag = ? AND p.collection_id = t.collection_id AND p.page_position IS NULL "+timeCondition+" ORDER BY p.created "+order+limitStr, collID, strings.ToLower(tag))
 	if err != nil {
 		log.Error("Failed selecting from posts: %v", err)
 		return nil, impart.HTTPError{http.StatusInternalServerError, "Couldn't retrieve collection posts."}
@@ -1241,7 +1442,7 @@ func (db *datastore) GetPostsTagged(cfg *config.Config, c *Collection, tag strin
 	posts := []PublicPost{}
 	for rows.Next() {
 		p := &Post{}
-		err = rows.Scan(&p.ID, &p.Slug, &p.Font, &p.Language, &p.RTL, &p.Privacy, &p.OwnerID, &p.CollectionID, &p.PinnedPosition, &p.Created, &p.Updated, &p.ViewCount, &p.Title, &p.Content)
+		err = rows.Scan(&p.ID, &p.Slug, &p.Font, &p.Language, &p.RTL, &p.Privacy, &p.OwnerID, &p.CollectionID, &p.PinnedPosition, &p.PagePosition, &p.Created, &p.Updated, &p.ViewCount, &p.Title, &p.Content)
 		if err != nil {
 			log.Error("Failed scanning row: %v", err)
 			break
@@ -1369,7 +1570,7 @@ func (db *datastore) DispersePosts(userID int64, postIDs []string) (*[]ClaimPost
 		// Do AND owner_id = ? for sanity.
 		// This should've been caught and returned with a good error message
 		// just above.
-		query = "UPDATE posts SET collection_id = NULL WHERE id = ? AND owner_id = ?"
+		query = "UPDATE posts SET collection_id = NULL, page_position = NULL WHERE id = ? AND owner_id = ?"
 		params = []interface{}{postID, userID}
 		qRes, err = db.Exec(query, params...)
 		if err != nil {
@@ -1380,6 +1581,7 @@ func (db *datastore) DispersePosts(userID int64, postIDs []string) (*[]ClaimPost
 			log.Error("dispersePosts (post %s): %v", postID, err)
 			continue
 		}
+		db.updatePostTags(postID)
 
 		// Post was successfully dispersed
 		r.Code = http.StatusOK
@@ -1488,7 +1690,7 @@ func (db *datastore) ClaimPosts(cfg *config.Config, userID int64, collAlias stri
 					res = append(res, r)
 					continue
 				}
-				if coll.OwnerID != userID {
+				if !db.collectionRole(coll, userID).CanPost() {
 					r.Code = ErrForbiddenCollection.Status
 					r.ErrorMessage = ErrForbiddenCollection.Message
 					r.ID = p.ID
@@ -1499,17 +1701,18 @@ func (db *datastore) ClaimPosts(cfg *config.Config, userID int64, collAlias stri
 			if p.Slug == "" {
 				p.Slug = p.ID
 			}
+			// Posts in a collection belong to its owner, even when a member
+			// moves them there.
 			if canCollect {
 				// User already owns this post, so just add it to the given
 				// collection.
-				query = "UPDATE posts SET collection_id = ?, slug = ? WHERE id = ? AND owner_id = ?"
-				params = []interface{}{coll.ID, p.Slug, p.ID, userID}
-				slugIdx = 1
+				query = "UPDATE posts SET owner_id = ?, collection_id = ?, slug = ? WHERE id = ? AND owner_id = ?"
+				params = []interface{}{coll.OwnerID, coll.ID, p.Slug, p.ID, userID}
 			} else {
 				query = "UPDATE posts SET owner_id = ?, collection_id = ?, slug = ? WHERE id = ? AND modify_token = ? AND owner_id IS NULL"
-				params = []interface{}{userID, coll.ID, p.Slug, p.ID, p.Token}
-				slugIdx = 2
+				params = []interface{}{coll.OwnerID, coll.ID, p.Slug, p.ID, p.Token}
 			}
+			slugIdx = 2
 		} else {
 			query = "UPDATE posts SET owner_id = ? WHERE id = ? AND modify_token = ? AND owner_id IS NULL"
 			params = []interface{}{userID, p.ID, p.Token}
@@ -1540,7 +1743,11 @@ func (db *datastore) ClaimPosts(cfg *config.Config, userID int64, collAlias stri
 				continue
 			}
 		}
-		if fullPost.OwnerID.Int64 != userID {
+		ownerID := userID
+		if coll != nil {
+			ownerID = coll.OwnerID
+		}
+		if fullPost.OwnerID.Int64 != ownerID {
 			r.Code = http.StatusConflict
 			r.ErrorMessage = "Post is already owned by someone else."
 			r.ID = p.ID
@@ -1552,6 +1759,10 @@ func (db *datastore) ClaimPosts(cfg *config.Config, userID int64, collAlias stri
 		r.Code = http.StatusOK
 		r.Post = fullPost
 		if coll != nil {
+			db.updatePostTags(p.ID)
+			if a, _ := db.GetPostAuthor(p.ID); a == nil {
+				db.SetPostAuthor(p.ID, userID)
+			}
 			r.Post.Collection = &CollectionObj{Collection: *coll}
 		}
 
@@ -1633,6 +1844,103 @@ func (db *datastore) GetPinnedPosts(coll *CollectionObj, includeFuture bool) (*[
 	return &posts, nil
 }
 
+// SetPostPage makes the given post one of its collection's pages, placed at
+// pos among them, or turns it back into a regular post. A pos of 0 keeps a
+// page where it was, or adds a new page to the end.
+func (db *datastore) SetPostPage(postID string, collID int64, page bool, pos int) error {
+	t, err := db.Begin()
+	if err != nil {
+		log.Error("Couldn't start page transaction: %v", err)
+		return err
+	}
+
+	rows, err := t.Query("SELECT id FROM posts WHERE collection_id = ? AND page_position IS NOT NULL ORDER BY page_position ASC", collID)
+	if err != nil {
+		t.Rollback()
+		log.Error("Failed selecting collection pages: %v", err)
+		return err
+	}
+	ids := []string{}
+	curPos := 0
+	for rows.Next() {
+		var id string
+		if err = rows.Scan(&id); err != nil {
+			break
+		}
+		if id != postID {
+			ids = append(ids, id)
+		} else {
+			curPos = len(ids) + 1
+		}
+	}
+	rows.Close()
+	if err != nil {
+		t.Rollback()
+		log.Error("Failed scanning collection page: %v", err)
+		return err
+	}
+
+	if page {
+		if pos == 0 {
+			pos = curPos
+		}
+		ids = placeInOrder(ids, postID, pos)
+	} else {
+		_, err = t.Exec("UPDATE posts SET page_position = NULL WHERE id = ? AND collection_id = ?", postID, collID)
+		if err != nil {
+			t.Rollback()
+			log.Error("Couldn't remove page: %v", err)
+			return err
+		}
+	}
+	for i, id := range ids {
+		_, err = t.Exec("UPDATE posts SET page_position = ? WHERE id = ? AND collection_id = ?", i+1, id, collID)
+		if err != nil {
+			t.Rollback()
+			log.Error("Couldn't update page position: %v", err)
+			return err
+		}
+	}
+
+	return t.Commit()
+}
+
+// GetCollectionPages returns the given collection's pages, in order.
+// It will return future pages if `includeFuture` is true.
+func (db *datastore) GetCollectionPages(cfg *config.Config, c *Collection, includeFuture bool) (*[]PublicPost, error) {
+	timeCondition := ""
+	if !includeFuture {
+		timeCondition = "AND created <= " + db.now()
+	}
+	rows, err := db.Query("SELECT "+postCols+" FROM posts WHERE collection_id = ? AND page_position IS NOT NULL "+timeCondition+" ORDER BY page_position ASC", c.ID)
+	if err != nil {
+		log.Error("Failed selecting collection pages: %v", err)
+		return nil, impart.HTTPError{http.StatusInternalServerError, "Couldn't retrieve collection pages."}
+	}
+	defer rows.Close()
+
+	posts := []PublicPost{}
+	for rows.Next() {
+		p := &Post{}
+		err = rows.Scan(&p.ID, &p.Slug, &p.Font, &p.Language, &p.RTL, &p.Privacy, &p.OwnerID, &p.CollectionID, &p.PinnedPosition, &p.PagePosition, &p.Created, &p.Updated, &p.ViewCount, &p.Title, &p.Content)
+		if err != nil {
+			log.Error("Failed scanning row: %v", err)
+			break
+		}
+		p.extractData()
+		p.augmentContent(c)
+		p.formatContent(cfg, c, includeFuture, false)
+
+		posts = append(posts, p.processPost())
+	}
+	err = rows.Err()
+	if err != nil {
+		log.Error("Error after Next() on rows: %v", err)
+	}
+
+	return &posts, nil
+}
+
 func (db *datastore) GetCollections(u *User, hostName string) (*[]Collection, error) {
 	rows, err := db.Query("SELECT id, alias, title, description, privacy, view_count FROM collections WHERE owner_id = ? ORDER BY id ASC", u.ID)
 	if err != nil {
@@ -1676,6 +1984,11 @@ func (db *datastore) GetPublishableCollections(u *User, hostName string) (*[]Col
 	if err != nil {
 		return nil, err
 	}
+	mc, err := db.GetMemberCollections(u, roleAuthor, hostName)
+	if err != nil {
+		return nil, err
+	}
+	*c = append(*c, *mc...)
 
 	if len(*c) == 0 {
 		return nil, impart.HTTPError{http.StatusInternalServerError, "You don't seem to have any blogs; they might've moved to another account. Try logging out and logging into your other account."}
@@ -1927,6 +2240,21 @@ func (db *datastore) ChangeSettings(app *App, u *User, s *userSettings) error {
 	var errPass error
 	q := query.NewUpdate()
 
+	// Update interface language if given
+	if s.Locale != nil {
+		var err error
+		if *s.Locale == "" {
+			err = db.DeleteUserAttribute(u.ID, "locale")
+		} else if !locales.Supports(*s.Locale) {
+			return impart.HTTPError{http.StatusBadRequest, "That language isn't available."}
+		} else {
+			err = db.SetUserAttribute(u.ID, "locale", *s.Locale)
+		}
+		if err != nil {
+			return impart.HTTPError{http.StatusInternalServerError, "Unable to save language."}
+		}
+	}
+
 	// Update email if given
 	if s.Email != "" {
 		encEmail, err := data.Encrypt(app.keys.EmailKey, s.Email)
@@ -2044,11 +2372,11 @@ func (db *datastore) ChangeSettings(app *App, u *User, s *userSettings) error {
 	q.Append(u.ID)
 
 	if q.Updates == "" {
-		if s.Username == "" {
+		if s.Username == "" && s.Locale == nil {
 			return ErrPostNoUpdatableVals
 		}
 
-		// Nothing to update except username. That was successful, so return now.
+		// Nothing to update except username or language. That was successful, so return now.
 		return nil
 	}
 
@@ -2152,7 +2480,7 @@ func (db *datastore) DeleteCollection(alias string, userID int64) error {
 	}
 
 	// Float all collection's posts
-	_, err = t.Exec("UPDATE posts SET collection_id = NULL WHERE collection_id = ? AND owner_id = ?", c.ID, userID)
+	_, err = t.Exec("UPDATE posts SET collection_id = NULL, page_position = NULL WHERE collection_id = ? AND owner_id = ?", c.ID, userID)
 	if err != nil {
 		t.Rollback()
 		return err
@@ -2172,6 +2500,62 @@ func (db *datastore) DeleteCollection(alias string, userID int64) error {
 		return err
 	}
 
+	// Remove tags, which only exist within the collection
+	_, err = t.Exec("DELETE FROM posttags WHERE collection_id = ?", c.ID)
+	if err != nil {
+		t.Rollback()
+		return err
+	}
+	_, err = t.Exec("DELETE FROM collectiontags WHERE collection_id = ?", c.ID)
+	if err != nil {
+		t.Rollback()
+		return err
+	}
+	_, err = t.Exec("DELETE FROM collectionmenus WHERE collection_id = ?", c.ID)
+	if err != nil {
+		t.Rollback()
+		return err
+	}
+	_, err = t.Exec("DELETE FROM relatedposts WHERE collection_id = ?", c.ID)
+	if err != nil {
+		t.Rollback()
+		return err
+	}
+	_, err = t.Exec("DELETE FROM collectiondomains WHERE collection_id = ?", c.ID)
+	if err != nil {
+		t.Rollback()
+		return err
+	}
+
+	// Remove series, which only exist within the collection
+	_, err = t.Exec("DELETE FROM postseries WHERE collection_id = ?", c.ID)
+	if err != nil {
+		t.Rollback()
+		return err
+	}
+	_, err = t.Exec("DELETE FROM collectionseries WHERE collection_id = ?", c.ID)
+	if err != nil {
+		t.Rollback()
+		return err
+	}
+
+	// Remove members, outstanding invites, and drafts waiting for review
+	_, err = t.Exec("DELETE FROM collectionmembers WHERE collection_id = ?", c.ID)
+	if err != nil {
+		t.Rollback()
+		return err
+	}
+	_, err = t.Exec("DELETE FROM collectioninvites WHERE collection_id = ?", c.ID)
+	if err != nil {
+		t.Rollback()
+		return err
+	}
+	_, err = t.Exec("DELETE FROM postreviews WHERE collection_id = ?", c.ID)
+	if err != nil {
+		t.Rollback()
+		return err
+	}
+
 	// Finally, delete collection itself
 	_, err = t.Exec("DELETE FROM collections WHERE id = ?", c.ID)
 	if err != nil {
@@ -2184,6 +2568,7 @@ func (db *datastore) DeleteCollection(alias string, userID int64) error {
 		t.Rollback()
 		return err
 	}
+	customDomains.remove(c.ID)
 
 	return nil
 }
@@ -2236,6 +2621,42 @@ func (db *datastore) SetCollectionAttribute(id int64, attr, v string) error {
 	return nil
 }
 
+func (db *datastore) GetUserAttribute(id int64, attr string) string {
+	var v string
+	err := db.QueryRow("SELECT value FROM userattributes WHERE user_id = ? AND attribute = ?", id, attr).Scan(&v)
+	switch {
+	case err == sql.ErrNoRows:
+		return ""
+	case err != nil:
+		log.Error("Couldn't SELECT value in getUserAttribute for attribute '%s': %v", attr, err)
+		return ""
+	}
+	return v
+}
+
+func (db *datastore) SetUserAttribute(id int64, attr, v string) error {
+	var err error
+	if db.driverName == driverSQLite {
+		_, err = db.Exec("INSERT OR REPLACE INTO userattributes (user_id, attribute, value) VALUES (?, ?, ?)", id, attr, v)
+	} else {
+		_, err = db.Exec("INSERT INTO userattributes (user_id, attribute, value) VALUES (?, ?, ?) "+db.upsert("user_id", "attribute")+" value = ?", id, attr, v, v)
+	}
+	if err != nil {
+		log.Error("Unable to INSERT into userattributes: %v", err)
+		return err
+	}
+	return nil
+}
+
+func (db *datastore) DeleteUserAttribute(id int64, attr string) error {
+	_, err := db.Exec("DELETE FROM userattributes WHERE user_id = ? AND attribute = ?", id, attr)
+	if err != nil {
+		log.Error("Unable to DELETE from userattributes: %v", err)
+		return err
+	}
+	return nil
+}
+
 // DeleteAccount will delete the entire account for userID
 func (db *datastore) DeleteAccount(userID int64) error {
 	// Get all collections
@@ -2317,6 +2738,25 @@ func (db *datastore) DeleteAccount(userID int64) error {
 		}
 		rs, _ = res.RowsAffected()
 		log.Info("Deleted %d for %s from remotefollows", rs, c.Alias)
+
+		// Remove members and their invites
+		res, err = t.Exec("DELETE FROM collectionmembers WHERE collection_id = ?", c.ID)
+		if err != nil {
+			t.Rollback()
+			log.Error("Unable to delete members on %s: %v", c.Alias, err)
+			return err
+		}
+		rs, _ = res.RowsAffected()
+		log.Info("Deleted %d for %s from collectionmembers", rs, c.Alias)
+
+		res, err = t.Exec("DELETE FROM collectioninvites WHERE collection_id = ?", c.ID)
+		if err != nil {
+			t.Rollback()
+			log.Error("Unable to delete member invites on %s: %v", c.Alias, err)
+			return err
+		}
+		rs, _ = res.RowsAffected()
+		log.Info("Deleted %d for %s from collectioninvites", rs, c.Alias)
 	}
 
 	// Delete collections
@@ -2339,6 +2779,16 @@ func (db *datastore) DeleteAccount(userID int64) error {
 	rs, _ = res.RowsAffected()
 	log.Info("Deleted %d from accesstokens", rs)
 
+	// Delete memberships in others' collections
+	res, err = t.Exec("DELETE FROM collectionmembers WHERE user_id = ?", userID)
+	if err != nil {
+		t.Rollback()
+		log.Error("Unable to delete collection memberships: %v", err)
+		return err
+	}
+	rs, _ = res.RowsAffected()
+	log.Info("Deleted %d from collectionmembers", rs)
+
 	// Delete user attributes
 	res, err = t.Exec("DELETE FROM oauth_users WHERE user_id = ?", userID)
 	if err != nil {
@@ -2756,6 +3206,1414 @@ func (db *datastore) RemoveOauth(ctx context.Context, userID int64, provider str
 	return err
 }
 
+func (db *datastore) CreateJob(j *Job) error {
+	_, err := db.Exec("INSERT INTO jobs (id, user_id, type, status, input, created, updated) VALUES (?, ?, ?, ?, ?, "+db.now()+", "+db.now()+")", j.ID, j.UserID, j.Type, jobQueued, j.Input)
+	if err != nil {
+		log.Error("Couldn't INSERT job: %v", err)
+		return err
+	}
+	return nil
+}
+
+func (db *datastore) GetJob(id string) (*Job, error) {
+	j := &Job{}
+	var input, result, message sql.NullString
+	err := db.QueryRow("SELECT id, user_id, type, status, progress, total, input, result, message, created, updated FROM jobs WHERE id = ?", id).Scan(&j.ID, &j.UserID, &j.Type, &j.Status, &j.Progress, &j.Total, &input, &result, &message, &j.Created, &j.Updated)
+	switch {
+	case err == sql.ErrNoRows:
+		return nil, impart.HTTPError{http.StatusNotFound, "Job doesn't exist."}
+	case err != nil:
+		log.Error("Couldn't SELECT job %s: %v", id, err)
+		return nil, err
+	}
+	j.Input = input.String
+	j.Result = result.String
+	j.Message = message.String
+	return j, nil
+}
+
+// GetUserJobs returns the given user's most recent jobs of the given types.
+func (db *datastore) GetUserJobs(userID int64, types ...jobType) (*[]Job, error) {
+	params := []interface{}{userID}
+	for _, t := range types {
+		params = append(params, t)
+	}
+	typeCond := "?" + strings.Repeat(", ?", len(types)-1)
+	rows, err := db.Query("SELECT id, type, status, progress, total, result, message, created, updated FROM jobs WHERE user_id = ? AND type IN ("+typeCond+") ORDER BY created DESC LIMIT 10", params...)
+	if err != nil {
+		log.Error("Failed selecting from jobs: %v", err)
+		return nil, impart.HTTPError{http.StatusInternalServerError, "Couldn't retrieve jobs."}
+	}
+	defer rows.Close()
+
+	js := []Job{}
+	for rows.Next() {
+		j := Job{UserID: userID}
+		var result, message sql.NullString
+		err = rows.Scan(&j.ID, &j.Type, &j.Status, &j.Progress, &j.Total, &result, &message, &j.Created, &j.Updated)
+		if err != nil {
+			log.Error("Failed scanning job: %v", err)
+			continue
+		}
+		j.Result = result.String
+		j.Message = message.String
+		js = append(js, j)
+	}
+	return &js, nil
+}
+
+// ClaimNextJob marks the oldest queued job as running and returns it, or nil
+// if there's nothing in the queue.
+func (db *datastore) ClaimNextJob() (*Job, error) {
+	for {
+		var id string
+		err := db.QueryRow("SELECT id FROM jobs WHERE status = ? ORDER BY created ASC LIMIT 1", jobQueued).Scan(&id)
+		switch {
+		case err == sql.ErrNoRows:
+			return nil, nil
+		case err != nil:
+			log.Error("Couldn't SELECT next job: %v", err)
+			return nil, err
+		}
+
+		res, err := db.Exec("UPDATE jobs SET status = ?, updated = "+db.now()+" WHERE id = ? AND status = ?", jobRunning, id, jobQueued)
+		if err != nil {
+			log.Error("Couldn't claim job %s: %v", id, err)
+			return nil, err
+		}
+		if rowsAffected, _ := res.RowsAffected(); rowsAffected == 0 {
+			// Another worker got to it first
+			continue
+		}
+		return db.GetJob(id)
+	}
+}
+
+// UpdateJobProgress records a running job's progress, and any message about
+// it so far. It returns false if the job is no longer running, e.g. because it
+// was canceled.
+func (db *datastore) UpdateJobProgress(id string, progress, total int, message string) (bool, error) {
+	res, err := db.Exec("UPDATE jobs SET progress = ?, total = ?, message = ?, updated = "+db.now()+" WHERE id = ? AND status = ?", progress, total, sql.NullString{String: message, Valid: message != ""}, id, jobRunning)
+	if err != nil {
+		log.Error("Couldn't UPDATE job %s progress: %v", id, err)
+		return true, err
+	}
+	if rowsAffected, _ := res.RowsAffected(); rowsAffected > 0 {
+		return true, nil
+	}
+	// MySQL reports no affected rows when nothing changed, so check the
+	// status itself
+	var status jobStatus
+	err = db.QueryRow("SELECT status FROM jobs WHERE id = ?", id).Scan(&status)
+	if err == sql.ErrNoRows {
+		return false, nil
+	} else if err != nil {
+		log.Error("Couldn't SELECT job %s status: %v", id, err)
+		return true, err
+	}
+	return status == jobRunning, nil
+}
+
+// FinishJob sets the final status of a running job, along with its result
+// file and a message for the user.
+func (db *datastore) FinishJob(id string, status jobStatus, result, message string) error {
+	_, err := db.Exec("UPDATE jobs SET status = ?, result = ?, message = ?, updated = "+db.now()+" WHERE id = ? AND status = ?", status, sql.NullString{String: result, Valid: result != ""}, sql.NullString{String: message, Valid: message != ""}, id, jobRunning)
+	if err != nil {
+		log.Error("Couldn't UPDATE job %s status: %v", id, err)
+		return err
+	}
+	return nil
+}
+
+// RequeueJob puts a running job back in the queue, e.g. when the server shuts
+// down before it completes.
+func (db *datastore) RequeueJob(id string) error {
+	_, err := db.Exec("UPDATE jobs SET status = ?, updated = "+db.now()+" WHERE id = ? AND status = ?", jobQueued, id, jobRunning)
+	if err != nil {
+		log.Error("Couldn't requeue job %s: %v", id, err)
+		return err
+	}
+	return nil
+}
+
+// RequeueInterruptedJobs puts back in the queue any jobs left running when
+// the server last stopped, e.g. because it crashed. It must only be called
+// before any job workers start, since it can't tell those jobs apart from
+// ones that are still being worked on.
+func (db *datastore) RequeueInterruptedJobs() (int64, error) {
+	res, err := db.Exec("UPDATE jobs SET status = ? WHERE status = ?", jobQueued, jobRunning)
+	if err != nil {
+		log.Error("Couldn't requeue stale jobs: %v", err)
+		return 0, err
+	}
+	return res.RowsAffected()
+}
+
+// CancelJob cancels the given user's job, if it hasn't finished yet. It
+// returns false if there was nothing to cancel.
+func (db *datastore) CancelJob(id string, userID int64) (bool, error) {
+	res, err := db.Exec("UPDATE jobs SET status = ?, updated = "+db.now()+" WHERE id = ? AND user_id = ? AND status IN (?, ?)", jobCanceled, id, userID, jobQueued, jobRunning)
+	if err != nil {
+		log.Error("Couldn't cancel job %s: %v", id, err)
+		return false, err
+	}
+	rowsAffected, _ := res.RowsAffected()
+	return rowsAffected > 0, nil
+}
+
+// GetExpiredJobs returns the IDs of finished jobs that were last updated more
+// than the given number of days ago.
+func (db *datastore) GetExpiredJobs(days int) ([]string, error) {
+	rows, err := db.Query("SELECT id FROM jobs WHERE status IN (?, ?, ?) AND updated < "+db.dateSub(days, "day"), jobCompleted, jobFailed, jobCanceled)
+	if err != nil {
+		log.Error("Failed selecting expired jobs: %v", err)
+		return nil, err
+	}
+	defer rows.Close()
+
+	ids := []string{}
+	for rows.Next() {
+		var id string
+		if err = rows.Scan(&id); err != nil {
+			log.Error("Failed scanning expired job: %v", err)
+			continue
+		}
+		ids = append(ids, id)
+	}
+	return ids, nil
+}
+
+func (db *datastore) DeleteJob(id string) error {
+	_, err := db.Exec("DELETE FROM jobs WHERE id = ?", id)
+	if err != nil {
+		log.Error("Couldn't DELETE job %s: %v", id, err)
+		return err
+	}
+	return nil
+}
+
+// GetCollectionMemberRole returns the given user's role in the collection, or
+// roleNone if they aren't a member. Collection owners aren't stored as members;
+// see collectionRole.
+func (db *datastore) GetCollectionMemberRole(collID, userID int64) (collRole, error) {
+	var role collRole
+	err := db.QueryRow("SELECT role FROM collectionmembers WHERE collection_id = ? AND user_id = ?", collID, userID).Scan(&role)
+	switch {
+	case err == sql.ErrNoRows:
+		return roleNone, nil
+	case err != nil:
+		log.Error("Failed selecting from collectionmembers: %v", err)
+		return roleNone, err
+	}
+	return role, nil
+}
+
+func (db *datastore) GetCollectionMembers(collID int64) (*[]CollectionMember, error) {
+	rows, err := db.Query("SELECT u.id, u.username, m.role, m.created FROM collectionmembers m INNER JOIN users u ON u.id = m.user_id WHERE m.collection_id = ? ORDER BY m.role DESC, m.created ASC", collID)
+	if err != nil {
+		log.Error("Failed selecting from collectionmembers: %v", err)
+		return nil, impart.HTTPError{http.StatusInternalServerError, "Couldn't retrieve collection members."}
+	}
+	defer rows.Close()
+
+	ms := []CollectionMember{}
+	for rows.Next() {
+		m := CollectionMember{User: &User{}}
+		err = rows.Scan(&m.User.ID, &m.User.Username, &m.Role, &m.Created)
+		if err != nil {
+			log.Error("Failed scanning collection member: %v", err)
+			continue
+		}
+		ms = append(ms, m)
+	}
+	return &ms, nil
+}
+
+// GetMemberCollections returns the collections the given user is a member of,
+// with at least the given role.
+func (db *datastore) GetMemberCollections(u *User, minRole collRole, hostName string) (*[]Collection, error) {
+	rows, err := db.Query("SELECT c.id, c.alias, c.title, c.description, c.privacy, c.view_count, c.owner_id FROM collections c INNER JOIN collectionmembers m ON m.collection_id = c.id WHERE m.user_id = ? AND m.role >= ? ORDER BY c.id ASC", u.ID, minRole)
+	if err != nil {
+		log.Error("Failed selecting member collections: %v", err)
+		return nil, impart.HTTPError{http.StatusInternalServerError, "Couldn't retrieve user collections."}
+	}
+	defer rows.Close()
+
+	colls := []Collection{}
+	for rows.Next() {
+		c := Collection{}
+		err = rows.Scan(&c.ID, &c.Alias, &c.Title, &c.Description, &c.Visibility, &c.Views, &c.OwnerID)
+		if err != nil {
+			log.Error("Failed scanning row: %v", err)
+			break
+		}
+		c.hostName = hostName
+		c.URL = c.CanonicalURL()
+		c.Public = c.IsPublic()
+		colls = append(colls, c)
+	}
+	err = rows.Err()
+	if err != nil {
+		log.Error("Error after Next() on rows: %v", err)
+	}
+
+	return &colls, nil
+}
+
+// SetCollectionMember adds the given user to the collection with the given
+// role, or changes their role if they're already a member.
+func (db *datastore) SetCollectionMember(collID, userID int64, role collRole) error {
+	res, err := db.Exec("UPDATE collectionmembers SET role = ? WHERE collection_id = ? AND user_id = ?", role, collID, userID)
+	if err != nil {
+		log.Error("Couldn't UPDATE collectionmembers: %v", err)
+		return err
+	}
+	if n, _ := res.RowsAffected(); n > 0 {
+		return nil
+	}
+	_, err = db.Exec("INSERT INTO collectionmembers (collection_id, user_id, role, created) VALUES (?, ?, ?, "+db.now()+")", collID, userID, role)
+	if err != nil {
+		if db.isDuplicateKeyErr(err) {
+			// Added by a concurrent request
+			return nil
+		}
+		log.Error("Couldn't INSERT into collectionmembers: %v", err)
+		return err
+	}
+	return nil
+}
+
+func (db *datastore) RemoveCollectionMember(collID, userID int64) error {
+	_, err := db.Exec("DELETE FROM collectionmembers WHERE collection_id = ? AND user_id = ?", collID, userID)
+	if err != nil {
+		log.Error("Couldn't DELETE from collectionmembers: %v", err)
+		return err
+	}
+	return nil
+}
+
+func (db *datastore) CreateCollectionInvite(i *CollectionInvite) error {
+	_, err := db.Exec("INSERT INTO collectioninvites (id, collection_id, role, owner_id, created, expires) VALUES (?, ?, ?, ?, "+db.now()+", ?)", i.ID, i.CollectionID, i.Role, i.OwnerID, i.Expires)
+	if err != nil {
+		log.Error("Couldn't INSERT collection invite: %v", err)
+		return err
+	}
+	return nil
+}
+
+func (db *datastore) GetCollectionInvite(id string) (*CollectionInvite, error) {
+	i := &CollectionInvite{}
+	err := db.QueryRow("SELECT id, collection_id, role, owner_id, created, expires FROM collectioninvites WHERE id = ?", id).Scan(&i.ID, &i.CollectionID, &i.Role, &i.OwnerID, &i.Created, &i.Expires)
+	switch {
+	case err == sql.ErrNoRows:
+		return nil, impart.HTTPError{http.StatusNotFound, "Invite doesn't exist."}
+	case err != nil:
+		log.Error("Failed selecting collection invite: %v", err)
+		return nil, err
+	}
+	return i, nil
+}
+
+// GetCollectionInvites returns the collection's invites that haven't expired.
+func (db *datastore) GetCollectionInvites(collID int64) (*[]CollectionInvite, error) {
+	rows, err := db.Query("SELECT id, role, owner_id, created, expires FROM collectioninvites WHERE collection_id = ? ORDER BY created DESC", collID)
+	if err != nil {
+		log.Error("Failed selecting from collectioninvites: %v", err)
+		return nil, impart.HTTPError{http.StatusInternalServerError, "Couldn't retrieve collection invites."}
+	}
+	defer rows.Close()
+
+	is := []CollectionInvite{}
+	for rows.Next() {
+		i := CollectionInvite{CollectionID: collID}
+		err = rows.Scan(&i.ID, &i.Role, &i.OwnerID, &i.Created, &i.Expires)
+		if err != nil {
+			log.Error("Failed scanning collection invite: %v", err)
+			continue
+		}
+		if i.Expired() {
+			continue
+		}
+		is = append(is, i)
+	}
+	return &is, nil
+}
+
+func (db *datastore) DeleteCollectionInvite(id string) error {
+	_, err := db.Exec("DELETE FROM collectioninvites WHERE id = ?", id)
+	if err != nil {
+		log.Error("Couldn't DELETE collection invite %s: %v", id, err)
+		return err
+	}
+	return nil
+}
+
+// SetPostAuthor records the given user as the author of the post, which may
+// be owned by someone else, e.g. the owner of a team collection.
+func (db *datastore) SetPostAuthor(postID string, userID int64) error {
+	res, err := db.Exec("UPDATE postauthors SET user_id = ? WHERE post_id = ?", userID, postID)
+	if err != nil {
+		log.Error("Couldn't UPDATE post author: %v", err)
+		return err
+	}
+	if n, _ := res.RowsAffected(); n > 0 {
+		return nil
+	}
+	_, err = db.Exec("INSERT INTO postauthors (post_id, user_id) VALUES (?, ?)", postID, userID)
+	if err != nil {
+		log.Error("Couldn't INSERT post author: %v", err)
+		return err
+	}
+	return nil
+}
+
+// GetPostAuthor returns the recorded author of the post, or nil if there
+// isn't one.
+func (db *datastore) GetPostAuthor(postID string) (*User, error) {
+	u := &User{}
+	err := db.QueryRow("SELECT u.id, u.username FROM postauthors a INNER JOIN users u ON u.id = a.user_id WHERE a.post_id = ?", postID).Scan(&u.ID, &u.Username)
+	switch {
+	case err == sql.ErrNoRows:
+		return nil, nil
+	case err != nil:
+		log.Error("Failed selecting post author: %v", err)
+		return nil, err
+	}
+	return u, nil
+}
+
+// GetPostAuthors fills in the authors of the given posts, if the collection
+// has any members.
+func (db *datastore) GetPostAuthors(c *Collection, posts *[]PublicPost) error {
+	if posts == nil || len(*posts) == 0 {
+		return nil
+	}
+	var members int
+	err := db.QueryRow("SELECT COUNT(*) FROM collectionmembers WHERE collection_id = ?", c.ID).Scan(&members)
+	if err != nil {
+		log.Error("Failed counting collection members: %v", err)
+		return err
+	}
+	if members == 0 {
+		return nil
+	}
+
+	params := []interface{}{}
+	idx := map[string]int{}
+	for i, p := range *posts {
+		params = append(params, p.ID)
+		idx[p.ID] = i
+	}
+	rows, err := db.Query("SELECT a.post_id, u.username FROM postauthors a INNER JOIN users u ON u.id = a.user_id WHERE a.post_id IN (?"+strings.Repeat(", ?", len(params)-1)+")", params...)
+	if err != nil {
+		log.Error("Failed selecting post authors: %v", err)
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var postID, username string
+		err = rows.Scan(&postID, &username)
+		if err != nil {
+			log.Error("Failed scanning post author: %v", err)
+			continue
+		}
+		(*posts)[idx[postID]].Author = &PublicUser{Username: username}
+	}
+	return nil
+}
+
+// SubmitPostForReview submits the given draft to a collection for review,
+// replacing any earlier review of it.
+func (db *datastore) SubmitPostForReview(postID string, collID, authorID int64) error {
+	// Resubmitting a draft reopens its existing review, clearing any earlier decision
+	_, err := db.Exec("INSERT INTO postreviews (post_id, collection_id, author_id, status, created, updated) VALUES (?, ?, ?, ?, "+db.now()+", "+db.now()+") "+db.upsert("post_id")+" collection_id = ?, author_id = ?, status = ?, reviewer_id = NULL, comment = NULL, updated = "+db.now(), postID, collID, authorID, reviewPending, collID, authorID, reviewPending)
+	if err != nil {
+		log.Error("Couldn't upsert postreviews: %v", err)
+		return err
+	}
+	return nil
+}
+
+func (db *datastore) GetPostReview(postID string) (*PostReview, error) {
+	r := &PostReview{}
+	var reviewerID sql.NullInt64
+	var comment sql.NullString
+	err := db.QueryRow("SELECT post_id, collection_id, author_id, status, reviewer_id, comment, created, updated FROM postreviews WHERE post_id = ?", postID).Scan(&r.PostID, &r.CollectionID, &r.AuthorID, &r.Status, &reviewerID, &comment, &r.Created, &r.Updated)
+	switch {
+	case err == sql.ErrNoRows:
+		return nil, impart.HTTPError{http.StatusNotFound, "Review doesn't exist."}
+	case err != nil:
+		log.Error("Failed selecting post review: %v", err)
+		return nil, err
+	}
+	r.ReviewerID = reviewerID.Int64
+	r.Comment = comment.String
+	return r, nil
+}
+
+// GetPostReviews returns the reviews in the given collection with the given
+// status, oldest first, along with their drafts.
+func (db *datastore) GetPostReviews(collID int64, status reviewStatus) (*[]PostReview, error) {
+	rows, err := db.Query(`SELECT r.post_id, r.author_id, u.username, r.comment, r.created, r.updated, p.title, p.content, p.created
+	FROM postreviews r
+	INNER JOIN posts p ON p.id = r.post_id
+	INNER JOIN users u ON u.id = r.author_id
+	WHERE r.collection_id = ? AND r.status = ? AND p.collection_id IS NULL
+	ORDER BY r.updated ASC`, collID, status)
+	if err != nil {
+		log.Error("Failed selecting from postreviews: %v", err)
+		return nil, impart.HTTPError{http.StatusInternalServerError, "Couldn't retrieve post reviews."}
+	}
+	defer rows.Close()
+
+	rs := []PostReview{}
+	for rows.Next() {
+		r := PostReview{CollectionID: collID, Status: status}
+		p := &Post{}
+		var comment sql.NullString
+		err = rows.Scan(&r.PostID, &r.AuthorID, &r.AuthorName, &comment, &r.Created, &r.Updated, &p.Title, &p.Content, &p.Created)
+		if err != nil {
+			log.Error("Failed scanning post review: %v", err)
+			continue
+		}
+		r.Comment = comment.String
+		p.ID = r.PostID
+		pp := p.processPost()
+		r.Post = &pp
+		rs = append(rs, r)
+	}
+	return &rs, nil
+}
+
+// GetUserPostReviews returns the reviews of the given user's drafts, keyed by
+// post ID.
+func (db *datastore) GetUserPostReviews(userID int64, hostName string) (map[string]*PostReview, error) {
+	rows, err := db.Query(`SELECT r.post_id, r.status, r.comment, r.updated, c.alias, c.title
+	FROM postreviews r
+	INNER JOIN posts p ON p.id = r.post_id
+	INNER JOIN collections c ON c.id = r.collection_id
+	WHERE r.author_id = ? AND p.owner_id = ? AND p.collection_id IS NULL`, userID, userID)
+	if err != nil {
+		log.Error("Failed selecting from postreviews: %v", err)
+		return nil, impart.HTTPError{http.StatusInternalServerError, "Couldn't retrieve post reviews."}
+	}
+	defer rows.Close()
+
+	rs := map[string]*PostReview{}
+	for rows.Next() {
+		r := &PostReview{AuthorID: userID, Collection: &Collection{hostName: hostName}}
+		var comment sql.NullString
+		err = rows.Scan(&r.PostID, &r.Status, &comment, &r.Updated, &r.Collection.Alias, &r.Collection.Title)
+		if err != nil {
+			log.Error("Failed scanning post review: %v", err)
+			continue
+		}
+		r.Comment = comment.String
+		rs[r.PostID] = r
+	}
+	return rs, nil
+}
+
+// ApprovePostReview publishes the draft under review to the given collection,
+// and records the reviewer's decision. Like other posts in the collection,
+// the published post belongs to the collection's owner, while its submitter
+// is recorded as its author.
+func (db *datastore) ApprovePostReview(r *PostReview, c *Collection, reviewerID int64, comment string) error {
+	p, err := db.GetOwnedPost(r.PostID, r.AuthorID)
+	if err != nil {
+		return err
+	}
+	if p.CollectionID.Valid {
+		return impart.HTTPError{http.StatusConflict, "This post has already been published."}
+	}
+
+	slug := getSlugFromPost(p.Title.String, p.Content, p.Language.String)
+	if slug == "" {
+		slug = p.ID
+	}
+	created := time.Now()
+	if db.driverName == driverSQLite {
+		// SQLite stores datetimes in UTC, so convert time.Now() to it here
+		created = created.UTC()
+	}
+	cr := &ClaimPostRequest{AnonymousAuthPost: &AnonymousAuthPost{ID: p.ID}, Slug: slug}
+	res, err := db.AttemptClaim(cr, "UPDATE posts SET owner_id = ?, collection_id = ?, slug = ?, created = ? WHERE id = ? AND owner_id = ? AND collection_id IS NULL", []interface{}{c.OwnerID, c.ID, slug, created.Truncate(time.Second), p.ID, r.AuthorID}, 2)
+	if err != nil {
+		log.Error("Unable to publish reviewed post %s: %v", p.ID, err)
+		return err
+	}
+	if n, _ := res.RowsAffected(); n != 1 {
+		// The draft was published, moved, or deleted since we looked it up
+		return impart.HTTPError{http.StatusConflict, "This post has already been published."}
+	}
+
+	err = db.SetPostAuthor(p.ID, r.AuthorID)
+	if err != nil {
+		return err
+	}
+	db.updatePostTags(p.ID)
+	return db.setPostReviewStatus(r.PostID, reviewApproved, reviewerID, comment)
+}
+
+// RejectPostReview sends the draft under review back to its author, with the
+// reviewer's comment.
+func (db *datastore) RejectPostReview(postID string, reviewerID int64, comment string) error {
+	return db.setPostReviewStatus(postID, reviewRejected, reviewerID, comment)
+}
+
+func (db *datastore) setPostReviewStatus(postID string, status reviewStatus, reviewerID int64, comment string) error {
+	res, err := db.Exec("UPDATE postreviews SET status = ?, reviewer_id = ?, comment = ?, updated = "+db.now()+" WHERE post_id = ? AND status = ?", status, reviewerID, sql.NullString{String: comment, Valid: comment != ""}, postID, reviewPending)
+	if err != nil {
+		log.Error("Couldn't UPDATE postreviews: %v", err)
+		return err
+	}
+	if n, _ := res.RowsAffected(); n != 1 {
+		// Another editor decided on the review first
+		return impart.HTTPError{http.StatusConflict, "This post has already been reviewed."}
+	}
+	return nil
+}
+
+// AddViews adds the given batch of view counts to posts, collections, and
+// daily post stats.
+func (db *datastore) AddViews(b *viewBatch) error {
+	t, err := db.Begin()
+	if err != nil {
+		log.Error("Couldn't start view count transaction: %v", err)
+		return err
+	}
+	for id, n := range b.Posts {
+		_, err = t.Exec("UPDATE posts SET view_count = view_count + ? WHERE id = ?", n, id)
+		if err != nil {
+			t.Rollback()
+			log.Error("Unable to update posts count: %v", err)
+			return err
+		}
+	}
+	for id, n := range b.Collections {
+		_, err = t.Exec("UPDATE collections SET view_count = view_count + ? WHERE id = ?", n, id)
+		if err != nil {
+			t.Rollback()
+			log.Error("Unable to update collections count: %v", err)
+			return err
+		}
+	}
+	for k, n := range b.PostStats {
+		_, err = t.Exec("INSERT INTO postviews (post_id, day, source, referrer, views) VALUES (?, ?, ?, ?, ?) "+db.upsert("post_id", "day", "source", "referrer")+" views = views + ?", k.PostID, k.Day, k.Source, k.Referrer, n, n)
+		if err != nil {
+			t.Rollback()
+			log.Error("Couldn't INSERT into postviews: %v", err)
+			return err
+		}
+	}
+	return t.Commit()
+}
+
+// IsFediverseHost returns whether any fediverse users we know of are on the
+// given host.
+func (db *datastore) IsFediverseHost(host string) bool {
+	var n int
+	// Match the host literally. The escape character is "!", since a
+	// backslash means something different to MySQL and SQLite.
+	pattern := likeEscaper.Replace("https://"+host+"/") + "%"
+	err := db.QueryRow("SELECT 1 FROM remoteusers WHERE actor_id LIKE ? ESCAPE '!' LIMIT 1", pattern).Scan(&n)
+	if err != nil && err != sql.ErrNoRows {
+		log.Error("Failed selecting remote user host: %v", err)
+	}
+	return n == 1
+}
+
+// likeEscaper escapes the wildcards in a string for use in a LIKE pattern with
+// "!" as the ESCAPE character.
+var likeEscaper = strings.NewReplacer("!", "!!", "%", "!%", "_", "!_")
+
+// postViewsWhere returns the conditions and parameters for selecting the
+// view stats of a collection, or of one of its posts, since the given time.
+func postViewsWhere(collID int64, postID string, since time.Time) (string, []interface{}) {
+	where := "p.collection_id = ? AND v.day >= ?"
+	params := []interface{}{collID, since}
+	if postID != "" {
+		where += " AND v.post_id = ?"
+		params = append(params, postID)
+	}
+	return where, params
+}
+
+// GetPostViews returns all view stats of a collection or one of its posts,
+// since the given time.
+func (db *datastore) GetPostViews(collID int64, postID string, since time.Time) ([]PostView, error) {
+	where, params := postViewsWhere(collID, postID, since)
+	rows, err := db.Query("SELECT v.post_id, v.day, v.source, v.referrer, v.views FROM postviews v INNER JOIN posts p ON p.id = v.post_id WHERE "+where+" ORDER BY v.day ASC, v.post_id ASC", params...)
+	if err != nil {
+		log.Error("Failed selecting from postviews: %v", err)
+		return nil, impart.HTTPError{http.StatusInternalServerError, "Couldn't retrieve stats."}
+	}
+	defer rows.Close()
+
+	views := []PostView{}
+	for rows.Next() {
+		v := PostView{}
+		err = rows.Scan(&v.PostID, &v.Day, &v.Source, &v.Referrer, &v.Views)
+		if err != nil {
+			log.Error("Failed scanning post view: %v", err)
+			continue
+		}
+		views = append(views, v)
+	}
+	return views, nil
+}
+
+// GetDailyViews returns the total views of a collection or one of its posts
+// on each day since the given time. Days without views are left out.
+func (db *datastore) GetDailyViews(collID int64, postID string, since time.Time) ([]DailyViews, error) {
+	where, params := postViewsWhere(collID, postID, since)
+	rows, err := db.Query("SELECT v.day, SUM(v.views) FROM postviews v INNER JOIN posts p ON p.id = v.post_id WHERE "+where+" GROUP BY v.day ORDER BY v.day ASC", params...)
+	if err != nil {
+		log.Error("Failed selecting from postviews: %v", err)
+		return nil, impart.HTTPError{http.StatusInternalServerError, "Couldn't retrieve stats."}
+	}
+	defer rows.Close()
+
+	views := []DailyViews{}
+	for rows.Next() {
+		v := DailyViews{}
+		err = rows.Scan(&v.Day, &v.Views)
+		if err != nil {
+			log.Error("Failed scanning daily views: %v", err)
+			continue
+		}
+		views = append(views, v)
+	}
+	return views, nil
+}
+
+// GetViewSources returns the total views of a collection or one of its posts
+// from each kind of source since the given time, most views first.
+func (db *datastore) GetViewSources(collID int64, postID string, since time.Time) ([]ViewCount, error) {
+	where, params := postViewsWhere(collID, postID, since)
+	rows, err := db.Query("SELECT v.source, SUM(v.views) AS total FROM postviews v INNER JOIN posts p ON p.id = v.post_id WHERE "+where+" GROUP BY v.source ORDER BY total DESC", params...)
+	if err != nil {
+		log.Error("Failed selecting from postviews: %v", err)
+		return nil, impart.HTTPError{http.StatusInternalServerError, "Couldn't retrieve stats."}
+	}
+	defer rows.Close()
+
+	counts := []ViewCount{}
+	for rows.Next() {
+		var src viewSource
+		c := ViewCount{}
+		err = rows.Scan(&src, &c.Views)
+		if err != nil {
+			log.Error("Failed scanning view source: %v", err)
+			continue
+		}
+		c.Name = src.String()
+		counts = append(counts, c)
+	}
+	return counts, nil
+}
+
+// GetTopReferrers returns the domains that referred the most views to a
+// collection or one of its posts since the given time.
+func (db *datastore) GetTopReferrers(collID int64, postID string, since time.Time) ([]ViewCount, error) {
+	where, params := postViewsWhere(collID, postID, since)
+	rows, err := db.Query("SELECT v.referrer, SUM(v.views) AS total FROM postviews v INNER JOIN posts p ON p.id = v.post_id WHERE "+where+" AND v.referrer <> '' GROUP BY v.referrer ORDER BY total DESC LIMIT 25", params...)
+	if err != nil {
+		log.Error("Failed selecting from postviews: %v", err)
+		return nil, impart.HTTPError{http.StatusInternalServerError, "Couldn't retrieve stats."}
+	}
+	defer rows.Close()
+
+	counts := []ViewCount{}
+	for rows.Next() {
+		c := ViewCount{}
+		err = rows.Scan(&c.Name, &c.Views)
+		if err != nil {
+			log.Error("Failed scanning referrer: %v", err)
+			continue
+		}
+		counts = append(counts, c)
+	}
+	return counts, nil
+}
+
+// updatePostTags stores the tags in the given post's content, or removes
+// them if the post isn't in a collection.
+func (db *datastore) updatePostTags(postID string) error {
+	var collID sql.NullInt64
+	var content string
+	err := db.QueryRow("SELECT collection_id, content FROM posts WHERE id = ?", postID).Scan(&collID, &content)
+	if err != nil && err != sql.ErrNoRows {
+		log.Error("Failed selecting post to tag: %v", err)
+		return err
+	}
+
+	t, err := db.Begin()
+	if err != nil {
+		log.Error("Couldn't start post tags transaction: %v", err)
+		return err
+	}
+	_, err = t.Exec("DELETE FROM posttags WHERE post_id = ?", postID)
+	if err != nil {
+		t.Rollback()
+		log.Error("Couldn't DELETE from posttags: %v", err)
+		return err
+	}
+	if collID.Valid {
+		for _, tag := range postTags(content) {
+			_, err = t.Exec("INSERT INTO posttags (post_id, collection_id, tag) VALUES (?, ?, ?)", postID, collID.Int64, tag)
+			if err != nil {
+				t.Rollback()
+				log.Error("Couldn't INSERT into posttags: %v", err)
+				return err
+			}
+		}
+	}
+	return t.Commit()
+}
+
+// GetCollectionTags returns all tags used in the given collection, along with
+// the number of posts that use them. Scheduled posts are only counted if
+// includeFuture is true.
+func (db *datastore) GetCollectionTags(collID int64, includeFuture bool) ([]CollectionTag, error) {
+	timeCondition := ""
+	if !includeFuture {
+		timeCondition = "AND p.created <= " + db.now()
+	}
+	rows, err := db.Query("SELECT t.tag, COUNT(*), d.description, d.category FROM posttags t INNER JOIN posts p ON p.id = t.post_id AND p.collection_id = t.collection_id LEFT JOIN collectiontags d ON d.collection_id = t.collection_id AND d.tag = t.tag WHERE t.collection_id = ? "+timeCondition+" GROUP BY t.tag, d.description, d.category ORDER BY t.tag ASC", collID)
+	if err != nil {
+		log.Error("Failed selecting from posttags: %v", err)
+		return nil, impart.HTTPError{http.StatusInternalServerError, "Couldn't retrieve tags."}
+	}
+	defer rows.Close()
+
+	tags := []CollectionTag{}
+	for rows.Next() {
+		t := CollectionTag{}
+		var desc sql.NullString
+		var category sql.NullBool
+		err = rows.Scan(&t.Name, &t.Posts, &desc, &category)
+		if err != nil {
+			log.Error("Failed scanning tag: %v", err)
+			continue
+		}
+		t.Description = desc.String
+		t.Category = category.Bool
+		tags = append(tags, t)
+	}
+	return tags, nil
+}
+
+// GetCollectionTagDescription returns the description of the given tag in a
+// collection, or "" if it doesn't have one.
+func (db *datastore) GetCollectionTagDescription(collID int64, tag string) string {
+	var desc string
+	err := db.QueryRow("SELECT description FROM collectiontags WHERE collection_id = ? AND tag = ?", collID, strings.ToLower(tag)).Scan(&desc)
+	if err != nil && err != sql.ErrNoRows {
+		log.Error("Failed selecting tag description: %v", err)
+	}
+	return desc
+}
+
+// SetCollectionTagDescription sets the description of the given tag in a
+// collection.
+func (db *datastore) SetCollectionTagDescription(collID int64, tag, desc string) error {
+	_, err := db.Exec("INSERT INTO collectiontags (collection_id, tag, description) VALUES (?, ?, ?) "+db.upsert("collection_id", "tag")+" description = ?", collID, tag, desc, desc)
+	if err != nil {
+		log.Error("Couldn't set tag description: %v", err)
+		return err
+	}
+	return nil
+}
+
+// SetCollectionTagCategory sets whether the given tag is one of the
+// collection's categories.
+func (db *datastore) SetCollectionTagCategory(collID int64, tag string, category bool) error {
+	_, err := db.Exec("INSERT INTO collectiontags (collection_id, tag, description, category) VALUES (?, ?, '', ?) "+db.upsert("collection_id", "tag")+" category = ?", collID, tag, category, category)
+	if err != nil {
+		log.Error("Couldn't set tag category: %v", err)
+		return err
+	}
+	return nil
+}
+
+// GetCollectionCategories returns the tags that are categories in the given
+// collection.
+func (db *datastore) GetCollectionCategories(collID int64) ([]string, error) {
+	rows, err := db.Query("SELECT tag FROM collectiontags WHERE collection_id = ? AND category = ? ORDER BY tag ASC", collID, true)
+	if err != nil {
+		log.Error("Failed selecting categories: %v", err)
+		return nil, impart.HTTPError{http.StatusInternalServerError, "Couldn't retrieve categories."}
+	}
+	defer rows.Close()
+
+	cats := []string{}
+	for rows.Next() {
+		var tag string
+		err = rows.Scan(&tag)
+		if err != nil {
+			log.Error("Failed scanning category: %v", err)
+			continue
+		}
+		cats = append(cats, tag)
+	}
+	return cats, nil
+}
+
+// GetCollectionMenu returns the items in the collection's navigation menu, in
+// order.
+func (db *datastore) GetCollectionMenu(collID int64) ([]MenuItem, error) {
+	rows, err := db.Query("SELECT item_type, title, target FROM collectionmenus WHERE collection_id = ? ORDER BY position ASC", collID)
+	if err != nil {
+		log.Error("Failed selecting from collectionmenus: %v", err)
+		return nil, impart.HTTPError{http.StatusInternalServerError, "Couldn't retrieve menu."}
+	}
+	defer rows.Close()
+
+	items := []MenuItem{}
+	for rows.Next() {
+		i := MenuItem{}
+		err = rows.Scan(&i.Type, &i.Title, &i.Target)
+		if err != nil {
+			log.Error("Failed scanning menu item: %v", err)
+			continue
+		}
+		items = append(items, i)
+	}
+	return items, nil
+}
+
+// SetCollectionMenu replaces the collection's navigation menu with the given
+// items.
+func (db *datastore) SetCollectionMenu(collID int64, items []MenuItem) error {
+	t, err := db.Begin()
+	if err != nil {
+		log.Error("Couldn't start menu transaction: %v", err)
+		return err
+	}
+	_, err = t.Exec("DELETE FROM collectionmenus WHERE collection_id = ?", collID)
+	if err != nil {
+		t.Rollback()
+		log.Error("Couldn't DELETE from collectionmenus: %v", err)
+		return err
+	}
+	for pos, i := range items {
+		_, err = t.Exec("INSERT INTO collectionmenus (collection_id, position, item_type, title, target) VALUES (?, ?, ?, ?, ?)", collID, pos, i.Type, i.Title, i.Target)
+		if err != nil {
+			t.Rollback()
+			log.Error("Couldn't INSERT into collectionmenus: %v", err)
+			return err
+		}
+	}
+	return t.Commit()
+}
+
+// RenameCollectionTag changes the given hashtag in every post in the
+// collection that uses it, merging the two tags if the new one is already in
+// use. It returns the number of posts changed.
+func (db *datastore) RenameCollectionTag(collID int64, from, to string) (int, error) {
+	t, err := db.Begin()
+	if err != nil {
+		log.Error("Couldn't start tag rename transaction: %v", err)
+		return 0, err
+	}
+
+	rows, err := t.Query("SELECT p.id, p.content FROM posttags t INNER JOIN posts p ON p.id = t.post_id WHERE t.collection_id = ? AND t.tag = ?", collID, from)
+	if err != nil {
+		t.Rollback()
+		log.Error("Failed selecting tagged posts: %v", err)
+		return 0, err
+	}
+	contents := map[string]string{}
+	for rows.Next() {
+		var id, content string
+		if err = rows.Scan(&id, &content); err != nil {
+			break
+		}
+		contents[id] = content
+	}
+	rows.Close()
+	if err != nil {
+		t.Rollback()
+		log.Error("Failed scanning tagged post: %v", err)
+		return 0, err
+	}
+
+	for id, content := range contents {
+		_, err = t.Exec("UPDATE posts SET content = ? WHERE id = ?", replaceHashtag(content, from, to), id)
+		if err == nil {
+			_, err = t.Exec("DELETE FROM posttags WHERE post_id = ? AND tag = ?", id, from)
+		}
+		if err == nil {
+			_, err = t.Exec("INSERT INTO posttags (post_id, collection_id, tag) VALUES (?, ?, ?) "+db.upsert("post_id", "tag")+" tag = ?", id, collID, to, to)
+		}
+		if err != nil {
+			t.Rollback()
+			log.Error("Couldn't rename tag on post %s: %v", id, err)
+			return 0, err
+		}
+	}
+
+	// Keep the old tag's description, unless the new one already has one
+	var dummy int
+	err = t.QueryRow("SELECT 1 FROM collectiontags WHERE collection_id = ? AND tag = ?", collID, to).Scan(&dummy)
+	if err == sql.ErrNoRows {
+		_, err = t.Exec("UPDATE collectiontags SET tag = ? WHERE collection_id = ? AND tag = ?", to, collID, from)
+	} else if err == nil {
+		_, err = t.Exec("DELETE FROM collectiontags WHERE collection_id = ? AND tag = ?", collID, from)
+	}
+	if err != nil {
+		t.Rollback()
+		log.Error("Couldn't rename tag description: %v", err)
+		return 0, err
+	}
+	_, err = t.Exec("UPDATE collectionmenus SET target = ? WHERE collection_id = ? AND target = ? AND item_type IN (?, ?)", to, collID, from, menuItemTag, menuItemCategory)
+	if err != nil {
+		t.Rollback()
+		log.Error("Couldn't rename tag in menu: %v", err)
+		return 0, err
+	}
+
+	return len(contents), t.Commit()
+}
+
+// SetPostSeries adds the given post to the collection's series with the given
+// title, creating the series if needed, and places it at the given part. A
+// part of 0 keeps the post where it is if it's already in the series, and
+// otherwise adds it to the end. An empty title removes the post from its
+// series.
+func (db *datastore) SetPostSeries(postID string, collID int64, title string, part int) error {
+	title = strings.TrimSpace(title)
+	slug := ""
+	if title != "" {
+		slug = getSlug(title, "")
+		if slug == "" {
+			return impart.HTTPError{http.StatusBadRequest, "Series title needs some letters or numbers in it."}
+		}
+	}
+
+	t, err := db.Begin()
+	if err != nil {
+		log.Error("Couldn't start series transaction: %v", err)
+		return err
+	}
+
+	var curSlug string
+	var curPos int
+	err = t.QueryRow("SELECT series_slug, position FROM postseries WHERE post_id = ?", postID).Scan(&curSlug, &curPos)
+	if err != nil && err != sql.ErrNoRows {
+		t.Rollback()
+		log.Error("Failed selecting post series: %v", err)
+		return err
+	}
+	_, err = t.Exec("DELETE FROM postseries WHERE post_id = ?", postID)
+	if err != nil {
+		t.Rollback()
+		log.Error("Couldn't DELETE from postseries: %v", err)
+		return err
+	}
+
+	if slug != "" {
+		var dummy int
+		err = t.QueryRow("SELECT 1 FROM collectionseries WHERE collection_id = ? AND slug = ?", collID, slug).Scan(&dummy)
+		if err == sql.ErrNoRows {
+			_, err = t.Exec("INSERT INTO collectionseries (collection_id, slug, title) VALUES (?, ?, ?)", collID, slug, title)
+		}
+		if err != nil {
+			t.Rollback()
+			log.Error("Couldn't create series: %v", err)
+			return err
+		}
+
+		rows, err := t.Query("SELECT post_id FROM postseries WHERE collection_id = ? AND series_slug = ? ORDER BY position ASC", collID, slug)
+		if err != nil {
+			t.Rollback()
+			log.Error("Failed selecting series posts: %v", err)
+			return err
+		}
+		ids := []string{}
+		for rows.Next() {
+			var id string
+			if err = rows.Scan(&id); err != nil {
+				break
+			}
+			ids = append(ids, id)
+		}
+		rows.Close()
+		if err != nil {
+			t.Rollback()
+			log.Error("Failed scanning series post: %v", err)
+			return err
+		}
+
+		if part == 0 && curSlug == slug {
+			// Keep the post where it was
+			part = curPos
+		}
+		ids = placeInOrder(ids, postID, part)
+		for i, id := range ids {
+			if id == postID {
+				_, err = t.Exec("INSERT INTO postseries (post_id, collection_id, series_slug, position) VALUES (?, ?, ?, ?)", id, collID, slug, i+1)
+			} else {
+				_, err = t.Exec("UPDATE postseries SET position = ? WHERE post_id = ?", i+1, id)
+			}
+			if err != nil {
+				t.Rollback()
+				log.Error("Couldn't update series position: %v", err)
+				return err
+			}
+		}
+	}
+
+	// Clean up any series left without posts
+	_, err = t.Exec("DELETE FROM collectionseries WHERE collection_id = ? AND slug NOT IN (SELECT series_slug FROM postseries WHERE collection_id = ?)", collID, collID)
+	if err != nil {
+		t.Rollback()
+		log.Error("Couldn't DELETE empty series: %v", err)
+		return err
+	}
+	return t.Commit()
+}
+
+// GetPostSeries returns the series the given post is part of, or nil if it
+// isn't part of one.
+func (db *datastore) GetPostSeries(postID string) (*Series, error) {
+	s := &Series{}
+	err := db.QueryRow("SELECT s.collection_id, s.slug, s.title FROM postseries ps INNER JOIN collectionseries s ON s.collection_id = ps.collection_id AND s.slug = ps.series_slug INNER JOIN posts p ON p.id = ps.post_id AND p.collection_id = ps.collection_id WHERE ps.post_id = ?", postID).Scan(&s.CollectionID, &s.Slug, &s.Title)
+	switch {
+	case err == sql.ErrNoRows:
+		return nil, nil
+	case err != nil:
+		log.Error("Failed selecting post series: %v", err)
+		return nil, err
+	}
+	return s, nil
+}
+
+// GetSeries returns the collection's series with the given slug.
+func (db *datastore) GetSeries(collID int64, slug string) (*Series, error) {
+	s := &Series{CollectionID: collID}
+	err := db.QueryRow("SELECT slug, title FROM collectionseries WHERE collection_id = ? AND slug = ?", collID, strings.ToLower(slug)).Scan(&s.Slug, &s.Title)
+	switch {
+	case err == sql.ErrNoRows:
+		return nil, ErrCollectionPageNotFound
+	case err != nil:
+		log.Error("Failed selecting series: %v", err)
+		return nil, err
+	}
+	return s, nil
+}
+
+// GetSeriesPosts returns the posts in the given series, in order.
+func (db *datastore) GetSeriesPosts(cfg *config.Config, c *Collection, slug string, includeFuture bool) (*[]PublicPost, error) {
+	timeCondition := ""
+	if !includeFuture {
+		timeCondition = "AND p.created <= " + db.now()
+	}
+	cols := "p." + strings.Replace(postCols, ", ", ", p.", -1)
+	rows, err := db.Query("SELECT "+cols+" FROM postseries ps INNER JOIN posts p ON p.id = ps.post_id WHERE ps.collection_id = ? AND ps.series_slug = ? AND p.collection_id = ps.collection_id "+timeCondition+" ORDER BY ps.position ASC", c.ID, slug)
+	if err != nil {
+		log.Error("Failed selecting series posts: %v", err)
+		return nil, impart.HTTPError{http.StatusInternalServerError, "Couldn't retrieve series posts."}
+	}
+	defer rows.Close()
+
+	posts := []PublicPost{}
+	for rows.Next() {
+		p := &Post{}
+		err = rows.Scan(&p.ID, &p.Slug, &p.Font, &p.Language, &p.RTL, &p.Privacy, &p.OwnerID, &p.CollectionID, &p.PinnedPosition, &p.PagePosition, &p.Created, &p.Updated, &p.ViewCount, &p.Title, &p.Content)
+		if err != nil {
+			log.Error("Failed scanning row: %v", err)
+			break
+		}
+		p.extractData()
+		p.augmentContent(c)
+		p.formatContent(cfg, c, includeFuture, false)
+
+		posts = append(posts, p.processPost())
+	}
+	err = rows.Err()
+	if err != nil {
+		log.Error("Error after Next() on rows: %v", err)
+	}
+
+	return &posts, nil
+}
+
+// GetRelatedDocs returns all posts in the given collection, except for pages,
+// ready to be compared when finding related posts.
+func (db *datastore) GetRelatedDocs(collID int64) ([]relatedDoc, error) {
+	rows, err := db.Query("SELECT id, title, content FROM posts WHERE collection_id = ? AND page_position IS NULL", collID)
+	if err != nil {
+		log.Error("Failed selecting posts for related posts: %v", err)
+		return nil, err
+	}
+	defer rows.Close()
+
+	docs := []relatedDoc{}
+	for rows.Next() {
+		var id, content string
+		var title sql.NullString
+		err = rows.Scan(&id, &title, &content)
+		if err != nil {
+			log.Error("Failed scanning row: %v", err)
+			return nil, err
+		}
+		docs = append(docs, newRelatedDoc(id, title.String, content))
+	}
+	return docs, rows.Err()
+}
+
+// SetRelatedPosts replaces the related posts of all posts in the given
+// collection, and marks the collection as indexed.
+func (db *datastore) SetRelatedPosts(collID int64, related map[string][]string) error {
+	t, err := db.Begin()
+	if err != nil {
+		log.Error("Couldn't start related posts transaction: %v", err)
+		return err
+	}
+	_, err = t.Exec("DELETE FROM relatedposts WHERE collection_id = ?", collID)
+	if err != nil {
+		t.Rollback()
+		log.Error("Couldn't DELETE from relatedposts: %v", err)
+		return err
+	}
+	for postID, ids := range related {
+		for i, id := range ids {
+			_, err = t.Exec("INSERT INTO relatedposts (collection_id, post_id, related_id, position) VALUES (?, ?, ?, ?)", collID, postID, id, i+1)
+			if err != nil {
+				t.Rollback()
+				log.Error("Couldn't INSERT into relatedposts: %v", err)
+				return err
+			}
+		}
+	}
+	_, err = t.Exec("DELETE FROM collectionattributes WHERE collection_id = ? AND attribute = ?", collID, "related_posts")
+	if err == nil {
+		_, err = t.Exec("INSERT INTO collectionattributes (collection_id, attribute, value) VALUES (?, ?, ?)", collID, "related_posts", "1")
+	}
+	if err != nil {
+		t.Rollback()
+		log.Error("Couldn't mark related posts as indexed: %v", err)
+		return err
+	}
+	return t.Commit()
+}
+
+// GetRelatedPosts returns up to limit posts related to the given post, most
+// related first. It will return future posts if `includeFuture` is true.
+func (db *datastore) GetRelatedPosts(c *Collection, postID string, limit int, includeFuture bool) ([]RelatedPost, error) {
+	timeCondition := ""
+	if !includeFuture {
+		timeCondition = "AND p.created <= " + db.now()
+	}
+	rows, err := db.Query("SELECT p.id, p.slug, p.title, "+db.clip("p.content", 80)+" FROM relatedposts r INNER JOIN posts p ON p.id = r.related_id AND p.collection_id = r.collection_id WHERE r.post_id = ? AND r.collection_id = ? AND p.page_position IS NULL "+timeCondition+" ORDER BY r.position ASC"+fmt.Sprintf(" LIMIT %d", limit), postID, c.ID)
+	if err != nil {
+		log.Error("Failed selecting related posts: %v", err)
+		return nil, impart.HTTPError{http.StatusInternalServerError, "Couldn't retrieve related posts."}
+	}
+	defer rows.Close()
+
+	related := []RelatedPost{}
+	for rows.Next() {
+		p := &Post{}
+		err = rows.Scan(&p.ID, &p.Slug, &p.Title, &p.Content)
+		if err != nil {
+			log.Error("Failed scanning row: %v", err)
+			break
+		}
+		related = append(related, RelatedPost{
+			ID:    p.ID,
+			Slug:  p.Slug.String,
+			Title: p.PlainDisplayTitle(),
+			URL:   c.CanonicalURL() + p.Slug.String,
+		})
+	}
+	return related, nil
+}
+
+// GetUnindexedCollections returns the IDs of collections with more than one
+// post whose related posts have never been found.
+func (db *datastore) GetUnindexedCollections() ([]int64, error) {
+	rows, err := db.Query("SELECT collection_id FROM posts WHERE collection_id IS NOT NULL AND collection_id NOT IN (SELECT collection_id FROM collectionattributes WHERE attribute = ?) GROUP BY collection_id HAVING COUNT(*) > 1", "related_posts")
+	if err != nil {
+		log.Error("Failed selecting unindexed collections: %v", err)
+		return nil, err
+	}
+	defer rows.Close()
+
+	ids := []int64{}
+	for rows.Next() {
+		var id int64
+		if err = rows.Scan(&id); err != nil {
+			log.Error("Failed scanning row: %v", err)
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	return ids, rows.Err()
+}
+
+// GetLinkEmbed returns what's known about embedding the given URL, or nil if
+// it's never been looked up.
+func (db *datastore) GetLinkEmbed(u string) (*linkEmbed, error) {
+	e := &linkEmbed{URL: u}
+	err := db.QueryRow("SELECT kind, COALESCE(html, ''), fetched FROM linkembeds WHERE url_hash = ?", linkEmbedHash(u)).Scan(&e.Kind, &e.HTML, &e.Fetched)
+	switch {
+	case err == sql.ErrNoRows:
+		return nil, nil
+	case err != nil:
+		log.Error("Failed selecting from linkembeds: %v", err)
+		return nil, err
+	}
+	return e, nil
+}
+
+// QueueLinkEmbed marks the given URL to be looked up for embedding, keeping
+// any embed it already has until then.
+func (db *datastore) QueueLinkEmbed(u string) error {
+	res, err := db.Exec("UPDATE linkembeds SET fetched = NULL WHERE url_hash = ?", linkEmbedHash(u))
+	if err != nil {
+		log.Error("Failed updating linkembeds: %v", err)
+		return err
+	}
+	if n, _ := res.RowsAffected(); n > 0 {
+		return nil
+	}
+	ignore := "IGNORE"
+	if db.driverName == driverSQLite {
+		ignore = "OR IGNORE"
+	}
+	_, err = db.Exec("INSERT "+ignore+" INTO linkembeds (url_hash, url) VALUES (?, ?)", linkEmbedHash(u), u)
+	if err != nil {
+		log.Error("Failed inserting into linkembeds: %v", err)
+		return err
+	}
+	return nil
+}
+
+// GetQueuedLinkEmbeds returns up to limit URLs waiting to be looked up for
+// embedding, oldest first.
+func (db *datastore) GetQueuedLinkEmbeds(limit int) ([]string, error) {
+	rows, err := db.Query(fmt.Sprintf("SELECT url FROM linkembeds WHERE fetched IS NULL ORDER BY created ASC LIMIT %d", limit))
+	if err != nil {
+		log.Error("Failed selecting queued link embeds: %v", err)
+		return nil, err
+	}
+	defer rows.Close()
+
+	urls := []string{}
+	for rows.Next() {
+		var u string
+		if err = rows.Scan(&u); err != nil {
+			log.Error("Failed scanning row: %v", err)
+			return nil, err
+		}
+		urls = append(urls, u)
+	}
+	return urls, rows.Err()
+}
+
+// SetLinkEmbed saves the embed found for the given URL, where an empty kind
+// means there isn't one.
+func (db *datastore) SetLinkEmbed(u, kind, html string) error {
+	_, err := db.Exec("UPDATE linkembeds SET kind = ?, html = ?, fetched = "+db.now()+" WHERE url_hash = ?", kind, html, linkEmbedHash(u))
+	if err != nil {
+		log.Error("Failed updating linkembeds: %v", err)
+		return err
+	}
+	return nil
+}
+
+// GetCollectionDomain returns the custom domain set for the collection, or nil
+// if it doesn't have one. Claims that weren't verified in time are ignored.
+func (db *datastore) GetCollectionDomain(collID int64) (*CustomDomain, error) {
+	d := &CustomDomain{CollectionID: collID}
+	err := db.QueryRow("SELECT host, token, verified, created FROM collectiondomains WHERE collection_id = ? AND (verified IS NOT NULL OR created > "+db.dateSub(domainClaimDays, "day")+")", collID).Scan(&d.Host, &d.Token, &d.Verified, &d.Created)
+	switch {
+	case err == sql.ErrNoRows:
+		return nil, nil
+	case err != nil:
+		log.Error("Failed selecting from collectiondomains: %v", err)
+		return nil, err
+	}
+	return d, nil
+}
+
+// GetVerifiedDomains returns every custom domain that has been verified.
+func (db *datastore) GetVerifiedDomains() ([]CustomDomain, error) {
+	rows, err := db.Query("SELECT collection_id, host, token, verified, created FROM collectiondomains WHERE verified IS NOT NULL")
+	if err != nil {
+		log.Error("Failed selecting verified domains: %v", err)
+		return nil, err
+	}
+	defer rows.Close()
+
+	ds := []CustomDomain{}
+	for rows.Next() {
+		d := CustomDomain{}
+		if err = rows.Scan(&d.CollectionID, &d.Host, &d.Token, &d.Verified, &d.Created); err != nil {
+			log.Error("Failed scanning row: %v", err)
+			return nil, err
+		}
+		ds = append(ds, d)
+	}
+	return ds, rows.Err()
+}
+
+// SetCollectionDomain sets the collection's custom domain, which then needs to
+// be verified with the given token before it's used.
+func (db *datastore) SetCollectionDomain(collID int64, host, token string) error {
+	var otherID int64
+	err := db.QueryRow("SELECT collection_id FROM collectiondomains WHERE verified_host = ?", host).Scan(&otherID)
+	switch {
+	case err == nil && otherID != collID:
+		return errDomainTaken
+	case err != nil && err != sql.ErrNoRows:
+		log.Error("Failed selecting from collectiondomains: %v", err)
+		return err
+	}
+
+	// Clear out this collection's old domain, along with any claims that
+	// were never verified
+	_, err = db.Exec("DELETE FROM collectiondomains WHERE collection_id = ? OR (verified IS NULL AND created < "+db.dateSub(domainClaimDays, "day")+")", collID)
+	if err != nil {
+		log.Error("Failed deleting from collectiondomains: %v", err)
+		return err
+	}
+	_, err = db.Exec("INSERT INTO collectiondomains (collection_id, host, token, created) VALUES (?, ?, ?, "+db.now()+")", collID, host, token)
+	if err != nil {
+		log.Error("Failed inserting into collectiondomains: %v", err)
+		return err
+	}
+	return nil
+}
+
+// VerifyCollectionDomain marks the collection's custom domain as verified,
+// unless another collection has verified the same host first.
+func (db *datastore) VerifyCollectionDomain(collID int64) error {
+	_, err := db.Exec("UPDATE collectiondomains SET verified = "+db.now()+", verified_host = host WHERE collection_id = ?", collID)
+	if err != nil {
+		if db.isDuplicateKeyErr(err) {
+			return errDomainTaken
+		}
+		log.Error("Failed updating collectiondomains: %v", err)
+		return err
+	}
+	return nil
+}
+
+// RemoveCollectionDomain removes the collection's custom domain, if it has one.
+func (db *datastore) RemoveCollectionDomain(collID int64) error {
+	_, err := db.Exec("DELETE FROM collectiondomains WHERE collection_id = ?", collID)
+	if err != nil {
+		log.Error("Failed deleting from collectiondomains: %v", err)
+		return err
+	}
+	return nil
+}
+
 func stringLogln(log *string, s string, v ...interface{}) {
 	*log += fmt.Sprintf(s+"\n", v...)
 }
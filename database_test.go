@@ -48,3 +48,8 @@ func TestOAuthDatastore(t *testing.T) {
 		assert.Equal(t, localUserID, foundUserID)
 	})
 }
+
+func TestLikeEscaper(t *testing.T) {
+	assert.Equal(t, "https://ex!_ample.com/", likeEscaper.Replace("https://ex_ample.com/"))
+	assert.Equal(t, "100!%!!", likeEscaper.Replace("100%!"))
+}
@@ -0,0 +1,367 @@
+/*
+ * Copyright © 2021 A Bunch Tell LLC.
+ *
+ * This file is part of WriteFreely.
+ *
+ * WriteFreely is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License, included
+ * in the LICENSE file in this source code package.
+ */
+
+package writefreely
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/writeas/impart"
+	"github.com/writeas/web-core/id"
+	"github.com/writeas/web-core/log"
+	"golang.org/x/crypto/acme/autocert"
+	"golang.org/x/net/idna"
+)
+
+const (
+	domainTokenLen = 32
+
+	// domainTXTPrefix is prepended to a custom domain to get the name of the
+	// TXT record that verifies it.
+	domainTXTPrefix = "_writefreely."
+	// domainTXTValuePrefix is prepended to the verification token in the
+	// domain's TXT record.
+	domainTXTValuePrefix = "writefreely-domain="
+	// domainClaimDays is how long a custom domain can go unverified before
+	// it's dropped.
+	domainClaimDays = 7
+)
+
+var (
+	errDomainInvalid    = impart.HTTPError{http.StatusBadRequest, "Enter a domain name, like blog.example.com, without a port or IP address."}
+	errDomainUnverified = errors.New("couldn't find the TXT record for the domain yet")
+	errDomainTaken      = impart.HTTPError{http.StatusConflict, "That domain is already used by another blog."}
+
+	// lookupTXT finds a domain's TXT records. It's swapped out in tests.
+	lookupTXT = net.LookupTXT
+)
+
+// CustomDomain is a domain name that a collection is served from, instead of
+// from a path on the instance's host.
+type CustomDomain struct {
+	CollectionID int64
+	Host         string
+	Token        string
+	// Verified is when the collection's owner proved they control the domain,
+	// or nil if they haven't yet.
+	Verified *time.Time
+	Created  time.Time
+}
+
+// IsVerified returns whether the domain can be used for its collection.
+func (d *CustomDomain) IsVerified() bool {
+	return d.Verified != nil
+}
+
+// DisplayHost returns the domain as it should be shown to people, with any
+// internationalized labels decoded.
+func (d *CustomDomain) DisplayHost() string {
+	h, err := idna.ToUnicode(d.Host)
+	if err != nil {
+		return d.Host
+	}
+	return h
+}
+
+// TXTRecordName returns the name of the DNS record that verifies the domain.
+func (d *CustomDomain) TXTRecordName() string {
+	return domainTXTPrefix + d.Host
+}
+
+// TXTRecordValue returns the value the domain's TXT record needs to have.
+func (d *CustomDomain) TXTRecordValue() string {
+	return domainTXTValuePrefix + d.Token
+}
+
+// domainRegistry keeps the verified custom domains in memory, since every
+// request and every certificate request needs to be checked against them.
+type domainRegistry struct {
+	mu    sync.RWMutex
+	hosts map[string]int64
+	colls map[int64]string
+}
+
+var customDomains = newDomainRegistry()
+
+func newDomainRegistry() *domainRegistry {
+	return &domainRegistry{
+		hosts: map[string]int64{},
+		colls: map[int64]string{},
+	}
+}
+
+func (dr *domainRegistry) set(collID int64, host string) {
+	dr.mu.Lock()
+	defer dr.mu.Unlock()
+	if prev, ok := dr.colls[collID]; ok {
+		delete(dr.hosts, prev)
+	}
+	dr.hosts[host] = collID
+	dr.colls[collID] = host
+}
+
+func (dr *domainRegistry) remove(collID int64) {
+	dr.mu.Lock()
+	defer dr.mu.Unlock()
+	if host, ok := dr.colls[collID]; ok {
+		delete(dr.hosts, host)
+		delete(dr.colls, collID)
+	}
+}
+
+// collection returns the ID of the collection the given host was verified
+// for, or 0 if it isn't a verified custom domain.
+func (dr *domainRegistry) collection(host string) int64 {
+	dr.mu.RLock()
+	defer dr.mu.RUnlock()
+	return dr.hosts[host]
+}
+
+// host returns the collection's verified custom domain, or an empty string.
+func (dr *domainRegistry) host(collID int64) string {
+	dr.mu.RLock()
+	defer dr.mu.RUnlock()
+	return dr.colls[collID]
+}
+
+// initCustomDomains loads the verified custom domains. Custom domains aren't
+// used on single-user instances, where the blog is already at the top level.
+func initCustomDomains(app *App) {
+	if app.cfg.App.SingleUser {
+		return
+	}
+	ds, err := app.db.GetVerifiedDomains()
+	if err != nil {
+		log.Error("Unable to load custom domains: %v", err)
+		return
+	}
+	for _, d := range ds {
+		customDomains.set(d.CollectionID, d.Host)
+	}
+	if len(ds) > 0 {
+		log.Info("Loaded %d custom domain(s)", len(ds))
+	}
+}
+
+// Domain returns the collection's verified custom domain, or an empty string
+// if it's only served from the instance's host.
+func (c *Collection) Domain() string {
+	return customDomains.host(c.ID)
+}
+
+// hostWithoutPort returns the host of a request, lowercased and without any
+// port.
+func hostWithoutPort(host string) string {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	return strings.ToLower(strings.TrimSuffix(host, "."))
+}
+
+// normalizeDomain turns what someone entered as their blog's domain into the
+// ASCII host name it'll be requested with.
+func normalizeDomain(s string) (string, error) {
+	s = strings.ToLower(strings.TrimSpace(s))
+	if i := strings.Index(s, "://"); i > -1 {
+		s = s[i+3:]
+	}
+	if i := strings.IndexAny(s, "/?#"); i > -1 {
+		s = s[:i]
+	}
+	s = strings.TrimSuffix(s, ".")
+	if s == "" || strings.Contains(s, ":") || net.ParseIP(s) != nil {
+		return "", errDomainInvalid
+	}
+	host, err := idna.Lookup.ToASCII(s)
+	if err != nil || !strings.Contains(host, ".") || len(host) > 253 {
+		return "", errDomainInvalid
+	}
+	return host, nil
+}
+
+// verifyCustomDomain checks that whoever set the domain controls its DNS, with
+// a TXT record holding the verification token. Only the TXT record counts:
+// the domain pointing at this instance doesn't show who it belongs to.
+func verifyCustomDomain(d *CustomDomain) error {
+	txts, err := lookupTXT(d.TXTRecordName())
+	if err != nil {
+		return errDomainUnverified
+	}
+	for _, t := range txts {
+		if strings.TrimSpace(t) == d.TXTRecordValue() {
+			return nil
+		}
+	}
+	return errDomainUnverified
+}
+
+// customDomainHostPolicy allows certificates to be requested for the
+// instance's own host and for every verified custom domain.
+func customDomainHostPolicy(host string) autocert.HostPolicy {
+	return func(ctx context.Context, h string) error {
+		if h == host || customDomains.collection(h) != 0 {
+			return nil
+		}
+		return fmt.Errorf("acme/autocert: host %q not configured", h)
+	}
+}
+
+// isCustomDomainRequest matches requests made to a verified custom domain.
+func isCustomDomainRequest(r *http.Request, rm *mux.RouteMatch) bool {
+	return customDomains.collection(hostWithoutPort(r.Host)) != 0
+}
+
+// customDomainVars adds the alias of the collection that a request's custom
+// domain belongs to, along with the domain, to the request's route variables,
+// so collection handlers can serve it as they would from the instance's host.
+func customDomainVars(app *App) mux.MiddlewareFunc {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			host := hostWithoutPort(r.Host)
+			c, err := app.db.GetCollectionFromDomain(host)
+			if err != nil {
+				http.NotFound(w, r)
+				return
+			}
+			vars := mux.Vars(r)
+			if vars == nil {
+				vars = map[string]string{}
+			}
+			vars["collection"] = c.Alias
+			vars["domain"] = host
+			next.ServeHTTP(w, mux.SetURLVars(r, vars))
+		})
+	}
+}
+
+// RouteCustomDomains adds the routes for collections served from their own
+// domains.
+func RouteCustomDomains(handler *Handler, r *mux.Router) {
+	r.Use(customDomainVars(handler.app.App()))
+	r.HandleFunc("/", handler.Web(handleViewCollection, UserLevelReader))
+	RouteCollections(handler, r)
+}
+
+// customDomainRedirect sends readers who request a collection from the
+// instance's host to the same page on the collection's custom domain. Signed
+// in users stay where they are, since they're only signed in on this host.
+func customDomainRedirect(c *Collection, cr *collectionReq, u *User, r *http.Request) error {
+	if cr.isCustomDomain || u != nil || c.IsPrivate() || r.Method != http.MethodGet {
+		return nil
+	}
+	if c.Domain() == "" || strings.Contains(r.Header.Get("Accept"), "application/activity+json") {
+		return nil
+	}
+	p := strings.TrimPrefix(r.URL.Path, "/"+cr.prefix+cr.alias)
+	loc := c.CanonicalURL() + strings.TrimPrefix(p, "/")
+	if r.URL.RawQuery != "" {
+		loc += "?" + r.URL.RawQuery
+	}
+	return impart.HTTPError{http.StatusMovedPermanently, loc}
+}
+
+func handleSetCollectionDomain(app *App, u *User, w http.ResponseWriter, r *http.Request) error {
+	if app.cfg.App.SingleUser {
+		return impart.HTTPError{http.StatusNotFound, "Custom domains aren't available on single-user instances."}
+	}
+	if u.IsSilenced() {
+		return ErrUserSilenced
+	}
+	c, err := getOwnedCollection(app, u, r)
+	if err != nil {
+		return err
+	}
+	settingsURL := "/me/c/" + c.Alias + "#custom-domain"
+
+	input := r.FormValue("domain")
+	if strings.TrimSpace(input) == "" {
+		err = app.db.RemoveCollectionDomain(c.ID)
+		if err != nil {
+			return err
+		}
+		customDomains.remove(c.ID)
+		app.pages.invalidate(c.ID)
+		_ = addSessionFlash(app, w, r, "SUCCESS: Removed custom domain.", nil)
+		return impart.HTTPError{http.StatusFound, settingsURL}
+	}
+
+	host, err := normalizeDomain(input)
+	if instanceURL, _ := url.Parse(app.cfg.App.Host); err != nil || (instanceURL != nil && host == instanceURL.Hostname()) {
+		_ = addSessionFlash(app, w, r, errDomainInvalid.Message, nil)
+		return impart.HTTPError{http.StatusFound, settingsURL}
+	}
+
+	if prev, err := app.db.GetCollectionDomain(c.ID); err == nil && prev != nil && prev.Host == host {
+		_ = addSessionFlash(app, w, r, "INFO: That's already this blog's custom domain.", nil)
+		return impart.HTTPError{http.StatusFound, settingsURL}
+	}
+	err = app.db.SetCollectionDomain(c.ID, host, id.GenerateFriendlyRandomString(domainTokenLen))
+	if err != nil {
+		if herr, ok := err.(impart.HTTPError); ok {
+			_ = addSessionFlash(app, w, r, herr.Message, nil)
+			return impart.HTTPError{http.StatusFound, settingsURL}
+		}
+		return err
+	}
+	customDomains.remove(c.ID)
+	app.pages.invalidate(c.ID)
+
+	_ = addSessionFlash(app, w, r, "INFO: Now verify that you control "+host+".", nil)
+	return impart.HTTPError{http.StatusFound, settingsURL}
+}
+
+func handleVerifyCollectionDomain(app *App, u *User, w http.ResponseWriter, r *http.Request) error {
+	c, err := getOwnedCollection(app, u, r)
+	if err != nil {
+		return err
+	}
+	settingsURL := "/me/c/" + c.Alias + "#custom-domain"
+
+	d, err := app.db.GetCollectionDomain(c.ID)
+	if err != nil {
+		return err
+	}
+	if d == nil {
+		_ = addSessionFlash(app, w, r, "Add a custom domain first.", nil)
+		return impart.HTTPError{http.StatusFound, settingsURL}
+	}
+	if d.IsVerified() {
+		_ = addSessionFlash(app, w, r, "INFO: "+d.DisplayHost()+" is already verified.", nil)
+		return impart.HTTPError{http.StatusFound, settingsURL}
+	}
+
+	err = verifyCustomDomain(d)
+	if err != nil {
+		_ = addSessionFlash(app, w, r, "Unable to verify "+d.DisplayHost()+": "+err.Error()+". DNS changes can take a while to show up, so try again later.", nil)
+		return impart.HTTPError{http.StatusFound, settingsURL}
+	}
+	err = app.db.VerifyCollectionDomain(c.ID)
+	if err != nil {
+		if herr, ok := err.(impart.HTTPError); ok {
+			_ = addSessionFlash(app, w, r, herr.Message, nil)
+			return impart.HTTPError{http.StatusFound, settingsURL}
+		}
+		return err
+	}
+	customDomains.set(c.ID, d.Host)
+	app.pages.invalidate(c.ID)
+
+	_ = addSessionFlash(app, w, r, "SUCCESS: Verified "+d.DisplayHost()+". Your blog is now served from it.", nil)
+	return impart.HTTPError{http.StatusFound, settingsURL}
+}
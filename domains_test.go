@@ -0,0 +1,131 @@
+package writefreely
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/writeas/impart"
+)
+
+func TestNormalizeDomain(t *testing.T) {
+	tests := map[string]string{
+		"blog.example.com":               "blog.example.com",
+		"  Blog.Example.com. ":           "blog.example.com",
+		"https://blog.example.com/about": "blog.example.com",
+		"bücher.example":                 "xn--bcher-kva.example",
+		"localhost":                      "",
+		"blog.example.com:8080":          "",
+		"192.168.1.1":                    "",
+		"":                               "",
+	}
+	for in, want := range tests {
+		got, err := normalizeDomain(in)
+		if want == "" {
+			if err == nil {
+				t.Errorf("normalizeDomain(%q) = %q, want an error", in, got)
+			}
+			continue
+		}
+		if err != nil || got != want {
+			t.Errorf("normalizeDomain(%q) = %q, %v, want %q", in, got, err, want)
+		}
+	}
+}
+
+func TestDomainRegistry(t *testing.T) {
+	dr := newDomainRegistry()
+	dr.set(1, "blog.example.com")
+	dr.set(1, "www.example.com")
+	if id := dr.collection("blog.example.com"); id != 0 {
+		t.Errorf("Expected replaced domain to be removed, got collection %d", id)
+	}
+	if id := dr.collection("www.example.com"); id != 1 {
+		t.Errorf("Expected collection 1, got %d", id)
+	}
+	dr.remove(1)
+	if h := dr.host(1); h != "" {
+		t.Errorf("Expected no domain after removal, got %q", h)
+	}
+}
+
+func TestCustomDomainHostPolicy(t *testing.T) {
+	customDomains.set(42, "blog.example.com")
+	defer customDomains.remove(42)
+
+	policy := customDomainHostPolicy("write.example.com")
+	for _, h := range []string{"write.example.com", "blog.example.com"} {
+		if err := policy(context.Background(), h); err != nil {
+			t.Errorf("Expected %s to be allowed, got %v", h, err)
+		}
+	}
+	if err := policy(context.Background(), "other.example.com"); err == nil {
+		t.Error("Expected an unverified domain to be refused")
+	}
+}
+
+func TestCollectionCanonicalURLWithDomain(t *testing.T) {
+	c := &Collection{ID: 42, Alias: "matt", hostName: "https://write.example.com"}
+	if u := c.CanonicalURL(); u != "https://write.example.com/matt/" {
+		t.Errorf("Expected URL on the instance's host, got %s", u)
+	}
+
+	customDomains.set(42, "blog.example.com")
+	defer customDomains.remove(42)
+	if u := c.CanonicalURL(); u != "https://blog.example.com/" {
+		t.Errorf("Expected URL on the custom domain, got %s", u)
+	}
+}
+
+func TestCustomDomainRedirect(t *testing.T) {
+	customDomains.set(42, "blog.example.com")
+	defer customDomains.remove(42)
+	c := &Collection{ID: 42, Alias: "matt", hostName: "https://write.example.com", Visibility: CollPublic}
+
+	r := httptest.NewRequest("GET", "https://write.example.com/matt/my-post?t=1", nil)
+	err := customDomainRedirect(c, &collectionReq{alias: "matt"}, nil, r)
+	herr, ok := err.(impart.HTTPError)
+	if !ok || herr.Status != http.StatusMovedPermanently || herr.Message != "https://blog.example.com/my-post?t=1" {
+		t.Errorf("Expected a redirect to the custom domain, got %v", err)
+	}
+
+	if err := customDomainRedirect(c, &collectionReq{alias: "matt"}, &User{ID: 1}, r); err != nil {
+		t.Errorf("Expected signed in users to stay on the instance, got %v", err)
+	}
+	if err := customDomainRedirect(c, &collectionReq{alias: "matt", isCustomDomain: true}, nil, r); err != nil {
+		t.Errorf("Expected no redirect on the custom domain, got %v", err)
+	}
+}
+
+func TestVerifyCustomDomainTXT(t *testing.T) {
+	defer func(f func(string) ([]string, error)) { lookupTXT = f }(lookupTXT)
+	d := &CustomDomain{Host: "blog.example.com", Token: "abc123"}
+	lookupTXT = func(name string) ([]string, error) {
+		if name != "_writefreely.blog.example.com" {
+			t.Errorf("Looked up unexpected record %s", name)
+		}
+		return []string{"v=spf1 -all", "writefreely-domain=abc123"}, nil
+	}
+	if err := verifyCustomDomain(d); err != nil {
+		t.Errorf("Expected domain to be verified, got %v", err)
+	}
+}
+
+func TestVerifyCustomDomainWithoutTXT(t *testing.T) {
+	defer func(f func(string) ([]string, error)) { lookupTXT = f }(lookupTXT)
+	d := &CustomDomain{Host: "blog.example.com", Token: "abc123"}
+	lookupTXT = func(name string) ([]string, error) {
+		return []string{"writefreely-domain=someoneelse"}, nil
+	}
+	if err := verifyCustomDomain(d); err != errDomainUnverified {
+		t.Errorf("Expected %v with another token, got %v", errDomainUnverified, err)
+	}
+	lookupTXT = func(name string) ([]string, error) {
+		return nil, &net.DNSError{Err: "no such host", Name: name, IsNotFound: true}
+	}
+	if err := verifyCustomDomain(d); err != errDomainUnverified {
+		t.Errorf("Expected %v without a record, got %v", errDomainUnverified, err)
+	}
+}
@@ -14,10 +14,20 @@ import (
 	"archive/zip"
 	"bytes"
 	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"path/filepath"
+	"sort"
 	"strings"
 	"time"
 
 	"github.com/writeas/web-core/log"
+	"golang.org/x/net/html"
+	"golang.org/x/net/html/atom"
 )
 
 func exportPostsCSV(hostName string, u *User, posts *[]PublicPost) []byte {
@@ -100,7 +110,21 @@ func exportPostsZip(u *User, posts *[]PublicPost) []byte {
 	return b.Bytes()
 }
 
-func compileFullExport(app *App, u *User) *ExportUser {
+// exportCollection is a CollectionObj along with the settings needed to
+// recreate the collection when importing a full export.
+type exportCollection struct {
+	CollectionObj
+	Visibility collVisibility `json:"visibility"`
+	Signature  string         `json:"signature,omitempty"`
+	MathJax    bool           `json:"mathjax,omitempty"`
+
+	// PinnedPosts holds the IDs of the collection's pinned posts, in order.
+	PinnedPosts []string `json:"pinned_posts,omitempty"`
+}
+
+// compileFullExport gathers all of the user's data for export, reporting
+// progress after each collection.
+func compileFullExport(app *App, u *User, progress progressFunc) (*ExportUser, error) {
 	exportUser := &ExportUser{
 		User: u,
 	}
@@ -116,17 +140,474 @@ func compileFullExport(app *App, u *User) *ExportUser {
 	}
 	exportUser.AnonymousPosts = *posts
 
-	var collObjs []CollectionObj
-	for _, c := range *colls {
-		co := &CollectionObj{Collection: c}
+	var collObjs []exportCollection
+	for i, c := range *colls {
+		if progress != nil {
+			if err := progress(i, len(*colls)); err != nil {
+				return nil, err
+			}
+		}
+
+		co := &exportCollection{
+			CollectionObj: CollectionObj{Collection: c},
+			Visibility:    c.Visibility,
+		}
+		// Include all collection settings, so the export can be imported again
+		fullColl, err := app.db.GetCollectionByID(c.ID)
+		if err != nil {
+			log.Error("unable to get full collection: %v", err)
+		} else {
+			co.StyleSheet = fullColl.StyleSheet
+			co.Script = fullColl.Script
+			co.Collection.Format = fullColl.Format
+			co.Monetization = fullColl.Monetization
+			co.Signature = fullColl.Signature
+			co.MathJax = fullColl.RenderMathJax()
+		}
+		// Posts are fetched with the basic Collection, which has no signature, so
+		// their content isn't augmented with it.
 		co.Posts, err = app.db.GetPosts(app.cfg, &c, 0, true, false, true)
 		if err != nil {
 			log.Error("unable to get collection posts: %v", err)
+		} else {
+			co.PinnedPosts = pinnedPostIDs(co.Posts)
 		}
-		app.db.GetPostsCount(co, true)
+		app.db.GetPostsCount(&co.CollectionObj, true)
 		collObjs = append(collObjs, *co)
 	}
 	exportUser.Collections = &collObjs
 
-	return exportUser
+	return exportUser, nil
+}
+
+// pinnedPostIDs returns the IDs of any pinned posts in the given list, ordered
+// by their pinned position.
+func pinnedPostIDs(posts *[]PublicPost) []string {
+	pinned := []PublicPost{}
+	for _, p := range *posts {
+		if p.PinnedPosition.Valid {
+			pinned = append(pinned, p)
+		}
+	}
+	sort.Slice(pinned, func(i, j int) bool {
+		return pinned[i].PinnedPosition.Int64 < pinned[j].PinnedPosition.Int64
+	})
+
+	ids := make([]string, len(pinned))
+	for i, p := range pinned {
+		ids[i] = p.ID
+	}
+	return ids
+}
+
+const epubMaxImageSize = 5 << 20
+
+var epubImageTypes = map[string]string{
+	"image/jpeg":    ".jpg",
+	"image/png":     ".png",
+	"image/gif":     ".gif",
+	"image/svg+xml": ".svg",
+}
+
+type (
+	epubChapter struct {
+		File  string
+		Title string
+		Body  string
+	}
+
+	epubImage struct {
+		File      string
+		MediaType string
+		Data      []byte
+	}
+
+	// epubBook holds everything needed to compile a collection, or a tag
+	// within it, into an EPUB 3 book.
+	epubBook struct {
+		ID          string
+		Title       string
+		Description string
+		Author      string
+		Publisher   string
+		Language    string
+		Modified    time.Time
+		Chapters    []epubChapter
+
+		hostName string
+		images   []epubImage
+		// imageFiles maps remote image URLs to their file in the book
+		imageFiles map[string]string
+		client     *http.Client
+	}
+)
+
+// exportCollectionEPUB compiles the given posts from the collection into an
+// EPUB 3 book, one chapter per post, in the order given. Images are
+// downloaded and embedded in the book, so it can be read offline. If given,
+// progress is reported after each chapter.
+func exportCollectionEPUB(app *App, c *Collection, tag string, posts *[]PublicPost, progress progressFunc) ([]byte, error) {
+	c.hostName = app.cfg.App.Host
+	b := &epubBook{
+		ID:          c.CanonicalURL(),
+		Title:       c.DisplayTitle(),
+		Description: c.Description,
+		Author:      c.DisplayTitle(),
+		Publisher:   app.cfg.App.SiteName,
+		Language:    "en",
+		Modified:    time.Now().UTC(),
+		hostName:    app.cfg.App.Host,
+		imageFiles:  map[string]string{},
+		client:      newEmbedClient(),
+	}
+	if tag != "" {
+		b.ID += "tag:" + tag
+		b.Title = tag + " — " + b.Title
+	}
+	if c.PublicOwner {
+		if owner, err := app.db.GetUserByID(c.OwnerID); err == nil {
+			b.Author = owner.Username
+		}
+	}
+
+	showDates := c.NewFormat().ShowDates()
+	for i, listed := range *posts {
+		// Load each post in full, since listed posts may be truncated
+		p, err := app.db.GetPost(listed.Slug.String, c.ID)
+		if err != nil {
+			return nil, err
+		}
+		p.Collection = NewCollectionObj(c)
+		if i == 0 && p.Language.String != "" {
+			b.Language = p.Language.String
+		}
+
+		p.augmentContent()
+		p.Content = strings.Replace(p.Content, "<!--more-->", "", 1)
+		p.formatContent(app.cfg, true, true)
+
+		body := &bytes.Buffer{}
+		title := p.PlainDisplayTitle()
+		if p.Title.String != "" {
+			fmt.Fprintf(body, "<h1>%s</h1>\n", template.HTMLEscapeString(title))
+		}
+		if showDates {
+			fmt.Fprintf(body, "<p class=\"date\">%s</p>\n", template.HTMLEscapeString(p.DisplayDate))
+		}
+		body.WriteString(b.xhtml(string(p.HTMLContent)))
+
+		b.Chapters = append(b.Chapters, epubChapter{
+			File:  fmt.Sprintf("chapter-%d.xhtml", i+1),
+			Title: title,
+			Body:  body.String(),
+		})
+
+		if progress != nil {
+			if err = progress(i+1, len(*posts)); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	return b.compile()
+}
+
+type epubJobInput struct {
+	Collection string `json:"collection"`
+	Tag        string `json:"tag,omitempty"`
+}
+
+// runExportEPUBJob compiles the job's collection into an EPUB book.
+func runExportEPUBJob(app *App, j *Job, progress progressFunc) (string, string, error) {
+	input := epubJobInput{}
+	err := json.Unmarshal([]byte(j.Input), &input)
+	if err != nil {
+		log.Error("epub job: unmarshal input: %v", err)
+		return "", "", fmt.Errorf("Unable to read export options.")
+	}
+
+	c, err := app.db.GetCollection(input.Collection)
+	if err != nil || c.OwnerID != j.UserID {
+		return "", "", fmt.Errorf("Unable to find blog %s.", input.Collection)
+	}
+
+	var posts *[]PublicPost
+	if input.Tag != "" {
+		posts, err = app.db.GetPostsTagged(app.cfg, c, input.Tag, 0, false)
+	} else {
+		posts, err = app.db.GetPosts(app.cfg, c, 0, false, false, false)
+	}
+	if err != nil {
+		return "", "", fmt.Errorf("Unable to get posts.")
+	}
+	if len(*posts) == 0 {
+		return "", "", fmt.Errorf("There are no posts to export.")
+	}
+
+	data, err := exportCollectionEPUB(app, c, input.Tag, posts, progress)
+	if err == errJobCanceled || err == errJobInterrupted {
+		return "", "", err
+	} else if err != nil {
+		log.Error("Unable to export %s as EPUB: %v", c.Alias, err)
+		return "", "", fmt.Errorf("Unable to create book.")
+	}
+
+	filename := c.Alias
+	if tagSlug := getSlug(input.Tag, ""); tagSlug != "" {
+		filename += "-" + tagSlug
+	}
+	filename += ".epub"
+	err = ioutil.WriteFile(filepath.Join(j.dir(app), filename), data, 0600)
+	if err != nil {
+		log.Error("epub job: write file: %v", err)
+		return "", "", fmt.Errorf("Unable to save book.")
+	}
+
+	return filename, fmt.Sprintf("Your book of %s is ready.", c.DisplayTitle()), nil
+}
+
+// xhtml converts the given HTML into well-formed XHTML for the book, making
+// links absolute and embedding any images.
+func (b *epubBook) xhtml(content string) string {
+	context := &html.Node{Type: html.ElementNode, Data: "div", DataAtom: atom.Div}
+	nodes, err := html.ParseFragment(strings.NewReader(content), context)
+	if err != nil {
+		log.Error("epub: parse content: %v", err)
+		return "<p>" + template.HTMLEscapeString(content) + "</p>"
+	}
+
+	buf := &bytes.Buffer{}
+	for _, n := range nodes {
+		b.processNode(n)
+		html.Render(buf, n)
+	}
+	return buf.String()
+}
+
+func (b *epubBook) processNode(n *html.Node) {
+	if n.Type == html.ElementNode {
+		switch n.DataAtom {
+		case atom.A:
+			for i, a := range n.Attr {
+				if a.Key == "href" && strings.HasPrefix(a.Val, "/") && !strings.HasPrefix(a.Val, "//") {
+					n.Attr[i].Val = b.hostName + a.Val
+				}
+			}
+		case atom.Img:
+			src, alt := "", ""
+			for _, a := range n.Attr {
+				if a.Key == "src" {
+					src = a.Val
+				} else if a.Key == "alt" {
+					alt = a.Val
+				}
+			}
+			if file := b.embedImage(src); file != "" {
+				n.Attr = []html.Attribute{{Key: "src", Val: file}, {Key: "alt", Val: alt}}
+			} else {
+				// Books can't reference remote images, so link to it instead
+				if alt == "" {
+					alt = src
+				}
+				n.Data, n.DataAtom = "a", atom.A
+				n.Attr = []html.Attribute{{Key: "href", Val: src}}
+				n.AppendChild(&html.Node{Type: html.TextNode, Data: alt})
+			}
+		case atom.Script, atom.Iframe, atom.Style:
+			// Not supported in books
+			n.Data, n.DataAtom = "span", atom.Span
+			n.Attr = nil
+			for c := n.FirstChild; c != nil; c = n.FirstChild {
+				n.RemoveChild(c)
+			}
+			return
+		}
+	}
+	for c := n.FirstChild; c != nil; c = c.NextSibling {
+		b.processNode(c)
+	}
 }
+
+// embedImage downloads the image at the given URL into the book, returning its
+// path in the book, or an empty string if it can't be embedded. Only public
+// addresses are fetched.
+func (b *epubBook) embedImage(src string) string {
+	if f, ok := b.imageFiles[src]; ok {
+		return f
+	}
+	b.imageFiles[src] = ""
+
+	if strings.HasPrefix(src, "/") && !strings.HasPrefix(src, "//") {
+		src = b.hostName + src
+	}
+	if !strings.HasPrefix(src, "http://") && !strings.HasPrefix(src, "https://") {
+		return ""
+	}
+	resp, err := b.client.Get(src)
+	if err != nil {
+		log.Error("epub: fetch image %s: %v", src, err)
+		return ""
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		log.Error("epub: fetch image %s: status %d", src, resp.StatusCode)
+		return ""
+	}
+	data, err := ioutil.ReadAll(io.LimitReader(resp.Body, epubMaxImageSize+1))
+	if err != nil || len(data) > epubMaxImageSize {
+		log.Error("epub: image %s unreadable or too large", src)
+		return ""
+	}
+
+	mediaType := http.DetectContentType(data)
+	if strings.HasSuffix(strings.ToLower(src), ".svg") || strings.HasPrefix(resp.Header.Get("Content-Type"), "image/svg+xml") {
+		mediaType = "image/svg+xml"
+	}
+	ext, ok := epubImageTypes[mediaType]
+	if !ok {
+		return ""
+	}
+
+	file := fmt.Sprintf("images/image-%d%s", len(b.images)+1, ext)
+	b.images = append(b.images, epubImage{File: file, MediaType: mediaType, Data: data})
+	b.imageFiles[src] = file
+	return file
+}
+
+// compile packages the book into an EPUB archive.
+func (b *epubBook) compile() ([]byte, error) {
+	buf := new(bytes.Buffer)
+	w := zip.NewWriter(buf)
+
+	// The mimetype file must come first, uncompressed
+	f, err := w.CreateHeader(&zip.FileHeader{Name: "mimetype", Method: zip.Store})
+	if err != nil {
+		return nil, err
+	}
+	f.Write([]byte("application/epub+zip"))
+
+	files := []struct {
+		Name string
+		Data []byte
+	}{
+		{"META-INF/container.xml", []byte(epubContainer)},
+		{"OEBPS/content.opf", b.packageDocument()},
+		{"OEBPS/nav.xhtml", b.navDocument()},
+		{"OEBPS/style.css", []byte(epubStyle)},
+		{"OEBPS/cover.xhtml", b.page("cover", b.Title, `<section epub:type="titlepage"><h1 class="title">`+template.HTMLEscapeString(b.Title)+`</h1>`+
+			epubOptional(`<p class="description">%s</p>`, b.Description)+
+			epubOptional(`<p class="author">%s</p>`, b.Author)+`</section>`)},
+	}
+	for _, ch := range b.Chapters {
+		files = append(files, struct {
+			Name string
+			Data []byte
+		}{"OEBPS/" + ch.File, b.page("chapter", ch.Title, `<section epub:type="chapter">`+ch.Body+`</section>`)})
+	}
+	for _, img := range b.images {
+		files = append(files, struct {
+			Name string
+			Data []byte
+		}{"OEBPS/" + img.File, img.Data})
+	}
+
+	for _, file := range files {
+		f, err := w.CreateHeader(&zip.FileHeader{Name: file.Name, Method: zip.Deflate, Modified: b.Modified})
+		if err != nil {
+			return nil, err
+		}
+		if _, err = f.Write(file.Data); err != nil {
+			return nil, err
+		}
+	}
+
+	if err = w.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (b *epubBook) page(class, title, body string) []byte {
+	return []byte(`<?xml version="1.0" encoding="UTF-8"?>
+<!DOCTYPE html>
+<html xmlns="http://www.w3.org/1999/xhtml" xmlns:epub="http://www.idpf.org/2007/ops" lang="` + template.HTMLEscapeString(b.Language) + `" xml:lang="` + template.HTMLEscapeString(b.Language) + `">
+<head>
+<meta charset="utf-8" />
+<title>` + template.HTMLEscapeString(title) + `</title>
+<link rel="stylesheet" type="text/css" href="style.css" />
+</head>
+<body class="` + class + `">
+` + body + `
+</body>
+</html>
+`)
+}
+
+func (b *epubBook) navDocument() []byte {
+	toc := &bytes.Buffer{}
+	for _, ch := range b.Chapters {
+		fmt.Fprintf(toc, "<li><a href=\"%s\">%s</a></li>\n", ch.File, template.HTMLEscapeString(ch.Title))
+	}
+	return b.page("toc", "Contents", `<nav epub:type="toc" id="toc"><h1>Contents</h1>
+<ol>
+`+toc.String()+`</ol>
+</nav>`)
+}
+
+func (b *epubBook) packageDocument() []byte {
+	manifest := &bytes.Buffer{}
+	spine := &bytes.Buffer{}
+	for i, ch := range b.Chapters {
+		fmt.Fprintf(manifest, "<item id=\"chapter-%d\" href=\"%s\" media-type=\"application/xhtml+xml\" />\n", i+1, ch.File)
+		fmt.Fprintf(spine, "<itemref idref=\"chapter-%d\" />\n", i+1)
+	}
+	for i, img := range b.images {
+		fmt.Fprintf(manifest, "<item id=\"image-%d\" href=\"%s\" media-type=\"%s\" />\n", i+1, img.File, img.MediaType)
+	}
+
+	return []byte(`<?xml version="1.0" encoding="UTF-8"?>
+<package xmlns="http://www.idpf.org/2007/opf" version="3.0" unique-identifier="book-id" xml:lang="` + template.HTMLEscapeString(b.Language) + `">
+<metadata xmlns:dc="http://purl.org/dc/elements/1.1/">
+<dc:identifier id="book-id">` + template.HTMLEscapeString(b.ID) + `</dc:identifier>
+<dc:title>` + template.HTMLEscapeString(b.Title) + `</dc:title>
+<dc:language>` + template.HTMLEscapeString(b.Language) + `</dc:language>
+<dc:creator>` + template.HTMLEscapeString(b.Author) + `</dc:creator>
+` + epubOptional("<dc:description>%s</dc:description>\n", b.Description) +
+		epubOptional("<dc:publisher>%s</dc:publisher>\n", b.Publisher) +
+		`<meta property="dcterms:modified">` + b.Modified.Format("2006-01-02T15:04:05Z") + `</meta>
+</metadata>
+<manifest>
+<item id="nav" href="nav.xhtml" media-type="application/xhtml+xml" properties="nav" />
+<item id="cover" href="cover.xhtml" media-type="application/xhtml+xml" />
+<item id="style" href="style.css" media-type="text/css" />
+` + manifest.String() + `</manifest>
+<spine>
+<itemref idref="cover" />
+<itemref idref="nav" />
+` + spine.String() + `</spine>
+</package>
+`)
+}
+
+// epubOptional formats the given, escaped value, if it's not empty.
+func epubOptional(format, val string) string {
+	if val == "" {
+		return ""
+	}
+	return fmt.Sprintf(format, template.HTMLEscapeString(val))
+}
+
+const epubContainer = `<?xml version="1.0" encoding="UTF-8"?>
+<container version="1.0" xmlns="urn:oasis:names:tc:opendocument:xmlns:container">
+<rootfiles>
+<rootfile full-path="OEBPS/content.opf" media-type="application/oebps-package+xml" />
+</rootfiles>
+</container>
+`
+
+const epubStyle = `body { font-family: serif; line-height: 1.5; }
+h1 { text-align: center; }
+.cover section { text-align: center; margin-top: 30%; }
+.date { text-align: center; font-style: italic; }
+img { max-width: 100%; }
+`
@@ -0,0 +1,553 @@
+/*
+ * Copyright © 2021 A Bunch Tell LLC.
+ *
+ * This file is part of WriteFreely.
+ *
+ * WriteFreely is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License, included
+ * in the LICENSE file in this source code package.
+ */
+
+package writefreely
+
+import (
+	"archive/zip"
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/gorilla/feeds"
+	"github.com/ikeikeikeike/go-sitemap-generator/v2/stm"
+	stripmd "github.com/writeas/go-strip-markdown/v2"
+	"github.com/writeas/impart"
+	"github.com/writeas/web-core/log"
+	"github.com/writefreely/writefreely/page"
+)
+
+const (
+	staticFeedFile    = "feed.xml"
+	staticSitemapFile = "sitemap.xml"
+)
+
+var (
+	staticLinkReg   = regexp.MustCompile(`(href|src)="([^"]*)"`)
+	staticScriptReg = regexp.MustCompile(`'(/(?:css|js)/[^']+)'`)
+	staticCSSURLReg = regexp.MustCompile(`url\(['"]?(/[^'")?#]+)([^'")]*)['"]?\)`)
+	staticPageReg   = regexp.MustCompile(`^page/(\d+)$`)
+
+	// staticAssetDirs are the top-level directories in the static folder that
+	// exported pages can reference.
+	staticAssetDirs = map[string]bool{
+		"css":   true,
+		"js":    true,
+		"img":   true,
+		"fonts": true,
+	}
+)
+
+// staticExporter renders a collection as a standalone HTML site, with links
+// relative to each page so it can be hosted anywhere or browsed from disk.
+type staticExporter struct {
+	app *App
+	c   *Collection
+	dir string
+	// baseURL is where the exported site will be hosted, used for the feed
+	// and sitemap.
+	baseURL string
+
+	slugs  map[string]bool
+	tags   map[string]bool
+	assets map[string]bool
+}
+
+// exportStaticCollection writes every post, tag page and index page of the
+// given collection to dir as plain HTML, along with the static assets they
+// use, a sitemap and a feed.
+func exportStaticCollection(app *App, c *Collection, dir, baseURL string, progress progressFunc) error {
+	c.hostName = app.cfg.App.Host
+	if baseURL == "" {
+		baseURL = c.CanonicalURL()
+	}
+	if !strings.HasSuffix(baseURL, "/") {
+		baseURL += "/"
+	}
+	e := &staticExporter{
+		app:     app,
+		c:       c,
+		dir:     dir,
+		baseURL: baseURL,
+		slugs:   map[string]bool{},
+		tags:    map[string]bool{},
+		assets:  map[string]bool{},
+	}
+
+	err := os.MkdirAll(dir, 0755)
+	if err != nil {
+		return fmt.Errorf("create export directory: %v", err)
+	}
+
+	posts, err := app.db.GetPosts(app.cfg, c, 0, false, true, false)
+	if err != nil {
+		return err
+	}
+	coll := NewCollectionObj(c)
+	pinned, err := app.db.GetPinnedPosts(coll, false)
+	if err != nil {
+		return err
+	}
+	for _, p := range *posts {
+		e.slugs[p.Slug.String] = true
+		for _, t := range p.Tags {
+			e.tags[strings.ToLower(t)] = true
+		}
+	}
+	for _, p := range *pinned {
+		e.slugs[p.Slug.String] = true
+	}
+
+	owner, err := app.db.GetUserByID(c.OwnerID)
+	if err != nil {
+		log.Error("static export: get owner: %v", err)
+	}
+
+	total := len(*posts) + len(*pinned)
+	done := 0
+	for _, list := range []*[]PublicPost{pinned, posts} {
+		for _, p := range *list {
+			if progress != nil {
+				if err = progress(done, total); err != nil {
+					return err
+				}
+			}
+			done++
+			if err = e.writePost(p.Slug.String, owner, pinned); err != nil {
+				return err
+			}
+		}
+	}
+
+	if err = e.writeIndexes(owner, pinned); err != nil {
+		return err
+	}
+	for t := range e.tags {
+		if err = e.writeTag(t, owner, pinned); err != nil {
+			return err
+		}
+	}
+	if err = e.writeFeed(posts, owner); err != nil {
+		return err
+	}
+	if err = e.writeSitemap(posts, pinned); err != nil {
+		return err
+	}
+	return e.copyAssets()
+}
+
+func (e *staticExporter) staticPage(p string) page.StaticPage {
+	return page.StaticPage{
+		AppCfg:  e.app.cfg.App,
+		Path:    p,
+		Version: "v" + softwareVer,
+	}
+}
+
+func (e *staticExporter) newDisplayCollection(page int, owner *User) *DisplayCollection {
+	coll := &DisplayCollection{
+		CollectionObj: NewCollectionObj(e.c),
+		CurrentPage:   page,
+		IsTopLevel:    isSingleUser,
+	}
+	coll.Owner = owner
+	e.app.db.GetPostsCount(coll.CollectionObj, false)
+	return coll
+}
+
+func (e *staticExporter) writeIndexes(owner *User, pinned *[]PublicPost) error {
+	coll := e.newDisplayCollection(1, owner)
+	totalPages := int(math.Ceil(float64(coll.TotalPosts) / float64(coll.Format.PostsPerPage())))
+	if totalPages == 0 {
+		totalPages = 1
+	}
+
+	collTmpl := "collection"
+	if e.app.cfg.App.Chorus {
+		collTmpl = "chorus-collection"
+	}
+	for pg := 1; pg <= totalPages; pg++ {
+		coll := e.newDisplayCollection(pg, owner)
+		coll.TotalPages = totalPages
+		coll.Posts, _ = e.app.db.GetPosts(e.app.cfg, e.c, pg, false, false, false)
+
+		displayPage := CollectionPage{
+			DisplayCollection: coll,
+			StaticPage:        e.staticPage("/"),
+			PinnedPosts:       pinned,
+			CollAlias:         e.c.Alias,
+		}
+		displayPage.Owner = owner
+
+		name := "index.html"
+		if pg > 1 {
+			name = fmt.Sprintf("page/%d.html", pg)
+		}
+		err := e.render(name, collTmpl, "collection", displayPage)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (e *staticExporter) writeTag(tag string, owner *User, pinned *[]PublicPost) error {
+	coll := e.newDisplayCollection(1, owner)
+	coll.TotalPages = 1
+	// Include every tagged post on a single page, so none are lost
+	coll.Posts, _ = e.app.db.GetPostsTagged(e.app.cfg, e.c, tag, 0, false)
+	if coll.Posts == nil || len(*coll.Posts) == 0 {
+		return nil
+	}
+
+	displayPage := struct {
+		CollectionPage
+		Tag string
+	}{
+		CollectionPage: CollectionPage{
+			DisplayCollection: coll,
+			StaticPage:        e.staticPage("/tag:" + tag),
+			PinnedPosts:       pinned,
+		},
+		Tag: tag,
+	}
+	displayPage.Owner = owner
+
+	return e.render("tag/"+tag+".html", "collection-tags", "collection-tags", displayPage)
+}
+
+func (e *staticExporter) writePost(slug string, owner *User, pinned *[]PublicPost) error {
+	p, err := e.app.db.GetPost(slug, e.c.ID)
+	if err != nil {
+		return err
+	}
+	coll := NewCollectionObj(e.c)
+	coll.Owner = owner
+	p.Collection = coll
+	p.IsTopLevel = e.app.cfg.App.SingleUser
+
+	p.augmentContent()
+	p.extractData()
+	p.Content = strings.Replace(p.Content, "<!--more-->", "", 1)
+	p.formatContent(e.app.cfg, false, true)
+
+	tp := CollectionPostPage{
+		PublicPost:  p,
+		StaticPage:  e.staticPage("/" + slug),
+		IsFound:     true,
+		PinnedPosts: pinned,
+		CollAlias:   e.c.Alias,
+	}
+	tp.IsPinned = len(*tp.PinnedPosts) > 0 && PostsContains(tp.PinnedPosts, p)
+
+	postTmpl := "collection-post"
+	if e.app.cfg.App.Chorus {
+		postTmpl = "chorus-collection-post"
+	}
+	return e.render(slug+".html", postTmpl, "post", tp)
+}
+
+// render executes the given template, using the collection's theme if it has
+// one, and writes the result to name, relative to the export directory, with
+// all links rewritten for the static site.
+func (e *staticExporter) render(name, tmpl, def string, data interface{}) error {
+	buf := &bytes.Buffer{}
+	err := collectionTemplate(e.c, tmpl).ExecuteTemplate(buf, def, data)
+	if err != nil {
+		log.Error("static export: render %s: %v", name, err)
+		return fmt.Errorf("render %s: %v", name, err)
+	}
+
+	out := e.rewriteLinks(buf.String(), strings.Count(name, "/"))
+	return e.writeFile(name, []byte(out))
+}
+
+// rewriteLinks makes the links and script paths in a page at the given depth
+// in the export work in the static site.
+func (e *staticExporter) rewriteLinks(html string, depth int) string {
+	out := staticLinkReg.ReplaceAllStringFunc(html, func(m string) string {
+		parts := staticLinkReg.FindStringSubmatch(m)
+		return fmt.Sprintf(`%s="%s"`, parts[1], e.relativeLink(parts[2], depth))
+	})
+	return staticScriptReg.ReplaceAllStringFunc(out, func(m string) string {
+		return "'" + e.relativeLink(strings.Trim(m, "'"), depth) + "'"
+	})
+}
+
+func (e *staticExporter) writeFile(name string, data []byte) error {
+	fPath := filepath.Join(e.dir, filepath.FromSlash(name))
+	err := os.MkdirAll(filepath.Dir(fPath), 0755)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(fPath, data, 0644)
+}
+
+// relativeLink converts a link on a page at the given depth in the export
+// into one that works in the static site. Links to pages outside of the
+// export point back to the live site.
+func (e *staticExporter) relativeLink(link string, depth int) string {
+	var p string
+	collURL := e.c.CanonicalURL()
+	collPath := "/"
+	if !isSingleUser {
+		collPath = "/" + e.c.Alias + "/"
+	}
+	switch {
+	case strings.HasPrefix(link, collURL):
+		p = strings.TrimPrefix(link, collURL)
+	case strings.HasPrefix(link, "/") && !strings.HasPrefix(link, "//"):
+		// Static assets live at the root of the instance
+		assetPath := strings.SplitN(strings.TrimPrefix(link, "/"), "?", 2)[0]
+		if dir := strings.SplitN(assetPath, "/", 2)[0]; staticAssetDirs[dir] || assetPath == "favicon.ico" {
+			e.assets[assetPath] = true
+			return strings.Repeat("../", depth) + assetPath
+		}
+		if link+"/" == collPath {
+			p = ""
+		} else if strings.HasPrefix(link, collPath) {
+			p = strings.TrimPrefix(link, collPath)
+		} else {
+			return e.app.cfg.App.Host + link
+		}
+	default:
+		return link
+	}
+
+	fragment := ""
+	if i := strings.Index(p, "#"); i > -1 {
+		fragment = p[i:]
+		p = p[:i]
+	}
+	p = strings.SplitN(p, "?", 2)[0]
+	if unescaped, err := url.PathUnescape(p); err == nil {
+		p = unescaped
+	}
+
+	var target string
+	switch {
+	case p == "":
+		target = "index.html"
+	case p == "feed/":
+		target = staticFeedFile
+	case p == staticSitemapFile:
+		target = staticSitemapFile
+	case staticPageReg.MatchString(p):
+		target = p + ".html"
+	case strings.HasPrefix(p, "tag:") && e.tags[strings.ToLower(strings.TrimPrefix(p, "tag:"))]:
+		target = "tag/" + strings.ToLower(strings.TrimPrefix(p, "tag:")) + ".html"
+	case e.slugs[p]:
+		target = p + ".html"
+	default:
+		// Not part of the export
+		return collURL + p + fragment
+	}
+
+	target = (&url.URL{Path: target}).String()
+	return strings.Repeat("../", depth) + target + fragment
+}
+
+func (e *staticExporter) writeFeed(posts *[]PublicPost, owner *User) error {
+	author := ""
+	if e.c.PublicOwner && owner != nil {
+		author = owner.Username
+	}
+
+	feed := &feeds.Feed{
+		Title:       e.c.DisplayTitle(),
+		Link:        &feeds.Link{Href: e.baseURL},
+		Description: e.c.Description,
+		Author:      &feeds.Author{Name: author},
+		Created:     time.Now(),
+	}
+	for _, p := range *posts {
+		permalink := e.baseURL + p.Slug.String + ".html"
+		feed.Items = append(feed.Items, &feeds.Item{
+			Id:          permalink,
+			Title:       p.PlainDisplayTitle(),
+			Link:        &feeds.Link{Href: permalink},
+			Description: "<![CDATA[" + stripmd.Strip(p.Content) + "]]>",
+			Content:     string(p.HTMLContent),
+			Author:      &feeds.Author{Name: author},
+			Created:     p.Created,
+			Updated:     p.Updated,
+		})
+	}
+
+	rss, err := feed.ToRss()
+	if err != nil {
+		return err
+	}
+	return e.writeFile(staticFeedFile, []byte(rss))
+}
+
+func (e *staticExporter) writeSitemap(posts, pinned *[]PublicPost) error {
+	sm := buildSitemap(e.baseURL, "/")
+	lastSiteMod := time.Now()
+	for i, p := range append(append([]PublicPost{}, *posts...), *pinned...) {
+		if i == 0 {
+			lastSiteMod = p.Updated
+		}
+		sm.Add(stm.URL{
+			{"loc", p.Slug.String + ".html"},
+			{"changefreq", "never"},
+			{"lastmod", p.Updated},
+		})
+	}
+	sm.Add(stm.URL{
+		{"loc", "index.html"},
+		{"priority", "1.0"},
+		{"lastmod", lastSiteMod},
+	})
+	return e.writeFile(staticSitemapFile, sm.XMLContent())
+}
+
+// copyAssets copies all static files referenced by the exported pages, along
+// with anything their stylesheets reference, into the export.
+func (e *staticExporter) copyAssets() error {
+	staticPath := filepath.Join(e.app.cfg.Server.StaticParentDir, staticDir)
+	copied := map[string]bool{}
+	for len(copied) < len(e.assets) {
+		for a := range e.assets {
+			if copied[a] {
+				continue
+			}
+			copied[a] = true
+
+			data, err := ioutil.ReadFile(filepath.Join(staticPath, filepath.FromSlash(a)))
+			if err != nil {
+				log.Error("static export: skipping asset %s: %v", a, err)
+				continue
+			}
+			if path.Ext(a) == ".css" {
+				data = e.rewriteCSS(data, strings.Count(a, "/"))
+			}
+			if err = e.writeFile(a, data); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// rewriteCSS points the root-relative url()s in a stylesheet at the given
+// depth in the export to their copies in the static site, and marks those
+// files to be copied.
+func (e *staticExporter) rewriteCSS(data []byte, depth int) []byte {
+	return staticCSSURLReg.ReplaceAllFunc(data, func(m []byte) []byte {
+		parts := staticCSSURLReg.FindSubmatch(m)
+		if strings.HasPrefix(string(parts[1]), "//") {
+			// Protocol-relative URL on another host
+			return m
+		}
+		assetPath := strings.TrimPrefix(string(parts[1]), "/")
+		e.assets[assetPath] = true
+		return []byte("url('" + strings.Repeat("../", depth) + assetPath + string(parts[2]) + "')")
+	})
+}
+
+// zipDir writes the contents of the given directory to a zip archive at dest.
+func zipDir(dir, dest string) error {
+	f, err := os.Create(dest)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	z := zip.NewWriter(f)
+	err = filepath.Walk(dir, func(fPath string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() {
+			return err
+		}
+		rel, err := filepath.Rel(dir, fPath)
+		if err != nil {
+			return err
+		}
+		w, err := z.Create(filepath.ToSlash(rel))
+		if err != nil {
+			return err
+		}
+		src, err := os.Open(fPath)
+		if err != nil {
+			return err
+		}
+		defer src.Close()
+		_, err = io.Copy(w, src)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	return z.Close()
+}
+
+// handleExportStatic starts a job that renders one of the user's collections
+// as a static site, to be downloaded as a zip archive once it's ready.
+func handleExportStatic(app *App, u *User, w http.ResponseWriter, r *http.Request) error {
+	alias := r.FormValue("collection")
+	c, err := app.db.GetCollection(alias)
+	if err != nil {
+		return err
+	}
+	if c.OwnerID != u.ID {
+		return ErrCollectionNotFound
+	}
+
+	j, err := newJob(app, u.ID, jobTypeExportStatic)
+	if err != nil {
+		return err
+	}
+	j.Input = c.Alias
+	err = app.jobs.enqueue(j)
+	if err != nil {
+		return err
+	}
+
+	_ = addSessionFlash(app, w, r, fmt.Sprintf("Your static export of %s has started. It'll be ready to download below shortly.", c.DisplayTitle()), nil)
+	return impart.HTTPError{http.StatusFound, "/me/export"}
+}
+
+// runExportStaticJob renders the job's collection as a static site and
+// archives it.
+func runExportStaticJob(app *App, j *Job, progress progressFunc) (string, string, error) {
+	c, err := app.db.GetCollection(j.Input)
+	if err != nil || c.OwnerID != j.UserID {
+		return "", "", fmt.Errorf("Unable to find blog %s.", j.Input)
+	}
+
+	siteDir := filepath.Join(j.dir(app), "site")
+	defer os.RemoveAll(siteDir)
+	err = exportStaticCollection(app, c, siteDir, "", progress)
+	if err == errJobCanceled || err == errJobInterrupted {
+		return "", "", err
+	} else if err != nil {
+		log.Error("static export job: %v", err)
+		return "", "", fmt.Errorf("Unable to export %s.", c.DisplayTitle())
+	}
+
+	filename := c.Alias + "-" + time.Now().Truncate(time.Second).UTC().Format("200601021504") + ".zip"
+	err = zipDir(siteDir, filepath.Join(j.dir(app), filename))
+	if err != nil {
+		log.Error("static export job: zip: %v", err)
+		return "", "", fmt.Errorf("Unable to save export.")
+	}
+
+	return filename, fmt.Sprintf("Your static copy of %s is ready.", c.DisplayTitle()), nil
+}
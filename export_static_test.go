@@ -0,0 +1,146 @@
+/*
+ * Copyright © 2021 A Bunch Tell LLC.
+ *
+ * This file is part of WriteFreely.
+ *
+ * WriteFreely is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License, included
+ * in the LICENSE file in this source code package.
+ */
+
+package writefreely
+
+import (
+	"testing"
+
+	"github.com/writefreely/writefreely/config"
+)
+
+func newTestStaticExporter() *staticExporter {
+	app := &App{cfg: &config.Config{}}
+	app.cfg.App.Host = "https://example.com"
+	return &staticExporter{
+		app:    app,
+		c:      &Collection{Alias: "blog", hostName: app.cfg.App.Host},
+		slugs:  map[string]bool{"hello-world": true, "two words": true},
+		tags:   map[string]bool{"poetry": true},
+		assets: map[string]bool{},
+	}
+}
+
+func TestStaticRelativeLink(t *testing.T) {
+	defer func(su bool) { isSingleUser = su }(isSingleUser)
+	isSingleUser = false
+
+	tests := []struct {
+		link  string
+		depth int
+		want  string
+	}{
+		{"https://example.com/blog/", 0, "index.html"},
+		{"https://example.com/blog/hello-world", 0, "hello-world.html"},
+		{"https://example.com/blog/hello-world#comments", 1, "../hello-world.html#comments"},
+		{"https://example.com/blog/hello-world?x=1", 0, "hello-world.html"},
+		{"https://example.com/blog/two%20words", 0, "two%20words.html"},
+		{"https://example.com/blog/page/2", 1, "../page/2.html"},
+		{"https://example.com/blog/feed/", 0, "feed.xml"},
+		{"https://example.com/blog/tag:Poetry", 0, "tag/poetry.html"},
+		{"https://example.com/blog/tag:prose", 0, "https://example.com/blog/tag:prose"},
+		{"https://example.com/blog/draft", 0, "https://example.com/blog/draft"},
+		{"/blog", 0, "index.html"},
+		{"/blog/", 1, "../index.html"},
+		{"/blog/hello-world", 1, "../hello-world.html"},
+		{"/css/write.css", 0, "css/write.css"},
+		{"/img/avatar.png?v=2", 2, "../../img/avatar.png"},
+		{"/favicon.ico", 1, "../favicon.ico"},
+		{"/about", 0, "https://example.com/about"},
+		{"/other/post", 0, "https://example.com/other/post"},
+		{"//cdn.example.net/lib.js", 0, "//cdn.example.net/lib.js"},
+		{"https://elsewhere.example/", 0, "https://elsewhere.example/"},
+		{"#top", 0, "#top"},
+		{"mailto:me@example.com", 0, "mailto:me@example.com"},
+	}
+	for _, test := range tests {
+		e := newTestStaticExporter()
+		if got := e.relativeLink(test.link, test.depth); got != test.want {
+			t.Errorf("relativeLink(%q, %d) = %q, want %q", test.link, test.depth, got, test.want)
+		}
+	}
+
+	e := newTestStaticExporter()
+	e.relativeLink("/css/write.css", 0)
+	e.relativeLink("/img/avatar.png?v=2", 0)
+	e.relativeLink("/about", 0)
+	if len(e.assets) != 2 || !e.assets["css/write.css"] || !e.assets["img/avatar.png"] {
+		t.Errorf("Expected only the static assets to be collected, got %v", e.assets)
+	}
+}
+
+func TestStaticRelativeLinkSingleUser(t *testing.T) {
+	defer func(su bool) { isSingleUser = su }(isSingleUser)
+	isSingleUser = true
+
+	e := newTestStaticExporter()
+	tests := map[string]string{
+		"https://example.com/":            "../index.html",
+		"https://example.com/hello-world": "../hello-world.html",
+		"/hello-world":                    "../hello-world.html",
+		"/":                               "../index.html",
+		"/tag:poetry":                     "../tag/poetry.html",
+	}
+	for link, want := range tests {
+		if got := e.relativeLink(link, 1); got != want {
+			t.Errorf("relativeLink(%q, 1) = %q, want %q", link, got, want)
+		}
+	}
+}
+
+func TestStaticRewriteLinks(t *testing.T) {
+	defer func(su bool) { isSingleUser = su }(isSingleUser)
+	isSingleUser = false
+
+	e := newTestStaticExporter()
+	in := `<link rel="stylesheet" href="/css/write.css" />` +
+		`<a href="https://example.com/blog/hello-world">Hello</a>` +
+		`<a href="/blog/tag:poetry">#poetry</a>` +
+		`<img src="/img/avatar.png" />` +
+		`<script>load('/js/h.js');</script>` +
+		`<a href="/login">Log in</a>`
+	want := `<link rel="stylesheet" href="../css/write.css" />` +
+		`<a href="../hello-world.html">Hello</a>` +
+		`<a href="../tag/poetry.html">#poetry</a>` +
+		`<img src="../img/avatar.png" />` +
+		`<script>load('../js/h.js');</script>` +
+		`<a href="https://example.com/login">Log in</a>`
+	if got := e.rewriteLinks(in, 1); got != want {
+		t.Errorf("rewriteLinks:\n got %s\nwant %s", got, want)
+	}
+	for _, a := range []string{"css/write.css", "img/avatar.png", "js/h.js"} {
+		if !e.assets[a] {
+			t.Errorf("Expected %s to be collected", a)
+		}
+	}
+}
+
+func TestStaticRewriteCSS(t *testing.T) {
+	e := newTestStaticExporter()
+	in := `@font-face { src: url('/fonts/lora.woff2') format('woff2'), url("/fonts/lora.ttf?v=1#x"); }
+body { background: url(/img/bg.png); }
+.ext { background: url(//cdn.example.net/bg.png); }
+.data { background: url(data:image/png;base64,AAAA); }`
+	want := `@font-face { src: url('../fonts/lora.woff2') format('woff2'), url('../fonts/lora.ttf?v=1#x'); }
+body { background: url('../img/bg.png'); }
+.ext { background: url(//cdn.example.net/bg.png); }
+.data { background: url(data:image/png;base64,AAAA); }`
+	if got := string(e.rewriteCSS([]byte(in), 1)); got != want {
+		t.Errorf("rewriteCSS:\n got %s\nwant %s", got, want)
+	}
+	for _, a := range []string{"fonts/lora.woff2", "fonts/lora.ttf", "img/bg.png"} {
+		if !e.assets[a] {
+			t.Errorf("Expected %s to be collected", a)
+		}
+	}
+	if len(e.assets) != 3 {
+		t.Errorf("Expected 3 assets, got %v", e.assets)
+	}
+}
@@ -1,5 +1,5 @@
 /*
- * Copyright © 2018-2020 A Bunch Tell LLC.
+ * Copyright © 2018-2021 A Bunch Tell LLC.
  *
  * This file is part of WriteFreely.
  *
@@ -50,6 +50,12 @@ func ViewFeed(app *App, w http.ResponseWriter, req *http.Request) error {
 		return ErrCollectionNotFound
 	}
 
+	cacheKey := app.pages.key(c.ID, "feed", req)
+	if cp := app.pages.get(cacheKey); cp != nil {
+		cp.serve(w, req)
+		return nil
+	}
+
 	// Fetch extra data about the Collection
 	// TODO: refactor out this logic, shared in collection.go:fetchCollection()
 	coll := &DisplayCollection{CollectionObj: &CollectionObj{Collection: *c}}
@@ -120,6 +126,12 @@ func ViewFeed(app *App, w http.ResponseWriter, req *http.Request) error {
 		return err
 	}
 
-	fmt.Fprint(w, rss)
+	cp := &cachedPage{
+		ContentType: "application/rss+xml; charset=utf-8",
+		Body:        []byte(rss),
+		Modified:    postsLastModified(coll.Posts),
+	}
+	app.pages.set(cacheKey, cp)
+	cp.serve(w, req)
 	return nil
 }
@@ -0,0 +1,340 @@
+/*
+ * Copyright © 2021 A Bunch Tell LLC.
+ *
+ * This file is part of WriteFreely.
+ *
+ * WriteFreely is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License, included
+ * in the LICENSE file in this source code package.
+ */
+
+package writefreely
+
+import (
+	"bufio"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"math/big"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/writeas/web-core/log"
+)
+
+const (
+	geminiStatusSuccess          = 20
+	geminiStatusRedirect         = 31
+	geminiStatusTemporaryFailure = 40
+	geminiStatusNotFound         = 51
+	geminiStatusBadRequest       = 59
+
+	// geminiMaxRequestLen is the longest URL a Gemini request can have.
+	geminiMaxRequestLen = 1024
+	geminiTimeout       = 30 * time.Second
+	gemtextMediaType    = "text/gemini; charset=utf-8"
+)
+
+var (
+	geminiCertPath = filepath.Join(keysDir, "gemini_cert.pem")
+	geminiKeyPath  = filepath.Join(keysDir, "gemini_key.pem")
+)
+
+// geminiRequest is a request made to the Gemini server.
+type geminiRequest struct {
+	URL *url.URL
+}
+
+// geminiResponseWriter writes the response to a Gemini request. Writing a
+// body without a header first sends a successful gemtext response.
+type geminiResponseWriter struct {
+	w      io.Writer
+	status int
+}
+
+// WriteHeader sends the response's status and meta line. It does nothing if
+// a header was already sent.
+func (w *geminiResponseWriter) WriteHeader(status int, meta string) {
+	if w.status != 0 {
+		return
+	}
+	w.status = status
+	fmt.Fprintf(w.w, "%d %s\r\n", status, meta)
+}
+
+func (w *geminiResponseWriter) Write(b []byte) (int, error) {
+	w.WriteHeader(geminiStatusSuccess, gemtextMediaType)
+	return w.w.Write(b)
+}
+
+type geminiHandlerFunc func(w *geminiResponseWriter, r *geminiRequest)
+
+func initGemini(apper Apper) {
+	app := apper.App()
+	cert, err := geminiCertificate(app)
+	if err != nil {
+		log.Error("Unable to load Gemini certificate: %v", err)
+		return
+	}
+	l, err := tls.Listen("tcp", fmt.Sprintf(":%d", app.cfg.Server.GeminiPort), &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+	})
+	if err != nil {
+		log.Error("Unable to start Gemini server: %v", err)
+		return
+	}
+
+	handler := NewWFHandler(apper)
+	h := handler.Gemini(handleGemini)
+	log.Info("Serving on gemini://localhost:%d", app.cfg.Server.GeminiPort)
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			log.Error("gemini: %v", err)
+			continue
+		}
+		go serveGemini(conn, h)
+	}
+}
+
+// serveGemini reads a single request from the connection and responds to it.
+func serveGemini(conn net.Conn, h geminiHandlerFunc) {
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(geminiTimeout))
+
+	w := &geminiResponseWriter{w: conn}
+	line, err := bufio.NewReaderSize(conn, geminiMaxRequestLen+2).ReadSlice('\n')
+	if err != nil {
+		w.WriteHeader(geminiStatusBadRequest, "Bad request")
+		return
+	}
+	u, err := url.Parse(strings.TrimRight(string(line), "\r\n"))
+	if err != nil || u.Scheme != "gemini" {
+		w.WriteHeader(geminiStatusBadRequest, "Only gemini:// URLs are served here")
+		return
+	}
+	if u.Path == "" {
+		u.Path = "/"
+	}
+	h(w, &geminiRequest{URL: u})
+}
+
+// geminiCertificate returns the Gemini server's TLS certificate. Unless one
+// is configured, a self-signed certificate is used, as is usual in Gemini,
+// where clients trust the certificate they first see for a host.
+func geminiCertificate(app *App) (tls.Certificate, error) {
+	certPath, keyPath := app.cfg.Server.GeminiCertPath, app.cfg.Server.GeminiKeyPath
+	if certPath == "" || keyPath == "" {
+		certPath = filepath.Join(app.cfg.Server.KeysParentDir, geminiCertPath)
+		keyPath = filepath.Join(app.cfg.Server.KeysParentDir, geminiKeyPath)
+		if _, err := os.Stat(certPath); os.IsNotExist(err) {
+			log.Info("Generating self-signed Gemini certificate at %s", certPath)
+			err = generateGeminiCert(stripHostProtocol(app), certPath, keyPath)
+			if err != nil {
+				return tls.Certificate{}, err
+			}
+		}
+	}
+	return tls.LoadX509KeyPair(certPath, keyPath)
+}
+
+// generateGeminiCert writes a new self-signed certificate for the given host,
+// and its key, to the given paths.
+func generateGeminiCert(host, certPath, keyPath string) error {
+	priv, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return err
+	}
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return err
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: host},
+		DNSNames:     []string{host},
+		NotBefore:    time.Now(),
+		NotAfter:     time.Now().AddDate(10, 0, 0),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &priv.PublicKey, priv)
+	if err != nil {
+		return err
+	}
+	keyDER, err := x509.MarshalECPrivateKey(priv)
+	if err != nil {
+		return err
+	}
+
+	certOut, err := os.OpenFile(certPath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	defer certOut.Close()
+	err = pem.Encode(certOut, &pem.Block{Type: "CERTIFICATE", Bytes: der})
+	if err != nil {
+		return err
+	}
+	keyOut, err := os.OpenFile(keyPath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	defer keyOut.Close()
+	return pem.Encode(keyOut, &pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+}
+
+func handleGemini(app *App, w *geminiResponseWriter, r *geminiRequest) error {
+	if app.cfg.App.SingleUser {
+		c, err := app.db.GetCollectionByID(1)
+		if err != nil {
+			return err
+		}
+		return handleGeminiCollectionPath(app, w, c, "/", strings.TrimPrefix(r.URL.Path, "/"))
+	}
+
+	if r.URL.Path == "/" {
+		return handleGeminiDirectory(app, w)
+	}
+	parts := strings.SplitN(strings.TrimPrefix(r.URL.Path, "/"), "/", 2)
+	if len(parts) == 1 {
+		w.WriteHeader(geminiStatusRedirect, "/"+parts[0]+"/")
+		return nil
+	}
+	c, err := app.db.GetCollection(parts[0])
+	if err != nil {
+		return err
+	}
+	return handleGeminiCollectionPath(app, w, c, "/"+c.Alias+"/", parts[1])
+}
+
+// handleGeminiDirectory lists all public collections on the instance.
+func handleGeminiDirectory(app *App, w *geminiResponseWriter) error {
+	colls, err := app.db.GetPublicCollections(app.cfg.App.Host)
+	if err != nil {
+		return err
+	}
+
+	fmt.Fprintf(w, "# %s\n\n", app.cfg.App.SiteName)
+	for _, c := range *colls {
+		fmt.Fprintf(w, "=> /%s/ %s\n", c.Alias, c.DisplayTitle())
+	}
+	return nil
+}
+
+// handleGeminiCollectionPath serves the given path within a collection, whose
+// pages are under base.
+func handleGeminiCollectionPath(app *App, w *geminiResponseWriter, c *Collection, base, path string) error {
+	c.hostName = app.cfg.App.Host
+	// Only public blogs, by users in good standing, are served
+	if !c.IsPublic() {
+		return ErrCollectionNotFound
+	}
+	silenced, err := app.db.IsUserSilenced(c.OwnerID)
+	if err != nil {
+		return err
+	}
+	if silenced {
+		return ErrCollectionNotFound
+	}
+
+	switch {
+	case path == "":
+		return handleGeminiCollection(app, w, c, base)
+	case strings.HasPrefix(path, "tag:"):
+		return handleGeminiCollectionTag(app, w, c, base, strings.TrimPrefix(path, "tag:"))
+	default:
+		return handleGeminiCollectionPost(app, w, c, base, path)
+	}
+}
+
+func handleGeminiCollection(app *App, w *geminiResponseWriter, c *Collection, base string) error {
+	posts, err := app.db.GetPosts(app.cfg, c, 0, false, false, false)
+	if err != nil {
+		return err
+	}
+	pages, err := app.db.GetCollectionPages(app.cfg, c, false)
+	if err != nil {
+		return err
+	}
+
+	fmt.Fprintf(w, "# %s\n", c.DisplayTitle())
+	if c.Description != "" {
+		fmt.Fprintf(w, "\n%s\n", c.Description)
+	}
+	if len(*pages) > 0 {
+		fmt.Fprint(w, "\n")
+		for _, p := range *pages {
+			fmt.Fprintf(w, "=> %s%s %s\n", base, p.Slug.String, p.PlainDisplayTitle())
+		}
+	}
+	fmt.Fprint(w, "\n## Posts\n\n")
+	for _, p := range *posts {
+		fmt.Fprintf(w, "=> %s%s %s %s\n", base, p.Slug.String, p.Created.Format("2006-01-02"), p.PlainDisplayTitle())
+	}
+	fmt.Fprintf(w, "\n=> %s Read on the web\n", c.CanonicalURL())
+	return nil
+}
+
+func handleGeminiCollectionTag(app *App, w *geminiResponseWriter, c *Collection, base, tag string) error {
+	posts, err := app.db.GetPostsTagged(app.cfg, c, tag, 0, false)
+	if err != nil {
+		return err
+	}
+	if len(*posts) == 0 {
+		return ErrCollectionPageNotFound
+	}
+
+	fmt.Fprintf(w, "# #%s\n", tag)
+	if desc := app.db.GetCollectionTagDescription(c.ID, tag); desc != "" {
+		fmt.Fprintf(w, "\n%s\n", desc)
+	}
+	fmt.Fprint(w, "\n")
+	for _, p := range *posts {
+		fmt.Fprintf(w, "=> %s%s %s %s\n", base, p.Slug.String, p.Created.Format("2006-01-02"), p.PlainDisplayTitle())
+	}
+	fmt.Fprintf(w, "\n=> %s %s\n", base, c.DisplayTitle())
+	return nil
+}
+
+func handleGeminiCollectionPost(app *App, w *geminiResponseWriter, c *Collection, base, slug string) error {
+	p, err := app.db.GetPost(slug, c.ID)
+	if err != nil {
+		return err
+	}
+	if p.Created.After(time.Now()) {
+		// Scheduled posts aren't out yet
+		return ErrPostNotFound
+	}
+	p.extractData()
+
+	postURL, err := url.Parse(c.CanonicalURL() + p.Slug.String)
+	if err != nil {
+		return err
+	}
+	if p.Title.String != "" {
+		fmt.Fprintf(w, "# %s\n\n", p.Title.String)
+	}
+	if !p.IsPage {
+		fmt.Fprintf(w, "%s\n\n", p.DisplayDate)
+	}
+	fmt.Fprint(w, markdownToGemtext(p.Content, postURL))
+
+	fmt.Fprint(w, "\n")
+	for _, t := range postTags(p.Content) {
+		fmt.Fprintf(w, "=> %stag:%s #%s\n", base, t, t)
+	}
+	fmt.Fprintf(w, "=> %s %s\n", base, c.DisplayTitle())
+	return nil
+}
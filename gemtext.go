@@ -0,0 +1,124 @@
+/*
+ * Copyright © 2021 A Bunch Tell LLC.
+ *
+ * This file is part of WriteFreely.
+ *
+ * WriteFreely is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License, included
+ * in the LICENSE file in this source code package.
+ */
+
+package writefreely
+
+import (
+	"net/url"
+	"regexp"
+	"strings"
+)
+
+var (
+	mdImageOrLinkReg = regexp.MustCompile(`(!?)\[([^\]]*)\]\(([^)\s]+)(?:\s+"[^"]*")?\)`)
+	mdAutolinkReg    = regexp.MustCompile(`<((?:https?|gemini|gopher|mailto):[^>\s]+)>`)
+	mdHeadingReg     = regexp.MustCompile(`^(#{1,6})\s+(.*?)\s*#*\s*$`)
+	mdListItemReg    = regexp.MustCompile(`^\s*[-+*]\s+(.*)$`)
+	mdStrongReg      = regexp.MustCompile(`(\*\*|__)(\S(?:.*?\S)?)(\*\*|__)`)
+)
+
+// gemtextLink is a link lifted out of a line of Markdown.
+type gemtextLink struct {
+	URL   string
+	Label string
+}
+
+// markdownToGemtext converts the given post Markdown into gemtext. Since
+// gemtext has no inline links, each link and image is replaced by its text,
+// and listed on its own link line after the line it was in. Relative links
+// are resolved against base.
+func markdownToGemtext(content string, base *url.URL) string {
+	var b strings.Builder
+	preformatted := false
+	for _, line := range strings.Split(strings.Replace(content, "\r\n", "\n", -1), "\n") {
+		trimmed := strings.TrimSpace(line)
+
+		// Code blocks work the same way in both
+		if strings.HasPrefix(trimmed, "```") {
+			preformatted = !preformatted
+			b.WriteString(trimmed + "\n")
+			continue
+		}
+		if preformatted {
+			b.WriteString(line + "\n")
+			continue
+		}
+
+		var links []gemtextLink
+		if m := mdHeadingReg.FindStringSubmatch(trimmed); m != nil {
+			// Gemtext only has three levels of headings
+			level := len(m[1])
+			if level > 3 {
+				level = 3
+			}
+			var text string
+			text, links = liftGemtextLinks(m[2], base)
+			line = strings.Repeat("#", level) + " " + text
+		} else if m := mdListItemReg.FindStringSubmatch(line); m != nil {
+			var text string
+			text, links = liftGemtextLinks(m[1], base)
+			line = "* " + text
+		} else if strings.HasPrefix(trimmed, ">") {
+			var text string
+			text, links = liftGemtextLinks(strings.TrimSpace(strings.TrimPrefix(trimmed, ">")), base)
+			line = "> " + text
+		} else {
+			line, links = liftGemtextLinks(line, base)
+			if strings.HasPrefix(line, "#") || strings.HasPrefix(line, "=>") || strings.HasPrefix(line, "*") {
+				// Keep hashtags and the like from being read as gemtext
+				// headings, links, or list items
+				line = " " + line
+			}
+		}
+
+		b.WriteString(line + "\n")
+		for _, l := range links {
+			b.WriteString("=> " + l.URL)
+			if l.Label != "" && l.Label != l.URL {
+				b.WriteString(" " + l.Label)
+			}
+			b.WriteString("\n")
+		}
+	}
+	return b.String()
+}
+
+// liftGemtextLinks returns the given line of Markdown with its links and
+// images replaced by their text, and any emphasis removed, along with the
+// links it had.
+func liftGemtextLinks(line string, base *url.URL) (string, []gemtextLink) {
+	links := []gemtextLink{}
+	line = mdImageOrLinkReg.ReplaceAllStringFunc(line, func(s string) string {
+		m := mdImageOrLinkReg.FindStringSubmatch(s)
+		label := strings.TrimSpace(m[2])
+		if m[1] == "!" && label == "" {
+			label = "Image"
+		}
+		links = append(links, gemtextLink{URL: resolveGemtextURL(m[3], base), Label: label})
+		return label
+	})
+	line = mdAutolinkReg.ReplaceAllStringFunc(line, func(s string) string {
+		u := mdAutolinkReg.FindStringSubmatch(s)[1]
+		links = append(links, gemtextLink{URL: u})
+		return u
+	})
+	line = mdStrongReg.ReplaceAllString(line, "$2")
+	return line, links
+}
+
+// resolveGemtextURL returns the given link as an absolute URL, relative to
+// base.
+func resolveGemtextURL(link string, base *url.URL) string {
+	u, err := url.Parse(link)
+	if err != nil || base == nil {
+		return link
+	}
+	return base.ResolveReference(u).String()
+}
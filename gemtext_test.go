@@ -0,0 +1,41 @@
+/*
+ * Copyright © 2021 A Bunch Tell LLC.
+ *
+ * This file is part of WriteFreely.
+ *
+ * WriteFreely is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License, included
+ * in the LICENSE file in this source code package.
+ */
+
+package writefreely
+
+import (
+	"net/url"
+	"testing"
+)
+
+func TestMarkdownToGemtext(t *testing.T) {
+	base, _ := url.Parse("https://example.com/blog/")
+	tests := []struct {
+		name string
+		in   string
+		want string
+	}{
+		{"plain", "Just some text.", "Just some text.\n"},
+		{"link", "See [the docs](https://writefreely.org/docs) for more.", "See the docs for more.\n=> https://writefreely.org/docs the docs\n"},
+		{"relative link", "Read [my last post](/blog/last).", "Read my last post.\n=> https://example.com/blog/last my last post\n"},
+		{"image", "![A cat](cat.png)", "A cat\n=> https://example.com/blog/cat.png A cat\n"},
+		{"autolink", "Mail <mailto:me@example.com>", "Mail mailto:me@example.com\n=> mailto:me@example.com\n"},
+		{"headings", "# Title\n#### Deep", "# Title\n### Deep\n"},
+		{"list", "- one\n+ [two](https://two.example)", "* one\n* two\n=> https://two.example two\n"},
+		{"quote", "> **Bold** words", "> Bold words\n"},
+		{"hashtag", "#writing is fun", " #writing is fun\n"},
+		{"code", "```go\n# not a heading\n[not](a-link)\n```", "```go\n# not a heading\n[not](a-link)\n```\n"},
+	}
+	for _, test := range tests {
+		if got := markdownToGemtext(test.in, base); got != test.want {
+			t.Errorf("%s: markdownToGemtext(%q) = %q, want %q", test.name, test.in, got, test.want)
+		}
+	}
+}
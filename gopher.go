@@ -11,14 +11,18 @@
 package writefreely
 
 import (
-	"bytes"
 	"fmt"
 	"io"
+	"math"
+	"net/http"
 	"net/url"
 	"regexp"
+	"strconv"
 	"strings"
+	"time"
 
 	"git.mills.io/prologic/go-gopher"
+	"github.com/writeas/impart"
 	"github.com/writeas/web-core/log"
 )
 
@@ -40,21 +44,67 @@ func stripHostProtocol(app *App) string {
 	return u.Hostname()
 }
 
+// gopherItem returns a menu item linking to the given selector on this
+// server.
+func gopherItem(app *App, t gopher.ItemType, desc, sel string) *gopher.Item {
+	return &gopher.Item{
+		Host:        stripHostProtocol(app),
+		Port:        app.cfg.Server.GopherPort,
+		Type:        t,
+		Description: desc,
+		Selector:    sel,
+	}
+}
+
+// splitGopherPage splits a trailing "page/N" off the given path, returning
+// the rest of the path and the page number, which is 1 if there isn't one.
+func splitGopherPage(path string) (string, int) {
+	i := strings.LastIndex(path, "page/")
+	if i == -1 || (i > 0 && path[i-1] != '/') {
+		return path, 1
+	}
+	n, err := strconv.Atoi(path[i+len("page/"):])
+	if err != nil || n < 1 {
+		return path, 1
+	}
+	return strings.TrimSuffix(path[:i], "/"), n
+}
+
 func handleGopher(app *App, w gopher.ResponseWriter, r *gopher.Request) error {
-	parts := strings.Split(r.Selector, "/")
+	sel := strings.TrimPrefix(r.Selector, "/")
 	if app.cfg.App.SingleUser {
-		if parts[1] != "" {
-			return handleGopherCollectionPost(app, w, r)
+		c, err := app.db.GetCollectionByID(1)
+		if err != nil {
+			return err
 		}
-		return handleGopherCollection(app, w, r)
+		return handleGopherCollectionPath(app, w, c, "/", sel)
 	}
 
-	// Show all public collections (a gopher Reader view, essentially)
-	if len(parts) == 3 {
-		return handleGopherCollection(app, w, r)
+	if sel == "" {
+		return handleGopherDirectory(app, w)
 	}
+	parts := strings.SplitN(sel, "/", 2)
+	path := ""
+	if len(parts) == 2 {
+		path = parts[1]
+	}
+	if parts[0] == "read" {
+		return handleGopherReader(app, w, path)
+	}
+	c, err := app.db.GetCollection(parts[0])
+	if err != nil {
+		return err
+	}
+	return handleGopherCollectionPath(app, w, c, "/"+c.Alias+"/", path)
+}
 
+// handleGopherDirectory lists all public collections on the instance.
+func handleGopherDirectory(app *App, w gopher.ResponseWriter) error {
 	w.WriteInfo(fmt.Sprintf("Welcome to %s", app.cfg.App.SiteName))
+	if app.cfg.App.LocalTimeline {
+		w.WriteItem(gopherItem(app, gopher.DIRECTORY, "Reader", "/read/"))
+	}
+	w.WriteInfo("")
 
 	colls, err := app.db.GetPublicCollections(app.cfg.App.Host)
 	if err != nil {
@@ -62,106 +112,219 @@ func handleGopher(app *App, w gopher.ResponseWriter, r *gopher.Request) error {
 	}
 
 	for _, c := range *colls {
-		w.WriteItem(&gopher.Item{
-			Host:        stripHostProtocol(app),
-			Port:        app.cfg.Server.GopherPort,
-			Type:        gopher.DIRECTORY,
-			Description: c.DisplayTitle(),
-			Selector:    "/" + c.Alias + "/",
-		})
+		w.WriteItem(gopherItem(app, gopher.DIRECTORY, c.DisplayTitle(), "/"+c.Alias+"/"))
 	}
 	return w.End()
 }
 
-func handleGopherCollection(app *App, w gopher.ResponseWriter, r *gopher.Request) error {
-	var collAlias, slug string
-	var c *Collection
-	var err error
-	var baseSel = "/"
-
-	parts := strings.Split(r.Selector, "/")
-	if app.cfg.App.SingleUser {
-		// sanity check
-		slug = parts[1]
-		if slug != "" {
-			return handleGopherCollectionPost(app, w, r)
+// handleGopherReader lists posts from the instance's local timeline, on pages
+// found at the same paths as on the web.
+func handleGopherReader(app *App, w gopher.ResponseWriter, path string) error {
+	if !app.cfg.App.LocalTimeline {
+		return impart.HTTPError{http.StatusNotFound, "Page doesn't exist."}
+	}
+	page := 1
+	if path != "" {
+		n, err := strconv.Atoi(strings.TrimPrefix(path, "p/"))
+		if err != nil || n < 1 || !strings.HasPrefix(path, "p/") {
+			return impart.HTTPError{http.StatusNotFound, "Page doesn't exist."}
 		}
+		page = n
+	}
 
-		c, err = app.db.GetCollectionByID(1)
-		if err != nil {
-			return err
-		}
-	} else {
-		collAlias = parts[1]
-		slug = parts[2]
-		if slug != "" {
-			return handleGopherCollectionPost(app, w, r)
+	updateTimelineCache(app.timeline, false)
+	posts := *app.timeline.posts
+	ttlPages := int(math.Ceil(float64(len(posts)) / float64(app.timeline.postsPerPage)))
+	if page > 1 && page > ttlPages {
+		return impart.HTTPError{http.StatusNotFound, "Page doesn't exist."}
+	}
+	start := app.timeline.postsPerPage * (page - 1)
+	end := start + app.timeline.postsPerPage
+	if end > len(posts) {
+		end = len(posts)
+	}
+
+	w.WriteInfo(fmt.Sprintf("%s Reader", app.cfg.App.SiteName))
+	w.WriteInfo("")
+	for _, p := range posts[start:end] {
+		if p.Collection == nil {
+			continue
 		}
+		w.WriteItem(gopherItem(app, gopher.FILE, p.CreatedDate()+" - "+p.PlainDisplayTitle()+" ("+p.Collection.DisplayTitle()+")", "/"+p.Collection.Alias+"/"+p.Slug.String))
+	}
+	writeGopherPageNav(app, w, "/read/", "p/", page, ttlPages)
+	return w.End()
+}
 
-		c, err = app.db.GetCollection(collAlias)
-		if err != nil {
-			return err
+// writeGopherPageNav adds links to the pages before and after the given one,
+// where pages after the first are at base+prefix+N.
+func writeGopherPageNav(app *App, w gopher.ResponseWriter, base, prefix string, page, ttlPages int) {
+	if page <= 1 && page >= ttlPages {
+		return
+	}
+	w.WriteInfo("")
+	if page > 1 {
+		prev := base
+		if page > 2 {
+			prev += prefix + strconv.Itoa(page-1)
 		}
-		baseSel = "/" + c.Alias + "/"
+		w.WriteItem(gopherItem(app, gopher.DIRECTORY, "Previous page", prev))
 	}
+	if page < ttlPages {
+		w.WriteItem(gopherItem(app, gopher.DIRECTORY, "Next page", base+prefix+strconv.Itoa(page+1)))
+	}
+}
+
+// handleGopherCollectionPath serves the given path within a collection, whose
+// selectors start with base.
+func handleGopherCollectionPath(app *App, w gopher.ResponseWriter, c *Collection, base, path string) error {
 	c.hostName = app.cfg.App.Host
+	// Only public blogs, by users in good standing, are served
+	if !c.IsPublic() {
+		return ErrCollectionNotFound
+	}
+	silenced, err := app.db.IsUserSilenced(c.OwnerID)
+	if err != nil {
+		return err
+	}
+	if silenced {
+		return ErrCollectionNotFound
+	}
+
+	path, page := splitGopherPage(strings.TrimSuffix(path, "/"))
+	switch {
+	case path == "":
+		return handleGopherCollection(app, w, c, base, page)
+	case path == "tags" && page == 1:
+		return handleGopherCollectionTags(app, w, c, base)
+	case strings.HasPrefix(path, "tag:"):
+		return handleGopherCollectionTag(app, w, c, base, strings.TrimPrefix(path, "tag:"), page)
+	case page == 1:
+		return handleGopherCollectionPost(app, w, c, base, path)
+	}
+	return ErrCollectionPageNotFound
+}
+
+func handleGopherCollection(app *App, w gopher.ResponseWriter, c *Collection, base string, page int) error {
+	coll := &CollectionObj{Collection: *c}
+	app.db.GetPostsCount(coll, false)
+	ttlPages := int(math.Ceil(float64(coll.TotalPosts) / float64(c.NewFormat().PostsPerPage())))
+	if page > 1 && page > ttlPages {
+		return ErrCollectionPageNotFound
+	}
+	posts, err := app.db.GetPosts(app.cfg, c, page, false, false, false)
+	if err != nil {
+		return err
+	}
 
 	w.WriteInfo(c.DisplayTitle())
 	if c.Description != "" {
 		w.WriteInfo(c.Description)
 	}
+	w.WriteInfo("")
 
-	posts, err := app.db.GetPosts(app.cfg, c, 0, false, false, false)
-	if err != nil {
-		return err
+	if page == 1 {
+		pages, err := app.db.GetCollectionPages(app.cfg, c, false)
+		if err != nil {
+			return err
+		}
+		for _, p := range *pages {
+			w.WriteItem(gopherItem(app, gopher.FILE, p.PlainDisplayTitle(), base+p.Slug.String))
+		}
+		if len(*pages) > 0 {
+			w.WriteInfo("")
+		}
 	}
 
 	for _, p := range *posts {
-		w.WriteItem(&gopher.Item{
-			Port:        app.cfg.Server.GopherPort,
-			Host:        stripHostProtocol(app),
-			Type:        gopher.FILE,
-			Description: p.CreatedDate() + " - " + p.DisplayTitle(),
-			Selector:    baseSel + p.Slug.String,
-		})
+		w.WriteItem(gopherItem(app, gopher.FILE, p.CreatedDate()+" - "+p.PlainDisplayTitle(), base+p.Slug.String))
 	}
+	writeGopherPageNav(app, w, base, "page/", page, ttlPages)
+
+	w.WriteInfo("")
+	w.WriteItem(gopherItem(app, gopher.DIRECTORY, "Tags", base+"tags/"))
 	return w.End()
 }
 
-func handleGopherCollectionPost(app *App, w gopher.ResponseWriter, r *gopher.Request) error {
-	var collAlias, slug string
-	var c *Collection
-	var err error
+// handleGopherCollectionTags lists all tags used in the collection.
+func handleGopherCollectionTags(app *App, w gopher.ResponseWriter, c *Collection, base string) error {
+	tags, err := app.db.GetCollectionTags(c.ID, false)
+	if err != nil {
+		return err
+	}
 
-	parts := strings.Split(r.Selector, "/")
-	if app.cfg.App.SingleUser {
-		slug = parts[1]
-		c, err = app.db.GetCollectionByID(1)
-		if err != nil {
-			return err
-		}
-	} else {
-		collAlias = parts[1]
-		slug = parts[2]
-		c, err = app.db.GetCollection(collAlias)
-		if err != nil {
-			return err
+	w.WriteInfo(c.DisplayTitle() + " - Tags")
+	w.WriteInfo("")
+	for _, t := range tags {
+		w.WriteItem(gopherItem(app, gopher.DIRECTORY, fmt.Sprintf("#%s (%d)", t.Name, t.Posts), base+"tag:"+t.Name))
+	}
+	w.WriteInfo("")
+	w.WriteItem(gopherItem(app, gopher.DIRECTORY, c.DisplayTitle(), base))
+	return w.End()
+}
+
+func handleGopherCollectionTag(app *App, w gopher.ResponseWriter, c *Collection, base, tag string, page int) error {
+	posts, err := app.db.GetPostsTagged(app.cfg, c, tag, page, false)
+	if err != nil {
+		return err
+	}
+	if len(*posts) == 0 {
+		return ErrCollectionPageNotFound
+	}
+	tags, err := app.db.GetCollectionTags(c.ID, false)
+	if err != nil {
+		return err
+	}
+	ttlPages := 1
+	for _, t := range tags {
+		if t.Name == strings.ToLower(tag) {
+			ttlPages = int(math.Ceil(float64(t.Posts) / float64(c.NewFormat().PostsPerPage())))
 		}
 	}
-	c.hostName = app.cfg.App.Host
 
+	w.WriteInfo("#" + tag)
+	if desc := app.db.GetCollectionTagDescription(c.ID, tag); desc != "" {
+		w.WriteInfo(desc)
+	}
+	w.WriteInfo("")
+	for _, p := range *posts {
+		w.WriteItem(gopherItem(app, gopher.FILE, p.CreatedDate()+" - "+p.PlainDisplayTitle(), base+p.Slug.String))
+	}
+	writeGopherPageNav(app, w, base+"tag:"+tag, "/page/", page, ttlPages)
+
+	w.WriteInfo("")
+	w.WriteItem(gopherItem(app, gopher.DIRECTORY, c.DisplayTitle(), base))
+	return w.End()
+}
+
+func handleGopherCollectionPost(app *App, w gopher.ResponseWriter, c *Collection, base, slug string) error {
 	p, err := app.db.GetPost(slug, c.ID)
 	if err != nil {
 		return err
 	}
+	if p.Created.After(time.Now()) {
+		// Scheduled posts aren't out yet
+		return ErrPostNotFound
+	}
+	p.extractData()
 
-	b := bytes.Buffer{}
+	postURL, err := url.Parse(c.CanonicalURL() + p.Slug.String)
+	if err != nil {
+		return err
+	}
+	b := strings.Builder{}
 	if p.Title.String != "" {
 		b.WriteString(p.Title.String + "\n")
 	}
-	b.WriteString(p.DisplayDate + "\n\n")
-	b.WriteString(p.Content)
-	io.Copy(w, &b)
+	if !p.IsPage {
+		b.WriteString(p.DisplayDate + "\n")
+	}
+	b.WriteString("\n")
+	b.WriteString(markdownToPlainText(p.Content, postURL, gopherTextWidth))
+	if tags := postTags(p.Content); len(tags) > 0 {
+		b.WriteString("\nTags: #" + strings.Join(tags, " #") + "\n")
+	}
+	io.WriteString(w, b.String())
 
 	return w.End()
 }
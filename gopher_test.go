@@ -0,0 +1,35 @@
+/*
+ * Copyright © 2021 A Bunch Tell LLC.
+ *
+ * This file is part of WriteFreely.
+ *
+ * WriteFreely is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License, included
+ * in the LICENSE file in this source code package.
+ */
+
+package writefreely
+
+import "testing"
+
+func TestSplitGopherPage(t *testing.T) {
+	tests := []struct {
+		in   string
+		path string
+		page int
+	}{
+		{"", "", 1},
+		{"page/2", "", 2},
+		{"tag:go/page/3", "tag:go", 3},
+		{"my-first-post", "my-first-post", 1},
+		{"homepage/2", "homepage/2", 1},
+		{"page/0", "page/0", 1},
+		{"page/next", "page/next", 1},
+	}
+	for _, test := range tests {
+		path, page := splitGopherPage(test.in)
+		if path != test.path || page != test.page {
+			t.Errorf("splitGopherPage(%q) = %q, %d, want %q, %d", test.in, path, page, test.path, test.page)
+		}
+	}
+}
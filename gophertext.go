@@ -0,0 +1,156 @@
+/*
+ * Copyright © 2021 A Bunch Tell LLC.
+ *
+ * This file is part of WriteFreely.
+ *
+ * WriteFreely is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License, included
+ * in the LICENSE file in this source code package.
+ */
+
+package writefreely
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+	"unicode/utf8"
+)
+
+// gopherTextWidth is the column plain text posts are wrapped at.
+const gopherTextWidth = 70
+
+// markdownToPlainText converts the given post Markdown into plain text,
+// with paragraphs wrapped at the given width. Links and images are replaced
+// by their text and a numbered reference, and listed after the text as
+// footnotes. Relative links are resolved against base.
+func markdownToPlainText(content string, base *url.URL, width int) string {
+	var b strings.Builder
+	var links []string
+	var para []string
+	var prefix, indent string
+	inList := false
+
+	// flush writes out the paragraph so far, wrapped
+	flush := func() {
+		if len(para) == 0 {
+			return
+		}
+		listItem := prefix == "* "
+		if b.Len() > 0 && !(listItem && inList) {
+			// List items go together; everything else is set apart
+			b.WriteString("\n")
+		}
+		b.WriteString(wrapText(strings.Join(para, " "), prefix, indent, width))
+		para = nil
+		inList = listItem
+	}
+	// inline strips the line's Markdown, numbering its links as footnotes
+	inline := func(line string) string {
+		line = mdImageOrLinkReg.ReplaceAllStringFunc(line, func(s string) string {
+			m := mdImageOrLinkReg.FindStringSubmatch(s)
+			label := strings.TrimSpace(m[2])
+			if m[1] == "!" && label == "" {
+				label = "Image"
+			}
+			links = append(links, resolveGemtextURL(m[3], base))
+			return fmt.Sprintf("%s[%d]", label, len(links))
+		})
+		line = mdAutolinkReg.ReplaceAllString(line, "$1")
+		return mdStrongReg.ReplaceAllString(line, "$2")
+	}
+
+	preformatted := false
+	for _, line := range strings.Split(strings.Replace(content, "\r\n", "\n", -1), "\n") {
+		trimmed := strings.TrimSpace(line)
+
+		// Code is indented as-is, without wrapping
+		if strings.HasPrefix(trimmed, "```") {
+			flush()
+			preformatted = !preformatted
+			if preformatted && b.Len() > 0 {
+				b.WriteString("\n")
+			}
+			inList = false
+			continue
+		}
+		if preformatted {
+			b.WriteString("    " + line + "\n")
+			continue
+		}
+
+		if trimmed == "" {
+			flush()
+			continue
+		}
+		if m := mdHeadingReg.FindStringSubmatch(trimmed); m != nil {
+			flush()
+			text := inline(m[2])
+			underline := "-"
+			if len(m[1]) == 1 {
+				underline = "="
+			}
+			if b.Len() > 0 {
+				b.WriteString("\n")
+			}
+			b.WriteString(text + "\n" + strings.Repeat(underline, utf8.RuneCountInString(text)) + "\n")
+			inList = false
+			continue
+		}
+		if m := mdListItemReg.FindStringSubmatch(line); m != nil {
+			// Each list item is its own paragraph, with a hanging indent
+			flush()
+			prefix, indent = "* ", "  "
+			para = append(para, inline(m[1]))
+			continue
+		}
+		if strings.HasPrefix(trimmed, ">") {
+			if prefix != "> " {
+				flush()
+				prefix, indent = "> ", "> "
+			}
+			if text := strings.TrimSpace(strings.TrimPrefix(trimmed, ">")); text != "" {
+				para = append(para, inline(text))
+			}
+			continue
+		}
+		if len(para) == 0 {
+			prefix, indent = "", ""
+		}
+		para = append(para, inline(trimmed))
+	}
+	flush()
+
+	if len(links) > 0 {
+		b.WriteString("\n")
+		for i, l := range links {
+			fmt.Fprintf(&b, "[%d]: %s\n", i+1, l)
+		}
+	}
+	return b.String()
+}
+
+// wrapText breaks the given text into lines no longer than width, where
+// possible, starting the first line with prefix and the rest with indent.
+func wrapText(text, prefix, indent string, width int) string {
+	var b strings.Builder
+	line := prefix
+	lineLen := utf8.RuneCountInString(prefix)
+	empty := true
+	for _, w := range strings.Fields(text) {
+		wLen := utf8.RuneCountInString(w)
+		if !empty && lineLen+1+wLen > width {
+			b.WriteString(line + "\n")
+			line, lineLen, empty = indent, utf8.RuneCountInString(indent), true
+		}
+		if !empty {
+			line += " "
+			lineLen++
+		}
+		line += w
+		lineLen += wLen
+		empty = false
+	}
+	b.WriteString(line + "\n")
+	return b.String()
+}
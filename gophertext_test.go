@@ -0,0 +1,39 @@
+/*
+ * Copyright © 2021 A Bunch Tell LLC.
+ *
+ * This file is part of WriteFreely.
+ *
+ * WriteFreely is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License, included
+ * in the LICENSE file in this source code package.
+ */
+
+package writefreely
+
+import (
+	"net/url"
+	"testing"
+)
+
+func TestMarkdownToPlainText(t *testing.T) {
+	base, _ := url.Parse("https://example.com/blog/")
+	tests := []struct {
+		name string
+		in   string
+		want string
+	}{
+		{"plain", "Just some text.", "Just some text.\n"},
+		{"reflow", "One two three\nfour five six seven eight", "One two three four\nfive six seven eight\n"},
+		{"paragraphs", "One.\n\nTwo.", "One.\n\nTwo.\n"},
+		{"links", "See [the docs](https://writefreely.org/docs) and ![a cat](cat.png).", "See the docs[1] and\na cat[2].\n\n[1]: https://writefreely.org/docs\n[2]: https://example.com/blog/cat.png\n"},
+		{"headings", "# Title\nText\n## Sub", "Title\n=====\n\nText\n\nSub\n---\n"},
+		{"list", "- one two three four five six\n- **seven**", "* one two three four\n  five six\n* seven\n"},
+		{"quote", "> one two three four five\n> six", "> one two three four\n> five six\n"},
+		{"code", "Before\n```\nfunc  main() {}\n```\nAfter", "Before\n\n    func  main() {}\n\nAfter\n"},
+	}
+	for _, test := range tests {
+		if got := markdownToPlainText(test.in, base, 20); got != test.want {
+			t.Errorf("%s: markdownToPlainText(%q) = %q, want %q", test.name, test.in, got, test.want)
+		}
+	}
+}
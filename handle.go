@@ -66,6 +66,7 @@ func UserLevelReader(cfg *config.Config) UserLevel {
 type (
 	handlerFunc          func(app *App, w http.ResponseWriter, r *http.Request) error
 	gopherFunc           func(app *App, w gopher.ResponseWriter, r *gopher.Request) error
+	geminiFunc           func(app *App, w *geminiResponseWriter, r *geminiRequest) error
 	userHandlerFunc      func(app *App, u *User, w http.ResponseWriter, r *http.Request) error
 	userApperHandlerFunc func(apper Apper, u *User, w http.ResponseWriter, r *http.Request) error
 	dataHandlerFunc      func(app *App, w http.ResponseWriter, r *http.Request) ([]byte, string, error)
@@ -987,12 +988,38 @@ func (h *Handler) Gopher(f gopherFunc) gopher.HandlerFunc {
 
 		err := f(h.app.App(), w, r)
 		if err != nil {
+			if err, ok := err.(impart.HTTPError); ok && (err.Status == http.StatusNotFound || err.Status == http.StatusGone) {
+				w.WriteError(err.Message)
+				return
+			}
 			log.Error("failed: %s", err)
 			w.WriteError("the page failed for some reason (see logs)")
 		}
 	}
 }
 
+func (h *Handler) Gemini(f geminiFunc) geminiHandlerFunc {
+	return func(w *geminiResponseWriter, r *geminiRequest) {
+		defer func() {
+			if e := recover(); e != nil {
+				log.Error("%s: %s", e, debug.Stack())
+				w.WriteHeader(geminiStatusTemporaryFailure, "An internal error occurred")
+			}
+			log.Info("gemini: %s", r.URL.Path)
+		}()
+
+		err := f(h.app.App(), w, r)
+		if err != nil {
+			if err, ok := err.(impart.HTTPError); ok && (err.Status == http.StatusNotFound || err.Status == http.StatusGone) {
+				w.WriteHeader(geminiStatusNotFound, "Not found")
+				return
+			}
+			log.Error("failed: %s", err)
+			w.WriteHeader(geminiStatusTemporaryFailure, "The page failed for some reason (see logs)")
+		}
+	}
+}
+
 func sendRedirect(w http.ResponseWriter, code int, location string) int {
 	w.Header().Set("Location", location)
 	w.WriteHeader(code)
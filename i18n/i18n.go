@@ -0,0 +1,306 @@
+/*
+ * Copyright © 2021 A Bunch Tell LLC.
+ *
+ * This file is part of WriteFreely.
+ *
+ * WriteFreely is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License, included
+ * in the LICENSE file in this source code package.
+ */
+
+// Package i18n loads the message catalogs WriteFreely's interface is
+// translated with, and picks which language to show someone.
+//
+// Each catalog is a JSON file named after its language tag, like es.json or
+// pt-br.json. It maps the English text of a message to its translation. A
+// message that depends on a number maps to an object of CLDR plural forms
+// ("zero", "one", "two", "few", "many" and "other") instead:
+//
+//	{
+//		"@name": "Español",
+//		"Drafts": "Borradores",
+//		"%d post": {"one": "%d entrada", "other": "%d entradas"}
+//	}
+//
+// English is the source language, so the English catalog only needs the
+// plural forms of messages.
+package i18n
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// SourceLang is the language messages are written in.
+const SourceLang = "en"
+
+// nameKey is the catalog entry that holds the language's name for itself.
+const nameKey = "@name"
+
+type (
+	// Bundle holds the message catalogs for every language the interface is
+	// translated into.
+	Bundle struct {
+		catalogs map[string]*catalog
+	}
+
+	// Language is a language the interface can be shown in.
+	Language struct {
+		Tag  string
+		Name string
+	}
+
+	// Key is a message found in a template.
+	Key struct {
+		Text   string
+		Plural bool
+	}
+
+	catalog struct {
+		name     string
+		messages map[string]string
+		plurals  map[string]map[string]string
+	}
+)
+
+// Load reads every catalog in the given directory. A missing directory
+// leaves the interface in English only.
+func Load(dir string) (*Bundle, error) {
+	b := &Bundle{catalogs: map[string]*catalog{}}
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return b, nil
+		}
+		return nil, err
+	}
+	for _, f := range files {
+		if f.IsDir() || filepath.Ext(f.Name()) != ".json" {
+			continue
+		}
+		tag := normalizeTag(strings.TrimSuffix(f.Name(), ".json"))
+		src, err := ioutil.ReadFile(filepath.Join(dir, f.Name()))
+		if err != nil {
+			return nil, err
+		}
+		c, err := parseCatalog(src)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %s", f.Name(), err)
+		}
+		b.catalogs[tag] = c
+	}
+	return b, nil
+}
+
+func parseCatalog(src []byte) (*catalog, error) {
+	var raw map[string]json.RawMessage
+	if err := json.Unmarshal(src, &raw); err != nil {
+		return nil, err
+	}
+	c := &catalog{
+		messages: map[string]string{},
+		plurals:  map[string]map[string]string{},
+	}
+	for k, v := range raw {
+		var s string
+		if err := json.Unmarshal(v, &s); err == nil {
+			if k == nameKey {
+				c.name = s
+			} else {
+				c.messages[k] = s
+			}
+			continue
+		}
+		forms := map[string]string{}
+		if err := json.Unmarshal(v, &forms); err != nil {
+			return nil, fmt.Errorf("message %q must be a string or an object of plural forms", k)
+		}
+		for form := range forms {
+			if !isPluralForm(form) {
+				return nil, fmt.Errorf("message %q has unknown plural form %q", k, form)
+			}
+		}
+		c.plurals[k] = forms
+	}
+	return c, nil
+}
+
+func normalizeTag(tag string) string {
+	return strings.ToLower(strings.Replace(strings.TrimSpace(tag), "_", "-", -1))
+}
+
+func baseLang(tag string) string {
+	if i := strings.Index(tag, "-"); i > -1 {
+		return tag[:i]
+	}
+	return tag
+}
+
+// catalog returns the catalog for the given language, or the catalog of its
+// base language, or nil if there's neither.
+func (b *Bundle) catalog(lang string) *catalog {
+	if b == nil || lang == "" {
+		return nil
+	}
+	lang = normalizeTag(lang)
+	if c, ok := b.catalogs[lang]; ok {
+		return c
+	}
+	return b.catalogs[baseLang(lang)]
+}
+
+// Supports returns whether the interface can be shown in the given language.
+func (b *Bundle) Supports(lang string) bool {
+	lang = normalizeTag(lang)
+	return baseLang(lang) == SourceLang || b.catalog(lang) != nil
+}
+
+// Languages returns every language the interface can be shown in, ordered by
+// tag.
+func (b *Bundle) Languages() []Language {
+	langs := []Language{{Tag: SourceLang, Name: "English"}}
+	if b == nil {
+		return langs
+	}
+	for tag, c := range b.catalogs {
+		if tag == SourceLang {
+			continue
+		}
+		name := c.name
+		if name == "" {
+			name = tag
+		}
+		langs = append(langs, Language{Tag: tag, Name: name})
+	}
+	sort.Slice(langs, func(i, j int) bool {
+		return langs[i].Tag < langs[j].Tag
+	})
+	return langs
+}
+
+// Match returns the supported language that best fits an Accept-Language
+// header, or an empty string if none of them do.
+func (b *Bundle) Match(acceptLanguage string) string {
+	type pref struct {
+		tag string
+		q   float64
+	}
+	prefs := []pref{}
+	for _, part := range strings.Split(acceptLanguage, ",") {
+		params := strings.Split(part, ";")
+		p := pref{tag: normalizeTag(params[0]), q: 1}
+		for _, param := range params[1:] {
+			param = strings.TrimSpace(param)
+			if strings.HasPrefix(param, "q=") {
+				if q, err := strconv.ParseFloat(param[2:], 64); err == nil {
+					p.q = q
+				}
+			}
+		}
+		if p.tag == "" || p.tag == "*" || p.q <= 0 {
+			continue
+		}
+		prefs = append(prefs, p)
+	}
+	sort.SliceStable(prefs, func(i, j int) bool {
+		return prefs[i].q > prefs[j].q
+	})
+
+	for _, p := range prefs {
+		if baseLang(p.tag) == SourceLang {
+			return SourceLang
+		}
+		if b.catalog(p.tag) == nil {
+			continue
+		}
+		if _, ok := b.catalogs[p.tag]; ok {
+			return p.tag
+		}
+		return baseLang(p.tag)
+	}
+	return ""
+}
+
+// String returns the translation of the given message, and whether there is
+// one.
+func (b *Bundle) String(lang, key string) (string, bool) {
+	c := b.catalog(lang)
+	if c == nil {
+		return "", false
+	}
+	s, ok := c.messages[key]
+	return s, ok && s != ""
+}
+
+// Plural returns the form of the given message that fits the number n, and
+// whether there is one. When the language's catalog doesn't have the message,
+// the English forms are used.
+func (b *Bundle) Plural(lang, key string, n int) (string, bool) {
+	if c := b.catalog(lang); c != nil {
+		if forms, ok := c.plurals[key]; ok {
+			if s := pluralForm(forms, PluralCategory(lang, n)); s != "" {
+				return s, true
+			}
+		}
+	}
+	if c := b.catalog(SourceLang); c != nil {
+		if forms, ok := c.plurals[key]; ok {
+			if s := pluralForm(forms, PluralCategory(SourceLang, n)); s != "" {
+				return s, true
+			}
+		}
+	}
+	return "", false
+}
+
+func pluralForm(forms map[string]string, category string) string {
+	if s := forms[category]; s != "" {
+		return s
+	}
+	return forms["other"]
+}
+
+// Missing returns the given messages that the language's catalog doesn't
+// translate. English only needs the messages that have plural forms.
+func (b *Bundle) Missing(lang string, keys []Key) []Key {
+	c := b.catalog(lang)
+	missing := []Key{}
+	for _, k := range keys {
+		if k.Plural {
+			if c == nil || len(c.plurals[k.Text]) == 0 {
+				missing = append(missing, k)
+			}
+			continue
+		}
+		if baseLang(normalizeTag(lang)) == SourceLang {
+			continue
+		}
+		if c == nil || c.messages[k.Text] == "" {
+			missing = append(missing, k)
+		}
+	}
+	return missing
+}
+
+var templateKeyReg = regexp.MustCompile(`\blocal(str|html|nstr)\s+("(?:[^"\\]|\\.)*"|` + "`[^`]*`" + `)`)
+
+// TemplateKeys returns the messages that the given template source looks up
+// with the localstr, localhtml and localnstr template functions.
+func TemplateKeys(src string) []Key {
+	keys := []Key{}
+	for _, m := range templateKeyReg.FindAllStringSubmatch(src, -1) {
+		text, err := strconv.Unquote(m[2])
+		if err != nil {
+			continue
+		}
+		keys = append(keys, Key{Text: text, Plural: m[1] == "nstr"})
+	}
+	return keys
+}
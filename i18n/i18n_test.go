@@ -0,0 +1,141 @@
+package i18n
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func testBundle(t *testing.T) *Bundle {
+	dir, err := ioutil.TempDir("", "i18n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	catalogs := map[string]string{
+		"en.json":    `{"%d post": {"one": "%d post", "other": "%d posts"}}`,
+		"es.json":    `{"@name": "Español", "Drafts": "Borradores", "%d post": {"one": "%d entrada", "other": "%d entradas"}}`,
+		"pt_BR.json": `{"@name": "Português (Brasil)", "Drafts": "Rascunhos"}`,
+		"ru.json":    `{"@name": "Русский", "%d post": {"one": "%d запись", "few": "%d записи", "many": "%d записей"}}`,
+	}
+	for name, src := range catalogs {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(src), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	b, err := Load(dir)
+	if err != nil {
+		t.Fatalf("Load: %v", err)
+	}
+	return b
+}
+
+func TestLoadInvalidPluralForm(t *testing.T) {
+	if _, err := parseCatalog([]byte(`{"%d post": {"several": "%d posts"}}`)); err == nil {
+		t.Error("Expected an error for an unknown plural form")
+	}
+}
+
+func TestMatch(t *testing.T) {
+	b := testBundle(t)
+	tests := map[string]string{
+		"es-MX,es;q=0.9,en;q=0.8": "es",
+		"pt-BR":                   "pt-br",
+		"fr;q=0.9,es;q=0.5":       "es",
+		"de,en-GB;q=0.5":          "en",
+		"en;q=0.1,es":             "es",
+		"fr":                      "",
+		"":                        "",
+		"*":                       "",
+	}
+	for accept, want := range tests {
+		if got := b.Match(accept); got != want {
+			t.Errorf("Match(%q) = %q, want %q", accept, got, want)
+		}
+	}
+}
+
+func TestString(t *testing.T) {
+	b := testBundle(t)
+	if s, ok := b.String("es-AR", "Drafts"); !ok || s != "Borradores" {
+		t.Errorf("Expected regional language to use its base catalog, got %q", s)
+	}
+	if _, ok := b.String("es", "Blogs"); ok {
+		t.Error("Expected no translation for a message that isn't in the catalog")
+	}
+	if _, ok := b.String("fr", "Drafts"); ok {
+		t.Error("Expected no translation for an unsupported language")
+	}
+}
+
+func TestPlural(t *testing.T) {
+	b := testBundle(t)
+	tests := []struct {
+		lang string
+		n    int
+		want string
+	}{
+		{"en", 1, "%d post"},
+		{"en", 0, "%d posts"},
+		{"es", 1, "%d entrada"},
+		{"es", 3, "%d entradas"},
+		{"ru", 21, "%d запись"},
+		{"ru", 3, "%d записи"},
+		{"ru", 11, "%d записей"},
+		{"pt-br", 2, "%d posts"},
+	}
+	for _, test := range tests {
+		if s, _ := b.Plural(test.lang, "%d post", test.n); s != test.want {
+			t.Errorf("Plural(%s, %d) = %q, want %q", test.lang, test.n, s, test.want)
+		}
+	}
+}
+
+func TestPluralCategory(t *testing.T) {
+	tests := []struct {
+		lang string
+		n    int
+		want string
+	}{
+		{"en", 1, "one"},
+		{"en", 0, "other"},
+		{"fr", 0, "one"},
+		{"ja", 1, "other"},
+		{"pl", 22, "few"},
+		{"pl", 12, "many"},
+		{"cs", 3, "few"},
+		{"ar", 2, "two"},
+		{"ar", 111, "many"},
+	}
+	for _, test := range tests {
+		if c := PluralCategory(test.lang, test.n); c != test.want {
+			t.Errorf("PluralCategory(%s, %d) = %s, want %s", test.lang, test.n, c, test.want)
+		}
+	}
+}
+
+func TestTemplateKeys(t *testing.T) {
+	src := `<a href="/me/posts/">{{localstr "Drafts" .Locale}}</a>
+<p>{{localnstr "%d post" .Count .Locale}}</p>
+<title>{{localhtml "Say \"hi\"" $.Locale}}</title>`
+	want := []Key{{Text: "Drafts"}, {Text: "%d post", Plural: true}, {Text: `Say "hi"`}}
+	if keys := TemplateKeys(src); !reflect.DeepEqual(keys, want) {
+		t.Errorf("TemplateKeys = %v, want %v", keys, want)
+	}
+}
+
+func TestMissing(t *testing.T) {
+	b := testBundle(t)
+	keys := []Key{{Text: "Drafts"}, {Text: "Blogs"}, {Text: "%d post", Plural: true}}
+	if m := b.Missing("es", keys); !reflect.DeepEqual(m, []Key{{Text: "Blogs"}}) {
+		t.Errorf("Missing(es) = %v", m)
+	}
+	if m := b.Missing("pt-br", keys); len(m) != 2 {
+		t.Errorf("Expected 2 missing messages for pt-br, got %v", m)
+	}
+	if m := b.Missing("en", keys); len(m) != 0 {
+		t.Errorf("Expected nothing missing in English, got %v", m)
+	}
+}
@@ -0,0 +1,461 @@
+/*
+ * Copyright © 2021 A Bunch Tell LLC.
+ *
+ * This file is part of WriteFreely.
+ *
+ * WriteFreely is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License, included
+ * in the LICENSE file in this source code package.
+ */
+
+package writefreely
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/writeas/impart"
+	"github.com/writeas/web-core/id"
+	"github.com/writeas/web-core/log"
+)
+
+const (
+	jobsDir     = "jobs"
+	jobInputDir = "input"
+	jobIDLen    = 16
+
+	defaultJobWorkers = 2
+	jobPollInterval   = 10 * time.Second
+	jobCleanInterval  = time.Hour
+	// jobExpiryDays is how long finished jobs, and their results, are kept.
+	jobExpiryDays = 7
+)
+
+var (
+	errJobCanceled    = errors.New("job canceled")
+	errJobInterrupted = errors.New("job interrupted")
+)
+
+type jobType string
+
+const (
+	jobTypeImport       jobType = "import"
+	jobTypeImportFull   jobType = "import-full"
+	jobTypeExport       jobType = "export"
+	jobTypeExportStatic jobType = "export-static"
+	jobTypeExportEPUB   jobType = "export-epub"
+)
+
+var jobTypeDescriptions = map[jobType]string{
+	jobTypeImport:       "Text files",
+	jobTypeImportFull:   "WriteFreely export",
+	jobTypeExport:       "User + Blogs + Posts",
+	jobTypeExportStatic: "Static site",
+	jobTypeExportEPUB:   "EPUB book",
+}
+
+type jobStatus int
+
+const (
+	jobQueued jobStatus = iota
+	jobRunning
+	jobCompleted
+	jobFailed
+	jobCanceled
+)
+
+var jobStatusNames = map[jobStatus]string{
+	jobQueued:    "queued",
+	jobRunning:   "running",
+	jobCompleted: "completed",
+	jobFailed:    "failed",
+	jobCanceled:  "canceled",
+}
+
+func (s jobStatus) String() string {
+	return jobStatusNames[s]
+}
+
+func (s jobStatus) MarshalText() ([]byte, error) {
+	return []byte(s.String()), nil
+}
+
+// Finished returns whether or not a job with this status is done running.
+func (s jobStatus) Finished() bool {
+	return s >= jobCompleted
+}
+
+// Job is a long-running task, like an import or export, that's carried out in
+// the background on behalf of a user.
+type Job struct {
+	ID       string    `json:"id"`
+	UserID   int64     `json:"-"`
+	Type     jobType   `json:"type"`
+	Status   jobStatus `json:"status"`
+	Progress int       `json:"progress"`
+	Total    int       `json:"total"`
+	Input    string    `json:"-"`
+	Result   string    `json:"-"`
+	Message  string    `json:"message,omitempty"`
+	Created  time.Time `json:"created"`
+	Updated  time.Time `json:"updated"`
+}
+
+// dir returns the directory where the job's uploaded files and results are
+// stored.
+func (j *Job) dir(app *App) string {
+	return filepath.Join(app.cfg.Server.JobsParentDir, jobsDir, j.ID)
+}
+
+func (j *Job) inputDir(app *App) string {
+	return filepath.Join(j.dir(app), jobInputDir)
+}
+
+// Percent returns how far along the job is, from 0 to 100.
+func (j *Job) Percent() int {
+	if j.Status == jobCompleted {
+		return 100
+	}
+	if j.Total <= 0 {
+		return 0
+	}
+	return j.Progress * 100 / j.Total
+}
+
+// MessageLines returns each line of the job's message, for display.
+func (j *Job) MessageLines() []string {
+	if j.Message == "" {
+		return nil
+	}
+	return strings.Split(j.Message, "\n")
+}
+
+// Description returns a short, human-readable name for the kind of job.
+func (j *Job) Description() string {
+	return jobTypeDescriptions[j.Type]
+}
+
+// HasResult returns whether or not the job produced a file that can be
+// downloaded.
+func (j *Job) HasResult() bool {
+	return j.Status == jobCompleted && j.Result != ""
+}
+
+// progressFunc records that a job has finished done out of total units of
+// work, along with any notes for the user about the work done so far, so a
+// resumed job can pick up where it left off. It returns errJobCanceled or
+// errJobInterrupted when the job should stop.
+type progressFunc func(done, total int, notes ...string) error
+
+// jobRunner carries out a job, returning the name of any result file it wrote
+// to the job's directory, and a message for the user.
+type jobRunner func(app *App, j *Job, progress progressFunc) (result, message string, err error)
+
+var jobRunners = map[jobType]jobRunner{
+	jobTypeImport:       runImportJob,
+	jobTypeImportFull:   runImportFullJob,
+	jobTypeExport:       runExportJob,
+	jobTypeExportStatic: runExportStaticJob,
+	jobTypeExportEPUB:   runExportEPUBJob,
+}
+
+// newJob creates a Job of the given type for the user, along with a directory
+// for any files it needs. The job isn't run until it's enqueued.
+func newJob(app *App, userID int64, t jobType) (*Job, error) {
+	j := &Job{
+		ID:     id.GenerateFriendlyRandomString(jobIDLen),
+		UserID: userID,
+		Type:   t,
+		Status: jobQueued,
+	}
+	err := os.MkdirAll(j.inputDir(app), 0700)
+	if err != nil {
+		log.Error("Unable to create job directory: %v", err)
+		return nil, impart.HTTPError{http.StatusInternalServerError, "Couldn't start that job."}
+	}
+	return j, nil
+}
+
+// jobQueue runs queued jobs with a pool of workers.
+type jobQueue struct {
+	app  *App
+	wake chan struct{}
+	quit chan struct{}
+	wg   sync.WaitGroup
+}
+
+func initJobQueue(app *App) {
+	workers := app.cfg.Server.JobWorkers
+	if workers <= 0 {
+		workers = defaultJobWorkers
+	}
+
+	app.jobs = &jobQueue{
+		app:  app,
+		wake: make(chan struct{}, 1),
+		quit: make(chan struct{}),
+	}
+
+	// Any jobs still marked as running were cut short when the server last
+	// stopped, since no workers have started yet
+	if n, err := app.db.RequeueInterruptedJobs(); err == nil && n > 0 {
+		log.Info("Requeued %d interrupted jobs.", n)
+	}
+
+	log.Info("Starting %d job workers...", workers)
+	app.jobs.wg.Add(workers + 1)
+	go app.jobs.clean()
+	for i := 0; i < workers; i++ {
+		go app.jobs.work()
+	}
+}
+
+// enqueue saves the given job, so the next available worker will run it.
+func (q *jobQueue) enqueue(j *Job) error {
+	err := q.app.db.CreateJob(j)
+	if err != nil {
+		return impart.HTTPError{http.StatusInternalServerError, "Couldn't start that job."}
+	}
+
+	select {
+	case q.wake <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// stop waits for all workers to exit. Jobs that are still running are put
+// back in the queue, to be picked up again when the server restarts.
+func (q *jobQueue) stop() {
+	log.Info("Stopping job workers...")
+	close(q.quit)
+	q.wg.Wait()
+}
+
+func (q *jobQueue) stopping() bool {
+	select {
+	case <-q.quit:
+		return true
+	default:
+		return false
+	}
+}
+
+func (q *jobQueue) work() {
+	defer q.wg.Done()
+	for {
+		for !q.stopping() {
+			j, err := q.app.db.ClaimNextJob()
+			if err != nil || j == nil {
+				break
+			}
+			q.run(j)
+		}
+
+		select {
+		case <-q.quit:
+			return
+		case <-q.wake:
+		case <-time.After(jobPollInterval):
+		}
+	}
+}
+
+// clean periodically deletes expired jobs.
+func (q *jobQueue) clean() {
+	defer q.wg.Done()
+	for {
+		ids, err := q.app.db.GetExpiredJobs(jobExpiryDays)
+		if err == nil {
+			for _, jobID := range ids {
+				j := &Job{ID: jobID}
+				if err := os.RemoveAll(j.dir(q.app)); err != nil {
+					log.Error("Unable to remove job %s files: %v", jobID, err)
+					continue
+				}
+				q.app.db.DeleteJob(jobID)
+			}
+		}
+
+		select {
+		case <-q.quit:
+			return
+		case <-time.After(jobCleanInterval):
+		}
+	}
+}
+
+func (q *jobQueue) run(j *Job) {
+	runner, ok := jobRunners[j.Type]
+	if !ok {
+		log.Error("Unknown type for job %s: %s", j.ID, j.Type)
+		q.app.db.FinishJob(j.ID, jobFailed, "", "This job couldn't be run.")
+		return
+	}
+
+	log.Info("Running %s job %s", j.Type, j.ID)
+	progress := func(done, total int, notes ...string) error {
+		// Save progress first, so work that's already done isn't repeated
+		// when an interrupted job is resumed
+		running, err := q.app.db.UpdateJobProgress(j.ID, done, total, strings.Join(notes, "\n"))
+		if err == nil && !running {
+			return errJobCanceled
+		}
+		if q.stopping() {
+			return errJobInterrupted
+		}
+		return nil
+	}
+
+	result, msg, err := func() (result, msg string, err error) {
+		defer func() {
+			if e := recover(); e != nil {
+				log.Error("Job %s panicked: %v", j.ID, e)
+				err = fmt.Errorf("Something went wrong.")
+			}
+		}()
+		return runner(q.app, j, progress)
+	}()
+
+	switch err {
+	case errJobInterrupted:
+		log.Info("Job %s interrupted; requeuing", j.ID)
+		q.app.db.RequeueJob(j.ID)
+		return
+	case errJobCanceled:
+		log.Info("Job %s canceled", j.ID)
+		q.app.db.FinishJob(j.ID, jobCanceled, "", "")
+	case nil:
+		log.Info("Job %s completed", j.ID)
+		q.app.db.FinishJob(j.ID, jobCompleted, result, msg)
+	default:
+		log.Error("Job %s failed: %v", j.ID, err)
+		if msg != "" {
+			msg = err.Error() + "\n" + msg
+		} else {
+			msg = err.Error()
+		}
+		q.app.db.FinishJob(j.ID, jobFailed, "", msg)
+	}
+
+	// Uploaded files are no longer needed once the job is done
+	if err := os.RemoveAll(j.inputDir(q.app)); err != nil {
+		log.Error("Unable to remove job %s input: %v", j.ID, err)
+	}
+}
+
+// runExportJob writes a full JSON export of the user's account to the job's
+// directory.
+func runExportJob(app *App, j *Job, progress progressFunc) (string, string, error) {
+	u, err := app.db.GetUserByID(j.UserID)
+	if err != nil {
+		return "", "", fmt.Errorf("Unable to find user.")
+	}
+
+	input := struct {
+		Pretty bool `json:"pretty"`
+	}{}
+	if j.Input != "" {
+		json.Unmarshal([]byte(j.Input), &input)
+	}
+
+	exportUser, err := compileFullExport(app, u, progress)
+	if err != nil {
+		return "", "", err
+	}
+
+	var data []byte
+	if input.Pretty {
+		data, err = json.MarshalIndent(exportUser, "", "\t")
+	} else {
+		data, err = json.Marshal(exportUser)
+	}
+	if err != nil {
+		log.Error("export job: marshal: %v", err)
+		return "", "", fmt.Errorf("Unable to create export.")
+	}
+
+	filename := u.Username + "-" + time.Now().Truncate(time.Second).UTC().Format("200601021504") + ".json"
+	err = ioutil.WriteFile(filepath.Join(j.dir(app), filename), data, 0600)
+	if err != nil {
+		log.Error("export job: write file: %v", err)
+		return "", "", fmt.Errorf("Unable to save export.")
+	}
+
+	return filename, "Your export is ready.", nil
+}
+
+func viewJobAPI(app *App, u *User, w http.ResponseWriter, r *http.Request) error {
+	j, err := app.db.GetJob(mux.Vars(r)["job"])
+	if err != nil {
+		return err
+	}
+	if j.UserID != u.ID {
+		return impart.HTTPError{http.StatusNotFound, "Job doesn't exist."}
+	}
+	return impart.WriteSuccess(w, j, http.StatusOK)
+}
+
+func handleCancelJob(app *App, u *User, w http.ResponseWriter, r *http.Request) error {
+	jobID := mux.Vars(r)["job"]
+	j, err := app.db.GetJob(jobID)
+	if err != nil {
+		return err
+	}
+	if j.UserID != u.ID {
+		return impart.HTTPError{http.StatusNotFound, "Job doesn't exist."}
+	}
+
+	canceled, err := app.db.CancelJob(jobID, u.ID)
+	if err != nil {
+		return impart.HTTPError{http.StatusInternalServerError, "Couldn't cancel job."}
+	}
+	if IsJSON(r) {
+		if !canceled {
+			return impart.HTTPError{http.StatusConflict, "Job already finished."}
+		}
+		return impart.WriteSuccess(w, nil, http.StatusOK)
+	}
+
+	if j.Type == jobTypeExport || j.Type == jobTypeExportStatic || j.Type == jobTypeExportEPUB {
+		if canceled {
+			_ = addSessionFlash(app, w, r, "Export canceled.", nil)
+		}
+		return impart.HTTPError{http.StatusFound, "/me/export"}
+	}
+	if canceled {
+		_ = addSessionFlash(app, w, r, "INFO: Import canceled.", nil)
+	}
+	return impart.HTTPError{http.StatusFound, "/me/import"}
+}
+
+func viewJobResult(app *App, u *User, w http.ResponseWriter, r *http.Request) error {
+	j, err := app.db.GetJob(mux.Vars(r)["job"])
+	if err != nil {
+		return err
+	}
+	if j.UserID != u.ID || !j.HasResult() {
+		return impart.HTTPError{http.StatusNotFound, "Job doesn't exist."}
+	}
+
+	f, err := os.Open(filepath.Join(j.dir(app), j.Result))
+	if err != nil {
+		log.Error("Unable to open result for job %s: %v", j.ID, err)
+		return impart.HTTPError{http.StatusGone, "This download is no longer available."}
+	}
+	defer f.Close()
+
+	w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": j.Result}))
+	http.ServeContent(w, r, j.Result, j.Updated, f)
+	return nil
+}
@@ -0,0 +1,175 @@
+/*
+ * Copyright © 2021 A Bunch Tell LLC.
+ *
+ * This file is part of WriteFreely.
+ *
+ * WriteFreely is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License, included
+ * in the LICENSE file in this source code package.
+ */
+
+package writefreely
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/writeas/web-core/l10n"
+	"github.com/writeas/web-core/log"
+	"github.com/writefreely/writefreely/config"
+	"github.com/writefreely/writefreely/i18n"
+)
+
+// localesDir is where the interface's message catalogs live, inside the
+// templates directory.
+const localesDir = "locales"
+
+// locales holds the message catalogs the interface is translated with.
+var locales *i18n.Bundle
+
+// InitLocales loads the interface's message catalogs.
+func InitLocales(cfg *config.Config) error {
+	log.Info("Loading locales...")
+	b, err := i18n.Load(localesPath(cfg))
+	if err != nil {
+		return err
+	}
+	locales = b
+	return nil
+}
+
+func localesPath(cfg *config.Config) string {
+	return filepath.Join(cfg.Server.TemplatesParentDir, templatesDir, localesDir)
+}
+
+// localeForReq returns the language to show the interface in: the one the
+// user chose, or else the best fit for their browser's languages.
+func localeForReq(app *App, r *http.Request, u *User) string {
+	if u != nil {
+		if l := app.db.GetUserAttribute(u.ID, "locale"); l != "" && locales.Supports(l) {
+			return l
+		}
+	}
+	if l := locales.Match(r.Header.Get("Accept-Language")); l != "" {
+		return l
+	}
+	return i18n.SourceLang
+}
+
+// localNStr returns the form of the given message that fits the number n,
+// with n filled in. Templates pass both int and int64 counts.
+func localNStr(term string, n interface{}, lang string) string {
+	var count int
+	switch v := n.(type) {
+	case int:
+		count = v
+	case int64:
+		count = int(v)
+	}
+	s, ok := locales.Plural(lang, term, count)
+	if !ok {
+		s = term
+	}
+	if strings.Contains(s, "%") {
+		return fmt.Sprintf(s, count)
+	}
+	return s
+}
+
+// FindMissingTranslations reports the interface messages that the given
+// languages' catalogs don't translate yet, or every catalog's when no
+// languages are given.
+func FindMissingTranslations(apper Apper, langs []string) error {
+	err := apper.LoadConfig()
+	if err != nil {
+		return err
+	}
+	cfg := apper.App().Config()
+	b, err := i18n.Load(localesPath(cfg))
+	if err != nil {
+		return err
+	}
+
+	keys, err := templateMessageKeys(cfg)
+	if err != nil {
+		return err
+	}
+
+	if len(langs) == 0 {
+		for _, l := range b.Languages() {
+			langs = append(langs, l.Tag)
+		}
+	}
+	total := 0
+	for _, lang := range langs {
+		if !b.Supports(lang) {
+			return fmt.Errorf("No catalog for %s in %s", lang, localesPath(cfg))
+		}
+		missing := []i18n.Key{}
+		for _, k := range b.Missing(lang, keys) {
+			// Messages shown on blogs may already be translated by web-core
+			if !k.Plural && l10n.Strings(lang)[k.Text] != "" {
+				continue
+			}
+			missing = append(missing, k)
+		}
+		if len(missing) == 0 {
+			fmt.Printf("%s: complete\n", lang)
+			continue
+		}
+		fmt.Printf("%s: %d missing\n", lang, len(missing))
+		for _, k := range missing {
+			if k.Plural {
+				fmt.Printf("  %q (plural)\n", k.Text)
+			} else {
+				fmt.Printf("  %q\n", k.Text)
+			}
+		}
+		total += len(missing)
+	}
+	if total > 0 {
+		return fmt.Errorf("%d missing translation(s)", total)
+	}
+	return nil
+}
+
+// templateMessageKeys returns every message looked up in the templates and
+// pages, sorted and without duplicates.
+func templateMessageKeys(cfg *config.Config) ([]i18n.Key, error) {
+	seen := map[i18n.Key]bool{}
+	keys := []i18n.Key{}
+	collect := func(path string, f os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if f.IsDir() || !strings.HasSuffix(path, ".tmpl") {
+			return nil
+		}
+		src, err := ioutil.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		for _, k := range i18n.TemplateKeys(string(src)) {
+			if !seen[k] {
+				seen[k] = true
+				keys = append(keys, k)
+			}
+		}
+		return nil
+	}
+	if err := filepath.Walk(filepath.Join(cfg.Server.TemplatesParentDir, templatesDir), collect); err != nil {
+		return nil, err
+	}
+	if err := filepath.Walk(filepath.Join(cfg.Server.PagesParentDir, pagesDir), collect); err != nil {
+		return nil, err
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		return keys[i].Text < keys[j].Text
+	})
+	return keys, nil
+}
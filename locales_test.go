@@ -0,0 +1,101 @@
+package writefreely
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"testing"
+
+	"github.com/writefreely/writefreely/i18n"
+)
+
+func TestLocalesCatalogs(t *testing.T) {
+	b, err := i18n.Load("templates/locales")
+	if err != nil {
+		t.Fatalf("Expected bundled catalogs to load, got %v", err)
+	}
+	for _, lang := range []string{"es", "de"} {
+		if !b.Supports(lang) {
+			t.Errorf("Expected a %s catalog", lang)
+		}
+	}
+}
+
+func TestLocalNStr(t *testing.T) {
+	defer func(b *i18n.Bundle) { locales = b }(locales)
+	var err error
+	locales, err = i18n.Load("templates/locales")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		term string
+		n    interface{}
+		lang string
+		want string
+	}{
+		{"%d views", 1, "en", "1 view"},
+		{"%d views", int64(12), "en", "12 views"},
+		{"%d views", 1, "es", "1 visita"},
+		{"%d views", 3, "fr", "3 views"},
+		{"%d widgets", 2, "en", "2 widgets"},
+	}
+	for _, test := range tests {
+		if s := localNStr(test.term, test.n, test.lang); s != test.want {
+			t.Errorf("localNStr(%q, %v, %s) = %q, want %q", test.term, test.n, test.lang, s, test.want)
+		}
+	}
+}
+
+func TestLocalesCoverTemplates(t *testing.T) {
+	b, err := i18n.Load("templates/locales")
+	if err != nil {
+		t.Fatal(err)
+	}
+	files := []string{
+		"templates/base.tmpl",
+		"templates/edit-meta.tmpl",
+		"templates/user/admin.tmpl",
+		"templates/user/collection.tmpl",
+		"templates/user/export.tmpl",
+		"templates/user/import.tmpl",
+		"templates/user/include/jobs.tmpl",
+		"templates/user/invite.tmpl",
+		"templates/user/invite-help.tmpl",
+		"templates/user/join.tmpl",
+		"templates/user/members.tmpl",
+		"templates/user/menu.tmpl",
+		"templates/user/reviews.tmpl",
+		"templates/user/tags.tmpl",
+	}
+	adminFiles, err := filepath.Glob("templates/user/admin/*.tmpl")
+	if err != nil {
+		t.Fatal(err)
+	}
+	termReg := regexp.MustCompile(`local(str|html|nstr) ("(?:[^"\\]|\\.)*")`)
+	for _, f := range append(files, adminFiles...) {
+		data, err := ioutil.ReadFile(f)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, m := range termReg.FindAllSubmatch(data, -1) {
+			term, err := strconv.Unquote(string(m[2]))
+			if err != nil {
+				t.Fatalf("%s: bad term %s: %v", f, m[2], err)
+			}
+			for _, lang := range []string{"es", "de"} {
+				var ok bool
+				if string(m[1]) == "nstr" {
+					_, ok = b.Plural(lang, term, 2)
+				} else {
+					_, ok = b.String(lang, term)
+				}
+				if !ok {
+					t.Errorf("%s: no %s translation for %q", f, lang, term)
+				}
+			}
+		}
+	}
+}
@@ -0,0 +1,202 @@
+/*
+ * Copyright © 2021 A Bunch Tell LLC.
+ *
+ * This file is part of WriteFreely.
+ *
+ * WriteFreely is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License, included
+ * in the LICENSE file in this source code package.
+ */
+
+package writefreely
+
+import (
+	"fmt"
+	"html"
+	"math"
+	"strings"
+	"unicode"
+
+	stripmd "github.com/writeas/go-strip-markdown/v2"
+	"github.com/writeas/web-core/activitystreams"
+	"github.com/yuin/goldmark/ast"
+	"github.com/yuin/goldmark/parser"
+	"github.com/yuin/goldmark/text"
+)
+
+const (
+	// wordsPerMinute and charsPerMinute are how fast posts are assumed to be
+	// read, in words, and in characters of languages that don't space words,
+	// like Chinese and Japanese.
+	wordsPerMinute = 230
+	charsPerMinute = 500
+
+	// minTOCHeadings is how many headings a post needs for a table of
+	// contents, and maxTOCDepth how many levels of headings are in it.
+	minTOCHeadings = 3
+	maxTOCDepth    = 3
+)
+
+// readingStats returns how many words the given post content has, and about
+// how many minutes it takes to read. Characters of languages that don't space
+// words each count as a word.
+func readingStats(content string) (words, minutes int) {
+	content = stripmd.StripOptions(stripHTMLWithoutEscaping(content), stripmd.Options{SkipImages: true})
+	var spaced, unspaced int
+	for _, f := range strings.Fields(content) {
+		isWord := false
+		for _, r := range f {
+			if unicode.In(r, unicode.Han, unicode.Hiragana, unicode.Katakana) {
+				unspaced++
+			} else if unicode.IsLetter(r) || unicode.IsDigit(r) {
+				isWord = true
+			}
+		}
+		if isWord {
+			spaced++
+		}
+	}
+	words = spaced + unspaced
+	if words == 0 {
+		return 0, 0
+	}
+	minutes = int(math.Ceil(float64(spaced)/wordsPerMinute + float64(unspaced)/charsPerMinute))
+	return words, minutes
+}
+
+// tocHeading is a heading in a post, as listed in its table of contents.
+type tocHeading struct {
+	Level int
+	ID    string
+	Text  string
+}
+
+// postHeadings returns the headings in the given post content, with the IDs
+// they're rendered with.
+func postHeadings(content []byte) []tocHeading {
+	doc := postMarkdown.Parser().Parse(text.NewReader(content), parser.WithContext(parser.NewContext()))
+	headings := []tocHeading{}
+	ast.Walk(doc, func(n ast.Node, entering bool) (ast.WalkStatus, error) {
+		if !entering {
+			return ast.WalkContinue, nil
+		}
+		h, ok := n.(*ast.Heading)
+		if !ok {
+			return ast.WalkContinue, nil
+		}
+		id, _ := h.AttributeString("id")
+		idBytes, _ := id.([]byte)
+		t := strings.TrimSpace(string(h.Text(content)))
+		if len(idBytes) > 0 && t != "" {
+			headings = append(headings, tocHeading{Level: h.Level, ID: string(idBytes), Text: t})
+		}
+		return ast.WalkSkipChildren, nil
+	})
+	return headings
+}
+
+// tableOfContents returns a nested list linking to the headings in the given
+// post content, or "" if there aren't enough headings to need one. Lower-level
+// headings are nested up to maxTOCDepth deep.
+func tableOfContents(content []byte) string {
+	headings := postHeadings(content)
+	if len(headings) < minTOCHeadings {
+		return ""
+	}
+
+	var b strings.Builder
+	// open holds the heading level of each list that's currently open, from
+	// the outermost in
+	open := []int{}
+	for _, h := range headings {
+		if len(open) == 0 {
+			b.WriteString("<ol>")
+			open = append(open, h.Level)
+		} else if h.Level > open[len(open)-1] {
+			if len(open) == maxTOCDepth {
+				continue
+			}
+			// Skipped levels only nest one deeper
+			b.WriteString("<ol>")
+			open = append(open, h.Level)
+		} else {
+			b.WriteString("</li>")
+			for len(open) > 1 && open[len(open)-2] >= h.Level {
+				b.WriteString("</ol></li>")
+				open = open[:len(open)-1]
+			}
+			// A heading between two open levels joins the deeper list
+			open[len(open)-1] = h.Level
+		}
+		b.WriteString(`<li><a href="#` + html.EscapeString(h.ID) + `">` + html.EscapeString(h.Text) + `</a>`)
+	}
+	for range open {
+		b.WriteString("</li></ol>")
+	}
+	return b.String()
+}
+
+// ShowTOC returns whether the collection's posts show a table of contents,
+// when they have enough headings.
+func (c *Collection) ShowTOC() bool {
+	return c.db.CollectionHasAttribute(c.ID, "show_toc")
+}
+
+// activityArticle is a post's ActivityPub object, with how long it is as
+// schema.org properties.
+type activityArticle struct {
+	*activitystreams.Object
+	WordCount    int    `json:"wordCount,omitempty"`
+	TimeRequired string `json:"timeRequired,omitempty"`
+}
+
+// articleActivity is an activity, like Create or Update, carrying a post's
+// activityArticle as its object.
+type articleActivity struct {
+	*activitystreams.Activity
+	Object *activityArticle `json:"object"`
+}
+
+// activityArticleContext is the JSON-LD context that defines the schema.org
+// properties of an activityArticle.
+func activityArticleContext() []interface{} {
+	return []interface{}{
+		activitystreams.Namespace,
+		map[string]string{
+			"schema":       "http://schema.org#",
+			"wordCount":    "schema:wordCount",
+			"timeRequired": "schema:timeRequired",
+		},
+	}
+}
+
+// articleObject returns the post's ActivityPub object, along with how long
+// it is.
+func (p *PublicPost) articleObject(app *App) *activityArticle {
+	o := p.ActivityObject(app)
+	if p.WordCount == 0 {
+		p.WordCount, p.ReadingTime = readingStats(p.Content)
+	}
+	a := &activityArticle{Object: o, WordCount: p.WordCount}
+	if p.ReadingTime > 0 {
+		a.TimeRequired = fmt.Sprintf("PT%dM", p.ReadingTime)
+	}
+	return a
+}
+
+// activityArticle returns the post's ActivityPub object, for serving on its
+// own.
+func (p *PublicPost) activityArticle(app *App) *activityArticle {
+	a := p.articleObject(app)
+	a.Context = activityArticleContext()
+	return a
+}
+
+// newArticleActivity returns the given activity with the article as its
+// object, and a context that defines the article's properties.
+func newArticleActivity(act *activitystreams.Activity, o *activityArticle) *articleActivity {
+	if act.Context != nil {
+		act.Context = activityArticleContext()
+	}
+	return &articleActivity{Activity: act, Object: o}
+}
@@ -0,0 +1,58 @@
+/*
+ * Copyright © 2021 A Bunch Tell LLC.
+ *
+ * This file is part of WriteFreely.
+ *
+ * WriteFreely is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License, included
+ * in the LICENSE file in this source code package.
+ */
+
+package writefreely
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestReadingStats(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		words   int
+		minutes int
+	}{
+		{"empty", "", 0, 0},
+		{"short", "# Hello\n\nA **short** post, with - punctuation.", 6, 1},
+		{"html", "<p>Two <em>words</em></p>", 2, 1},
+		{"long", strings.Repeat("word ", 461), 461, 3},
+		{"unspaced", "日本語の文章です。", 8, 1},
+		{"long unspaced", strings.Repeat("文", 1001), 1001, 3},
+	}
+	for _, test := range tests {
+		words, minutes := readingStats(test.content)
+		if words != test.words || minutes != test.minutes {
+			t.Errorf("%s: got %d words, %d min; want %d words, %d min", test.name, words, minutes, test.words, test.minutes)
+		}
+	}
+}
+
+func TestTableOfContents(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		want    string
+	}{
+		{"too few", "## One\n\n## Two", ""},
+		{"flat", "## One\n\n## Two\n\n## Three", `<ol><li><a href="#one">One</a></li><li><a href="#two">Two</a></li><li><a href="#three">Three</a></li></ol>`},
+		{"nested", "## One\n\n### One A\n\n#### One A i\n\n##### Too deep\n\n## Two & more", `<ol><li><a href="#one">One</a><ol><li><a href="#one-a">One A</a><ol><li><a href="#one-a-i">One A i</a></li></ol></li></ol></li><li><a href="#two--more">Two &amp; more</a></li></ol>`},
+		{"skipped level", "# Title\n\n### Deep\n\n# Next", `<ol><li><a href="#title">Title</a><ol><li><a href="#deep">Deep</a></li></ol></li><li><a href="#next">Next</a></li></ol>`},
+		{"skipped level siblings", "## A\n\n#### B\n\n#### C\n\n#### D", `<ol><li><a href="#a">A</a><ol><li><a href="#b">B</a></li><li><a href="#c">C</a></li><li><a href="#d">D</a></li></ol></li></ol>`},
+		{"between levels", "## A\n\n#### B\n\n### C\n\n## D", `<ol><li><a href="#a">A</a><ol><li><a href="#b">B</a></li><li><a href="#c">C</a></li></ol></li><li><a href="#d">D</a></li></ol>`},
+	}
+	for _, test := range tests {
+		if got := tableOfContents([]byte(test.content)); got != test.want {
+			t.Errorf("%s: got\n%s\nwant\n%s", test.name, got, test.want)
+		}
+	}
+}
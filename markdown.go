@@ -0,0 +1,670 @@
+/*
+ * Copyright © 2021 A Bunch Tell LLC.
+ *
+ * This file is part of WriteFreely.
+ *
+ * WriteFreely is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License, included
+ * in the LICENSE file in this source code package.
+ */
+
+package writefreely
+
+import (
+	"bytes"
+	"regexp"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/alecthomas/chroma"
+	"github.com/alecthomas/chroma/lexers"
+	"github.com/alecthomas/chroma/styles"
+	"github.com/writeas/web-core/log"
+	"github.com/yuin/goldmark"
+	"github.com/yuin/goldmark/ast"
+	"github.com/yuin/goldmark/extension"
+	"github.com/yuin/goldmark/parser"
+	"github.com/yuin/goldmark/renderer"
+	"github.com/yuin/goldmark/renderer/html"
+	"github.com/yuin/goldmark/text"
+	"github.com/yuin/goldmark/util"
+)
+
+var (
+	// mdTagPrefixKey and mdHandlePrefixKey hold the URLs that hashtags and
+	// mentions link to, followed by the tag or handle. Hashtags and mentions
+	// are only linked when they're set.
+	mdTagPrefixKey    = parser.NewContextKey()
+	mdHandlePrefixKey = parser.NewContextKey()
+	// mdMathKey is set when LaTeX math should be rendered, which is only on
+	// collections with math turned on, since "$" is common in other writing.
+	mdMathKey = parser.NewContextKey()
+	// mdEmbedsKey holds the linkEmbedder that finds embeds for links on lines
+	// of their own, which are only embedded when it's set.
+	mdEmbedsKey = parser.NewContextKey()
+
+	mdMentionReg = regexp.MustCompile(`^@([A-Za-z0-9._%+-]+@[A-Za-z0-9.-]+\.[A-Za-z]+)\b`)
+
+	// mdTypographer makes quotes curly and dashes long, as posts always have.
+	mdTypographer = extension.NewTypographer(extension.WithTypographicSubstitutions(extension.TypographicSubstitutions{
+		extension.EnDash: []byte("&mdash;"),
+	}))
+
+	// postMarkdown renders post content as CommonMark, with GitHub Flavored
+	// Markdown, footnotes, definition lists, heading IDs, linked hashtags and
+	// mentions, math, highlighted code, and embedded links.
+	postMarkdown = goldmark.New(
+		goldmark.WithExtensions(
+			extension.GFM,
+			extension.Footnote,
+			extension.DefinitionList,
+			mdTypographer,
+			socialMarkdown{},
+			mathMarkdown{},
+			highlightMarkdown{},
+			embedMarkdown{},
+		),
+		goldmark.WithParserOptions(parser.WithAutoHeadingID()),
+		goldmark.WithRendererOptions(html.WithUnsafe()),
+	)
+
+	// titleMarkdown renders post titles, where only inline formatting is
+	// wanted.
+	titleMarkdown = goldmark.New(
+		goldmark.WithExtensions(
+			extension.Strikethrough,
+			mdTypographer,
+		),
+	)
+)
+
+// renderMarkdown converts the given Markdown into HTML, linking hashtags to
+// tagPrefix and mentions to handlePrefix, unless they're empty, rendering
+// LaTeX math if math is true, and embedding links with embeds, unless it's
+// nil.
+func renderMarkdown(md goldmark.Markdown, data []byte, tagPrefix, handlePrefix string, math bool, embeds linkEmbedder) []byte {
+	ctx := parser.NewContext()
+	if tagPrefix != "" {
+		ctx.Set(mdTagPrefixKey, tagPrefix)
+	}
+	if handlePrefix != "" {
+		ctx.Set(mdHandlePrefixKey, handlePrefix)
+	}
+	if math {
+		ctx.Set(mdMathKey, true)
+	}
+	if embeds != nil {
+		ctx.Set(mdEmbedsKey, embeds)
+	}
+
+	var buf bytes.Buffer
+	err := md.Convert(data, &buf, parser.WithContext(ctx))
+	if err != nil {
+		log.Error("Unable to render Markdown: %v", err)
+	}
+	return buf.Bytes()
+}
+
+// hashtag is a #hashtag in a post, linked to the posts that share it.
+type hashtag struct {
+	ast.BaseInline
+	Tag []byte
+	URL []byte
+}
+
+var kindHashtag = ast.NewNodeKind("Hashtag")
+
+func (n *hashtag) Kind() ast.NodeKind {
+	return kindHashtag
+}
+
+func (n *hashtag) Dump(source []byte, level int) {
+	ast.DumpHelper(n, source, level, map[string]string{"Tag": string(n.Tag)}, nil)
+}
+
+// mention is a mention of a fediverse user, like @user@example.com, linked
+// to their profile.
+type mention struct {
+	ast.BaseInline
+	Handle []byte
+	URL    []byte
+}
+
+var kindMention = ast.NewNodeKind("Mention")
+
+func (n *mention) Kind() ast.NodeKind {
+	return kindMention
+}
+
+func (n *mention) Dump(source []byte, level int) {
+	ast.DumpHelper(n, source, level, map[string]string{"Handle": string(n.Handle)}, nil)
+}
+
+// canPrecedeSocial returns whether a hashtag or mention can come right after
+// the given character, so e.g. URL fragments and email addresses aren't
+// mistaken for them.
+func canPrecedeSocial(r rune) bool {
+	if unicode.IsSpace(r) {
+		return true
+	}
+	switch r {
+	case '#', '&', '/', '@':
+		return false
+	}
+	return unicode.IsPunct(r)
+}
+
+type hashtagParser struct{}
+
+func (hashtagParser) Trigger() []byte {
+	return []byte{'#'}
+}
+
+func (hashtagParser) Parse(parent ast.Node, block text.Reader, pc parser.Context) ast.Node {
+	prefix, ok := pc.Get(mdTagPrefixKey).(string)
+	if !ok || pc.IsInLinkLabel() || !canPrecedeSocial(block.PrecendingCharacter()) {
+		return nil
+	}
+	line, _ := block.PeekLine()
+
+	// Tags are made of letters, numbers, and underscores, like those found by
+	// postTags, and aren't only numbers
+	end := 1
+	hasNonDigit := false
+	for end < len(line) {
+		r, size := utf8.DecodeRune(line[end:])
+		if !unicode.IsLetter(r) && !unicode.IsDigit(r) && !unicode.IsMark(r) && r != '_' {
+			break
+		}
+		if !unicode.IsDigit(r) {
+			hasNonDigit = true
+		}
+		end += size
+	}
+	if !hasNonDigit {
+		return nil
+	}
+
+	tag := append([]byte{}, line[1:end]...)
+	block.Advance(end)
+	return &hashtag{
+		Tag: tag,
+		URL: append([]byte(prefix), tag...),
+	}
+}
+
+type mentionParser struct{}
+
+func (mentionParser) Trigger() []byte {
+	return []byte{'@'}
+}
+
+func (mentionParser) Parse(parent ast.Node, block text.Reader, pc parser.Context) ast.Node {
+	prefix, ok := pc.Get(mdHandlePrefixKey).(string)
+	if !ok || pc.IsInLinkLabel() || !canPrecedeSocial(block.PrecendingCharacter()) {
+		return nil
+	}
+	line, _ := block.PeekLine()
+	m := mdMentionReg.FindSubmatch(line)
+	if m == nil {
+		return nil
+	}
+
+	handle := append([]byte{}, m[1]...)
+	block.Advance(len(m[0]))
+	return &mention{
+		Handle: handle,
+		URL:    append([]byte(prefix), handle...),
+	}
+}
+
+type socialRenderer struct{}
+
+func (r socialRenderer) RegisterFuncs(reg renderer.NodeRendererFuncRegisterer) {
+	reg.Register(kindHashtag, r.renderHashtag)
+	reg.Register(kindMention, r.renderMention)
+}
+
+func (r socialRenderer) renderHashtag(w util.BufWriter, source []byte, node ast.Node, entering bool) (ast.WalkStatus, error) {
+	if !entering {
+		return ast.WalkContinue, nil
+	}
+	n := node.(*hashtag)
+	w.WriteString(`<a href="`)
+	w.Write(util.EscapeHTML(n.URL))
+	w.WriteString(`" class="hashtag"><span>#</span><span class="p-category">`)
+	w.Write(util.EscapeHTML(n.Tag))
+	w.WriteString(`</span></a>`)
+	return ast.WalkContinue, nil
+}
+
+func (r socialRenderer) renderMention(w util.BufWriter, source []byte, node ast.Node, entering bool) (ast.WalkStatus, error) {
+	if !entering {
+		return ast.WalkContinue, nil
+	}
+	n := node.(*mention)
+	w.WriteString(`<a href="`)
+	w.Write(util.EscapeHTML(n.URL))
+	w.WriteString(`" class="u-url mention">@<span>`)
+	w.Write(util.EscapeHTML(n.Handle))
+	w.WriteString(`</span></a>`)
+	return ast.WalkContinue, nil
+}
+
+// socialMarkdown is a Markdown extension that links hashtags and mentions.
+type socialMarkdown struct{}
+
+func (socialMarkdown) Extend(m goldmark.Markdown) {
+	m.Parser().AddOptions(parser.WithInlineParsers(
+		util.Prioritized(hashtagParser{}, 500),
+		util.Prioritized(mentionParser{}, 500),
+	))
+	m.Renderer().AddOptions(renderer.WithNodeRenderers(
+		util.Prioritized(socialRenderer{}, 500),
+	))
+}
+
+// mathInline is LaTeX math within a paragraph, between $ or \( and \), or $$
+// or \[ and \] for display math.
+type mathInline struct {
+	ast.BaseInline
+	TeX     []byte
+	Display bool
+}
+
+var kindMathInline = ast.NewNodeKind("MathInline")
+
+func (n *mathInline) Kind() ast.NodeKind {
+	return kindMathInline
+}
+
+func (n *mathInline) Dump(source []byte, level int) {
+	ast.DumpHelper(n, source, level, map[string]string{"TeX": string(n.TeX)}, nil)
+}
+
+// mathBlock is display math on lines of its own, between $$ or \[ and \].
+type mathBlock struct {
+	ast.BaseBlock
+	closer []byte
+	closed bool
+}
+
+var kindMathBlock = ast.NewNodeKind("MathBlock")
+
+func (n *mathBlock) Kind() ast.NodeKind {
+	return kindMathBlock
+}
+
+func (n *mathBlock) IsRaw() bool {
+	return true
+}
+
+func (n *mathBlock) Dump(source []byte, level int) {
+	ast.DumpHelper(n, source, level, nil, nil)
+}
+
+// mathDelimiters holds the delimiters math can be written between, and
+// whether they're for display math.
+var mathDelimiters = []struct {
+	open, close string
+	display     bool
+}{
+	{"$$", "$$", true},
+	{"$", "$", false},
+	{`\[`, `\]`, true},
+	{`\(`, `\)`, false},
+}
+
+type mathInlineParser struct{}
+
+func (mathInlineParser) Trigger() []byte {
+	return []byte{'$', '\\'}
+}
+
+func (mathInlineParser) Parse(parent ast.Node, block text.Reader, pc parser.Context) ast.Node {
+	if pc.Get(mdMathKey) == nil {
+		return nil
+	}
+	line, _ := block.PeekLine()
+	for _, d := range mathDelimiters {
+		if !bytes.HasPrefix(line, []byte(d.open)) {
+			continue
+		}
+		rest := line[len(d.open):]
+		// Like in Pandoc, $ must be right before math, and right after it,
+		// without a digit following, so prices like $5 aren't mistaken for it
+		if d.open == "$" && (len(rest) == 0 || util.IsSpace(rest[0])) {
+			return nil
+		}
+		for i := 1; i < len(rest); i++ {
+			if bytes.HasPrefix(rest[i:], []byte(d.close)) {
+				if d.open != "$" || (!util.IsSpace(rest[i-1]) && (i+1 == len(rest) || !util.IsNumeric(rest[i+1]))) {
+					block.Advance(len(d.open) + i + len(d.close))
+					return &mathInline{
+						TeX:     append([]byte{}, rest[:i]...),
+						Display: d.display,
+					}
+				}
+			}
+			if rest[i] == '\\' {
+				// Skip escaped characters, like \$
+				i++
+			}
+		}
+		return nil
+	}
+	return nil
+}
+
+type mathBlockParser struct{}
+
+func (mathBlockParser) Trigger() []byte {
+	return []byte{'$', '\\'}
+}
+
+func (mathBlockParser) Open(parent ast.Node, reader text.Reader, pc parser.Context) (ast.Node, parser.State) {
+	if pc.Get(mdMathKey) == nil {
+		return nil, parser.NoChildren
+	}
+	line, segment := reader.PeekLine()
+	pos := pc.BlockOffset()
+	if pos < 0 {
+		return nil, parser.NoChildren
+	}
+	var closer []byte
+	switch {
+	case bytes.HasPrefix(line[pos:], []byte("$$")):
+		closer = []byte("$$")
+	case bytes.HasPrefix(line[pos:], []byte(`\[`)):
+		closer = []byte(`\]`)
+	default:
+		return nil, parser.NoChildren
+	}
+	start := pos + len(closer)
+	node := &mathBlock{closer: closer}
+	rest := util.TrimRightSpace(line[start:])
+	if i := bytes.Index(rest, closer); i > -1 {
+		if i != len(rest)-len(closer) {
+			// There's text after the math, so it's left for mathInlineParser
+			return nil, parser.NoChildren
+		}
+		node.closed = true
+		node.Lines().Append(text.NewSegment(segment.Start+start, segment.Start+start+i))
+	} else if len(rest) > 0 {
+		// Math spanning lines starts on a line of its own, so an unclosed $$
+		// in a paragraph doesn't swallow the rest of the post
+		return nil, parser.NoChildren
+	}
+	return node, parser.NoChildren
+}
+
+func (mathBlockParser) Continue(node ast.Node, reader text.Reader, pc parser.Context) parser.State {
+	n := node.(*mathBlock)
+	if n.closed {
+		return parser.Close
+	}
+	line, segment := reader.PeekLine()
+	newline := 0
+	if line[len(line)-1] == '\n' {
+		newline = 1
+	}
+	rest := util.TrimRightSpace(line)
+	if bytes.HasSuffix(rest, n.closer) {
+		n.Lines().Append(text.NewSegment(segment.Start, segment.Start+len(rest)-len(n.closer)))
+		reader.Advance(segment.Len() - newline)
+		return parser.Close
+	}
+	n.Lines().Append(segment)
+	reader.Advance(segment.Len() - newline)
+	return parser.Continue | parser.NoChildren
+}
+
+func (mathBlockParser) Close(node ast.Node, reader text.Reader, pc parser.Context) {}
+
+func (mathBlockParser) CanInterruptParagraph() bool {
+	return true
+}
+
+func (mathBlockParser) CanAcceptIndentedLine() bool {
+	return false
+}
+
+type mathRenderer struct{}
+
+func (r mathRenderer) RegisterFuncs(reg renderer.NodeRendererFuncRegisterer) {
+	reg.Register(kindMathInline, r.renderMathInline)
+	reg.Register(kindMathBlock, r.renderMathBlock)
+}
+
+func (r mathRenderer) renderMathInline(w util.BufWriter, source []byte, node ast.Node, entering bool) (ast.WalkStatus, error) {
+	if entering {
+		n := node.(*mathInline)
+		w.WriteString(latexToMathML(string(n.TeX), n.Display))
+	}
+	return ast.WalkSkipChildren, nil
+}
+
+func (r mathRenderer) renderMathBlock(w util.BufWriter, source []byte, node ast.Node, entering bool) (ast.WalkStatus, error) {
+	if entering {
+		var tex bytes.Buffer
+		lines := node.Lines()
+		for i := 0; i < lines.Len(); i++ {
+			seg := lines.At(i)
+			tex.Write(seg.Value(source))
+		}
+		w.WriteString(latexToMathML(tex.String(), true))
+		w.WriteByte('\n')
+	}
+	return ast.WalkSkipChildren, nil
+}
+
+// mathMarkdown is a Markdown extension that renders LaTeX math as MathML.
+type mathMarkdown struct{}
+
+func (mathMarkdown) Extend(m goldmark.Markdown) {
+	m.Parser().AddOptions(
+		parser.WithBlockParsers(util.Prioritized(mathBlockParser{}, 650)),
+		parser.WithInlineParsers(util.Prioritized(mathInlineParser{}, 150)),
+	)
+	m.Renderer().AddOptions(renderer.WithNodeRenderers(
+		util.Prioritized(mathRenderer{}, 500),
+	))
+}
+
+// highlightRenderer renders fenced code with syntax highlighting, using the
+// language it's marked with, or one guessed from the code when it isn't.
+// Highlighted code is marked up with classes, styled by the collection's code
+// theme.
+type highlightRenderer struct{}
+
+func (r highlightRenderer) RegisterFuncs(reg renderer.NodeRendererFuncRegisterer) {
+	reg.Register(ast.KindFencedCodeBlock, r.renderFencedCodeBlock)
+}
+
+func (r highlightRenderer) renderFencedCodeBlock(w util.BufWriter, source []byte, node ast.Node, entering bool) (ast.WalkStatus, error) {
+	if !entering {
+		return ast.WalkContinue, nil
+	}
+	n := node.(*ast.FencedCodeBlock)
+	var code bytes.Buffer
+	lines := n.Lines()
+	for i := 0; i < lines.Len(); i++ {
+		seg := lines.At(i)
+		code.Write(seg.Value(source))
+	}
+	lang := string(n.Language(source))
+
+	var lexer chroma.Lexer
+	if lang != "" {
+		lexer = lexers.Get(lang)
+	} else if lexer = lexers.Analyse(code.String()); lexer != nil {
+		lang = strings.ToLower(lexer.Config().Name)
+	}
+	var tokens []chroma.Token
+	if lexer != nil {
+		it, err := chroma.Coalesce(lexer).Tokenise(nil, code.String())
+		if err != nil {
+			log.Error("Unable to highlight %s code: %v", lang, err)
+		} else {
+			tokens = it.Tokens()
+		}
+	}
+
+	if tokens == nil {
+		w.WriteString("<pre><code")
+	} else {
+		w.WriteString(`<pre class="chroma"><code`)
+	}
+	if lang != "" {
+		w.WriteString(` class="language-`)
+		w.Write(util.EscapeHTML([]byte(lang)))
+		w.WriteString(`"`)
+	}
+	w.WriteString(">")
+	if tokens == nil {
+		w.Write(util.EscapeHTML(code.Bytes()))
+	}
+	for _, t := range tokens {
+		if class := highlightClass(t.Type); class != "" {
+			w.WriteString(`<span class="` + class + `">`)
+			w.Write(util.EscapeHTML([]byte(t.Value)))
+			w.WriteString("</span>")
+		} else {
+			w.Write(util.EscapeHTML([]byte(t.Value)))
+		}
+	}
+	w.WriteString("</code></pre>\n")
+	return ast.WalkSkipChildren, nil
+}
+
+// highlightClass returns the class for the given type of token, which is the
+// class of its nearest parent type that has one, like chroma uses in its CSS.
+func highlightClass(t chroma.TokenType) string {
+	for ; t != 0; t = t.Parent() {
+		if class, ok := chroma.StandardTypes[t]; ok {
+			return class
+		}
+	}
+	return chroma.StandardTypes[t]
+}
+
+// highlightMarkdown is a Markdown extension that highlights fenced code.
+type highlightMarkdown struct{}
+
+func (highlightMarkdown) Extend(m goldmark.Markdown) {
+	m.Renderer().AddOptions(renderer.WithNodeRenderers(
+		util.Prioritized(highlightRenderer{}, 500),
+	))
+}
+
+// linkEmbedder returns the HTML to show in place of a link to the given URL,
+// or "" to leave the link as it is.
+type linkEmbedder func(u string) string
+
+// embed is a link on a line of its own, shown as an embed or a preview card.
+type embed struct {
+	ast.BaseBlock
+	HTML string
+}
+
+var kindEmbed = ast.NewNodeKind("Embed")
+
+func (n *embed) Kind() ast.NodeKind {
+	return kindEmbed
+}
+
+func (n *embed) Dump(source []byte, level int) {
+	ast.DumpHelper(n, source, level, map[string]string{"HTML": n.HTML}, nil)
+}
+
+// embedTransformer replaces paragraphs that are nothing but a link to a web
+// page with the page's embed, when there is one.
+type embedTransformer struct{}
+
+func (embedTransformer) Transform(doc *ast.Document, reader text.Reader, pc parser.Context) {
+	embeds, ok := pc.Get(mdEmbedsKey).(linkEmbedder)
+	if !ok {
+		return
+	}
+	source := reader.Source()
+	for n := doc.FirstChild(); n != nil; {
+		next := n.NextSibling()
+		if u := standaloneLink(n, source); u != "" {
+			if h := embeds(u); h != "" {
+				doc.ReplaceChild(doc, n, &embed{HTML: h})
+			}
+		}
+		n = next
+	}
+}
+
+// standaloneLink returns the URL of the given paragraph's link, if the
+// paragraph is a bare http or https URL and nothing else.
+func standaloneLink(n ast.Node, source []byte) string {
+	if n.Kind() != ast.KindParagraph || n.ChildCount() != 1 {
+		return ""
+	}
+	link, ok := n.FirstChild().(*ast.AutoLink)
+	if !ok || link.AutoLinkType != ast.AutoLinkURL {
+		return ""
+	}
+	u := string(link.URL(source))
+	if !strings.HasPrefix(u, "https://") && !strings.HasPrefix(u, "http://") {
+		return ""
+	}
+	return u
+}
+
+type embedRenderer struct{}
+
+func (r embedRenderer) RegisterFuncs(reg renderer.NodeRendererFuncRegisterer) {
+	reg.Register(kindEmbed, r.renderEmbed)
+}
+
+func (r embedRenderer) renderEmbed(w util.BufWriter, source []byte, node ast.Node, entering bool) (ast.WalkStatus, error) {
+	if entering {
+		w.WriteString(node.(*embed).HTML)
+		w.WriteByte('\n')
+	}
+	return ast.WalkSkipChildren, nil
+}
+
+// embedMarkdown is a Markdown extension that shows links on lines of their
+// own as embeds.
+type embedMarkdown struct{}
+
+func (embedMarkdown) Extend(m goldmark.Markdown) {
+	m.Parser().AddOptions(parser.WithASTTransformers(
+		util.Prioritized(embedTransformer{}, 500),
+	))
+	m.Renderer().AddOptions(renderer.WithNodeRenderers(
+		util.Prioritized(embedRenderer{}, 500),
+	))
+}
+
+// defaultCodeTheme is the theme highlighted code is shown in, unless a
+// collection picks another.
+const defaultCodeTheme = "github"
+
+// isCodeTheme returns whether highlighted code can be shown in the given
+// theme.
+func isCodeTheme(name string) bool {
+	_, ok := styles.Registry[name]
+	return ok
+}
+
+// codeThemes returns the names of all themes highlighted code can be shown in.
+func codeThemes() []string {
+	return styles.Names()
+}
+
+// CodeTheme returns the name of the theme that highlighted code in the
+// collection's posts is shown in.
+func (c *Collection) CodeTheme() string {
+	t := c.db.GetCollectionAttribute(c.ID, "code_theme")
+	if !isCodeTheme(t) {
+		return defaultCodeTheme
+	}
+	return t
+}
@@ -0,0 +1,787 @@
+/*
+ * Copyright © 2021 A Bunch Tell LLC.
+ *
+ * This file is part of WriteFreely.
+ *
+ * WriteFreely is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License, included
+ * in the LICENSE file in this source code package.
+ */
+
+package writefreely
+
+import (
+	"html"
+	"strings"
+	"unicode"
+)
+
+// latexToMathML converts a LaTeX math expression into MathML, so math shows
+// in browsers and feed readers without any JavaScript. Display math is
+// rendered as a block. The original LaTeX is kept as an annotation, and any
+// commands that aren't supported are shown as errors.
+func latexToMathML(tex string, display bool) string {
+	p := &mathParser{toks: tokenizeTeX(tex), display: display}
+	var items []string
+	for {
+		items = append(items, p.parseRow()...)
+		if p.peek() == nil {
+			break
+		}
+		// Skip anything left unbalanced, like a stray "}"
+		p.pos++
+	}
+
+	b := strings.Builder{}
+	b.WriteString(`<math xmlns="http://www.w3.org/1998/Math/MathML"`)
+	if display {
+		b.WriteString(` display="block"`)
+	}
+	b.WriteString(`><semantics><mrow>`)
+	b.WriteString(strings.Join(items, ""))
+	b.WriteString(`</mrow><annotation encoding="application/x-tex">`)
+	b.WriteString(html.EscapeString(strings.TrimSpace(tex)))
+	b.WriteString(`</annotation></semantics></math>`)
+	return b.String()
+}
+
+type texTokenKind int
+
+const (
+	texSpace texTokenKind = iota
+	texLetter
+	texNumber
+	texSymbol
+	texCommand
+)
+
+type texToken struct {
+	kind texTokenKind
+	val  string
+}
+
+// tokenizeTeX splits LaTeX into commands, like \frac or \{, single letters
+// and symbols, numbers, and runs of whitespace.
+func tokenizeTeX(s string) []texToken {
+	toks := []texToken{}
+	rs := []rune(s)
+	for i := 0; i < len(rs); {
+		r := rs[i]
+		start := i
+		i++
+		switch {
+		case unicode.IsSpace(r):
+			for i < len(rs) && unicode.IsSpace(rs[i]) {
+				i++
+			}
+			toks = append(toks, texToken{texSpace, " "})
+		case r == '\\':
+			if i < len(rs) && isTeXLetter(rs[i]) {
+				for i < len(rs) && isTeXLetter(rs[i]) {
+					i++
+				}
+			} else if i < len(rs) {
+				i++
+			}
+			toks = append(toks, texToken{texCommand, string(rs[start:i])})
+		case unicode.IsDigit(r) || (r == '.' && i < len(rs) && unicode.IsDigit(rs[i])):
+			for i < len(rs) && (unicode.IsDigit(rs[i]) || (rs[i] == '.' && i+1 < len(rs) && unicode.IsDigit(rs[i+1]))) {
+				i++
+			}
+			toks = append(toks, texToken{texNumber, string(rs[start:i])})
+		case unicode.IsLetter(r):
+			toks = append(toks, texToken{texLetter, string(r)})
+		default:
+			toks = append(toks, texToken{texSymbol, string(r)})
+		}
+	}
+	return toks
+}
+
+func isTeXLetter(r rune) bool {
+	return (r >= 'a' && r <= 'z') || (r >= 'A' && r <= 'Z')
+}
+
+// isEnd returns whether the token ends the group or table cell it's in.
+func (t *texToken) isEnd() bool {
+	switch t.val {
+	case "}", "&", `\\`, `\right`, `\end`:
+		return true
+	}
+	return false
+}
+
+type mathParser struct {
+	toks    []texToken
+	pos     int
+	display bool
+
+	// variant is the style of letters and numbers set by commands like
+	// \mathbf, applied to everything within them.
+	variant string
+}
+
+// peek returns the next token that isn't whitespace, or nil at the end.
+func (p *mathParser) peek() *texToken {
+	for p.pos < len(p.toks) && p.toks[p.pos].kind == texSpace {
+		p.pos++
+	}
+	if p.pos >= len(p.toks) {
+		return nil
+	}
+	return &p.toks[p.pos]
+}
+
+func (p *mathParser) next() *texToken {
+	t := p.peek()
+	if t != nil {
+		p.pos++
+	}
+	return t
+}
+
+// skip consumes the next token if it's the given one.
+func (p *mathParser) skip(val string) bool {
+	if t := p.peek(); t != nil && t.val == val {
+		p.pos++
+		return true
+	}
+	return false
+}
+
+// parseRow parses items until the end of the group or table cell they're in.
+func (p *mathParser) parseRow() []string {
+	items := []string{}
+	for {
+		t := p.peek()
+		if t == nil || t.isEnd() {
+			return items
+		}
+		if ml := p.parseScripted(); ml != "" {
+			items = append(items, ml)
+		}
+	}
+}
+
+// parseUntil parses items until the given symbol, like the "]" that closes
+// an optional argument, and consumes it.
+func (p *mathParser) parseUntil(val string) []string {
+	items := []string{}
+	for {
+		t := p.peek()
+		if t == nil || t.isEnd() {
+			return items
+		}
+		if t.val == val {
+			p.pos++
+			return items
+		}
+		if ml := p.parseScripted(); ml != "" {
+			items = append(items, ml)
+		}
+	}
+}
+
+// mathRow groups the given items, unless there's only one.
+func mathRow(items []string) string {
+	if len(items) == 1 {
+		return items[0]
+	}
+	return "<mrow>" + strings.Join(items, "") + "</mrow>"
+}
+
+const (
+	limitsAuto = iota
+	limitsAlways
+	limitsNever
+)
+
+// parseScripted parses an item along with any subscript, superscript, or
+// primes that follow it.
+func (p *mathParser) parseScripted() string {
+	base, limits := p.parseAtom()
+	if base == "" {
+		return ""
+	}
+	mode := limitsAuto
+	var sub, sup string
+	primes := 0
+	hasSub, hasSup := false, false
+loop:
+	for {
+		t := p.peek()
+		if t == nil {
+			break
+		}
+		switch t.val {
+		case "_":
+			if hasSub {
+				break loop
+			}
+			p.pos++
+			sub, hasSub = p.parseScriptArg(), true
+		case "^":
+			if hasSup {
+				break loop
+			}
+			p.pos++
+			sup, hasSup = p.parseScriptArg(), true
+		case "'":
+			if hasSup {
+				break loop
+			}
+			p.pos++
+			primes++
+		case `\limits`:
+			p.pos++
+			mode = limitsAlways
+		case `\nolimits`:
+			p.pos++
+			mode = limitsNever
+		default:
+			break loop
+		}
+	}
+	if primes > 0 {
+		if hasSup {
+			sup = "<mrow>" + mathOp(strings.Repeat("′", primes)) + sup + "</mrow>"
+		} else {
+			sup = mathOp(strings.Repeat("′", primes))
+		}
+		hasSup = true
+	}
+
+	under := limits && (mode == limitsAlways || (mode == limitsAuto && p.display))
+	switch {
+	case hasSub && hasSup && under:
+		return "<munderover>" + base + sub + sup + "</munderover>"
+	case hasSub && hasSup:
+		return "<msubsup>" + base + sub + sup + "</msubsup>"
+	case hasSub && under:
+		return "<munder>" + base + sub + "</munder>"
+	case hasSub:
+		return "<msub>" + base + sub + "</msub>"
+	case hasSup && under:
+		return "<mover>" + base + sup + "</mover>"
+	case hasSup:
+		return "<msup>" + base + sup + "</msup>"
+	}
+	return base
+}
+
+// parseScriptArg parses a subscript or superscript, which like in TeX is a
+// group or a single item, so x^23 only raises the 2.
+func (p *mathParser) parseScriptArg() string {
+	if t := p.peek(); t != nil && t.kind == texNumber && len(t.val) > 1 {
+		n := t.val[:1]
+		t.val = t.val[1:]
+		return p.mn(n)
+	}
+	return p.parseArg()
+}
+
+// parseArg parses a command's argument, which is a group or a single item.
+func (p *mathParser) parseArg() string {
+	if p.skip("{") {
+		items := p.parseRow()
+		p.skip("}")
+		return mathRow(items)
+	}
+	ml, _ := p.parseAtom()
+	if ml == "" {
+		return "<mrow></mrow>"
+	}
+	return ml
+}
+
+// rawArg returns a command's argument as plain text, for commands like \text.
+func (p *mathParser) rawArg() string {
+	t := p.peek()
+	if t == nil || t.isEnd() {
+		return ""
+	}
+	p.pos++
+	if t.val != "{" {
+		return t.val
+	}
+	b := strings.Builder{}
+	depth := 0
+	for ; p.pos < len(p.toks); p.pos++ {
+		t := p.toks[p.pos]
+		switch {
+		case t.val == "{" && t.kind == texSymbol:
+			depth++
+		case t.val == "}" && t.kind == texSymbol:
+			if depth == 0 {
+				p.pos++
+				return b.String()
+			}
+			depth--
+		case t.kind == texCommand && len(t.val) == 2 && !isTeXLetter(rune(t.val[1])):
+			// Escaped characters, like \& and \{
+			b.WriteString(t.val[1:])
+			continue
+		}
+		b.WriteString(t.val)
+	}
+	return b.String()
+}
+
+func (p *mathParser) mi(s string) string {
+	switch p.variant {
+	case "":
+		return "<mi>" + html.EscapeString(s) + "</mi>"
+	case "normal":
+		if len([]rune(s)) == 1 {
+			return `<mi mathvariant="normal">` + html.EscapeString(s) + "</mi>"
+		}
+		return "<mi>" + html.EscapeString(s) + "</mi>"
+	}
+	return "<mi>" + html.EscapeString(mathAlphanumeric(p.variant, s)) + "</mi>"
+}
+
+func (p *mathParser) mn(s string) string {
+	if p.variant != "" && p.variant != "normal" {
+		s = mathAlphanumeric(p.variant, s)
+	}
+	return "<mn>" + html.EscapeString(s) + "</mn>"
+}
+
+func mathOp(s string) string {
+	return "<mo>" + html.EscapeString(s) + "</mo>"
+}
+
+func mathSpace(width string) string {
+	return `<mspace width="` + width + `"></mspace>`
+}
+
+func mathError(s string) string {
+	return "<merror><mtext>" + html.EscapeString(s) + "</mtext></merror>"
+}
+
+// parseAtom parses a single item, returning its MathML and whether scripts
+// on it go above and below it in display math, as on \sum.
+func (p *mathParser) parseAtom() (string, bool) {
+	t := p.peek()
+	if t == nil || t.isEnd() {
+		return "", false
+	}
+	if t.kind == texSymbol && (t.val == "^" || t.val == "_") {
+		// Scripts without anything before them
+		return "<mrow></mrow>", false
+	}
+	p.pos++
+
+	switch t.kind {
+	case texNumber:
+		return p.mn(t.val), false
+	case texLetter:
+		return p.mi(t.val), false
+	case texCommand:
+		return p.parseCommand(t.val)
+	}
+
+	switch t.val {
+	case "{":
+		items := p.parseRow()
+		p.skip("}")
+		return mathRow(items), false
+	case "-":
+		return mathOp("−"), false
+	case "*":
+		return mathOp("∗"), false
+	case "~":
+		return "<mtext> </mtext>", false
+	}
+	return mathOp(t.val), false
+}
+
+func (p *mathParser) parseCommand(name string) (string, bool) {
+	cmd := name[1:]
+	if r, ok := mathGreek[cmd]; ok {
+		if unicode.IsUpper(r) {
+			return `<mi mathvariant="normal">` + string(r) + "</mi>", false
+		}
+		return p.mi(string(r)), false
+	}
+	if s, ok := mathOperators[cmd]; ok {
+		return mathOp(s), false
+	}
+	if s, ok := mathIdentifiers[cmd]; ok {
+		return p.mi(s), false
+	}
+	if s, ok := mathBigOperators[cmd]; ok {
+		// Integrals keep their limits to the side
+		return mathOp(s), !strings.Contains(cmd, "int")
+	}
+	if limits, ok := mathFunctions[cmd]; ok {
+		if strings.HasPrefix(cmd, "lim") && len(cmd) > 3 {
+			// \liminf and \limsup
+			cmd = "lim " + cmd[3:]
+		}
+		return "<mi>" + cmd + "</mi>", limits
+	}
+	if w, ok := mathSpaces[cmd]; ok {
+		return mathSpace(w), false
+	}
+	if v, ok := mathVariants[cmd]; ok {
+		prev := p.variant
+		p.variant = v
+		arg := p.parseArg()
+		p.variant = prev
+		return arg, false
+	}
+	if a, ok := mathAccents[cmd]; ok {
+		base := p.parseArg()
+		stretchy := ""
+		if a.stretchy {
+			stretchy = ` stretchy="true"`
+		}
+		if a.under {
+			return `<munder accentunder="true">` + base + "<mo" + stretchy + ">" + html.EscapeString(a.char) + "</mo></munder>", false
+		}
+		return `<mover accent="true">` + base + "<mo" + stretchy + ">" + html.EscapeString(a.char) + "</mo></mover>", false
+	}
+	if size, ok := mathDelimiterSizes[strings.TrimRight(cmd, "lmr")]; ok {
+		d := p.delimiter()
+		if d == "" {
+			return "", false
+		}
+		return `<mo fence="true" stretchy="true" minsize="` + size + `" maxsize="` + size + `">` + html.EscapeString(d) + "</mo>", false
+	}
+
+	switch cmd {
+	case "frac", "dfrac", "tfrac", "cfrac":
+		num := p.parseArg()
+		den := p.parseArg()
+		return "<mfrac>" + num + den + "</mfrac>", false
+	case "binom", "dbinom", "tbinom":
+		n := p.parseArg()
+		k := p.parseArg()
+		return `<mrow><mo>(</mo><mfrac linethickness="0">` + n + k + `</mfrac><mo>)</mo></mrow>`, false
+	case "sqrt":
+		if p.skip("[") {
+			index := p.parseUntil("]")
+			return "<mroot>" + p.parseArg() + mathRow(index) + "</mroot>", false
+		}
+		return "<msqrt>" + p.parseArg() + "</msqrt>", false
+	case "overset", "stackrel":
+		over := p.parseArg()
+		return "<mover>" + p.parseArg() + over + "</mover>", false
+	case "underset":
+		under := p.parseArg()
+		return "<munder>" + p.parseArg() + under + "</munder>", false
+	case "overbrace":
+		return `<mover accent="true">` + p.parseArg() + `<mo stretchy="true">⏞</mo></mover>`, true
+	case "underbrace":
+		return `<munder accentunder="true">` + p.parseArg() + `<mo stretchy="true">⏟</mo></munder>`, true
+	case "text", "textrm", "textnormal", "mbox", "hbox":
+		return "<mtext>" + html.EscapeString(p.rawArg()) + "</mtext>", false
+	case "textbf":
+		return `<mtext mathvariant="bold">` + html.EscapeString(p.rawArg()) + "</mtext>", false
+	case "textit":
+		return `<mtext mathvariant="italic">` + html.EscapeString(p.rawArg()) + "</mtext>", false
+	case "operatorname":
+		limits := p.skip("*")
+		return "<mi>" + html.EscapeString(p.rawArg()) + "</mi>", limits
+	case "left":
+		open := p.fence(p.delimiter())
+		items := p.parseRow()
+		close := ""
+		if p.skip(`\right`) {
+			close = p.fence(p.delimiter())
+		}
+		return "<mrow>" + open + strings.Join(items, "") + close + "</mrow>", false
+	case "middle":
+		return p.fence(p.delimiter()), false
+	case "begin":
+		return p.parseEnvironment(p.rawArg()), false
+	case "not":
+		ml, _ := p.parseAtom()
+		if strings.HasSuffix(ml, "</mo>") {
+			return strings.TrimSuffix(ml, "</mo>") + "\u0338</mo>", false
+		}
+		return ml, false
+	case "pmod":
+		return "<mrow>" + mathSpace("0.444em") + mathOp("(") + "<mi>mod</mi>" + mathSpace("0.333em") + p.parseArg() + mathOp(")") + "</mrow>", false
+	case "bmod", "mod":
+		return `<mo lspace="0.278em" rspace="0.278em">mod</mo>`, false
+	case "displaystyle", "textstyle", "scriptstyle", "limits", "nolimits", "hline", "nonumber", "notag":
+		return "", false
+	}
+	return mathError(name), false
+}
+
+// delimiter returns the delimiter after a command like \left, which is empty
+// for ".".
+func (p *mathParser) delimiter() string {
+	t := p.next()
+	if t == nil {
+		return ""
+	}
+	switch t.kind {
+	case texCommand:
+		if s, ok := mathOperators[t.val[1:]]; ok {
+			return s
+		}
+		return ""
+	case texSymbol:
+		if t.val == "." {
+			return ""
+		}
+		return t.val
+	}
+	return ""
+}
+
+func (p *mathParser) fence(d string) string {
+	if d == "" {
+		return ""
+	}
+	return `<mo fence="true" stretchy="true">` + html.EscapeString(d) + "</mo>"
+}
+
+// parseEnvironment parses the contents of an environment like pmatrix or
+// aligned into a table.
+func (p *mathParser) parseEnvironment(name string) string {
+	if name == "array" {
+		// Column alignment isn't supported, so it's skipped
+		p.rawArg()
+	}
+	rows := []string{}
+	cells := []string{}
+	for {
+		cells = append(cells, mathRow(p.parseRow()))
+		t := p.next()
+		if t != nil && t.val == "&" {
+			continue
+		}
+		// Skip rows that are left empty, like after a final \\
+		if len(cells) > 1 || cells[0] != "<mrow></mrow>" {
+			rows = append(rows, "<mtr><mtd>"+strings.Join(cells, "</mtd><mtd>")+"</mtd></mtr>")
+		}
+		cells = cells[:0]
+		if t == nil {
+			break
+		}
+		switch t.val {
+		case `\\`:
+			if p.skip("[") {
+				// Skip extra spacing between rows, like \\[2pt]
+				p.parseUntil("]")
+			}
+			continue
+		case `\end`:
+			p.rawArg()
+		default:
+			// The table ended without \end, so leave what closed it
+			p.pos--
+		}
+		break
+	}
+
+	table := "<mtable>"
+	switch strings.TrimSuffix(name, "*") {
+	case "cases":
+		table = `<mtable columnalign="left left">`
+	case "aligned", "align", "alignat", "split", "eqnarray":
+		table = `<mtable displaystyle="true" columnalign="right left right left right left">`
+	case "gathered", "gather":
+		table = `<mtable displaystyle="true">`
+	}
+	table += strings.Join(rows, "") + "</mtable>"
+
+	switch name {
+	case "pmatrix":
+		return "<mrow>" + p.fence("(") + table + p.fence(")") + "</mrow>"
+	case "bmatrix":
+		return "<mrow>" + p.fence("[") + table + p.fence("]") + "</mrow>"
+	case "Bmatrix":
+		return "<mrow>" + p.fence("{") + table + p.fence("}") + "</mrow>"
+	case "vmatrix":
+		return "<mrow>" + p.fence("|") + table + p.fence("|") + "</mrow>"
+	case "Vmatrix":
+		return "<mrow>" + p.fence("‖") + table + p.fence("‖") + "</mrow>"
+	case "cases":
+		return "<mrow>" + p.fence("{") + table + "</mrow>"
+	}
+	return table
+}
+
+// mathAlphanumeric converts letters and digits into the given style from
+// Unicode's Mathematical Alphanumeric Symbols, which show correctly in all
+// browsers, unlike the mathvariant attribute.
+func mathAlphanumeric(variant, s string) string {
+	style, ok := mathAlphanumericStyles[variant]
+	if !ok {
+		return s
+	}
+	b := strings.Builder{}
+	for _, r := range s {
+		if hole, ok := mathAlphanumericHoles[string([]rune{style.upper, r})]; ok {
+			b.WriteRune(hole)
+			continue
+		}
+		switch {
+		case r >= 'A' && r <= 'Z' && style.upper != 0:
+			b.WriteRune(style.upper + r - 'A')
+		case r >= 'a' && r <= 'z' && style.lower != 0:
+			b.WriteRune(style.lower + r - 'a')
+		case r >= '0' && r <= '9' && style.digit != 0:
+			b.WriteRune(style.digit + r - '0')
+		default:
+			b.WriteRune(r)
+		}
+	}
+	return b.String()
+}
+
+var mathAlphanumericStyles = map[string]struct{ upper, lower, digit rune }{
+	"bold":          {0x1D400, 0x1D41A, 0x1D7CE},
+	"italic":        {0x1D434, 0x1D44E, 0},
+	"bold-italic":   {0x1D468, 0x1D482, 0},
+	"script":        {0x1D49C, 0x1D4B6, 0},
+	"fraktur":       {0x1D504, 0x1D51E, 0},
+	"double-struck": {0x1D538, 0x1D552, 0x1D7D8},
+	"sans-serif":    {0x1D5A0, 0x1D5BA, 0x1D7E2},
+	"monospace":     {0x1D670, 0x1D68A, 0x1D7F6},
+}
+
+// mathAlphanumericHoles holds the letters that were already in Unicode before
+// the Mathematical Alphanumeric Symbols block, keyed by the first letter of
+// their style and the letter.
+var mathAlphanumericHoles = map[string]rune{
+	"\U0001D434h": 'ℎ',
+	"\U0001D49CB": 'ℬ', "\U0001D49CE": 'ℰ', "\U0001D49CF": 'ℱ', "\U0001D49CH": 'ℋ',
+	"\U0001D49CI": 'ℐ', "\U0001D49CL": 'ℒ', "\U0001D49CM": 'ℳ', "\U0001D49CR": 'ℛ',
+	"\U0001D49Ce": 'ℯ', "\U0001D49Cg": 'ℊ', "\U0001D49Co": 'ℴ',
+	"\U0001D504C": 'ℭ', "\U0001D504H": 'ℌ', "\U0001D504I": 'ℑ', "\U0001D504R": 'ℜ', "\U0001D504Z": 'ℨ',
+	"\U0001D538C": 'ℂ', "\U0001D538H": 'ℍ', "\U0001D538N": 'ℕ', "\U0001D538P": 'ℙ',
+	"\U0001D538Q": 'ℚ', "\U0001D538R": 'ℝ', "\U0001D538Z": 'ℤ',
+}
+
+var mathVariants = map[string]string{
+	"mathrm":     "normal",
+	"mathup":     "normal",
+	"mathbf":     "bold",
+	"boldsymbol": "bold",
+	"mathit":     "italic",
+	"mathcal":    "script",
+	"mathscr":    "script",
+	"mathfrak":   "fraktur",
+	"mathbb":     "double-struck",
+	"mathsf":     "sans-serif",
+	"mathtt":     "monospace",
+}
+
+var mathGreek = map[string]rune{
+	"alpha": 'α', "beta": 'β', "gamma": 'γ', "delta": 'δ', "epsilon": 'ϵ',
+	"varepsilon": 'ε', "zeta": 'ζ', "eta": 'η', "theta": 'θ', "vartheta": 'ϑ',
+	"iota": 'ι', "kappa": 'κ', "lambda": 'λ', "mu": 'μ', "nu": 'ν', "xi": 'ξ',
+	"omicron": 'ο', "pi": 'π', "varpi": 'ϖ', "rho": 'ρ', "varrho": 'ϱ',
+	"sigma": 'σ', "varsigma": 'ς', "tau": 'τ', "upsilon": 'υ', "phi": 'ϕ',
+	"varphi": 'φ', "chi": 'χ', "psi": 'ψ', "omega": 'ω',
+	"Gamma": 'Γ', "Delta": 'Δ', "Theta": 'Θ', "Lambda": 'Λ', "Xi": 'Ξ',
+	"Pi": 'Π', "Sigma": 'Σ', "Upsilon": 'Υ', "Phi": 'Φ', "Psi": 'Ψ', "Omega": 'Ω',
+}
+
+var mathIdentifiers = map[string]string{
+	"infty": "∞", "partial": "∂", "nabla": "∇", "emptyset": "∅", "varnothing": "∅",
+	"hbar": "ℏ", "ell": "ℓ", "aleph": "ℵ", "beth": "ℶ", "Re": "ℜ", "Im": "ℑ",
+	"wp": "℘", "imath": "ı", "jmath": "ȷ", "top": "⊤", "bot": "⊥",
+	"angle": "∠", "triangle": "△", "square": "□", "Box": "□", "degree": "°",
+	"$": "$", "%": "%", "#": "#", "_": "_",
+}
+
+var mathOperators = map[string]string{
+	// Binary operators
+	"pm": "±", "mp": "∓", "times": "×", "div": "÷", "cdot": "⋅", "ast": "∗",
+	"star": "⋆", "circ": "∘", "bullet": "∙", "oplus": "⊕", "ominus": "⊖",
+	"otimes": "⊗", "odot": "⊙", "wedge": "∧", "land": "∧", "vee": "∨",
+	"lor": "∨", "cap": "∩", "cup": "∪", "setminus": "∖", "sqcup": "⊔",
+	"sqcap": "⊓", "uplus": "⊎", "amalg": "⨿", "dagger": "†", "ddagger": "‡",
+	"wr": "≀", "diamond": "⋄", "&": "&",
+	// Relations
+	"leq": "≤", "le": "≤", "geq": "≥", "ge": "≥", "neq": "≠", "ne": "≠",
+	"lt": "<", "gt": ">", "leqslant": "⩽", "geqslant": "⩾", "ll": "≪", "gg": "≫",
+	"approx": "≈", "equiv": "≡", "sim": "∼", "simeq": "≃", "cong": "≅",
+	"propto": "∝", "asymp": "≍", "doteq": "≐", "triangleq": "≜", "coloneqq": "≔",
+	"prec": "≺", "succ": "≻", "preceq": "⪯", "succeq": "⪰", "in": "∈",
+	"notin": "∉", "ni": "∋", "owns": "∋", "subset": "⊂", "supset": "⊃",
+	"subseteq": "⊆", "supseteq": "⊇", "subsetneq": "⊊", "supsetneq": "⊋",
+	"sqsubseteq": "⊑", "sqsupseteq": "⊒", "models": "⊨", "vdash": "⊢",
+	"dashv": "⊣", "perp": "⊥", "parallel": "∥", "mid": "∣", "nmid": "∤",
+	// Arrows
+	"to": "→", "rightarrow": "→", "gets": "←", "leftarrow": "←",
+	"leftrightarrow": "↔", "Rightarrow": "⇒", "Leftarrow": "⇐",
+	"Leftrightarrow": "⇔", "implies": "⟹", "impliedby": "⟸", "iff": "⟺",
+	"longrightarrow": "⟶", "longleftarrow": "⟵", "Longrightarrow": "⟹",
+	"Longleftarrow": "⟸", "longleftrightarrow": "⟷", "mapsto": "↦",
+	"longmapsto": "⟼", "uparrow": "↑", "downarrow": "↓", "Uparrow": "⇑",
+	"Downarrow": "⇓", "hookrightarrow": "↪", "hookleftarrow": "↩",
+	"rightleftharpoons": "⇌", "nearrow": "↗", "searrow": "↘",
+	// Logic
+	"neg": "¬", "lnot": "¬", "forall": "∀", "exists": "∃", "nexists": "∄",
+	"therefore": "∴", "because": "∵",
+	// Delimiters
+	"{": "{", "}": "}", "|": "‖", "vert": "|", "Vert": "‖", "lvert": "|",
+	"rvert": "|", "lVert": "‖", "rVert": "‖", "langle": "⟨", "rangle": "⟩",
+	"lfloor": "⌊", "rfloor": "⌋", "lceil": "⌈", "rceil": "⌉", "backslash": "\\",
+	// Punctuation
+	"colon": ":", "ldots": "…", "dots": "…", "cdots": "⋯", "vdots": "⋮",
+	"ddots": "⋱", "prime": "′",
+}
+
+var mathBigOperators = map[string]string{
+	"sum": "∑", "prod": "∏", "coprod": "∐", "int": "∫", "iint": "∬",
+	"iiint": "∭", "oint": "∮", "bigcup": "⋃", "bigcap": "⋂", "bigoplus": "⨁",
+	"bigotimes": "⨂", "bigodot": "⨀", "bigvee": "⋁", "bigwedge": "⋀",
+	"biguplus": "⨄", "bigsqcup": "⨆",
+}
+
+// mathFunctions holds named functions, and whether scripts on them go below
+// them in display math, like \lim.
+var mathFunctions = map[string]bool{
+	"arccos": false, "arcsin": false, "arctan": false, "arg": false,
+	"cos": false, "cosh": false, "cot": false, "coth": false, "csc": false,
+	"deg": false, "dim": false, "exp": false, "hom": false, "ker": false,
+	"lg": false, "ln": false, "log": false, "sec": false, "sin": false,
+	"sinh": false, "tan": false, "tanh": false,
+	"det": true, "gcd": true, "inf": true, "lim": true, "liminf": true,
+	"limsup": true, "max": true, "min": true, "Pr": true, "sup": true,
+}
+
+var mathSpaces = map[string]string{
+	",": "0.1667em", ":": "0.2222em", ">": "0.2222em", ";": "0.2778em",
+	"!": "-0.1667em", " ": "0.3333em", "quad": "1em", "qquad": "2em",
+}
+
+var mathAccents = map[string]struct {
+	char     string
+	stretchy bool
+	under    bool
+}{
+	"hat":            {"^", false, false},
+	"widehat":        {"^", true, false},
+	"check":          {"ˇ", false, false},
+	"tilde":          {"~", false, false},
+	"widetilde":      {"~", true, false},
+	"acute":          {"´", false, false},
+	"grave":          {"`", false, false},
+	"dot":            {"˙", false, false},
+	"ddot":           {"¨", false, false},
+	"breve":          {"˘", false, false},
+	"bar":            {"‾", false, false},
+	"overline":       {"‾", true, false},
+	"vec":            {"→", false, false},
+	"overrightarrow": {"→", true, false},
+	"overleftarrow":  {"←", true, false},
+	"underline":      {"‾", true, true},
+}
+
+var mathDelimiterSizes = map[string]string{
+	"big":  "1.2em",
+	"Big":  "1.623em",
+	"bigg": "2.047em",
+	"Bigg": "2.470em",
+}
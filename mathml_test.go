@@ -0,0 +1,49 @@
+/*
+ * Copyright © 2021 A Bunch Tell LLC.
+ *
+ * This file is part of WriteFreely.
+ *
+ * WriteFreely is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License, included
+ * in the LICENSE file in this source code package.
+ */
+
+package writefreely
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestLatexToMathML(t *testing.T) {
+	tests := []struct {
+		name    string
+		in      string
+		display bool
+		want    string
+	}{
+		{"scripts", `x_i^2 + y'`, false, `<msubsup><mi>x</mi><mi>i</mi><mn>2</mn></msubsup><mo>+</mo><msup><mi>y</mi><mo>′</mo></msup>`},
+		{"single digit script", `x^23`, false, `<msup><mi>x</mi><mn>2</mn></msup><mn>3</mn>`},
+		{"fraction", `\frac{1}{n}`, false, `<mfrac><mn>1</mn><mi>n</mi></mfrac>`},
+		{"root", `\sqrt[3]{x}`, false, `<mroot><mi>x</mi><mn>3</mn></mroot>`},
+		{"greek", `\alpha\Omega`, false, `<mi>α</mi><mi mathvariant="normal">Ω</mi>`},
+		{"inline limits", `\sum_{i}`, false, `<msub><mo>∑</mo><mi>i</mi></msub>`},
+		{"display limits", `\sum_{i}`, true, `<munder><mo>∑</mo><mi>i</mi></munder>`},
+		{"integral", `\int_0^1`, true, `<msubsup><mo>∫</mo><mn>0</mn><mn>1</mn></msubsup>`},
+		{"function", `\sin x`, false, `<mi>sin</mi><mi>x</mi>`},
+		{"text", `\text{if } x`, false, `<mtext>if </mtext><mi>x</mi>`},
+		{"variant", `\mathbb{R}\mathbf{v}`, false, `<mi>ℝ</mi><mi>𝐯</mi>`},
+		{"fences", `\left(x\right.`, false, `<mrow><mo fence="true" stretchy="true">(</mo><mi>x</mi></mrow>`},
+		{"matrix", `\begin{bmatrix}1&0\\0&1\\\end{bmatrix}`, false, `<mrow><mo fence="true" stretchy="true">[</mo><mtable><mtr><mtd><mn>1</mn></mtd><mtd><mn>0</mn></mtd></mtr><mtr><mtd><mn>0</mn></mtd><mtd><mn>1</mn></mtd></mtr></mtable><mo fence="true" stretchy="true">]</mo></mrow>`},
+		{"escaping", `a<b`, false, `<mi>a</mi><mo>&lt;</mo><mi>b</mi>`},
+		{"unknown", `\nope`, false, `<merror><mtext>\nope</mtext></merror>`},
+		{"unbalanced", `x}`, false, `<mi>x</mi>`},
+	}
+	for _, test := range tests {
+		got := latexToMathML(test.in, test.display)
+		got = got[strings.Index(got, "<semantics><mrow>")+len("<semantics><mrow>") : strings.Index(got, "</mrow><annotation")]
+		if got != test.want {
+			t.Errorf("%s: latexToMathML(%q) = %s, want %s", test.name, test.in, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,245 @@
+/*
+ * Copyright © 2021 A Bunch Tell LLC.
+ *
+ * This file is part of WriteFreely.
+ *
+ * WriteFreely is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License, included
+ * in the LICENSE file in this source code package.
+ */
+
+package writefreely
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/gorilla/mux"
+	"github.com/writeas/impart"
+	"github.com/writeas/web-core/log"
+)
+
+// maxMenuItems is the most items a collection's navigation menu can have.
+const maxMenuItems = 12
+
+// menuItemType is the kind of page a navigation menu item links to.
+type menuItemType string
+
+const (
+	menuItemTag      menuItemType = "tag"
+	menuItemCategory menuItemType = "category"
+	menuItemPage     menuItemType = "page"
+	menuItemLink     menuItemType = "link"
+)
+
+// MenuItem is a link in a collection's navigation menu.
+type MenuItem struct {
+	Type  menuItemType `json:"type"`
+	Title string       `json:"title"`
+	// Target is the tag, the slug of the post, or the external URL the item
+	// links to, depending on its Type.
+	Target string `json:"target"`
+	URL    string `json:"url"`
+}
+
+// resolve fills in the URL of the menu item in the given collection.
+func (i *MenuItem) resolve(c *Collection) {
+	switch i.Type {
+	case menuItemTag, menuItemCategory:
+		i.URL = c.CanonicalURL() + "tag:" + i.Target
+	case menuItemPage:
+		i.URL = c.CanonicalURL() + i.Target
+	default:
+		i.URL = i.Target
+	}
+}
+
+// validate checks and normalizes a menu item submitted by a collection owner.
+func (i *MenuItem) validate(app *App, c *Collection, categories []string) error {
+	i.Title = strings.TrimSpace(i.Title)
+	i.Target = strings.TrimSpace(i.Target)
+	if len(i.Title) > 255 || len(i.Target) > 255 {
+		return impart.HTTPError{http.StatusBadRequest, "Menu item titles and links can be at most 255 characters."}
+	}
+
+	switch i.Type {
+	case menuItemTag, menuItemCategory:
+		i.Target = strings.ToLower(strings.TrimPrefix(i.Target, "#"))
+		if !isValidTag(i.Target) {
+			return impart.HTTPError{http.StatusBadRequest, fmt.Sprintf("#%s isn't a valid tag.", i.Target)}
+		}
+		if i.Type == menuItemCategory && !stringsContains(categories, i.Target) {
+			return impart.HTTPError{http.StatusBadRequest, fmt.Sprintf("#%s isn't a category. Make it one on the Tags page first.", i.Target)}
+		}
+		if i.Title == "" {
+			i.Title = "#" + i.Target
+			if i.Type == menuItemCategory {
+				i.Title = strings.Title(i.Target)
+			}
+		}
+	case menuItemPage:
+		i.Target = strings.ToLower(strings.Trim(i.Target, "/"))
+		p, err := app.db.GetPost(i.Target, c.ID)
+		if err != nil {
+			return impart.HTTPError{http.StatusBadRequest, fmt.Sprintf("There's no post at /%s on this blog.", i.Target)}
+		}
+		if i.Title == "" {
+			i.Title = p.PlainDisplayTitle()
+		}
+	case menuItemLink:
+		u, err := url.Parse(i.Target)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return impart.HTTPError{http.StatusBadRequest, fmt.Sprintf("%s isn't a valid link. Links need to start with http:// or https://.", i.Target)}
+		}
+		if i.Title == "" {
+			i.Title = u.Host
+		}
+	default:
+		return impart.HTTPError{http.StatusBadRequest, "Invalid menu item type."}
+	}
+	return nil
+}
+
+func stringsContains(s []string, v string) bool {
+	for _, x := range s {
+		if x == v {
+			return true
+		}
+	}
+	return false
+}
+
+// postCategories returns the tags on the post that are categories in its
+// collection.
+func postCategories(p *Post, categories []string) []string {
+	cats := []string{}
+	for _, t := range p.Tags {
+		t = strings.ToLower(t)
+		if stringsContains(categories, t) && !stringsContains(cats, t) {
+			cats = append(cats, t)
+		}
+	}
+	return cats
+}
+
+// getCollectionMenu returns the navigation menu of the given collection, ready
+// for display. The collection's pages come first, unless the menu already
+// links to them.
+func getCollectionMenu(app *App, c *Collection) []MenuItem {
+	items, err := app.db.GetCollectionMenu(c.ID)
+	if err != nil {
+		return nil
+	}
+	if pages, err := app.db.GetCollectionPages(app.cfg, c, false); err == nil {
+		items = append(pageMenuItems(pages, items), items...)
+	}
+	for i := range items {
+		items[i].resolve(c)
+	}
+	return items
+}
+
+func viewCollectionMenu(app *App, u *User, w http.ResponseWriter, r *http.Request) error {
+	c, err := app.db.GetCollection(mux.Vars(r)["collection"])
+	if err != nil {
+		return err
+	}
+	if c.OwnerID != u.ID {
+		return ErrCollectionNotFound
+	}
+	c.hostName = app.cfg.App.Host
+
+	flashes, _ := getSessionFlashes(app, w, r, nil)
+	p := struct {
+		*UserPage
+		Collection *Collection
+		IsOwner    bool
+		Menu       []MenuItem
+		Categories []string
+		Silenced   bool
+	}{
+		UserPage:   NewUserPage(app, r, u, "Menu", flashes),
+		Collection: c,
+		IsOwner:    true,
+	}
+	p.Silenced, err = app.db.IsUserSilenced(u.ID)
+	if err != nil {
+		log.Error("view collection menu: %v", err)
+	}
+	p.Menu, err = app.db.GetCollectionMenu(c.ID)
+	if err != nil {
+		return err
+	}
+	p.Categories, err = app.db.GetCollectionCategories(c.ID)
+	if err != nil {
+		return err
+	}
+	// Leave room for new items
+	for n := 0; n < 3 && len(p.Menu) < maxMenuItems; n++ {
+		p.Menu = append(p.Menu, MenuItem{Type: menuItemLink})
+	}
+
+	showUserPage(w, "menu", p)
+	return nil
+}
+
+// handleUpdateCollectionMenu replaces a collection's navigation menu with the
+// submitted items. Items without a target are left out.
+func handleUpdateCollectionMenu(app *App, u *User, w http.ResponseWriter, r *http.Request) error {
+	if u.IsSilenced() {
+		return ErrUserSilenced
+	}
+	c, err := app.db.GetCollection(mux.Vars(r)["collection"])
+	if err != nil {
+		return err
+	}
+	if c.OwnerID != u.ID {
+		return ErrCollectionNotFound
+	}
+	c.hostName = app.cfg.App.Host
+
+	err = r.ParseForm()
+	if err != nil {
+		return ErrBadFormData
+	}
+	types, titles, targets := r.PostForm["type"], r.PostForm["title"], r.PostForm["target"]
+	if len(titles) != len(types) || len(targets) != len(types) {
+		return ErrBadFormData
+	}
+
+	categories, err := app.db.GetCollectionCategories(c.ID)
+	if err != nil {
+		return err
+	}
+	redirect := "/me/c/" + c.Alias + "/menu"
+	items := []MenuItem{}
+	for i := range types {
+		item := MenuItem{Type: menuItemType(types[i]), Title: titles[i], Target: targets[i]}
+		if strings.TrimSpace(item.Target) == "" {
+			continue
+		}
+		if err := item.validate(app, c, categories); err != nil {
+			if err, ok := err.(impart.HTTPError); ok {
+				addSessionFlash(app, w, r, err.Message, nil)
+				return impart.HTTPError{http.StatusFound, redirect}
+			}
+			return err
+		}
+		items = append(items, item)
+	}
+	if len(items) > maxMenuItems {
+		addSessionFlash(app, w, r, fmt.Sprintf("Menus can have at most %d items.", maxMenuItems), nil)
+		return impart.HTTPError{http.StatusFound, redirect}
+	}
+
+	err = app.db.SetCollectionMenu(c.ID, items)
+	if err != nil {
+		return err
+	}
+	app.pages.invalidate(c.ID)
+
+	addSessionFlash(app, w, r, "Saved menu.", nil)
+	return impart.HTTPError{http.StatusFound, redirect}
+}
@@ -66,6 +66,17 @@ var migrations = []Migration{
 	New("support oauth via invite", oauthInvites),                   // V7 -> V8 (v0.12.0)
 	New("optimize drafts retrieval", optimizeDrafts),                // V8 -> V9
 	New("support post signatures", supportPostSignatures),           // V9 -> V10
+	New("support background jobs", supportJobs),                     // V10 -> V11
+	New("support collection members", supportCollectionMembers),     // V11 -> V12
+	New("support post reviews", supportPostReviews),                 // V12 -> V13
+	New("support post view analytics", supportPostViews),            // V13 -> V14
+	New("support post series", supportSeries),                       // V14 -> V15
+	New("support tags", supportTags),                                // V15 -> V16
+	New("support navigation menus", supportMenus),                   // V16 -> V17
+	New("support collection pages", supportCollectionPages),         // V17 -> V18
+	New("support related posts", supportRelatedPosts),               // V18 -> V19
+	New("support link embeds", supportLinkEmbeds),                   // V19 -> V20
+	New("support custom domains", supportCustomDomains),             // V20 -> V21
 }
 
 // CurrentVer returns the current migration version the application is on
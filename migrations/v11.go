@@ -0,0 +1,55 @@
+/*
+ * Copyright © 2021 A Bunch Tell LLC.
+ *
+ * This file is part of WriteFreely.
+ *
+ * WriteFreely is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License, included
+ * in the LICENSE file in this source code package.
+ */
+
+package migrations
+
+import (
+	"context"
+	"database/sql"
+
+	wf_db "github.com/writefreely/writefreely/db"
+)
+
+func supportJobs(db *datastore) error {
+	dialect := wf_db.DialectMySQL
+	if db.driverName == driverSQLite {
+		dialect = wf_db.DialectSQLite
+	}
+	return wf_db.RunTransactionWithOptions(context.Background(), db.DB, &sql.TxOptions{}, func(ctx context.Context, tx *sql.Tx) error {
+		builders := []wf_db.SQLBuilder{
+			dialect.
+				Table("jobs").
+				SetIfNotExists(false).
+				Column(dialect.Column("id", wf_db.ColumnTypeChar, wf_db.OptionalInt{Set: true, Value: 16}).SetPrimaryKey(true)).
+				Column(dialect.Column("user_id", wf_db.ColumnTypeInteger, wf_db.UnsetSize)).
+				Column(dialect.Column("type", wf_db.ColumnTypeVarChar, wf_db.OptionalInt{Set: true, Value: 32})).
+				Column(dialect.Column("status", wf_db.ColumnTypeSmallInt, wf_db.UnsetSize).SetDefault("0")).
+				Column(dialect.Column("progress", wf_db.ColumnTypeInteger, wf_db.UnsetSize).SetDefault("0")).
+				Column(dialect.Column("total", wf_db.ColumnTypeInteger, wf_db.UnsetSize).SetDefault("0")).
+				Column(dialect.Column("input", wf_db.ColumnTypeText, wf_db.UnsetSize).SetNullable(true)).
+				Column(dialect.Column("result", wf_db.ColumnTypeVarChar, wf_db.OptionalInt{Set: true, Value: 255}).SetNullable(true)).
+				Column(dialect.Column("message", wf_db.ColumnTypeText, wf_db.UnsetSize).SetNullable(true)).
+				Column(dialect.Column("created", wf_db.ColumnTypeDateTime, wf_db.UnsetSize).SetDefaultCurrentTimestamp()).
+				Column(dialect.Column("updated", wf_db.ColumnTypeDateTime, wf_db.UnsetSize).SetDefaultCurrentTimestamp()),
+			dialect.CreateIndex("jobs_status_created", "jobs", "status", "created"),
+			dialect.CreateIndex("jobs_user_id", "jobs", "user_id"),
+		}
+		for _, builder := range builders {
+			query, err := builder.ToSQL()
+			if err != nil {
+				return err
+			}
+			if _, err := tx.ExecContext(ctx, query); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
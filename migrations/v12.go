@@ -0,0 +1,64 @@
+/*
+ * Copyright © 2021 A Bunch Tell LLC.
+ *
+ * This file is part of WriteFreely.
+ *
+ * WriteFreely is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License, included
+ * in the LICENSE file in this source code package.
+ */
+
+package migrations
+
+import (
+	"context"
+	"database/sql"
+
+	wf_db "github.com/writefreely/writefreely/db"
+)
+
+func supportCollectionMembers(db *datastore) error {
+	dialect := wf_db.DialectMySQL
+	if db.driverName == driverSQLite {
+		dialect = wf_db.DialectSQLite
+	}
+	return wf_db.RunTransactionWithOptions(context.Background(), db.DB, &sql.TxOptions{}, func(ctx context.Context, tx *sql.Tx) error {
+		builders := []wf_db.SQLBuilder{
+			dialect.
+				Table("collectionmembers").
+				SetIfNotExists(false).
+				Column(dialect.Column("collection_id", wf_db.ColumnTypeInteger, wf_db.UnsetSize)).
+				Column(dialect.Column("user_id", wf_db.ColumnTypeInteger, wf_db.UnsetSize)).
+				Column(dialect.Column("role", wf_db.ColumnTypeSmallInt, wf_db.UnsetSize)).
+				Column(dialect.Column("created", wf_db.ColumnTypeDateTime, wf_db.UnsetSize).SetDefaultCurrentTimestamp()).
+				UniqueConstraint("collection_id", "user_id"),
+			dialect.CreateIndex("collectionmembers_user_id", "collectionmembers", "user_id"),
+			dialect.
+				Table("collectioninvites").
+				SetIfNotExists(false).
+				Column(dialect.Column("id", wf_db.ColumnTypeChar, wf_db.OptionalInt{Set: true, Value: 16}).SetPrimaryKey(true)).
+				Column(dialect.Column("collection_id", wf_db.ColumnTypeInteger, wf_db.UnsetSize)).
+				Column(dialect.Column("role", wf_db.ColumnTypeSmallInt, wf_db.UnsetSize)).
+				Column(dialect.Column("owner_id", wf_db.ColumnTypeInteger, wf_db.UnsetSize)).
+				Column(dialect.Column("created", wf_db.ColumnTypeDateTime, wf_db.UnsetSize).SetDefaultCurrentTimestamp()).
+				Column(dialect.Column("expires", wf_db.ColumnTypeDateTime, wf_db.UnsetSize)),
+			dialect.CreateIndex("collectioninvites_collection_id", "collectioninvites", "collection_id"),
+			dialect.
+				Table("postauthors").
+				SetIfNotExists(false).
+				Column(dialect.Column("post_id", wf_db.ColumnTypeChar, wf_db.OptionalInt{Set: true, Value: 16}).SetPrimaryKey(true)).
+				Column(dialect.Column("user_id", wf_db.ColumnTypeInteger, wf_db.UnsetSize)),
+			dialect.CreateIndex("postauthors_user_id", "postauthors", "user_id"),
+		}
+		for _, builder := range builders {
+			query, err := builder.ToSQL()
+			if err != nil {
+				return err
+			}
+			if _, err := tx.ExecContext(ctx, query); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
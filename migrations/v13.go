@@ -0,0 +1,52 @@
+/*
+ * Copyright © 2021 A Bunch Tell LLC.
+ *
+ * This file is part of WriteFreely.
+ *
+ * WriteFreely is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License, included
+ * in the LICENSE file in this source code package.
+ */
+
+package migrations
+
+import (
+	"context"
+	"database/sql"
+
+	wf_db "github.com/writefreely/writefreely/db"
+)
+
+func supportPostReviews(db *datastore) error {
+	dialect := wf_db.DialectMySQL
+	if db.driverName == driverSQLite {
+		dialect = wf_db.DialectSQLite
+	}
+	return wf_db.RunTransactionWithOptions(context.Background(), db.DB, &sql.TxOptions{}, func(ctx context.Context, tx *sql.Tx) error {
+		builders := []wf_db.SQLBuilder{
+			dialect.
+				Table("postreviews").
+				SetIfNotExists(false).
+				Column(dialect.Column("post_id", wf_db.ColumnTypeChar, wf_db.OptionalInt{Set: true, Value: 16}).SetPrimaryKey(true)).
+				Column(dialect.Column("collection_id", wf_db.ColumnTypeInteger, wf_db.UnsetSize)).
+				Column(dialect.Column("author_id", wf_db.ColumnTypeInteger, wf_db.UnsetSize)).
+				Column(dialect.Column("status", wf_db.ColumnTypeSmallInt, wf_db.UnsetSize)).
+				Column(dialect.Column("reviewer_id", wf_db.ColumnTypeInteger, wf_db.UnsetSize).SetNullable(true)).
+				Column(dialect.Column("comment", wf_db.ColumnTypeText, wf_db.UnsetSize).SetNullable(true)).
+				Column(dialect.Column("created", wf_db.ColumnTypeDateTime, wf_db.UnsetSize).SetDefaultCurrentTimestamp()).
+				Column(dialect.Column("updated", wf_db.ColumnTypeDateTime, wf_db.UnsetSize).SetDefaultCurrentTimestamp()),
+			dialect.CreateIndex("postreviews_collection_status", "postreviews", "collection_id", "status"),
+			dialect.CreateIndex("postreviews_author_id", "postreviews", "author_id"),
+		}
+		for _, builder := range builders {
+			query, err := builder.ToSQL()
+			if err != nil {
+				return err
+			}
+			if _, err := tx.ExecContext(ctx, query); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
@@ -0,0 +1,49 @@
+/*
+ * Copyright © 2021 A Bunch Tell LLC.
+ *
+ * This file is part of WriteFreely.
+ *
+ * WriteFreely is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License, included
+ * in the LICENSE file in this source code package.
+ */
+
+package migrations
+
+import (
+	"context"
+	"database/sql"
+
+	wf_db "github.com/writefreely/writefreely/db"
+)
+
+func supportPostViews(db *datastore) error {
+	dialect := wf_db.DialectMySQL
+	if db.driverName == driverSQLite {
+		dialect = wf_db.DialectSQLite
+	}
+	return wf_db.RunTransactionWithOptions(context.Background(), db.DB, &sql.TxOptions{}, func(ctx context.Context, tx *sql.Tx) error {
+		builders := []wf_db.SQLBuilder{
+			dialect.
+				Table("postviews").
+				SetIfNotExists(false).
+				Column(dialect.Column("post_id", wf_db.ColumnTypeChar, wf_db.OptionalInt{Set: true, Value: 16})).
+				Column(dialect.Column("day", wf_db.ColumnTypeDateTime, wf_db.UnsetSize)).
+				Column(dialect.Column("source", wf_db.ColumnTypeSmallInt, wf_db.UnsetSize)).
+				Column(dialect.Column("referrer", wf_db.ColumnTypeVarChar, wf_db.OptionalInt{Set: true, Value: 255})).
+				Column(dialect.Column("views", wf_db.ColumnTypeInteger, wf_db.UnsetSize)).
+				UniqueConstraint("post_id", "day", "source", "referrer"),
+			dialect.CreateIndex("postviews_day", "postviews", "day"),
+		}
+		for _, builder := range builders {
+			query, err := builder.ToSQL()
+			if err != nil {
+				return err
+			}
+			if _, err := tx.ExecContext(ctx, query); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
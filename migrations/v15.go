@@ -0,0 +1,55 @@
+/*
+ * Copyright © 2021 A Bunch Tell LLC.
+ *
+ * This file is part of WriteFreely.
+ *
+ * WriteFreely is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License, included
+ * in the LICENSE file in this source code package.
+ */
+
+package migrations
+
+import (
+	"context"
+	"database/sql"
+
+	wf_db "github.com/writefreely/writefreely/db"
+)
+
+func supportSeries(db *datastore) error {
+	dialect := wf_db.DialectMySQL
+	if db.driverName == driverSQLite {
+		dialect = wf_db.DialectSQLite
+	}
+	return wf_db.RunTransactionWithOptions(context.Background(), db.DB, &sql.TxOptions{}, func(ctx context.Context, tx *sql.Tx) error {
+		builders := []wf_db.SQLBuilder{
+			dialect.
+				Table("collectionseries").
+				SetIfNotExists(false).
+				Column(dialect.Column("collection_id", wf_db.ColumnTypeInteger, wf_db.UnsetSize)).
+				Column(dialect.Column("slug", wf_db.ColumnTypeVarChar, wf_db.OptionalInt{Set: true, Value: 100})).
+				Column(dialect.Column("title", wf_db.ColumnTypeVarChar, wf_db.OptionalInt{Set: true, Value: 255})).
+				Column(dialect.Column("created", wf_db.ColumnTypeDateTime, wf_db.UnsetSize).SetDefaultCurrentTimestamp()).
+				UniqueConstraint("collection_id", "slug"),
+			dialect.
+				Table("postseries").
+				SetIfNotExists(false).
+				Column(dialect.Column("post_id", wf_db.ColumnTypeChar, wf_db.OptionalInt{Set: true, Value: 16}).SetPrimaryKey(true)).
+				Column(dialect.Column("collection_id", wf_db.ColumnTypeInteger, wf_db.UnsetSize)).
+				Column(dialect.Column("series_slug", wf_db.ColumnTypeVarChar, wf_db.OptionalInt{Set: true, Value: 100})).
+				Column(dialect.Column("position", wf_db.ColumnTypeInteger, wf_db.UnsetSize)),
+			dialect.CreateIndex("postseries_series", "postseries", "collection_id", "series_slug"),
+		}
+		for _, builder := range builders {
+			query, err := builder.ToSQL()
+			if err != nil {
+				return err
+			}
+			if _, err := tx.ExecContext(ctx, query); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
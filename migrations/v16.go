@@ -0,0 +1,96 @@
+/*
+ * Copyright © 2021 A Bunch Tell LLC.
+ *
+ * This file is part of WriteFreely.
+ *
+ * WriteFreely is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License, included
+ * in the LICENSE file in this source code package.
+ */
+
+package migrations
+
+import (
+	"context"
+	"database/sql"
+	"strings"
+
+	"github.com/writeas/web-core/tags"
+	wf_db "github.com/writefreely/writefreely/db"
+)
+
+func supportTags(db *datastore) error {
+	dialect := wf_db.DialectMySQL
+	if db.driverName == driverSQLite {
+		dialect = wf_db.DialectSQLite
+	}
+	return wf_db.RunTransactionWithOptions(context.Background(), db.DB, &sql.TxOptions{}, func(ctx context.Context, tx *sql.Tx) error {
+		builders := []wf_db.SQLBuilder{
+			dialect.
+				Table("posttags").
+				SetIfNotExists(false).
+				Column(dialect.Column("post_id", wf_db.ColumnTypeChar, wf_db.OptionalInt{Set: true, Value: 16})).
+				Column(dialect.Column("collection_id", wf_db.ColumnTypeInteger, wf_db.UnsetSize)).
+				Column(dialect.Column("tag", wf_db.ColumnTypeVarChar, wf_db.OptionalInt{Set: true, Value: 100})).
+				UniqueConstraint("post_id", "tag"),
+			dialect.CreateIndex("posttags_collection_tag", "posttags", "collection_id", "tag"),
+			dialect.
+				Table("collectiontags").
+				SetIfNotExists(false).
+				Column(dialect.Column("collection_id", wf_db.ColumnTypeInteger, wf_db.UnsetSize)).
+				Column(dialect.Column("tag", wf_db.ColumnTypeVarChar, wf_db.OptionalInt{Set: true, Value: 100})).
+				Column(dialect.Column("description", wf_db.ColumnTypeText, wf_db.UnsetSize)).
+				UniqueConstraint("collection_id", "tag"),
+		}
+		for _, builder := range builders {
+			query, err := builder.ToSQL()
+			if err != nil {
+				return err
+			}
+			if _, err := tx.ExecContext(ctx, query); err != nil {
+				return err
+			}
+		}
+
+		// Fill in tags from the hashtags in existing posts
+		type postTags struct {
+			id     string
+			collID int64
+			tags   []string
+		}
+		rows, err := tx.QueryContext(ctx, "SELECT id, collection_id, content FROM posts WHERE collection_id IS NOT NULL")
+		if err != nil {
+			return err
+		}
+		posts := []postTags{}
+		for rows.Next() {
+			var p postTags
+			var content string
+			if err := rows.Scan(&p.id, &p.collID, &content); err != nil {
+				rows.Close()
+				return err
+			}
+			p.tags = tags.Extract(content)
+			posts = append(posts, p)
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return err
+		}
+
+		for _, p := range posts {
+			added := map[string]bool{}
+			for _, t := range p.tags {
+				t = strings.ToLower(t)
+				if added[t] || len(t) > 100 {
+					continue
+				}
+				added[t] = true
+				if _, err := tx.ExecContext(ctx, "INSERT INTO posttags (post_id, collection_id, tag) VALUES (?, ?, ?)", p.id, p.collID, t); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	})
+}
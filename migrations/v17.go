@@ -0,0 +1,51 @@
+/*
+ * Copyright © 2021 A Bunch Tell LLC.
+ *
+ * This file is part of WriteFreely.
+ *
+ * WriteFreely is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License, included
+ * in the LICENSE file in this source code package.
+ */
+
+package migrations
+
+import (
+	"context"
+	"database/sql"
+
+	wf_db "github.com/writefreely/writefreely/db"
+)
+
+func supportMenus(db *datastore) error {
+	dialect := wf_db.DialectMySQL
+	if db.driverName == driverSQLite {
+		dialect = wf_db.DialectSQLite
+	}
+	return wf_db.RunTransactionWithOptions(context.Background(), db.DB, &sql.TxOptions{}, func(ctx context.Context, tx *sql.Tx) error {
+		builders := []wf_db.SQLBuilder{
+			dialect.
+				AlterTable("collectiontags").
+				AddColumn(dialect.Column("category", wf_db.ColumnTypeBool, wf_db.UnsetSize).SetDefault("0")),
+			dialect.
+				Table("collectionmenus").
+				SetIfNotExists(false).
+				Column(dialect.Column("collection_id", wf_db.ColumnTypeInteger, wf_db.UnsetSize)).
+				Column(dialect.Column("position", wf_db.ColumnTypeSmallInt, wf_db.UnsetSize)).
+				Column(dialect.Column("item_type", wf_db.ColumnTypeVarChar, wf_db.OptionalInt{Set: true, Value: 16})).
+				Column(dialect.Column("title", wf_db.ColumnTypeVarChar, wf_db.OptionalInt{Set: true, Value: 255})).
+				Column(dialect.Column("target", wf_db.ColumnTypeVarChar, wf_db.OptionalInt{Set: true, Value: 255})).
+				UniqueConstraint("collection_id", "position"),
+		}
+		for _, builder := range builders {
+			query, err := builder.ToSQL()
+			if err != nil {
+				return err
+			}
+			if _, err := tx.ExecContext(ctx, query); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
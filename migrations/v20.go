@@ -0,0 +1,48 @@
+/*
+ * Copyright © 2021 A Bunch Tell LLC.
+ *
+ * This file is part of WriteFreely.
+ *
+ * WriteFreely is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License, included
+ * in the LICENSE file in this source code package.
+ */
+
+package migrations
+
+import (
+	"context"
+	"database/sql"
+
+	wf_db "github.com/writefreely/writefreely/db"
+)
+
+func supportLinkEmbeds(db *datastore) error {
+	dialect := wf_db.DialectMySQL
+	if db.driverName == driverSQLite {
+		dialect = wf_db.DialectSQLite
+	}
+	return wf_db.RunTransactionWithOptions(context.Background(), db.DB, &sql.TxOptions{}, func(ctx context.Context, tx *sql.Tx) error {
+		builders := []wf_db.SQLBuilder{
+			dialect.
+				Table("linkembeds").
+				SetIfNotExists(false).
+				Column(dialect.Column("url_hash", wf_db.ColumnTypeChar, wf_db.OptionalInt{Set: true, Value: 64}).SetPrimaryKey(true)).
+				Column(dialect.Column("url", wf_db.ColumnTypeText, wf_db.UnsetSize)).
+				Column(dialect.Column("kind", wf_db.ColumnTypeVarChar, wf_db.OptionalInt{Set: true, Value: 8}).SetDefault("")).
+				Column(dialect.Column("html", wf_db.ColumnTypeText, wf_db.UnsetSize).SetNullable(true)).
+				Column(dialect.Column("fetched", wf_db.ColumnTypeDateTime, wf_db.UnsetSize).SetNullable(true)).
+				Column(dialect.Column("created", wf_db.ColumnTypeDateTime, wf_db.UnsetSize).SetDefaultCurrentTimestamp()),
+		}
+		for _, builder := range builders {
+			query, err := builder.ToSQL()
+			if err != nil {
+				return err
+			}
+			if _, err := tx.ExecContext(ctx, query); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
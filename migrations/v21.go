@@ -0,0 +1,52 @@
+/*
+ * Copyright © 2021 A Bunch Tell LLC.
+ *
+ * This file is part of WriteFreely.
+ *
+ * WriteFreely is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License, included
+ * in the LICENSE file in this source code package.
+ */
+
+package migrations
+
+import (
+	"context"
+	"database/sql"
+
+	wf_db "github.com/writefreely/writefreely/db"
+)
+
+func supportCustomDomains(db *datastore) error {
+	dialect := wf_db.DialectMySQL
+	if db.driverName == driverSQLite {
+		dialect = wf_db.DialectSQLite
+	}
+	return wf_db.RunTransactionWithOptions(context.Background(), db.DB, &sql.TxOptions{}, func(ctx context.Context, tx *sql.Tx) error {
+		builders := []wf_db.SQLBuilder{
+			dialect.
+				Table("collectiondomains").
+				SetIfNotExists(false).
+				Column(dialect.Column("collection_id", wf_db.ColumnTypeInteger, wf_db.UnsetSize).SetPrimaryKey(true)).
+				Column(dialect.Column("host", wf_db.ColumnTypeVarChar, wf_db.OptionalInt{Set: true, Value: 255})).
+				Column(dialect.Column("token", wf_db.ColumnTypeChar, wf_db.OptionalInt{Set: true, Value: 32})).
+				Column(dialect.Column("verified", wf_db.ColumnTypeDateTime, wf_db.UnsetSize).SetNullable(true)).
+				// verified_host is only set once the host is verified, so
+				// unverified claims don't keep anyone else from using it
+				Column(dialect.Column("verified_host", wf_db.ColumnTypeVarChar, wf_db.OptionalInt{Set: true, Value: 255}).SetNullable(true)).
+				Column(dialect.Column("created", wf_db.ColumnTypeDateTime, wf_db.UnsetSize).SetDefaultCurrentTimestamp()).
+				UniqueConstraint("verified_host"),
+			dialect.CreateIndex("collectiondomains_host", "collectiondomains", "host"),
+		}
+		for _, builder := range builders {
+			query, err := builder.ToSQL()
+			if err != nil {
+				return err
+			}
+			if _, err := tx.ExecContext(ctx, query); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
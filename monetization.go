@@ -108,13 +108,12 @@ func handleGetSplitContent(app *App, w http.ResponseWriter, r *http.Request) err
 	}{}
 
 	if exc := strings.Index(p.Content, shortCodePaid); exc > -1 {
-		baseURL := ""
+		d.Content = p.Content[exc+len(shortCodePaid):]
 		if coll != nil {
-			baseURL = coll.CanonicalURL()
+			d.HTMLContent = applyCollectionMarkdown([]byte(d.Content), coll.CanonicalURL(), app.cfg, coll)
+		} else {
+			d.HTMLContent = applyMarkdown([]byte(d.Content), "", app.cfg)
 		}
-
-		d.Content = p.Content[exc+len(shortCodePaid):]
-		d.HTMLContent = applyMarkdown([]byte(d.Content), baseURL, app.cfg)
 	}
 
 	return impart.WriteSuccess(w, d, http.StatusOK)
@@ -0,0 +1,621 @@
+/*
+ * Copyright © 2021 A Bunch Tell LLC.
+ *
+ * This file is part of WriteFreely.
+ *
+ * WriteFreely is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License, included
+ * in the LICENSE file in this source code package.
+ */
+
+package writefreely
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/microcosm-cc/bluemonday"
+	"github.com/writeas/impart"
+	"github.com/writeas/web-core/log"
+	"github.com/writeas/web-core/stringmanip"
+	xhtml "golang.org/x/net/html"
+)
+
+const (
+	// embedFetchInterval is how often links waiting to be embedded are
+	// looked up.
+	embedFetchInterval = time.Minute
+	// embedFetchBatch is the most links looked up each time.
+	embedFetchBatch = 20
+	// embedTTL is how long a link's embed is kept before it's looked up
+	// again, and embedFailedTTL how long a link without one waits.
+	embedTTL       = 7 * 24 * time.Hour
+	embedFailedTTL = 24 * time.Hour
+
+	embedTimeout     = 10 * time.Second
+	maxEmbedBodySize = 1 << 20
+	maxEmbedWidth    = 640
+
+	// defaultOEmbedWidth is how wide embeds of our posts are, unless the
+	// consumer asks for narrower.
+	defaultOEmbedWidth = 600
+)
+
+// Kinds of link embeds
+const (
+	embedKindNone  = ""
+	embedKindEmbed = "embed"
+	embedKindCard  = "card"
+)
+
+// embedProvider is a site whose links are embedded with oEmbed, from the
+// given endpoint.
+type embedProvider struct {
+	Name     string
+	Endpoint string
+	Schemes  []*regexp.Regexp
+}
+
+// embedProviders are the oEmbed providers that links are embedded from.
+// Links to anywhere else get a preview card.
+var embedProviders = []embedProvider{
+	{"YouTube", "https://www.youtube.com/oembed", embedSchemes(`^https?://(www\.|m\.)?youtube\.com/(watch\?|shorts/|playlist\?)`, `^https?://youtu\.be/`)},
+	{"Vimeo", "https://vimeo.com/api/oembed.json", embedSchemes(`^https?://(www\.)?vimeo\.com/(channels/[^/]+/)?\d+`)},
+	{"SoundCloud", "https://soundcloud.com/oembed", embedSchemes(`^https?://(www\.|m\.)?soundcloud\.com/[^/]+/`)},
+	{"Bandcamp", "https://bandcamp.com/oembed", embedSchemes(`^https?://[a-z0-9-]+\.bandcamp\.com/(album|track)/`)},
+	{"Spotify", "https://open.spotify.com/oembed", embedSchemes(`^https?://open\.spotify\.com/(track|album|playlist|episode|show|artist)/`)},
+	{"Flickr", "https://www.flickr.com/services/oembed/", embedSchemes(`^https?://(www\.)?flickr\.com/photos/`, `^https?://flic\.kr/p/`)},
+	{"Twitter", "https://publish.twitter.com/oembed", embedSchemes(`^https?://(www\.|mobile\.)?twitter\.com/[^/]+/status/\d+`)},
+	{"CodePen", "https://codepen.io/api/oembed", embedSchemes(`^https?://codepen\.io/[^/]+/pen/`)},
+	{"SlideShare", "https://www.slideshare.net/api/oembed/2", embedSchemes(`^https?://(www\.)?slideshare\.net/[^/]+/`)},
+}
+
+func embedSchemes(patterns ...string) []*regexp.Regexp {
+	res := make([]*regexp.Regexp, len(patterns))
+	for i, p := range patterns {
+		res[i] = regexp.MustCompile(p)
+	}
+	return res
+}
+
+// findEmbedProvider returns the provider that embeds the given URL, or nil.
+func findEmbedProvider(u string) *embedProvider {
+	for i := range embedProviders {
+		for _, s := range embedProviders[i].Schemes {
+			if s.MatchString(u) {
+				return &embedProviders[i]
+			}
+		}
+	}
+	return nil
+}
+
+// linkEmbed is what's shown in place of a link on a line of its own in a
+// post: an embed from the site it links to, a preview card, or nothing.
+type linkEmbed struct {
+	URL  string
+	Kind string
+	HTML string
+	// Fetched is when the link was last looked up, or nil when it's waiting
+	// to be.
+	Fetched *time.Time
+}
+
+// stale returns whether it's time to look up the link again.
+func (e *linkEmbed) stale() bool {
+	if e.Fetched == nil {
+		return false
+	}
+	ttl := embedTTL
+	if e.Kind == embedKindNone {
+		ttl = embedFailedTTL
+	}
+	return time.Since(*e.Fetched) > ttl
+}
+
+// linkEmbedHash returns the key the given URL's embed is saved under.
+func linkEmbedHash(u string) string {
+	h := sha256.Sum256([]byte(u))
+	return hex.EncodeToString(h[:])
+}
+
+// linkEmbedHTML returns the HTML to show in place of a link to the given URL,
+// if it's been looked up. Links that haven't been, or not in a while, are
+// queued to be looked up in the background, so rendering never waits on
+// another site.
+func (db *datastore) linkEmbedHTML(u string) string {
+	e, err := db.GetLinkEmbed(u)
+	if err != nil {
+		return ""
+	}
+	if e == nil || e.stale() {
+		db.QueueLinkEmbed(u)
+	}
+	if e == nil {
+		return ""
+	}
+	return e.HTML
+}
+
+// oEmbed is an oEmbed response, as we get them from providers and serve them
+// for our own posts.
+type oEmbed struct {
+	Type         string      `json:"type"`
+	Version      string      `json:"version"`
+	Title        string      `json:"title,omitempty"`
+	AuthorName   string      `json:"author_name,omitempty"`
+	AuthorURL    string      `json:"author_url,omitempty"`
+	ProviderName string      `json:"provider_name,omitempty"`
+	ProviderURL  string      `json:"provider_url,omitempty"`
+	URL          string      `json:"url,omitempty"`
+	HTML         string      `json:"html,omitempty"`
+	Width        interface{} `json:"width,omitempty"`
+	Height       interface{} `json:"height"`
+}
+
+// embedPolicy is what's kept of the HTML that providers give us to embed.
+// Frames are kept only when they're served securely, and scripts, which some
+// providers use to dress up a plain blockquote, never are.
+var embedPolicy = func() *bluemonday.Policy {
+	policy := bluemonday.NewPolicy()
+	policy.AllowStandardURLs()
+	policy.AllowAttrs("src").Matching(regexp.MustCompile(`^https://`)).OnElements("iframe")
+	policy.AllowAttrs("width", "height").Matching(bluemonday.NumberOrPercent).OnElements("iframe")
+	policy.AllowAttrs("frameborder").Matching(bluemonday.Integer).OnElements("iframe")
+	policy.AllowAttrs("allowfullscreen", "title").OnElements("iframe")
+	policy.AllowAttrs("cite").OnElements("blockquote")
+	policy.AllowAttrs("href").OnElements("a")
+	policy.AllowAttrs("src", "alt").OnElements("img")
+	policy.AllowElements("p", "br", "strong", "em", "span")
+	return policy
+}()
+
+// oEmbedHTML returns the HTML for embedding the given provider response for
+// the link to u, or "" if there's nothing that can be embedded.
+func oEmbedHTML(res *oEmbed, u string) string {
+	switch res.Type {
+	case "photo":
+		if !isWebURL(res.URL) {
+			return ""
+		}
+		return `<figure class="embed embed-photo"><a href="` + html.EscapeString(u) + `"><img src="` + html.EscapeString(res.URL) + `" alt="` + html.EscapeString(res.Title) + `"></a></figure>`
+	case "video", "rich":
+		h := strings.TrimSpace(embedPolicy.Sanitize(res.HTML))
+		if h == "" {
+			return ""
+		}
+		return `<figure class="embed embed-` + res.Type + `">` + h + `</figure>`
+	}
+	return ""
+}
+
+// isWebURL returns whether the given URL is an absolute http or https one.
+func isWebURL(u string) bool {
+	pu, err := url.Parse(u)
+	return err == nil && (pu.Scheme == "http" || pu.Scheme == "https") && pu.Host != ""
+}
+
+// linkCard previews a web page, from its Open Graph metadata or failing that
+// its plain HTML metadata.
+type linkCard struct {
+	Title       string
+	Description string
+	Image       string
+	SiteName    string
+}
+
+// parseLinkCard reads a preview card from the head of the HTML page at the
+// given URL.
+func parseLinkCard(r io.Reader, pageURL *url.URL) linkCard {
+	var lc linkCard
+	var title, desc string
+	z := xhtml.NewTokenizer(r)
+	inTitle := false
+loop:
+	for {
+		tt := z.Next()
+		switch tt {
+		case xhtml.ErrorToken:
+			break loop
+		case xhtml.TextToken:
+			if inTitle {
+				title += string(z.Text())
+			}
+		case xhtml.EndTagToken:
+			name, _ := z.TagName()
+			switch string(name) {
+			case "title":
+				inTitle = false
+			case "head":
+				break loop
+			}
+		case xhtml.StartTagToken, xhtml.SelfClosingTagToken:
+			name, hasAttr := z.TagName()
+			switch string(name) {
+			case "body":
+				break loop
+			case "title":
+				inTitle = tt == xhtml.StartTagToken
+			case "meta":
+				var prop, content string
+				for hasAttr {
+					var k, v []byte
+					k, v, hasAttr = z.TagAttr()
+					switch string(k) {
+					case "property", "name":
+						prop = strings.ToLower(string(v))
+					case "content":
+						content = strings.TrimSpace(string(v))
+					}
+				}
+				switch prop {
+				case "og:title":
+					lc.Title = content
+				case "og:description":
+					lc.Description = content
+				case "description":
+					desc = content
+				case "og:site_name":
+					lc.SiteName = content
+				case "og:image", "og:image:url", "og:image:secure_url":
+					if lc.Image != "" {
+						break
+					}
+					if img, err := pageURL.Parse(content); err == nil && isWebURL(img.String()) {
+						lc.Image = img.String()
+					}
+				}
+			}
+		}
+	}
+	if lc.Title == "" {
+		lc.Title = strings.TrimSpace(title)
+	}
+	if lc.Description == "" {
+		lc.Description = desc
+	}
+	if lc.SiteName == "" {
+		lc.SiteName = strings.TrimPrefix(pageURL.Hostname(), "www.")
+	}
+	lc.Title = strings.Join(strings.Fields(stringmanip.Substring(lc.Title, 0, 200)), " ")
+	lc.Description = strings.Join(strings.Fields(stringmanip.Substring(lc.Description, 0, 300)), " ")
+	return lc
+}
+
+// html returns the card's HTML, linking to the page at u.
+func (lc linkCard) html(u string) string {
+	var b strings.Builder
+	b.WriteString(`<figure class="embed embed-card"><a href="` + html.EscapeString(u) + `">`)
+	if lc.Image != "" {
+		b.WriteString(`<img src="` + html.EscapeString(lc.Image) + `" alt="">`)
+	}
+	b.WriteString(`<span class="embed-card-title">` + html.EscapeString(lc.Title) + `</span>`)
+	if lc.Description != "" {
+		b.WriteString(`<span class="embed-card-description">` + html.EscapeString(lc.Description) + `</span>`)
+	}
+	b.WriteString(`<span class="embed-card-site">` + html.EscapeString(lc.SiteName) + `</span>`)
+	b.WriteString(`</a></figure>`)
+	return b.String()
+}
+
+var errEmbedHostForbidden = errors.New("host isn't on the public internet")
+
+// embedBlockedNets are the addresses that links are never fetched from, so
+// posts can't be used to reach the server's own network.
+var embedBlockedNets = func() []*net.IPNet {
+	cidrs := []string{
+		"0.0.0.0/8", "10.0.0.0/8", "100.64.0.0/10", "127.0.0.0/8",
+		"169.254.0.0/16", "172.16.0.0/12", "192.0.0.0/24", "192.168.0.0/16",
+		"198.18.0.0/15", "224.0.0.0/4", "240.0.0.0/4",
+		"::/128", "::1/128", "fc00::/7", "fe80::/10", "ff00::/8",
+	}
+	nets := make([]*net.IPNet, len(cidrs))
+	for i, c := range cidrs {
+		_, n, err := net.ParseCIDR(c)
+		if err != nil {
+			panic(err)
+		}
+		nets[i] = n
+	}
+	return nets
+}()
+
+// isPublicIP returns whether links may be fetched from the given address.
+func isPublicIP(ip net.IP) bool {
+	for _, n := range embedBlockedNets {
+		if n.Contains(ip) {
+			return false
+		}
+	}
+	return true
+}
+
+// newEmbedClient returns an HTTP client for looking up links, which only
+// connects to public addresses, checked as it connects so a redirect or a
+// changed DNS record can't get around it.
+func newEmbedClient() *http.Client {
+	dialer := &net.Dialer{
+		Timeout: embedTimeout,
+		Control: func(network, address string, c syscall.RawConn) error {
+			host, _, err := net.SplitHostPort(address)
+			if err != nil {
+				return err
+			}
+			if ip := net.ParseIP(host); ip == nil || !isPublicIP(ip) {
+				return errEmbedHostForbidden
+			}
+			return nil
+		},
+	}
+	return &http.Client{
+		Timeout: embedTimeout,
+		Transport: &http.Transport{
+			DialContext:         dialer.DialContext,
+			TLSHandshakeTimeout: embedTimeout,
+			MaxIdleConns:        10,
+			IdleConnTimeout:     time.Minute,
+		},
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			if len(via) >= 5 {
+				return errors.New("too many redirects")
+			}
+			if req.URL.Scheme != "http" && req.URL.Scheme != "https" {
+				return fmt.Errorf("redirected to unsupported scheme %q", req.URL.Scheme)
+			}
+			return nil
+		},
+	}
+}
+
+// embedFetcher looks up links that are waiting to be embedded in the
+// background, so pages never wait on other sites.
+type embedFetcher struct {
+	app      *App
+	interval time.Duration
+	client   *http.Client
+
+	quit chan struct{}
+	wg   sync.WaitGroup
+}
+
+func newEmbedFetcher(app *App, interval time.Duration) *embedFetcher {
+	return &embedFetcher{
+		app:      app,
+		interval: interval,
+		client:   newEmbedClient(),
+		quit:     make(chan struct{}),
+	}
+}
+
+func initEmbedFetcher(app *App) {
+	app.embeds = newEmbedFetcher(app, embedFetchInterval)
+	app.embeds.start()
+}
+
+// start periodically looks up queued links until the fetcher is stopped.
+func (ef *embedFetcher) start() {
+	ef.wg.Add(1)
+	go func() {
+		defer ef.wg.Done()
+		t := time.NewTicker(ef.interval)
+		defer t.Stop()
+		for {
+			select {
+			case <-ef.quit:
+				return
+			case <-t.C:
+				ef.update()
+			}
+		}
+	}()
+}
+
+// stop ends periodic lookups. Links still queued are looked up next time.
+func (ef *embedFetcher) stop() {
+	close(ef.quit)
+	ef.wg.Wait()
+}
+
+// update looks up a batch of queued links, and saves their embeds.
+func (ef *embedFetcher) update() {
+	urls, err := ef.app.db.GetQueuedLinkEmbeds(embedFetchBatch)
+	if err != nil {
+		log.Error("Unable to get links to embed: %v", err)
+		return
+	}
+	for _, u := range urls {
+		select {
+		case <-ef.quit:
+			return
+		default:
+		}
+		kind, h := ef.fetch(u)
+		ef.app.db.SetLinkEmbed(u, kind, h)
+	}
+}
+
+// fetch returns the kind of embed the given URL has and its HTML, from its
+// oEmbed provider if it has one, or else as a preview card.
+func (ef *embedFetcher) fetch(u string) (string, string) {
+	if p := findEmbedProvider(u); p != nil {
+		h, err := ef.fetchOEmbed(p, u)
+		if err == nil && h != "" {
+			return embedKindEmbed, h
+		}
+		if err != nil {
+			log.Info("Unable to get %s embed for %s: %v", p.Name, u, err)
+		}
+	}
+	lc, err := ef.fetchCard(u)
+	if err != nil {
+		log.Info("Unable to get preview of %s: %v", u, err)
+		return embedKindNone, ""
+	}
+	if lc.Title == "" {
+		return embedKindNone, ""
+	}
+	return embedKindCard, lc.html(u)
+}
+
+func (ef *embedFetcher) fetchOEmbed(p *embedProvider, u string) (string, error) {
+	q := url.Values{}
+	q.Set("url", u)
+	q.Set("format", "json")
+	q.Set("maxwidth", strconv.Itoa(maxEmbedWidth))
+	body, _, err := ef.get(p.Endpoint+"?"+q.Encode(), "application/json")
+	if err != nil {
+		return "", err
+	}
+	res := &oEmbed{}
+	if err = json.Unmarshal(body, res); err != nil {
+		return "", err
+	}
+	return oEmbedHTML(res, u), nil
+}
+
+func (ef *embedFetcher) fetchCard(u string) (linkCard, error) {
+	pageURL, err := url.Parse(u)
+	if err != nil {
+		return linkCard{}, err
+	}
+	body, contentType, err := ef.get(u, "text/html")
+	if err != nil {
+		return linkCard{}, err
+	}
+	if !strings.HasPrefix(contentType, "text/html") && !strings.HasPrefix(contentType, "application/xhtml+xml") {
+		return linkCard{}, nil
+	}
+	return parseLinkCard(bytes.NewReader(body), pageURL), nil
+}
+
+// get returns the body of the given URL, up to the most we'll read, and its
+// content type.
+func (ef *embedFetcher) get(u, accept string) ([]byte, string, error) {
+	req, err := http.NewRequest("GET", u, nil)
+	if err != nil {
+		return nil, "", err
+	}
+	req.Header.Set("User-Agent", ServerUserAgent(ef.app.cfg.App.Host))
+	req.Header.Set("Accept", accept)
+	resp, err := ef.client.Do(req)
+	if err != nil {
+		return nil, "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, "", fmt.Errorf("status %d", resp.StatusCode)
+	}
+	body, err := ioutil.ReadAll(io.LimitReader(resp.Body, maxEmbedBodySize))
+	if err != nil {
+		return nil, "", err
+	}
+	return body, resp.Header.Get("Content-Type"), nil
+}
+
+// embeddablePost returns the post at the given URL on this instance, and its
+// collection, as long as anyone can read it.
+func embeddablePost(app *App, u string) (*PublicPost, *Collection, error) {
+	pu, err := url.Parse(u)
+	if err != nil {
+		return nil, nil, impart.HTTPError{http.StatusBadRequest, "Invalid URL."}
+	}
+	host, err := url.Parse(app.cfg.App.Host)
+	if err != nil || !strings.EqualFold(pu.Host, host.Host) {
+		return nil, nil, ErrPostNotFound
+	}
+
+	var c *Collection
+	slug := strings.Trim(pu.Path, "/")
+	if app.cfg.App.SingleUser {
+		c, err = app.db.GetCollectionByID(1)
+	} else {
+		parts := strings.SplitN(slug, "/", 2)
+		if len(parts) != 2 {
+			return nil, nil, ErrPostNotFound
+		}
+		c, err = app.db.GetCollection(parts[0])
+		slug = parts[1]
+	}
+	if err != nil {
+		return nil, nil, ErrPostNotFound
+	}
+	c.hostName = app.cfg.App.Host
+	if c.IsPrivate() || c.IsProtected() {
+		return nil, nil, ErrPostNotFound
+	}
+	silenced, err := app.db.IsUserSilenced(c.OwnerID)
+	if err != nil || silenced {
+		return nil, nil, ErrPostNotFound
+	}
+
+	p, err := app.db.GetPost(slug, c.ID)
+	if err != nil {
+		return nil, nil, ErrPostNotFound
+	}
+	if p.IsScheduled() {
+		return nil, nil, ErrPostNotFound
+	}
+	return p, c, nil
+}
+
+// handleOEmbed serves oEmbed responses for posts on this instance, so other
+// sites can embed them.
+func handleOEmbed(app *App, w http.ResponseWriter, r *http.Request) error {
+	if f := r.FormValue("format"); f != "" && f != "json" {
+		return impart.HTTPError{http.StatusNotImplemented, "Only JSON is supported."}
+	}
+	u := r.FormValue("url")
+	if u == "" {
+		return impart.HTTPError{http.StatusBadRequest, "Missing URL."}
+	}
+	p, c, err := embeddablePost(app, u)
+	if err != nil {
+		return err
+	}
+
+	width := defaultOEmbedWidth
+	if mw, err := strconv.Atoi(r.FormValue("maxwidth")); err == nil && mw > 0 && mw < width {
+		width = mw
+	}
+	postURL := c.CanonicalURL() + p.Slug.String
+	title := p.PlainDisplayTitle()
+
+	var b strings.Builder
+	b.WriteString(`<blockquote class="writefreely-embed" cite="` + html.EscapeString(postURL) + `">`)
+	b.WriteString(`<p><a href="` + html.EscapeString(postURL) + `"><strong>` + html.EscapeString(title) + `</strong></a></p>`)
+	if summary := p.Summary(); summary != "" {
+		b.WriteString(`<p>` + html.EscapeString(summary) + `</p>`)
+	}
+	b.WriteString(`<p>&mdash; <a href="` + html.EscapeString(c.CanonicalURL()) + `">` + html.EscapeString(c.DisplayTitle()) + `</a></p>`)
+	b.WriteString(`</blockquote>`)
+
+	res := oEmbed{
+		Type:         "rich",
+		Version:      "1.0",
+		Title:        title,
+		AuthorName:   c.DisplayTitle(),
+		AuthorURL:    c.CanonicalURL(),
+		ProviderName: app.cfg.App.SiteName,
+		ProviderURL:  app.cfg.App.Host,
+		HTML:         b.String(),
+		Width:        width,
+	}
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	return json.NewEncoder(w).Encode(res)
+}
@@ -0,0 +1,110 @@
+/*
+ * Copyright © 2021 A Bunch Tell LLC.
+ *
+ * This file is part of WriteFreely.
+ *
+ * WriteFreely is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License, included
+ * in the LICENSE file in this source code package.
+ */
+
+package writefreely
+
+import (
+	"net"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestFindEmbedProvider(t *testing.T) {
+	tests := map[string]string{
+		"https://www.youtube.com/watch?v=abc123":           "YouTube",
+		"https://youtu.be/abc123":                          "YouTube",
+		"https://vimeo.com/123456":                         "Vimeo",
+		"https://twitter.com/writefreely/status/123456789": "Twitter",
+		"https://www.youtube.com/":                         "",
+		"https://twitter.com/writefreely":                  "",
+		"https://example.com/watch?v=abc123":               "",
+		"https://example.com/?u=https://youtu.be/abc123":   "",
+	}
+	for u, want := range tests {
+		got := ""
+		if p := findEmbedProvider(u); p != nil {
+			got = p.Name
+		}
+		if got != want {
+			t.Errorf("findEmbedProvider(%q) = %q, want %q", u, got, want)
+		}
+	}
+}
+
+func TestIsPublicIP(t *testing.T) {
+	tests := map[string]bool{
+		"93.184.216.34":    true,
+		"2606:2800:220::1": true,
+		"127.0.0.1":        false,
+		"10.1.2.3":         false,
+		"172.16.0.1":       false,
+		"192.168.1.1":      false,
+		"169.254.169.254":  false,
+		"0.0.0.0":          false,
+		"::1":              false,
+		"::ffff:127.0.0.1": false,
+		"fd00::1":          false,
+		"fe80::1":          false,
+	}
+	for ip, want := range tests {
+		if got := isPublicIP(net.ParseIP(ip)); got != want {
+			t.Errorf("isPublicIP(%s) = %t, want %t", ip, got, want)
+		}
+	}
+}
+
+func TestParseLinkCard(t *testing.T) {
+	pageURL, _ := url.Parse("https://www.example.com/posts/1")
+	page := `<!DOCTYPE html>
+<html><head>
+<title>Fallback  title</title>
+<meta name="description" content="Plain description">
+<meta property="og:title" content="Open Graph title">
+<meta property="og:image" content="/cover.jpg">
+</head><body><meta property="og:description" content="Not in the head"></body></html>`
+
+	got := parseLinkCard(strings.NewReader(page), pageURL)
+	want := linkCard{
+		Title:       "Open Graph title",
+		Description: "Plain description",
+		Image:       "https://www.example.com/cover.jpg",
+		SiteName:    "example.com",
+	}
+	if got != want {
+		t.Errorf("parseLinkCard() = %+v, want %+v", got, want)
+	}
+
+	got = parseLinkCard(strings.NewReader(`<title>Fallback  title</title><meta property="og:image" content="javascript:alert(1)">`), pageURL)
+	if got.Title != "Fallback title" || got.Image != "" {
+		t.Errorf("parseLinkCard() = %+v, want the plain title and no image", got)
+	}
+}
+
+func TestOEmbedHTML(t *testing.T) {
+	tests := []struct {
+		name string
+		res  oEmbed
+		want string
+	}{
+		{"video", oEmbed{Type: "video", HTML: `<iframe src="https://player.example.com/1" width="640" height="360" onload="alert(1)"></iframe>`}, `<figure class="embed embed-video"><iframe src="https://player.example.com/1" width="640" height="360"></iframe></figure>`},
+		{"insecure frame", oEmbed{Type: "video", HTML: `<iframe src="http://player.example.com/1"></iframe>`}, ``},
+		{"rich", oEmbed{Type: "rich", HTML: `<blockquote class="tweet"><p>Hi</p></blockquote><script src="https://example.com/widgets.js"></script>`}, `<figure class="embed embed-rich"><blockquote><p>Hi</p></blockquote></figure>`},
+		{"photo", oEmbed{Type: "photo", URL: "https://example.com/1.jpg", Title: `"Cat"`}, `<figure class="embed embed-photo"><a href="https://example.com/p/1"><img src="https://example.com/1.jpg" alt="&#34;Cat&#34;"></a></figure>`},
+		{"photo without image", oEmbed{Type: "photo", URL: "javascript:alert(1)"}, ``},
+		{"link", oEmbed{Type: "link", Title: "Page"}, ``},
+		{"empty", oEmbed{Type: "rich", HTML: `<script>alert(1)</script>`}, ``},
+	}
+	for _, test := range tests {
+		if got := oEmbedHTML(&test.res, "https://example.com/p/1"); got != test.want {
+			t.Errorf("%s: got\n%s\nwant\n%s", test.name, got, test.want)
+		}
+	}
+}
@@ -84,7 +84,7 @@ func handleViewPad(app *App, w http.ResponseWriter, r *http.Request) error {
 	if slug != "" {
 		// TODO: refactor all of this, especially for single-user blogs
 		appData.Post = getRawCollectionPost(app, slug, collAlias)
-		if appData.Post.OwnerID != appData.User.ID {
+		if !app.db.canEditPost(appData.Post.Id, appData.Post.OwnerID, appData.User.ID) {
 			// TODO: add ErrForbiddenEditPost message to flashes
 			return impart.HTTPError{http.StatusFound, r.URL.Path[:strings.LastIndex(r.URL.Path, "/edit")]}
 		}
@@ -127,6 +127,8 @@ func handleViewMeta(app *App, w http.ResponseWriter, r *http.Request) error {
 		Post           *RawPost
 		User           *User
 		EditCollection *Collection // Collection of the post we're editing, if any
+		Series         *PostSeries
+		PagePosition   int // Place among the collection's pages, or 0 if the post isn't one
 		Flashes        []string
 		NeedsToken     bool
 		Silenced       bool
@@ -151,7 +153,7 @@ func handleViewMeta(app *App, w http.ResponseWriter, r *http.Request) error {
 	w.Header().Set("Expires", "Thu, 28 Jul 1989 12:00:00 GMT")
 	if slug != "" {
 		appData.Post = getRawCollectionPost(app, slug, collAlias)
-		if appData.Post.OwnerID != appData.User.ID {
+		if !app.db.canEditPost(appData.Post.Id, appData.Post.OwnerID, appData.User.ID) {
 			// TODO: add ErrForbiddenEditPost message to flashes
 			return impart.HTTPError{http.StatusFound, r.URL.Path[:strings.LastIndex(r.URL.Path, "/meta")]}
 		}
@@ -165,12 +167,13 @@ func handleViewMeta(app *App, w http.ResponseWriter, r *http.Request) error {
 			return err
 		}
 		appData.EditCollection.hostName = app.cfg.App.Host
+		appData.PagePosition = getPagePosition(app, appData.EditCollection, appData.Post.Id)
 	} else {
 		// Editing a floating article
 		appData.Post = getRawPost(app, action)
 		appData.Post.Id = action
 	}
-	appData.NeedsToken = appData.User == nil || appData.User.ID != appData.Post.OwnerID
+	appData.NeedsToken = appData.User == nil || !app.db.canEditPost(appData.Post.Id, appData.Post.OwnerID, appData.User.ID)
 
 	if appData.Post.Gone {
 		return ErrPostUnpublished
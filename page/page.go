@@ -30,6 +30,8 @@ type StaticPage struct {
 	CanViewReader bool
 	IsAdmin       bool
 	CanInvite     bool
+	// Locale is the language the interface is shown in
+	Locale string
 }
 
 // SanitizeHost alters the StaticPage to contain a real hostname. This is
@@ -23,10 +23,12 @@ import (
 	"unicode"
 	"unicode/utf8"
 
+	chromahtml "github.com/alecthomas/chroma/formatters/html"
+	"github.com/alecthomas/chroma/styles"
+	"github.com/gorilla/mux"
 	"github.com/microcosm-cc/bluemonday"
 	stripmd "github.com/writeas/go-strip-markdown/v2"
 	"github.com/writeas/impart"
-	blackfriday "github.com/writeas/saturday"
 	"github.com/writeas/web-core/log"
 	"github.com/writeas/web-core/stringmanip"
 	"github.com/writefreely/writefreely/config"
@@ -38,7 +40,6 @@ var (
 	endBlockReg     = regexp.MustCompile("</([a-z]+)>\n</(ul|ol|blockquote)>")
 	youtubeReg      = regexp.MustCompile("(https?://www.youtube.com/embed/[a-zA-Z0-9\\-_]+)(\\?[^\t\n\f\r \"']+)?")
 	titleElementReg = regexp.MustCompile("</?h[1-6]>")
-	hashtagReg      = regexp.MustCompile(`{{\[\[\|\|([^|]+)\|\|\]\]}}`)
 	markeddownReg   = regexp.MustCompile("<p>(.+)</p>")
 	mentionReg      = regexp.MustCompile(`@([A-Za-z0-9._%+-]+)(@[A-Za-z0-9.-]+\.[A-Za-z]+)\b`)
 )
@@ -67,7 +68,7 @@ func (p *Post) handlePremiumContent(c *Collection, isOwner, postPage bool, cfg *
 				}
 
 				p.Content = p.Content[:spl+len(shortCodePaid)]
-				p.HTMLExcerpt = template.HTML(applyMarkdown([]byte(p.Content[:spl]), baseURL, cfg))
+				p.HTMLExcerpt = template.HTML(applyCollectionMarkdown([]byte(p.Content[:spl]), baseURL, cfg, c))
 			}
 		}
 	}
@@ -76,7 +77,7 @@ func (p *Post) handlePremiumContent(c *Collection, isOwner, postPage bool, cfg *
 func (p *Post) formatContent(cfg *config.Config, c *Collection, isOwner bool, isPostPage bool) {
 	baseURL := c.CanonicalURL()
 	// TODO: redundant
-	if !isSingleUser {
+	if !isSingleUser && c.Domain() == "" {
 		baseURL = "/" + c.Alias + "/"
 	}
 
@@ -84,9 +85,12 @@ func (p *Post) formatContent(cfg *config.Config, c *Collection, isOwner bool, is
 	p.Content = strings.Replace(p.Content, "&lt;!--paid-->", "<!--paid-->", 1)
 
 	p.HTMLTitle = template.HTML(applyBasicMarkdown([]byte(p.Title.String)))
-	p.HTMLContent = template.HTML(applyMarkdown([]byte(p.Content), baseURL, cfg))
+	p.HTMLContent = template.HTML(applyCollectionMarkdown([]byte(p.Content), baseURL, cfg, c))
+	if isPostPage && c.db != nil && c.ShowTOC() {
+		p.HTMLTOC = template.HTML(tableOfContents([]byte(p.Content)))
+	}
 	if exc := strings.Index(string(p.Content), "<!--more-->"); exc > -1 {
-		p.HTMLExcerpt = template.HTML(applyMarkdown([]byte(p.Content[:exc]), baseURL, cfg))
+		p.HTMLExcerpt = template.HTML(applyCollectionMarkdown([]byte(p.Content[:exc]), baseURL, cfg, c))
 	}
 }
 
@@ -120,7 +124,19 @@ func (p *PublicPost) augmentReadingDestination() {
 }
 
 func applyMarkdown(data []byte, baseURL string, cfg *config.Config) string {
-	return applyMarkdownSpecial(data, false, baseURL, cfg)
+	return applyMarkdownSpecial(data, false, false, baseURL, cfg, nil)
+}
+
+// applyCollectionMarkdown renders a post on the given collection, including
+// any math when the collection has it turned on, and embeds for links on lines
+// of their own.
+func applyCollectionMarkdown(data []byte, baseURL string, cfg *config.Config, c *Collection) string {
+	if c.db == nil {
+		return applyMarkdownSpecial(data, false, false, baseURL, cfg, nil)
+	}
+	// Only look up the setting when there might be math
+	math := bytes.ContainsAny(data, "$\\") && c.RenderMathJax()
+	return applyMarkdownSpecial(data, false, math, baseURL, cfg, c.db.linkEmbedHTML)
 }
 
 func disableYoutubeAutoplay(outHTML string) string {
@@ -142,34 +158,19 @@ func disableYoutubeAutoplay(outHTML string) string {
 	return outHTML
 }
 
-func applyMarkdownSpecial(data []byte, skipNoFollow bool, baseURL string, cfg *config.Config) string {
-	mdExtensions := 0 |
-		blackfriday.EXTENSION_TABLES |
-		blackfriday.EXTENSION_FENCED_CODE |
-		blackfriday.EXTENSION_AUTOLINK |
-		blackfriday.EXTENSION_STRIKETHROUGH |
-		blackfriday.EXTENSION_SPACE_HEADERS |
-		blackfriday.EXTENSION_AUTO_HEADER_IDS
-	htmlFlags := 0 |
-		blackfriday.HTML_USE_SMARTYPANTS |
-		blackfriday.HTML_SMARTYPANTS_DASHES
-
-	if baseURL != "" {
-		htmlFlags |= blackfriday.HTML_HASHTAGS
-	}
-
-	// Generate Markdown
-	md := blackfriday.Markdown([]byte(data), blackfriday.HtmlRenderer(htmlFlags, "", ""), mdExtensions)
+func applyMarkdownSpecial(data []byte, skipNoFollow, math bool, baseURL string, cfg *config.Config, embeds linkEmbedder) string {
+	// Hashtags and mentions are only linked in posts shown on a collection
+	var tagPrefix, handlePrefix string
 	if baseURL != "" {
-		// Replace special text generated by Markdown parser
-		tagPrefix := baseURL + "tag:"
+		tagPrefix = baseURL + "tag:"
 		if cfg.App.Chorus {
 			tagPrefix = "/read/t/"
 		}
-		md = []byte(hashtagReg.ReplaceAll(md, []byte("<a href=\""+tagPrefix+"$1\" class=\"hashtag\"><span>#</span><span class=\"p-category\">$1</span></a>")))
-		handlePrefix := cfg.App.Host + "/@/"
-		md = []byte(mentionReg.ReplaceAll(md, []byte("<a href=\""+handlePrefix+"$1$2\" class=\"u-url mention\">@<span>$1$2</span></a>")))
+		handlePrefix = cfg.App.Host + "/@/"
 	}
+
+	// Generate Markdown
+	md := renderMarkdown(postMarkdown, data, tagPrefix, handlePrefix, math, embeds)
 	// Strip out bad HTML
 	policy := getSanitizationPolicy()
 	policy.RequireNoFollowOnLinks(!skipNoFollow)
@@ -186,21 +187,12 @@ func applyBasicMarkdown(data []byte) string {
 		return ""
 	}
 
-	mdExtensions := 0 |
-		blackfriday.EXTENSION_STRIKETHROUGH |
-		blackfriday.EXTENSION_SPACE_HEADERS |
-		blackfriday.EXTENSION_HEADER_IDS
-	htmlFlags := 0 |
-		blackfriday.HTML_SKIP_HTML |
-		blackfriday.HTML_USE_SMARTYPANTS |
-		blackfriday.HTML_SMARTYPANTS_DASHES
-
 	// Generate Markdown
-	// This passes the supplied title into blackfriday.Markdown() as an H1 header, so we only render HTML that
+	// This passes the supplied title into the Markdown renderer as an H1 header, so we only render HTML that
 	// belongs in an H1.
-	md := blackfriday.Markdown(append([]byte("# "), data...), blackfriday.HtmlRenderer(htmlFlags, "", ""), mdExtensions)
+	md := renderMarkdown(titleMarkdown, append([]byte("# "), data...), "", "", false, nil)
 	// Remove H1 markup
-	md = bytes.TrimSpace(md) // blackfriday.Markdown adds a newline at the end of the <h1>
+	md = bytes.TrimSpace(md) // the renderer adds a newline at the end of the <h1>
 	md = md[len("<h1>") : len(md)-len("</h1>")]
 	// Strip out bad HTML
 	policy := bluemonday.UGCPolicy()
@@ -266,6 +258,22 @@ func getSanitizationPolicy() *bluemonday.Policy {
 	policy.AllowAttrs("controls", "loop", "muted", "autoplay", "preload").OnElements("audio")
 	policy.AllowAttrs("target").OnElements("a")
 	policy.AllowAttrs("title").OnElements("abbr")
+	// Allow task list checkboxes
+	policy.AllowAttrs("type").Matching(regexp.MustCompile("^checkbox$")).OnElements("input")
+	policy.AllowAttrs("checked", "disabled").OnElements("input")
+	// Keep footnotes' accessible roles
+	policy.AllowAttrs("role").Matching(regexp.MustCompile("^doc-(noteref|endnotes|backlink)$")).Globally()
+	// MathML, for rendered math
+	policy.AllowNoAttrs().OnElements("math", "semantics", "annotation", "mrow", "mi", "mn", "mo", "mtext", "mspace", "msub", "msup", "msubsup", "munder", "mover", "munderover", "mfrac", "msqrt", "mroot", "mtable", "mtr", "mtd", "merror")
+	policy.AllowAttrs("xmlns", "display").OnElements("math")
+	policy.AllowAttrs("encoding").OnElements("annotation")
+	policy.AllowAttrs("mathvariant").OnElements("mi", "mn", "mtext")
+	policy.AllowAttrs("fence", "stretchy", "minsize", "maxsize", "lspace", "rspace").OnElements("mo")
+	policy.AllowAttrs("width").OnElements("mspace")
+	policy.AllowAttrs("accent").OnElements("mover")
+	policy.AllowAttrs("accentunder").OnElements("munder")
+	policy.AllowAttrs("linethickness").OnElements("mfrac")
+	policy.AllowAttrs("displaystyle", "columnalign").OnElements("mtable")
 	policy.AllowAttrs("style", "class", "id").Globally()
 	policy.AllowElements("header", "footer")
 	policy.AllowURLSchemes("http", "https", "mailto", "xmpp")
@@ -356,3 +364,16 @@ func handleRenderMarkdown(app *App, w http.ResponseWriter, r *http.Request) erro
 
 	return impart.WriteSuccess(w, out, http.StatusOK)
 }
+
+// handleViewCodeTheme serves the stylesheet for highlighted code in the
+// requested theme.
+func handleViewCodeTheme(app *App, w http.ResponseWriter, r *http.Request) error {
+	theme := mux.Vars(r)["theme"]
+	if !isCodeTheme(theme) {
+		return impart.HTTPError{http.StatusNotFound, "Theme doesn't exist."}
+	}
+
+	w.Header().Set("Content-Type", "text/css; charset=utf-8")
+	w.Header().Set("Cache-Control", "public, max-age=604800")
+	return chromahtml.New(chromahtml.WithClasses(true)).WriteCSS(w, styles.Get(theme))
+}
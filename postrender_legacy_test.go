@@ -0,0 +1,62 @@
+/*
+ * Copyright © 2021 A Bunch Tell LLC.
+ *
+ * This file is part of WriteFreely.
+ *
+ * WriteFreely is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License, included
+ * in the LICENSE file in this source code package.
+ */
+
+package writefreely
+
+import (
+	"regexp"
+
+	blackfriday "github.com/writeas/saturday"
+	"github.com/writefreely/writefreely/config"
+)
+
+var legacyHashtagReg = regexp.MustCompile(`{{\[\[\|\|([^|]+)\|\|\]\]}}`)
+
+// applyLegacyMarkdown renders post content the way it was before the switch
+// to CommonMark, so golden tests can show how output has changed for
+// existing content.
+func applyLegacyMarkdown(data []byte, baseURL string, cfg *config.Config) string {
+	mdExtensions := 0 |
+		blackfriday.EXTENSION_TABLES |
+		blackfriday.EXTENSION_FENCED_CODE |
+		blackfriday.EXTENSION_AUTOLINK |
+		blackfriday.EXTENSION_STRIKETHROUGH |
+		blackfriday.EXTENSION_SPACE_HEADERS |
+		blackfriday.EXTENSION_AUTO_HEADER_IDS
+	htmlFlags := 0 |
+		blackfriday.HTML_USE_SMARTYPANTS |
+		blackfriday.HTML_SMARTYPANTS_DASHES
+
+	if baseURL != "" {
+		htmlFlags |= blackfriday.HTML_HASHTAGS
+	}
+
+	// Generate Markdown
+	md := blackfriday.Markdown([]byte(data), blackfriday.HtmlRenderer(htmlFlags, "", ""), mdExtensions)
+	if baseURL != "" {
+		// Replace special text generated by Markdown parser
+		tagPrefix := baseURL + "tag:"
+		if cfg.App.Chorus {
+			tagPrefix = "/read/t/"
+		}
+		md = []byte(legacyHashtagReg.ReplaceAll(md, []byte("<a href=\""+tagPrefix+"$1\" class=\"hashtag\"><span>#</span><span class=\"p-category\">$1</span></a>")))
+		handlePrefix := cfg.App.Host + "/@/"
+		md = []byte(mentionReg.ReplaceAll(md, []byte("<a href=\""+handlePrefix+"$1$2\" class=\"u-url mention\">@<span>$1$2</span></a>")))
+	}
+	// Strip out bad HTML
+	policy := getSanitizationPolicy()
+	policy.RequireNoFollowOnLinks(true)
+	outHTML := string(policy.SanitizeBytes(md))
+	// Strip newlines on certain block elements that render with them
+	outHTML = blockReg.ReplaceAllString(outHTML, "<$1>")
+	outHTML = endBlockReg.ReplaceAllString(outHTML, "</$1></$2>")
+	outHTML = disableYoutubeAutoplay(outHTML)
+	return outHTML
+}
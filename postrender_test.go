@@ -10,7 +10,40 @@
 
 package writefreely
 
-import "testing"
+import (
+	"flag"
+	"io/ioutil"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+
+	"github.com/writefreely/writefreely/config"
+)
+
+var updateGolden = flag.Bool("update", false, "update golden files in testdata")
+
+// legacyMarkdownChanges are the golden Markdown files whose HTML differs on
+// purpose from what the old renderer made of them, and why.
+var legacyMarkdownChanges = map[string]string{
+	"code":       "code is highlighted on the server",
+	"deflist":    "definition lists are new",
+	"footnotes":  "footnotes are new",
+	"intraword":  "underscores within words don't make emphasis, as in CommonMark",
+	"linkembeds": "links on lines of their own are embedded",
+	"math":       "math is rendered as MathML",
+	"table":      "column alignment is a style, not the obsolete align attribute",
+	"tasklist":   "task lists are new",
+}
+
+var htmlSpaceReg = regexp.MustCompile(`\s+`)
+
+// normalizeHTMLSpace collapses whitespace in the given HTML, so renderers that
+// only differ in newlines between elements compare the same.
+func normalizeHTMLSpace(s string) string {
+	s = htmlSpaceReg.ReplaceAllString(strings.TrimSpace(s), " ")
+	return strings.NewReplacer("> <", "><", " <", "<", "> ", ">").Replace(s)
+}
 
 func TestApplyBasicMarkdown(t *testing.T) {
 	tests := []struct {
@@ -41,3 +74,76 @@ func TestApplyBasicMarkdown(t *testing.T) {
 		})
 	}
 }
+
+// testLinkEmbed stands in for links that have been looked up for embedding.
+func testLinkEmbed(u string) string {
+	switch u {
+	case "https://www.youtube.com/watch?v=abc123":
+		return oEmbedHTML(&oEmbed{
+			Type: "video",
+			HTML: `<iframe width="640" height="360" src="https://www.youtube.com/embed/abc123?feature=oembed&autoplay=1" frameborder="0" allowfullscreen></iframe><script src="https://www.youtube.com/player.js"></script>`,
+		}, u)
+	case "https://example.com/article":
+		return linkCard{
+			Title:       "An article",
+			Description: "What it's about, & why.",
+			Image:       "https://example.com/cover.jpg",
+			SiteName:    "Example",
+		}.html(u)
+	}
+	return ""
+}
+
+// TestApplyMarkdownGolden renders the Markdown files in testdata/markdown,
+// comparing the results with the HTML files beside them, and with what the old
+// renderer made of them. Files named math* are rendered with math turned on,
+// and files named linkembeds* with links embedded by testLinkEmbed. Run with
+// -update to rewrite the HTML files.
+func TestApplyMarkdownGolden(t *testing.T) {
+	cfg := &config.Config{}
+	cfg.App.Host = "https://example.com"
+	baseURL := "https://example.com/blog/"
+
+	files, err := filepath.Glob(filepath.Join("testdata", "markdown", "*.md"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, f := range files {
+		name := strings.TrimSuffix(filepath.Base(f), ".md")
+		t.Run(name, func(t *testing.T) {
+			in, err := ioutil.ReadFile(f)
+			if err != nil {
+				t.Fatal(err)
+			}
+			math := strings.HasPrefix(name, "math")
+			var embeds linkEmbedder
+			if strings.HasPrefix(name, "linkembeds") {
+				embeds = testLinkEmbed
+			}
+			got := applyMarkdownSpecial(in, false, math, baseURL, cfg, embeds)
+
+			golden := strings.TrimSuffix(f, ".md") + ".html"
+			if *updateGolden {
+				err = ioutil.WriteFile(golden, []byte(got), 0644)
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+			want, err := ioutil.ReadFile(golden)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != string(want) {
+				t.Errorf("%s: got\n%s\nwant\n%s", name, got, want)
+			}
+
+			legacy := applyLegacyMarkdown(in, baseURL, cfg)
+			changed := normalizeHTMLSpace(got) != normalizeHTMLSpace(legacy)
+			if reason, ok := legacyMarkdownChanges[name]; ok && !changed {
+				t.Errorf("%s: same as the old renderer, though listed as changed (%s)", name, reason)
+			} else if !ok && changed {
+				t.Errorf("%s: differs from the old renderer\nold: %s\nnew: %s", name, legacy, got)
+			}
+		})
+	}
+}
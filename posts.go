@@ -11,6 +11,7 @@
 package writefreely
 
 import (
+	"bytes"
 	"database/sql"
 	"encoding/json"
 	"fmt"
@@ -31,7 +32,6 @@ import (
 	"github.com/writeas/monday"
 	"github.com/writeas/slug"
 	"github.com/writeas/web-core/activitystreams"
-	"github.com/writeas/web-core/bots"
 	"github.com/writeas/web-core/converter"
 	"github.com/writeas/web-core/i18n"
 	"github.com/writeas/web-core/log"
@@ -88,6 +88,20 @@ type (
 		IsRTL    converter.NullJSONBool   `json:"rtl" schema:"rtl"`
 		Language converter.NullJSONString `json:"lang" schema:"lang"`
 		Created  *string                  `json:"created" schema:"created"`
+
+		// Series is the title of the series the post is part of, or "" to
+		// remove it from its series. SeriesPart places it in the series,
+		// counting from 1; otherwise it's added to the end.
+		Series     *string `json:"series" schema:"series"`
+		SeriesPart *int    `json:"series_part" schema:"series_part"`
+
+		// Page makes the post one of its collection's pages, which are kept
+		// out of the collection's posts and feeds, or turns it back into a
+		// regular post. PagePosition orders it among the other pages,
+		// counting from 1; otherwise it keeps its place, or is added to the
+		// end.
+		Page         *bool `json:"page" schema:"page"`
+		PagePosition *int  `json:"page_position" schema:"page_position"`
 	}
 
 	// Post represents a post as found in the database.
@@ -101,6 +115,7 @@ type (
 		OwnerID        null.Int      `db:"owner_id" json:"-"`
 		CollectionID   null.Int      `db:"collection_id" json:"-"`
 		PinnedPosition null.Int      `db:"pinned_position" json:"-"`
+		PagePosition   null.Int      `db:"page_position" json:"-"`
 		Created        time.Time     `db:"created" json:"created"`
 		Updated        time.Time     `db:"updated" json:"updated"`
 		ViewCount      int64         `db:"view_count" json:"-"`
@@ -112,6 +127,10 @@ type (
 		Tags           []string      `json:"tags"`
 		Images         []string      `json:"images,omitempty"`
 		IsPaid         bool          `json:"paid"`
+		IsPage         bool          `json:"page,omitempty"`
+		WordCount      int           `json:"word_count"`
+		ReadingTime    int           `json:"reading_time"`
+		HTMLTOC        template.HTML `json:"-"`
 
 		OwnerName string `json:"owner,omitempty"`
 	}
@@ -127,9 +146,13 @@ type (
 		DisplayDate string         `json:"-"`
 		Views       int64          `json:"views"`
 		Owner       *PublicUser    `json:"-"`
+		Author      *PublicUser    `json:"author,omitempty"`
 		IsOwner     bool           `json:"-"`
 		URL         string         `json:"url,omitempty"`
 		Collection  *CollectionObj `json:"collection,omitempty"`
+		Series      *PostSeries    `json:"series,omitempty"`
+		Categories  []string       `json:"categories,omitempty"`
+		ReadNext    []RelatedPost  `json:"read_next,omitempty"`
 	}
 
 	CollectionPostPage struct {
@@ -269,6 +292,10 @@ func (p *Post) Created8601() string {
 	return p.Created.Format("2006-01-02T15:04:05Z")
 }
 
+func (p *Post) Updated8601() string {
+	return p.Updated.Format("2006-01-02T15:04:05Z")
+}
+
 func (p *Post) IsScheduled() bool {
 	return p.Created.After(time.Now())
 }
@@ -501,11 +528,8 @@ func handleViewPost(app *App, w http.ResponseWriter, r *http.Request) error {
 			return
 		}
 		// Update stats for non-raw post views
-		if !isRaw && r.Method != "HEAD" && !bots.IsBot(r.UserAgent()) {
-			_, err := app.db.Exec("UPDATE posts SET view_count = view_count + 1 WHERE id = ?", friendlyID)
-			if err != nil {
-				log.Error("Unable to update posts count: %v", err)
-			}
+		if !isRaw && !isBotRequest(r) {
+			app.views.addPostView(r, friendlyID)
 		}
 	}()
 
@@ -628,13 +652,21 @@ func newPost(app *App, w http.ResponseWriter, r *http.Request) error {
 				return err
 			}
 			coll.hostName = app.cfg.App.Host
-			if coll.OwnerID != u.ID {
+			if !app.db.collectionRole(coll, u.ID).CanPost() {
 				return ErrForbiddenCollection
 			}
 			collID = coll.ID
 		}
 		// TODO: return PublicPost from createPost
-		newPost.Post, err = app.db.CreatePost(userID, collID, p)
+		if coll != nil {
+			// Posts in a collection belong to its owner, even when a member wrote them
+			newPost.Post, err = app.db.CreatePost(coll.OwnerID, collID, p)
+			if err == nil {
+				app.db.SetPostAuthor(newPost.ID, userID)
+			}
+		} else {
+			newPost.Post, err = app.db.CreatePost(userID, collID, p)
+		}
 	}
 	if err != nil {
 		return err
@@ -648,6 +680,27 @@ func newPost(app *App, w http.ResponseWriter, r *http.Request) error {
 	newPost.OwnerName = username
 	newPost.URL = newPost.CanonicalURL(app.cfg.App.Host)
 
+	if newPost.Collection != nil {
+		if p.Series != nil {
+			err = app.db.SetPostSeries(newPost.ID, newPost.Collection.ID, *p.Series, seriesPart(p))
+			if err != nil {
+				log.Error("Unable to add new post to series: %v", err)
+			} else {
+				newPost.Series = getPostSeries(app, &newPost.Collection.Collection, newPost, true)
+			}
+		}
+		if p.Page != nil && *p.Page {
+			err = app.db.SetPostPage(newPost.ID, newPost.Collection.ID, true, pagePosition(p))
+			if err != nil {
+				log.Error("Unable to make new post a page: %v", err)
+			} else {
+				newPost.IsPage = true
+			}
+		}
+		app.pages.invalidate(newPost.Collection.ID)
+		app.related.queue(newPost.Collection.ID)
+	}
+
 	// Write success now
 	response := impart.WriteSuccess(w, newPost, http.StatusCreated)
 
@@ -735,7 +788,8 @@ func existingPost(app *App, w http.ResponseWriter, r *http.Request) error {
 	// Modify post struct
 	p.ID = postID
 
-	err = app.db.UpdateOwnedPost(&p, userID)
+	err = app.db.UpdateOwnedPost(&p, app.db.postEditorOwnerID(postID, userID))
+	updated := err == nil
 	if err != nil {
 		if reqJSON {
 			return err
@@ -758,6 +812,30 @@ func existingPost(app *App, w http.ResponseWriter, r *http.Request) error {
 	}
 
 	if pRes.CollectionID.Valid {
+		if updated && p.Series != nil {
+			err = app.db.SetPostSeries(p.ID, pRes.CollectionID.Int64, *p.Series, seriesPart(p.SubmittedPost))
+			if err != nil {
+				if reqJSON {
+					return err
+				}
+				log.Error("Unable to update post series: %v", err)
+			}
+		}
+		pRes.IsPage = pRes.PagePosition.Valid
+		if updated && p.Page != nil {
+			err = app.db.SetPostPage(p.ID, pRes.CollectionID.Int64, *p.Page, pagePosition(p.SubmittedPost))
+			if err != nil {
+				if reqJSON {
+					return err
+				}
+				log.Error("Unable to update post page: %v", err)
+			} else {
+				pRes.IsPage = *p.Page
+			}
+		}
+		app.pages.invalidate(pRes.CollectionID.Int64)
+		app.related.queue(pRes.CollectionID.Int64)
+		removeShareCards(app, pRes.ID)
 		coll, err := app.db.GetCollectionBy("id = ?", pRes.CollectionID.Int64)
 		if err == nil && !app.cfg.App.Private && app.cfg.App.Federation {
 			coll.hostName = app.cfg.App.Host
@@ -841,6 +919,7 @@ func deletePost(app *App, w http.ResponseWriter, r *http.Request) error {
 		} else {
 			ownerID = u.ID
 		}
+		ownerID = app.db.postEditorOwnerID(friendlyID, ownerID)
 
 		// TODO: don't make two queries
 		var realOwnerID sql.NullInt64
@@ -875,11 +954,30 @@ func deletePost(app *App, w http.ResponseWriter, r *http.Request) error {
 				return err
 			}
 			res, err = t.Exec("DELETE FROM posts WHERE id = ? AND owner_id = ?", friendlyID, ownerID)
+			if err == nil {
+				_, err = t.Exec("DELETE FROM postauthors WHERE post_id = ?", friendlyID)
+			}
+			if err == nil {
+				_, err = t.Exec("DELETE FROM postviews WHERE post_id = ?", friendlyID)
+			}
+			if err == nil {
+				_, err = t.Exec("DELETE FROM postseries WHERE post_id = ?", friendlyID)
+			}
+			if err == nil {
+				_, err = t.Exec("DELETE FROM posttags WHERE post_id = ?", friendlyID)
+			}
+			if err == nil {
+				_, err = t.Exec("DELETE FROM relatedposts WHERE post_id = ? OR related_id = ?", friendlyID, friendlyID)
+			}
 		}
 	} else {
 		return impart.HTTPError{http.StatusBadRequest, "No authenticated user or post token given."}
 	}
 	if err != nil {
+		if t != nil {
+			t.Rollback()
+			log.Error("Couldn't delete post %s; rolling back: %v", friendlyID, err)
+		}
 		return err
 	}
 
@@ -900,6 +998,11 @@ func deletePost(app *App, w http.ResponseWriter, r *http.Request) error {
 	if t != nil {
 		t.Commit()
 	}
+	if coll != nil {
+		app.pages.invalidate(coll.ID)
+		app.related.queue(coll.ID)
+	}
+	removeShareCards(app, friendlyID)
 	if coll != nil && !app.cfg.App.Private && app.cfg.App.Federation {
 		go deleteFederatedPost(app, pp, collID.Int64)
 	}
@@ -951,6 +1054,12 @@ func addPost(app *App, w http.ResponseWriter, r *http.Request) error {
 	if err != nil {
 		return err
 	}
+	for _, pRes := range *res {
+		if pRes.Code == http.StatusOK && pRes.Post.Collection != nil {
+			app.pages.invalidate(pRes.Post.Collection.ID)
+			app.related.queue(pRes.Post.Collection.ID)
+		}
+	}
 
 	if !app.cfg.App.Private && app.cfg.App.Federation {
 		for _, pRes := range *res {
@@ -998,6 +1107,12 @@ func dispersePost(app *App, w http.ResponseWriter, r *http.Request) error {
 	if err != nil {
 		return err
 	}
+	if colls, err := app.db.GetCollections(&User{ID: ownerID}, app.cfg.App.Host); err == nil {
+		for _, c := range *colls {
+			app.pages.invalidate(c.ID)
+			app.related.queue(c.ID)
+		}
+	}
 	return impart.WriteSuccess(w, res, http.StatusOK)
 }
 
@@ -1055,7 +1170,7 @@ func pinPost(app *App, w http.ResponseWriter, r *http.Request) error {
 	if err != nil {
 		return err
 	}
-	if coll.OwnerID != userID {
+	if !app.db.collectionRole(coll, userID).CanEditAll() {
 		return ErrForbiddenCollection
 	}
 
@@ -1073,6 +1188,7 @@ func pinPost(app *App, w http.ResponseWriter, r *http.Request) error {
 		}
 		res = append(res, ppr)
 	}
+	app.pages.invalidate(coll.ID)
 	return impart.WriteSuccess(w, res, http.StatusOK)
 }
 
@@ -1107,6 +1223,8 @@ func fetchPost(app *App, w http.ResponseWriter, r *http.Request) error {
 		if err != nil {
 			return err
 		}
+		p.Series = getPostSeries(app, coll, p, false)
+		p.ReadNext = getReadNext(app, coll, p.ID, false)
 	}
 
 	silenced, err := app.db.IsUserSilenced(p.OwnerID.Int64)
@@ -1128,8 +1246,8 @@ func fetchPost(app *App, w http.ResponseWriter, r *http.Request) error {
 		}
 
 		p.Collection = &CollectionObj{Collection: *coll}
-		po := p.ActivityObject(app)
-		po.Context = []interface{}{activitystreams.Namespace}
+		p.loadAuthor(app, coll)
+		po := p.activityArticle(app)
 		setCacheControl(w, apCacheTime)
 		return impart.RenderActivityJSON(w, po, http.StatusOK)
 	}
@@ -1185,10 +1303,10 @@ func (p *PublicPost) ActivityObject(app *App) *activitystreams.Object {
 		p.formatContent(cfg, false, false)
 		p.augmentReadingDestination()
 	}
-	o.Content = string(p.HTMLContent)
+	o.Content = string(p.HTMLContent) + p.authorByline()
 	if p.Language.Valid {
 		o.ContentMap = map[string]string{
-			p.Language.String: string(p.HTMLContent),
+			p.Language.String: o.Content,
 		}
 	}
 	if len(p.Tags) == 0 {
@@ -1391,7 +1509,7 @@ func viewCollectionPost(app *App, w http.ResponseWriter, r *http.Request) error
 	// Normalize the URL, redirecting user to consistent post URL
 	if slug != strings.ToLower(slug) {
 		loc := fmt.Sprintf("/%s", strings.ToLower(slug))
-		if !app.cfg.App.SingleUser {
+		if !app.cfg.App.SingleUser && !cr.isCustomDomain {
 			loc = "/" + cr.alias + loc
 		}
 		return impart.HTTPError{http.StatusMovedPermanently, loc}
@@ -1418,16 +1536,24 @@ func viewCollectionPost(app *App, w http.ResponseWriter, r *http.Request) error
 	}
 	c.hostName = app.cfg.App.Host
 
+	if err = customDomainRedirect(c, cr, u, r); err != nil {
+		return err
+	}
+
 	silenced, err := app.db.IsUserSilenced(c.OwnerID)
 	if err != nil {
 		log.Error("view collection post: %v", err)
 	}
 
 	// Check collection permissions
-	if c.IsPrivate() && (u == nil || u.ID != c.OwnerID) {
+	var role collRole
+	if u != nil {
+		role = app.db.collectionRole(c, u.ID)
+	}
+	if c.IsPrivate() && !role.CanRead() {
 		return ErrPostNotFound
 	}
-	if c.IsProtected() && (u == nil || u.ID != c.OwnerID) {
+	if c.IsProtected() && !role.CanRead() {
 		if silenced {
 			return ErrPostNotFound
 		} else if !isAuthorizedForCollection(app, c.Alias, r) {
@@ -1441,6 +1567,22 @@ func viewCollectionPost(app *App, w http.ResponseWriter, r *http.Request) error
 		slug = strings.Split(slug, ".")[0]
 	}
 
+	// Serve a cached page to readers who aren't logged in
+	cacheable := u == nil && c.IsPublic() && !silenced && !isRaw && !strings.Contains(r.Header.Get("Accept"), "application/activity+json")
+	var cacheKey string
+	if cacheable {
+		cacheKey = app.pages.key(c.ID, "post", r)
+		if cp := app.pages.get(cacheKey); cp != nil {
+			go func() {
+				if !isBotRequest(r) {
+					recordPostView(app, cp.PostID, r)
+				}
+			}()
+			cp.serve(w, r)
+			return nil
+		}
+	}
+
 	// Fetch extra data about the Collection
 	// TODO: refactor out this logic, shared in collection.go:fetchCollection()
 	coll := NewCollectionObj(c)
@@ -1478,12 +1620,14 @@ Are you sure it was ever here?`,
 		} else {
 			return err
 		}
+	} else {
+		p.loadAuthor(app, c)
 	}
 
 	// Check if the authenticated user is the post owner
 	p.IsOwner = u != nil && u.ID == p.OwnerID.Int64
 	p.Collection = coll
-	p.IsTopLevel = app.cfg.App.SingleUser
+	p.IsTopLevel = app.cfg.App.SingleUser || cr.isCustomDomain
 
 	// Only allow a post owner or admin to view a post for silenced collections
 	if silenced && !p.IsOwner && (u == nil || !u.IsAdmin()) {
@@ -1523,8 +1667,7 @@ Are you sure it was ever here?`,
 			return ErrCollectionPageNotFound
 		}
 		p.extractData()
-		ap := p.ActivityObject(app)
-		ap.Context = []interface{}{activitystreams.Namespace}
+		ap := p.activityArticle(app)
 		setCacheControl(w, apCacheTime)
 		return impart.RenderActivityJSON(w, ap, http.StatusOK)
 	} else {
@@ -1544,18 +1687,42 @@ Are you sure it was ever here?`,
 		tp.IsAdmin = u != nil && u.IsAdmin()
 		tp.CanInvite = canUserInvite(app.cfg, tp.IsAdmin)
 		tp.PinnedPosts, _ = app.db.GetPinnedPosts(coll, p.IsOwner)
+		coll.Menu = getCollectionMenu(app, c)
 		tp.IsPinned = len(*tp.PinnedPosts) > 0 && PostsContains(tp.PinnedPosts, p)
 		tp.Monetization = app.db.GetCollectionAttribute(coll.ID, "monetization_pointer")
-
-		if !postFound {
-			w.WriteHeader(http.StatusNotFound)
+		if postFound {
+			p.Series = getPostSeries(app, c, p, cr.isCollOwner)
+			if cats, err := app.db.GetCollectionCategories(c.ID); err == nil {
+				p.Categories = postCategories(p.Post, cats)
+			}
+			p.ReadNext = getReadNext(app, c, p.ID, cr.isCollOwner)
 		}
+
 		postTmpl := "collection-post"
 		if app.cfg.App.Chorus {
 			postTmpl = "chorus-collection-post"
 		}
-		if err := templates[postTmpl].ExecuteTemplate(w, "post", tp); err != nil {
-			log.Error("Error in %s template: %v", postTmpl, err)
+		if cacheable && postFound {
+			var buf bytes.Buffer
+			if err := collectionTemplate(c, postTmpl).ExecuteTemplate(&buf, "post", tp); err != nil {
+				log.Error("Error in %s template: %v", postTmpl, err)
+			} else {
+				cp := &cachedPage{
+					ContentType: "text/html; charset=utf-8",
+					Body:        buf.Bytes(),
+					Modified:    p.Updated,
+					PostID:      p.ID,
+				}
+				app.pages.set(cacheKey, cp)
+				cp.serve(w, r)
+			}
+		} else {
+			if !postFound {
+				w.WriteHeader(http.StatusNotFound)
+			}
+			if err := collectionTemplate(c, postTmpl).ExecuteTemplate(w, "post", tp); err != nil {
+				log.Error("Error in %s template: %v", postTmpl, err)
+			}
 		}
 	}
 
@@ -1567,11 +1734,8 @@ Are you sure it was ever here?`,
 			}
 		}
 		// Update stats for non-raw post views
-		if !isRaw && r.Method != "HEAD" && !bots.IsBot(r.UserAgent()) {
-			_, err := app.db.Exec("UPDATE posts SET view_count = view_count + 1 WHERE slug = ? AND collection_id = ?", slug, coll.ID)
-			if err != nil {
-				log.Error("Unable to update posts count: %v", err)
-			}
+		if !isRaw && !isBotRequest(r) {
+			recordPostView(app, p.ID, r)
 		}
 	}()
 
@@ -1591,6 +1755,8 @@ func PostsContains(sl *[]PublicPost, s *PublicPost) bool {
 func (p *Post) extractData() {
 	p.Tags = tags.Extract(p.Content)
 	p.extractImages()
+	p.IsPage = p.PagePosition.Valid
+	p.WordCount, p.ReadingTime = readingStats(p.Content)
 }
 
 func (rp *RawPost) UserFacingCreated() string {
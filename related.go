@@ -0,0 +1,320 @@
+/*
+ * Copyright © 2021 A Bunch Tell LLC.
+ *
+ * This file is part of WriteFreely.
+ *
+ * WriteFreely is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License, included
+ * in the LICENSE file in this source code package.
+ */
+
+package writefreely
+
+import (
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+	"unicode/utf8"
+
+	stripmd "github.com/writeas/go-strip-markdown/v2"
+	"github.com/writeas/web-core/log"
+)
+
+const (
+	// relatedUpdateInterval is how often collections whose posts changed get
+	// their related posts found again, so a burst of changes only does it
+	// once.
+	relatedUpdateInterval = time.Minute
+
+	// maxReadNext is the most related posts kept for each post, and shown
+	// after it.
+	maxReadNext = 5
+	// defaultReadNext is how many related posts are shown after a post,
+	// unless the collection's owner changes it.
+	defaultReadNext = 3
+	// minRelatedScore is how similar two posts need to be for one to be
+	// suggested after the other.
+	minRelatedScore = 0.1
+)
+
+// RelatedPost is a post suggested for reading after another one.
+type RelatedPost struct {
+	ID    string `json:"id"`
+	Slug  string `json:"slug"`
+	Title string `json:"title"`
+	URL   string `json:"url"`
+}
+
+// relatedDoc is a post, as compared with others when finding related posts.
+type relatedDoc struct {
+	ID    string
+	Tags  []string
+	Terms map[string]float64
+}
+
+// relatedStopWords are common English words that say nothing about what a
+// post is about.
+var relatedStopWords = map[string]bool{
+	"about": true, "after": true, "all": true, "also": true, "and": true,
+	"any": true, "are": true, "because": true, "been": true, "before": true,
+	"but": true, "can": true, "could": true, "did": true, "does": true,
+	"for": true, "from": true, "had": true, "has": true, "have": true,
+	"her": true, "here": true, "him": true, "his": true, "how": true,
+	"into": true, "its": true, "just": true, "like": true, "more": true,
+	"most": true, "not": true, "now": true, "one": true, "only": true,
+	"our": true, "out": true, "over": true, "she": true, "should": true,
+	"some": true, "such": true, "than": true, "that": true, "the": true,
+	"their": true, "them": true, "then": true, "there": true, "these": true,
+	"they": true, "this": true, "those": true, "very": true, "was": true,
+	"were": true, "what": true, "when": true, "where": true, "which": true,
+	"while": true, "who": true, "why": true, "will": true, "with": true,
+	"would": true, "you": true, "your": true,
+}
+
+// newRelatedDoc returns the given post's tags and the words in it, and how
+// often each appears.
+func newRelatedDoc(id, title, content string) relatedDoc {
+	d := relatedDoc{ID: id, Tags: postTags(content), Terms: map[string]float64{}}
+	words := strings.FieldsFunc(strings.ToLower(stripmd.Strip(title+"\n\n"+content)), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+	for _, w := range words {
+		if utf8.RuneCountInString(w) < 3 || relatedStopWords[w] {
+			continue
+		}
+		d.Terms[w]++
+	}
+	return d
+}
+
+// findRelated returns the IDs of up to max related posts for each of the
+// given posts, most related first. Posts are related by the share of their
+// tags they have in common, and by the TF-IDF cosine similarity of their
+// words, so words that are rare in the collection count the most.
+func findRelated(docs []relatedDoc, max int) map[string][]string {
+	df := map[string]int{}
+	for _, d := range docs {
+		for t := range d.Terms {
+			df[t]++
+		}
+	}
+
+	// Weigh and normalize each post's terms, and index posts by term and tag
+	n := float64(len(docs))
+	vecs := make([]map[string]float64, len(docs))
+	byTerm := map[string][]int{}
+	byTag := map[string][]int{}
+	for i, d := range docs {
+		v := map[string]float64{}
+		var norm float64
+		for t, tf := range d.Terms {
+			idf := math.Log(n / float64(df[t]))
+			if idf <= 0 {
+				// Words in every post don't tell them apart
+				continue
+			}
+			v[t] = (1 + math.Log(tf)) * idf
+			norm += v[t] * v[t]
+		}
+		norm = math.Sqrt(norm)
+		for t := range v {
+			v[t] /= norm
+			byTerm[t] = append(byTerm[t], i)
+		}
+		vecs[i] = v
+		for _, t := range d.Tags {
+			byTag[t] = append(byTag[t], i)
+		}
+	}
+
+	type scored struct {
+		i     int
+		score float64
+	}
+	related := map[string][]string{}
+	for i, d := range docs {
+		scores := map[int]float64{}
+		for t, w := range vecs[i] {
+			for _, j := range byTerm[t] {
+				if j != i {
+					scores[j] += w * vecs[j][t]
+				}
+			}
+		}
+		shared := map[int]int{}
+		for _, t := range d.Tags {
+			for _, j := range byTag[t] {
+				if j != i {
+					shared[j]++
+				}
+			}
+		}
+		for j, s := range shared {
+			scores[j] += float64(s) / float64(len(d.Tags)+len(docs[j].Tags)-s)
+		}
+
+		ranked := []scored{}
+		for j, s := range scores {
+			if s >= minRelatedScore {
+				ranked = append(ranked, scored{j, s})
+			}
+		}
+		if len(ranked) == 0 {
+			continue
+		}
+		sort.Slice(ranked, func(a, b int) bool {
+			if ranked[a].score != ranked[b].score {
+				return ranked[a].score > ranked[b].score
+			}
+			return docs[ranked[a].i].ID < docs[ranked[b].i].ID
+		})
+		if len(ranked) > max {
+			ranked = ranked[:max]
+		}
+		ids := make([]string, len(ranked))
+		for k, r := range ranked {
+			ids[k] = docs[r.i].ID
+		}
+		related[d.ID] = ids
+	}
+	return related
+}
+
+// updateRelatedPosts finds the related posts of every post in the given
+// collection, and saves them.
+func updateRelatedPosts(app *App, collID int64) error {
+	docs, err := app.db.GetRelatedDocs(collID)
+	if err != nil {
+		return err
+	}
+	err = app.db.SetRelatedPosts(collID, findRelated(docs, maxReadNext))
+	if err != nil {
+		return err
+	}
+	app.pages.invalidate(collID)
+	return nil
+}
+
+// getReadNext returns the posts to suggest after the given post, as many as
+// its collection is set to show.
+func getReadNext(app *App, c *Collection, postID string, includeFuture bool) []RelatedPost {
+	limit := c.ReadNextCount()
+	if limit == 0 {
+		return nil
+	}
+	related, err := app.db.GetRelatedPosts(c, postID, limit, includeFuture)
+	if err != nil {
+		return nil
+	}
+	return related
+}
+
+// ReadNextCount returns how many related posts the collection shows after
+// each post.
+func (c *Collection) ReadNextCount() int {
+	v := c.db.GetCollectionAttribute(c.ID, "read_next")
+	if v == "" {
+		return defaultReadNext
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil || n < 0 {
+		return defaultReadNext
+	}
+	if n > maxReadNext {
+		return maxReadNext
+	}
+	return n
+}
+
+// relatedIndexer finds collections' related posts in the background, a while
+// after their posts change, instead of on every change.
+type relatedIndexer struct {
+	app      *App
+	interval time.Duration
+
+	mu      sync.Mutex
+	pending map[int64]struct{}
+
+	quit chan struct{}
+	wg   sync.WaitGroup
+}
+
+func newRelatedIndexer(app *App, interval time.Duration) *relatedIndexer {
+	return &relatedIndexer{
+		app:      app,
+		interval: interval,
+		pending:  map[int64]struct{}{},
+		quit:     make(chan struct{}),
+	}
+}
+
+func initRelatedIndexer(app *App) {
+	app.related = newRelatedIndexer(app, relatedUpdateInterval)
+
+	// Index collections that haven't been yet, like those from before related
+	// posts existed
+	ids, err := app.db.GetUnindexedCollections()
+	if err != nil {
+		log.Error("Unable to get collections without related posts: %v", err)
+	}
+	for _, id := range ids {
+		app.related.queue(id)
+	}
+	app.related.start()
+}
+
+// queue marks the given collection's related posts to be found again.
+func (ri *relatedIndexer) queue(collID int64) {
+	if ri == nil {
+		return
+	}
+	ri.mu.Lock()
+	ri.pending[collID] = struct{}{}
+	ri.mu.Unlock()
+}
+
+// start periodically updates queued collections until the indexer is
+// stopped.
+func (ri *relatedIndexer) start() {
+	ri.wg.Add(1)
+	go func() {
+		defer ri.wg.Done()
+		t := time.NewTicker(ri.interval)
+		defer t.Stop()
+		for {
+			select {
+			case <-ri.quit:
+				return
+			case <-t.C:
+				ri.update()
+			}
+		}
+	}()
+}
+
+// stop ends periodic updates and updates any collections still queued.
+func (ri *relatedIndexer) stop() {
+	log.Info("Updating related posts...")
+	close(ri.quit)
+	ri.wg.Wait()
+	ri.update()
+}
+
+// update finds the related posts of all queued collections.
+func (ri *relatedIndexer) update() {
+	ri.mu.Lock()
+	pending := ri.pending
+	ri.pending = map[int64]struct{}{}
+	ri.mu.Unlock()
+
+	for collID := range pending {
+		err := updateRelatedPosts(ri.app, collID)
+		if err != nil {
+			log.Error("Unable to update related posts for collection %d: %v", collID, err)
+		}
+	}
+}
@@ -0,0 +1,40 @@
+/*
+ * Copyright © 2021 A Bunch Tell LLC.
+ *
+ * This file is part of WriteFreely.
+ *
+ * WriteFreely is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License, included
+ * in the LICENSE file in this source code package.
+ */
+
+package writefreely
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestFindRelated(t *testing.T) {
+	docs := []relatedDoc{
+		newRelatedDoc("bread", "Sourdough", "Keeping a sourdough starter alive, and what hydration does to the crumb. #baking"),
+		newRelatedDoc("crust", "Crust", "Baking sourdough in a dutch oven for a better crust. #baking"),
+		newRelatedDoc("trains", "Night trains", "Crossing Europe by night train, and reading railway timetables. #travel"),
+		newRelatedDoc("railway", "", "Railway timetables across Europe are a puzzle. #travel #trains"),
+		newRelatedDoc("garden", "Tomatoes", "Growing tomatoes on a balcony."),
+	}
+	want := map[string][]string{
+		"bread":   {"crust"},
+		"crust":   {"bread"},
+		"trains":  {"railway"},
+		"railway": {"trains"},
+	}
+	got := findRelated(docs, 3)
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("findRelated() = %v, want %v", got, want)
+	}
+
+	if got := findRelated(docs[:1], 3); len(got) != 0 {
+		t.Errorf("findRelated() with one post = %v, want none", got)
+	}
+}
@@ -0,0 +1,212 @@
+/*
+ * Copyright © 2021 A Bunch Tell LLC.
+ *
+ * This file is part of WriteFreely.
+ *
+ * WriteFreely is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License, included
+ * in the LICENSE file in this source code package.
+ */
+
+package writefreely
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/writeas/impart"
+	"github.com/writeas/web-core/log"
+)
+
+// reviewStatus is the state of a draft submitted to a collection for review.
+// Drafts without a review, and posts published directly, have no status.
+type reviewStatus int
+
+const (
+	reviewPending reviewStatus = iota + 1
+	reviewApproved
+	reviewRejected
+)
+
+var reviewStatusNames = map[reviewStatus]string{
+	reviewPending:  "in review",
+	reviewApproved: "approved",
+	reviewRejected: "rejected",
+}
+
+func (s reviewStatus) String() string {
+	return reviewStatusNames[s]
+}
+
+// PostReview tracks a draft submitted for publishing to a collection by one of
+// its members. The draft stays with its author until an editor approves it,
+// when it's moved into the collection and published.
+type PostReview struct {
+	PostID       string
+	CollectionID int64
+	AuthorID     int64
+	Status       reviewStatus
+	ReviewerID   int64
+	Comment      string
+	Created      time.Time
+	Updated      time.Time
+
+	// Fields for display
+	Post       *PublicPost
+	AuthorName string
+	Collection *Collection
+}
+
+func (r PostReview) IsPending() bool {
+	return r.Status == reviewPending
+}
+
+func (r PostReview) IsRejected() bool {
+	return r.Status == reviewRejected
+}
+
+// checkReviewable returns an error if the review can't be decided on by an
+// editor of the collection with the given ID, either because it was submitted
+// somewhere else, or because it's already been approved or rejected.
+func (r PostReview) checkReviewable(collID int64) error {
+	if r.CollectionID != collID {
+		return impart.HTTPError{http.StatusNotFound, "Review doesn't exist."}
+	}
+	if !r.IsPending() {
+		return impart.HTTPError{http.StatusConflict, "This post has already been reviewed."}
+	}
+	return nil
+}
+
+// handleSubmitPostForReview submits one of the user's drafts for review by the
+// editors of a collection they're a member of.
+func handleSubmitPostForReview(app *App, u *User, w http.ResponseWriter, r *http.Request) error {
+	if u.IsSilenced() {
+		return ErrUserSilenced
+	}
+	postID := r.FormValue("post")
+	c, err := app.db.GetCollection(r.FormValue("collection"))
+	if err != nil {
+		return err
+	}
+	if !app.db.collectionRole(c, u.ID).CanSubmitForReview() {
+		return ErrForbiddenCollection
+	}
+
+	p, err := app.db.GetOwnedPost(postID, u.ID)
+	if err != nil {
+		return err
+	}
+	if p.CollectionID.Valid {
+		return impart.HTTPError{http.StatusConflict, "Only drafts can be submitted for review."}
+	}
+
+	err = app.db.SubmitPostForReview(postID, c.ID, u.ID)
+	if err != nil {
+		return err
+	}
+
+	addSessionFlash(app, w, r, fmt.Sprintf("Submitted \"%s\" to %s for review.", p.PlainDisplayTitle(), c.DisplayTitle()), nil)
+	return impart.HTTPError{http.StatusFound, "/me/posts/"}
+}
+
+// getReviewableCollection returns the collection with the alias in the
+// request, if the given user can review posts submitted to it.
+func getReviewableCollection(app *App, u *User, r *http.Request) (*Collection, error) {
+	c, err := app.db.GetCollection(mux.Vars(r)["collection"])
+	if err != nil {
+		return nil, err
+	}
+	if !app.db.collectionRole(c, u.ID).CanReview() {
+		return nil, ErrCollectionNotFound
+	}
+	c.hostName = app.cfg.App.Host
+	return c, nil
+}
+
+func viewCollectionReviews(app *App, u *User, w http.ResponseWriter, r *http.Request) error {
+	c, err := getReviewableCollection(app, u, r)
+	if err != nil {
+		return err
+	}
+
+	flashes, _ := getSessionFlashes(app, w, r, nil)
+	p := struct {
+		*UserPage
+		Collection *Collection
+		IsOwner    bool
+		Reviews    *[]PostReview
+		Silenced   bool
+	}{
+		UserPage:   NewUserPage(app, r, u, "Review Queue", flashes),
+		Collection: c,
+		IsOwner:    c.OwnerID == u.ID,
+	}
+	p.Silenced, err = app.db.IsUserSilenced(u.ID)
+	if err != nil {
+		log.Error("view collection reviews: %v", err)
+	}
+	p.Reviews, err = app.db.GetPostReviews(c.ID, reviewPending)
+	if err != nil {
+		return err
+	}
+
+	showUserPage(w, "reviews", p)
+	return nil
+}
+
+// handleReviewPost approves or rejects a draft submitted to a collection.
+// Approved drafts are published to the collection, and federated like any
+// other new post.
+func handleReviewPost(app *App, u *User, w http.ResponseWriter, r *http.Request) error {
+	if u.IsSilenced() {
+		return ErrUserSilenced
+	}
+	c, err := getReviewableCollection(app, u, r)
+	if err != nil {
+		return err
+	}
+	pr, err := app.db.GetPostReview(mux.Vars(r)["post"])
+	if err != nil {
+		return err
+	}
+	err = pr.checkReviewable(c.ID)
+	if err != nil {
+		return err
+	}
+
+	redirect := "/me/c/" + c.Alias + "/reviews"
+	comment := r.FormValue("comment")
+	switch r.FormValue("action") {
+	case "approve":
+		err = app.db.ApprovePostReview(pr, c, u.ID, comment)
+		if err != nil {
+			return err
+		}
+		app.pages.invalidate(c.ID)
+		app.related.queue(c.ID)
+		p, err := app.db.GetPost(pr.PostID, 0)
+		if err != nil {
+			return err
+		}
+		addSessionFlash(app, w, r, fmt.Sprintf("Published \"%s\".", p.PlainDisplayTitle()), nil)
+
+		if !app.cfg.App.Private && app.cfg.App.Federation && !p.Created.After(time.Now()) {
+			c.ForPublic()
+			p.Collection = &CollectionObj{Collection: *c}
+			go federatePost(app, p, c.ID, false)
+		}
+	case "reject":
+		err = app.db.RejectPostReview(pr.PostID, u.ID, comment)
+		if err != nil {
+			return err
+		}
+		addSessionFlash(app, w, r, "Sent the post back to its author.", nil)
+	default:
+		return impart.HTTPError{http.StatusBadRequest, "Invalid review action."}
+	}
+
+	return impart.HTTPError{http.StatusFound, redirect}
+}
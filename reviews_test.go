@@ -0,0 +1,116 @@
+/*
+ * Copyright © 2021 A Bunch Tell LLC.
+ *
+ * This file is part of WriteFreely.
+ *
+ * WriteFreely is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License, included
+ * in the LICENSE file in this source code package.
+ */
+
+package writefreely
+
+import (
+	"database/sql"
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/writeas/impart"
+)
+
+func TestReviewPermissions(t *testing.T) {
+	tests := []struct {
+		role   collRole
+		submit bool
+		review bool
+	}{
+		{roleNone, false, false},
+		{roleContributor, true, false},
+		{roleAuthor, true, false},
+		{roleEditor, true, true},
+		{roleOwner, true, true},
+	}
+	for _, test := range tests {
+		if got := test.role.CanSubmitForReview(); got != test.submit {
+			t.Errorf("%q CanSubmitForReview = %t, want %t", test.role, got, test.submit)
+		}
+		if got := test.role.CanReview(); got != test.review {
+			t.Errorf("%q CanReview = %t, want %t", test.role, got, test.review)
+		}
+	}
+}
+
+func TestPostReviewCheckReviewable(t *testing.T) {
+	tests := []struct {
+		collID int64
+		status reviewStatus
+		want   int
+	}{
+		{1, reviewPending, 0},
+		{2, reviewPending, http.StatusNotFound},
+		{1, reviewApproved, http.StatusConflict},
+		{1, reviewRejected, http.StatusConflict},
+		// Reviews in other collections don't leak their status
+		{2, reviewRejected, http.StatusNotFound},
+	}
+	for _, test := range tests {
+		r := PostReview{CollectionID: test.collID, Status: test.status}
+		err := r.checkReviewable(1)
+		if test.want == 0 {
+			if err != nil {
+				t.Errorf("%q review in collection %d: got %v, want nil", test.status, test.collID, err)
+			}
+			continue
+		}
+		if herr, ok := err.(impart.HTTPError); !ok || herr.Status != test.want {
+			t.Errorf("%q review in collection %d: got %v, want status %d", test.status, test.collID, err, test.want)
+		}
+	}
+}
+
+func TestPostReviewDatastore(t *testing.T) {
+	if !runMySQLTests() {
+		t.Skip("skipping mysql tests")
+	}
+	withTestDB(t, func(db *sql.DB) {
+		ds := &datastore{
+			DB:         db,
+			driverName: "",
+		}
+		const postID = "abcdefghijklmnop"
+		var authorID, editorID, collID int64 = 1, 2, 3
+
+		assert.NoError(t, ds.SubmitPostForReview(postID, collID, authorID))
+		r, err := ds.GetPostReview(postID)
+		assert.NoError(t, err)
+		assert.Equal(t, reviewPending, r.Status)
+		assert.Equal(t, collID, r.CollectionID)
+
+		assert.NoError(t, ds.RejectPostReview(postID, editorID, "Needs a title"))
+		r, err = ds.GetPostReview(postID)
+		assert.NoError(t, err)
+		assert.True(t, r.IsRejected())
+		assert.Equal(t, editorID, r.ReviewerID)
+		assert.Equal(t, "Needs a title", r.Comment)
+
+		// A review can only be decided on once
+		err = ds.RejectPostReview(postID, editorID, "")
+		httpErr, ok := err.(impart.HTTPError)
+		assert.True(t, ok)
+		assert.Equal(t, http.StatusConflict, httpErr.Status)
+
+		// Resubmitting reopens the same review, without the old decision
+		assert.NoError(t, ds.SubmitPostForReview(postID, collID+1, authorID))
+		r, err = ds.GetPostReview(postID)
+		assert.NoError(t, err)
+		assert.True(t, r.IsPending())
+		assert.Equal(t, collID+1, r.CollectionID)
+		assert.Zero(t, r.ReviewerID)
+		assert.Empty(t, r.Comment)
+
+		var n int
+		assert.NoError(t, db.QueryRow("SELECT COUNT(*) FROM postreviews WHERE post_id = ?", postID).Scan(&n))
+		assert.Equal(t, 1, n)
+	})
+}
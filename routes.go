@@ -55,6 +55,11 @@ func InitRoutes(apper Apper, r *mux.Router) *mux.Router {
 		log.Info("Adding %s routes (multi-user)...", hostSubroute)
 	}
 
+	// Collections served from their own domains
+	if !apper.App().cfg.App.SingleUser {
+		RouteCustomDomains(handler, r.MatcherFunc(isCustomDomainRequest).Subrouter())
+	}
+
 	// Primary app routes
 	write := r.PathPrefix("/").Subrouter()
 
@@ -76,6 +81,11 @@ func InitRoutes(apper Apper, r *mux.Router) *mux.Router {
 	// handle mentions
 	write.HandleFunc("/@/{handle}", handler.Web(handleViewMention, UserLevelReader))
 
+	// Stylesheets for highlighted code
+	write.HandleFunc("/css/code/{theme}.css", handler.Web(handleViewCodeTheme, UserLevelReader)).Methods("GET")
+	// Stylesheets and assets of installed themes
+	write.HandleFunc("/themes/{theme}/{file:.+}", handler.Web(handleViewThemeFile, UserLevelReader)).Methods("GET")
+
 	configureSlackOauth(handler, write, apper.App())
 	configureWriteAsOauth(handler, write, apper.App())
 	configureGitlabOauth(handler, write, apper.App())
@@ -99,6 +109,12 @@ func InitRoutes(apper Apper, r *mux.Router) *mux.Router {
 	me.HandleFunc("/c/", handler.User(viewCollections)).Methods("GET")
 	me.HandleFunc("/c/{collection}", handler.User(viewEditCollection)).Methods("GET")
 	me.HandleFunc("/c/{collection}/stats", handler.User(viewStats)).Methods("GET")
+	me.HandleFunc("/c/{collection}/stats.csv", handler.Download(viewExportStats, UserLevelUser)).Methods("GET")
+	me.HandleFunc("/c/{collection}/members", handler.User(viewCollectionMembers)).Methods("GET")
+	me.HandleFunc("/c/{collection}/reviews", handler.User(viewCollectionReviews)).Methods("GET")
+	me.HandleFunc("/c/{collection}/tags", handler.User(viewCollectionTags)).Methods("GET")
+	me.HandleFunc("/c/{collection}/menu", handler.User(viewCollectionMenu)).Methods("GET")
+	me.HandleFunc("/c/{collection}/export.epub", handler.User(handleExportCollectionBook)).Methods("POST")
 	me.Path("/delete").Handler(csrf.Protect(apper.App().keys.CSRFKey)(handler.User(handleUserDelete))).Methods("POST")
 	me.HandleFunc("/posts", handler.Redirect("/me/posts/", UserLevelUser)).Methods("GET")
 	me.HandleFunc("/posts/", handler.User(viewArticles)).Methods("GET")
@@ -106,10 +122,12 @@ func InitRoutes(apper Apper, r *mux.Router) *mux.Router {
 	me.HandleFunc("/posts/export.zip", handler.Download(viewExportPosts, UserLevelUser)).Methods("GET")
 	me.HandleFunc("/posts/export.json", handler.Download(viewExportPosts, UserLevelUser)).Methods("GET")
 	me.HandleFunc("/export", handler.User(viewExportOptions)).Methods("GET")
-	me.HandleFunc("/export.json", handler.Download(viewExportFull, UserLevelUser)).Methods("GET")
+	me.HandleFunc("/export.json", handler.User(viewExportFull)).Methods("GET")
+	me.HandleFunc("/jobs/{job}/download", handler.User(viewJobResult)).Methods("GET")
 	me.HandleFunc("/import", handler.User(viewImport)).Methods("GET")
 	me.Path("/settings").Handler(csrf.Protect(apper.App().keys.CSRFKey)(handler.User(viewSettings))).Methods("GET")
 	me.HandleFunc("/invites", handler.User(handleViewUserInvites)).Methods("GET")
+	me.HandleFunc("/join/{code:[a-zA-Z0-9]+}", handler.User(viewCollectionInvite)).Methods("GET")
 	me.HandleFunc("/logout", handler.Web(viewLogout, UserLevelNone)).Methods("GET")
 
 	write.HandleFunc("/api/me", handler.All(viewMeAPI)).Methods("GET")
@@ -120,13 +138,22 @@ func InitRoutes(apper Apper, r *mux.Router) *mux.Router {
 	apiMe.HandleFunc("/password", handler.All(updatePassphrase)).Methods("POST")
 	apiMe.HandleFunc("/self", handler.All(updateSettings)).Methods("POST")
 	apiMe.HandleFunc("/invites", handler.User(handleCreateUserInvite)).Methods("POST")
+	apiMe.HandleFunc("/join/{code:[a-zA-Z0-9]+}", handler.User(handleJoinCollection)).Methods("POST")
+	apiMe.HandleFunc("/reviews", handler.User(handleSubmitPostForReview)).Methods("POST")
 	apiMe.HandleFunc("/import", handler.User(handleImport)).Methods("POST")
+	apiMe.HandleFunc("/import/full", handler.User(handleImportFull)).Methods("POST")
+	apiMe.HandleFunc("/export", handler.User(handleExportFull)).Methods("POST")
+	apiMe.HandleFunc("/export/static", handler.User(handleExportStatic)).Methods("POST")
+	apiMe.HandleFunc("/export/epub", handler.User(handleExportCollectionBook)).Methods("POST")
+	apiMe.HandleFunc("/jobs/{job}", handler.UserWebAPI(viewJobAPI)).Methods("GET")
+	apiMe.HandleFunc("/jobs/{job}/cancel", handler.User(handleCancelJob)).Methods("POST")
 	apiMe.HandleFunc("/oauth/remove", handler.User(removeOauth)).Methods("POST")
 
 	// Sign up validation
 	write.HandleFunc("/api/alias", handler.All(handleUsernameCheck)).Methods("POST")
 
 	write.HandleFunc("/api/markdown", handler.All(handleRenderMarkdown)).Methods("POST")
+	write.HandleFunc("/api/oembed", handler.AllReader(handleOEmbed)).Methods("GET")
 
 	instanceURL, _ := url.Parse(apper.App().Config().App.Host)
 	host := instanceURL.Host
@@ -146,6 +173,16 @@ func InitRoutes(apper Apper, r *mux.Router) *mux.Router {
 	apiColls.HandleFunc("/{alias}/posts/{post}/{property}", handler.AllReader(fetchPostProperty)).Methods("GET")
 	apiColls.HandleFunc("/{alias}/collect", handler.All(addPost)).Methods("POST")
 	apiColls.HandleFunc("/{alias}/pin", handler.All(pinPost)).Methods("POST")
+	apiColls.HandleFunc("/{collection}/invites", handler.User(handleCreateCollectionInvite)).Methods("POST")
+	apiColls.HandleFunc("/{collection}/invites/{code}/delete", handler.User(handleDeleteCollectionInvite)).Methods("POST")
+	apiColls.HandleFunc("/{collection}/members/{username}", handler.User(handleUpdateCollectionMember)).Methods("POST")
+	apiColls.HandleFunc("/{collection}/reviews/{post}", handler.User(handleReviewPost)).Methods("POST")
+	apiColls.HandleFunc("/{alias}/tags", handler.AllReader(fetchCollectionTags)).Methods("GET")
+	apiColls.HandleFunc("/{alias}/pages", handler.AllReader(fetchCollectionPages)).Methods("GET")
+	apiColls.HandleFunc("/{collection}/tags/{tag}", handler.User(handleUpdateCollectionTag)).Methods("POST")
+	apiColls.HandleFunc("/{collection}/menu", handler.User(handleUpdateCollectionMenu)).Methods("POST")
+	apiColls.HandleFunc("/{collection}/domain", handler.User(handleSetCollectionDomain)).Methods("POST")
+	apiColls.HandleFunc("/{collection}/domain/verify", handler.User(handleVerifyCollectionDomain)).Methods("POST")
 	apiColls.HandleFunc("/{alias}/unpin", handler.All(pinPost)).Methods("POST")
 	apiColls.HandleFunc("/{alias}/inbox", handler.All(handleFetchCollectionInbox)).Methods("POST")
 	apiColls.HandleFunc("/{alias}/outbox", handler.AllReader(handleFetchCollectionOutbox)).Methods("GET")
@@ -175,6 +212,9 @@ func InitRoutes(apper Apper, r *mux.Router) *mux.Router {
 	write.HandleFunc("/admin/user/{username}/passphrase", handler.Admin(handleAdminResetUserPass)).Methods("POST")
 	write.HandleFunc("/admin/pages", handler.Admin(handleViewAdminPages)).Methods("GET")
 	write.HandleFunc("/admin/page/{slug}", handler.Admin(handleViewAdminPage)).Methods("GET")
+	write.HandleFunc("/admin/themes", handler.Admin(handleViewAdminThemes)).Methods("GET")
+	write.HandleFunc("/admin/themes", handler.Admin(handleAdminInstallTheme)).Methods("POST")
+	write.HandleFunc("/admin/themes/{theme}/delete", handler.Admin(handleAdminDeleteTheme)).Methods("POST")
 	write.HandleFunc("/admin/update/config", handler.AdminApper(handleAdminUpdateConfig)).Methods("POST")
 	write.HandleFunc("/admin/update/{page}", handler.Admin(handleAdminUpdateSite)).Methods("POST")
 	write.HandleFunc("/admin/updates", handler.Admin(handleViewAdminUpdates)).Methods("GET")
@@ -218,9 +258,12 @@ func RouteCollections(handler *Handler, r *mux.Router) {
 	r.HandleFunc("/page/{page:[0-9]+}", handler.Web(handleViewCollection, UserLevelReader))
 	r.HandleFunc("/tag:{tag}", handler.Web(handleViewCollectionTag, UserLevelReader))
 	r.HandleFunc("/tag:{tag}/feed/", handler.Web(ViewFeed, UserLevelReader))
+	r.HandleFunc("/tags/", handler.Web(handleViewCollectionTagIndex, UserLevelReader))
+	r.HandleFunc("/series/{series}", handler.Web(handleViewCollectionSeries, UserLevelReader))
 	r.HandleFunc("/sitemap.xml", handler.AllReader(handleViewSitemap))
 	r.HandleFunc("/feed/", handler.AllReader(ViewFeed))
 	r.HandleFunc("/{slug}", handler.CollectionPostOrStatic)
+	r.HandleFunc("/{slug}/card.png", handler.AllReader(viewCollectionPostCard)).Methods("GET")
 	r.HandleFunc("/{slug}/edit", handler.Web(handleViewPad, UserLevelUser))
 	r.HandleFunc("/{slug}/edit/meta", handler.Web(handleViewMeta, UserLevelUser))
 	r.HandleFunc("/{slug}/", handler.Web(handleCollectionPostRedirect, UserLevelReader)).Methods("GET")
@@ -0,0 +1,182 @@
+/*
+ * Copyright © 2021 A Bunch Tell LLC.
+ *
+ * This file is part of WriteFreely.
+ *
+ * WriteFreely is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License, included
+ * in the LICENSE file in this source code package.
+ */
+
+package writefreely
+
+import (
+	"net/http"
+
+	"github.com/gorilla/mux"
+	"github.com/writeas/web-core/log"
+)
+
+type (
+	// Series is an ordered group of posts within a collection, like the parts
+	// of a multipart story.
+	Series struct {
+		CollectionID int64  `json:"-"`
+		Slug         string `json:"slug"`
+		Title        string `json:"title"`
+	}
+
+	// PostSeries is a post's place in its series.
+	PostSeries struct {
+		*Series
+		Part  int `json:"part"`
+		Total int `json:"total"`
+
+		Prev *PublicPost `json:"-"`
+		Next *PublicPost `json:"-"`
+	}
+)
+
+// placeInOrder returns the IDs of a series' posts or a collection's pages, in
+// order, with postID moved to the given part. A part that's out of range puts
+// the post at the end.
+func placeInOrder(ids []string, postID string, part int) []string {
+	placed := make([]string, 0, len(ids)+1)
+	for _, id := range ids {
+		if id != postID {
+			placed = append(placed, id)
+		}
+	}
+	if part < 1 || part > len(placed) {
+		return append(placed, postID)
+	}
+	placed = append(placed, "")
+	copy(placed[part:], placed[part-1:])
+	placed[part-1] = postID
+	return placed
+}
+
+// getPostSeries returns the given post's place in its series, with links to
+// the parts before and after it, or nil if it isn't part of one.
+func getPostSeries(app *App, c *Collection, p *PublicPost, includeFuture bool) *PostSeries {
+	s, err := app.db.GetPostSeries(p.ID)
+	if err != nil || s == nil {
+		return nil
+	}
+	posts, err := app.db.GetSeriesPosts(app.cfg, c, s.Slug, includeFuture)
+	if err != nil {
+		return nil
+	}
+
+	ps := &PostSeries{Series: s, Total: len(*posts)}
+	coll := &CollectionObj{Collection: *c}
+	for i := range *posts {
+		if (*posts)[i].ID != p.ID {
+			continue
+		}
+		ps.Part = i + 1
+		if i > 0 {
+			ps.Prev = &(*posts)[i-1]
+			ps.Prev.Collection = coll
+		}
+		if i < len(*posts)-1 {
+			ps.Next = &(*posts)[i+1]
+			ps.Next.Collection = coll
+		}
+		break
+	}
+	if ps.Part == 0 {
+		// Post isn't visible in the series yet, e.g. it's scheduled
+		return nil
+	}
+	return ps
+}
+
+func handleViewCollectionSeries(app *App, w http.ResponseWriter, r *http.Request) error {
+	vars := mux.Vars(r)
+
+	cr := &collectionReq{}
+	err := processCollectionRequest(cr, vars, w, r)
+	if err != nil {
+		return err
+	}
+
+	u, err := checkUserForCollection(app, cr, r, false)
+	if err != nil {
+		return err
+	}
+
+	c, err := processCollectionPermissions(app, cr, u, w, r)
+	if c == nil || err != nil {
+		return err
+	}
+
+	s, err := app.db.GetSeries(c.ID, vars["series"])
+	if err != nil {
+		return err
+	}
+
+	coll := newDisplayCollection(c, cr, 0)
+	coll.Posts, err = app.db.GetSeriesPosts(app.cfg, c, s.Slug, cr.isCollOwner)
+	if err != nil {
+		return err
+	}
+	if len(*coll.Posts) == 0 {
+		return ErrCollectionPageNotFound
+	}
+	app.db.GetPostAuthors(c, coll.Posts)
+
+	// Serve collection
+	displayPage := struct {
+		CollectionPage
+		Series *Series
+	}{
+		CollectionPage: CollectionPage{
+			DisplayCollection: coll,
+			StaticPage:        pageForReq(app, r),
+			IsCustomDomain:    cr.isCustomDomain,
+		},
+		Series: s,
+	}
+	var owner *User
+	if u != nil {
+		displayPage.Username = u.Username
+		displayPage.IsOwner = u.ID == coll.OwnerID
+		if displayPage.IsOwner {
+			owner = u
+		}
+	}
+	isOwner := owner != nil
+	if !isOwner {
+		owner, err = app.db.GetUserByID(coll.OwnerID)
+		if err != nil {
+			// Log the error and just continue
+			log.Error("Error getting user for collection: %v", err)
+		}
+		if owner.IsSilenced() {
+			return ErrCollectionNotFound
+		}
+	}
+	displayPage.Silenced = owner != nil && owner.IsSilenced()
+	displayPage.Owner = owner
+	coll.Owner = displayPage.Owner
+	displayPage.PinnedPosts, _ = app.db.GetPinnedPosts(coll.CollectionObj, isOwner)
+	coll.Menu = getCollectionMenu(app, c)
+	displayPage.Monetization = app.db.GetCollectionAttribute(coll.ID, "monetization_pointer")
+
+	err = templates["collection-series"].ExecuteTemplate(w, "collection-series", displayPage)
+	if err != nil {
+		log.Error("Unable to render collection series page: %v", err)
+	}
+
+	return nil
+}
+
+// seriesPart returns the part of its series that a submitted post should be,
+// or 0 if it wasn't given.
+func seriesPart(p *SubmittedPost) int {
+	if p.SeriesPart == nil {
+		return 0
+	}
+	return *p.SeriesPart
+}
@@ -0,0 +1,40 @@
+/*
+ * Copyright © 2021 A Bunch Tell LLC.
+ *
+ * This file is part of WriteFreely.
+ *
+ * WriteFreely is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License, included
+ * in the LICENSE file in this source code package.
+ */
+
+package writefreely
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestPlaceInOrder(t *testing.T) {
+	tests := []struct {
+		ids    []string
+		postID string
+		part   int
+		want   []string
+	}{
+		{[]string{}, "a", 0, []string{"a"}},
+		{[]string{"a", "b"}, "c", 0, []string{"a", "b", "c"}},
+		{[]string{"a", "b"}, "c", 1, []string{"c", "a", "b"}},
+		{[]string{"a", "b"}, "c", 2, []string{"a", "c", "b"}},
+		{[]string{"a", "b"}, "c", 9, []string{"a", "b", "c"}},
+		{[]string{"a", "b", "c"}, "a", 3, []string{"b", "c", "a"}},
+		{[]string{"a", "b", "c"}, "c", 1, []string{"c", "a", "b"}},
+		{[]string{"a", "b", "c"}, "b", -1, []string{"a", "c", "b"}},
+	}
+	for _, test := range tests {
+		got := placeInOrder(test.ids, test.postID, test.part)
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("placeInOrder(%v, %q, %d) = %v, want %v", test.ids, test.postID, test.part, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,417 @@
+/*
+ * Copyright © 2021 A Bunch Tell LLC.
+ *
+ * This file is part of WriteFreely.
+ *
+ * WriteFreely is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License, included
+ * in the LICENSE file in this source code package.
+ */
+
+package writefreely
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"hash/fnv"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/png"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/rainycape/unidecode"
+	"github.com/writeas/impart"
+	"github.com/writeas/web-core/log"
+)
+
+// Share cards are the images shown with a post shared on social media, when
+// the post doesn't have any images of its own. They're rendered with the
+// post's title and collection name, and cached on disk until the post is
+// edited.
+const (
+	cacheDir      = "cache"
+	shareCardsDir = "cards"
+
+	// shareCardVersion changes whenever cards are drawn differently, so they
+	// get rendered again.
+	shareCardVersion = "1"
+
+	shareCardWidth  = 1200
+	shareCardHeight = 630
+	shareCardMargin = 80
+
+	// Text is drawn with a 5x7 pixel font, each pixel of it a square of
+	// this many pixels on the card.
+	shareCardTitleScale = 9
+	shareCardNameScale  = 5
+	shareCardMaxLines   = 4
+	shareCardLineHeight = 11 * shareCardTitleScale
+)
+
+// shareCardBackgrounds are the colors that cards are drawn on. Each collection
+// gets one, so its cards look the same.
+var shareCardBackgrounds = []color.RGBA{
+	{0x2b, 0x3a, 0x55, 0xff},
+	{0x37, 0x5e, 0x4f, 0xff},
+	{0x6b, 0x2d, 0x3c, 0xff},
+	{0x44, 0x38, 0x6b, 0xff},
+	{0x7a, 0x4a, 0x1f, 0xff},
+	{0x1f, 0x5c, 0x73, 0xff},
+	{0x33, 0x33, 0x33, 0xff},
+}
+
+var (
+	shareCardForeground = color.NRGBA{0xff, 0xff, 0xff, 0xff}
+	shareCardSubtle     = color.NRGBA{0xff, 0xff, 0xff, 0xb0}
+)
+
+// shareCardText returns the title and collection name to draw on the post's
+// card.
+func (p *PublicPost) shareCardText() (title, name string) {
+	return p.PlainDisplayTitle(), p.Collection.DisplayTitle()
+}
+
+// shareCardHash identifies what a card shows, so a changed post gets a new
+// one.
+func shareCardHash(title, name string) string {
+	h := sha256.Sum256([]byte(shareCardVersion + "\x00" + title + "\x00" + name))
+	return hex.EncodeToString(h[:8])
+}
+
+func (p *PublicPost) shareCardURL() string {
+	title, name := p.shareCardText()
+	return p.Collection.CanonicalURL() + p.Slug.String + "/card.png?v=" + shareCardHash(title, name)
+}
+
+func shareCardsPath(app *App) string {
+	return filepath.Join(app.cfg.Server.CacheParentDir, cacheDir, shareCardsDir)
+}
+
+func shareCardPath(app *App, postID, hash string) string {
+	return filepath.Join(shareCardsPath(app), postID+"-"+hash+".png")
+}
+
+// removeShareCards deletes any cards cached for the given post.
+func removeShareCards(app *App, postID string) {
+	removeShareCardsExcept(app, postID, "")
+}
+
+func removeShareCardsExcept(app *App, postID, keep string) {
+	files, err := filepath.Glob(filepath.Join(shareCardsPath(app), postID+"-*.png"))
+	if err != nil {
+		return
+	}
+	for _, f := range files {
+		if f == keep {
+			continue
+		}
+		if err := os.Remove(f); err != nil && !os.IsNotExist(err) {
+			log.Error("Unable to remove share card %s: %v", f, err)
+		}
+	}
+}
+
+// shareCard returns the post's card, rendering and caching it first if it
+// isn't cached already.
+func shareCard(app *App, p *PublicPost) ([]byte, string, error) {
+	title, name := p.shareCardText()
+	hash := shareCardHash(title, name)
+	fname := shareCardPath(app, p.ID, hash)
+	if b, err := ioutil.ReadFile(fname); err == nil {
+		return b, hash, nil
+	}
+
+	h := fnv.New32a()
+	h.Write([]byte(p.Collection.Alias))
+	bg := shareCardBackgrounds[int(h.Sum32()%uint32(len(shareCardBackgrounds)))]
+
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, renderShareCard(title, name, bg)); err != nil {
+		return nil, "", err
+	}
+
+	// Write the card to a temporary file first, so readers never see a
+	// partial one
+	err := os.MkdirAll(shareCardsPath(app), 0755)
+	if err == nil {
+		var f *os.File
+		f, err = ioutil.TempFile(shareCardsPath(app), ".card-")
+		if err == nil {
+			_, err = f.Write(buf.Bytes())
+			if cerr := f.Close(); err == nil {
+				err = cerr
+			}
+			if err == nil {
+				err = os.Rename(f.Name(), fname)
+			}
+			if err != nil {
+				os.Remove(f.Name())
+			}
+		}
+	}
+	if err != nil {
+		log.Error("Unable to cache share card for %s: %v", p.ID, err)
+	} else {
+		removeShareCardsExcept(app, p.ID, fname)
+	}
+	return buf.Bytes(), hash, nil
+}
+
+// renderShareCard draws a card with the given title and collection name on
+// the given background.
+func renderShareCard(title, name string, bg color.RGBA) *image.RGBA {
+	img := image.NewRGBA(image.Rect(0, 0, shareCardWidth, shareCardHeight))
+	draw.Draw(img, img.Bounds(), &image.Uniform{bg}, image.Point{}, draw.Src)
+
+	// Accent bar along the top
+	draw.Draw(img, image.Rect(0, 0, shareCardWidth, 12), &image.Uniform{shareCardSubtle}, image.Point{}, draw.Over)
+
+	// Title, centered vertically in the space above the collection name
+	lines := wrapCardText(title, cardTextColumns(shareCardTitleScale), shareCardMaxLines)
+	nameY := shareCardHeight - shareCardMargin - 7*shareCardNameScale
+	textH := len(lines)*shareCardLineHeight - 4*shareCardTitleScale
+	y := shareCardMargin
+	if space := nameY - shareCardMargin/2 - shareCardMargin; textH < space {
+		y += (space - textH) / 2
+	}
+	for _, l := range lines {
+		drawCardText(img, l, shareCardMargin, y, shareCardTitleScale, shareCardForeground)
+		y += shareCardLineHeight
+	}
+
+	names := wrapCardText(name, cardTextColumns(shareCardNameScale), 1)
+	if len(names) > 0 {
+		drawCardText(img, names[0], shareCardMargin, nameY, shareCardNameScale, shareCardSubtle)
+	}
+	return img
+}
+
+// cardTextColumns returns how many characters fit on a line of a card at the
+// given scale.
+func cardTextColumns(scale int) int {
+	return (shareCardWidth - 2*shareCardMargin) / (6 * scale)
+}
+
+// wrapCardText breaks the given text into at most maxLines lines of at most
+// cols characters, ending it with an ellipsis if it doesn't fit. Text is
+// transliterated to ASCII, since that's all the card font has.
+func wrapCardText(s string, cols, maxLines int) []string {
+	var lines []string
+	var cur string
+	for _, w := range strings.Fields(unidecode.Unidecode(s)) {
+		for w != "" {
+			if cur != "" && len(cur)+1+len(w) <= cols {
+				cur += " " + w
+				w = ""
+				continue
+			}
+			if cur != "" {
+				lines = append(lines, cur)
+			}
+			// Break words that don't fit on a line by themselves
+			n := len(w)
+			if n > cols {
+				n = cols
+			}
+			cur, w = w[:n], w[n:]
+			if len(lines) == maxLines {
+				last := lines[maxLines-1]
+				if len(last)+3 > cols {
+					last = strings.TrimRight(last[:cols-3], " ")
+				}
+				lines[maxLines-1] = last + "..."
+				return lines
+			}
+		}
+	}
+	if cur != "" {
+		lines = append(lines, cur)
+	}
+	return lines
+}
+
+// drawCardText draws the given ASCII text with its top left corner at x, y.
+func drawCardText(img draw.Image, s string, x, y, scale int, c color.Color) {
+	src := &image.Uniform{c}
+	for i := 0; i < len(s); i++ {
+		ch := s[i]
+		if ch < ' ' || ch > '~' {
+			ch = '?'
+		}
+		glyph := cardFont[ch-' ']
+		for col, bits := range glyph {
+			for row := 0; row < 7; row++ {
+				if bits&(1<<uint(row)) == 0 {
+					continue
+				}
+				px := x + col*scale
+				py := y + row*scale
+				draw.Draw(img, image.Rect(px, py, px+scale, py+scale), src, image.Point{}, draw.Over)
+			}
+		}
+		x += 6 * scale
+	}
+}
+
+// viewCollectionPostCard serves the share card for a collection post.
+func viewCollectionPostCard(app *App, w http.ResponseWriter, r *http.Request) error {
+	vars := mux.Vars(r)
+	cr := &collectionReq{}
+	err := processCollectionRequest(cr, vars, w, r)
+	if err != nil {
+		return err
+	}
+
+	var c *Collection
+	if app.cfg.App.SingleUser {
+		c, err = app.db.GetCollectionByID(1)
+	} else {
+		c, err = app.db.GetCollection(cr.alias)
+	}
+	if err != nil {
+		return err
+	}
+	c.hostName = app.cfg.App.Host
+
+	// Only public posts get cards, since nobody else could see them
+	if !c.IsPublic() {
+		return ErrPostNotFound
+	}
+	if silenced, err := app.db.IsUserSilenced(c.OwnerID); err != nil {
+		log.Error("view share card: %v", err)
+	} else if silenced {
+		return ErrPostNotFound
+	}
+
+	p, err := app.db.GetPost(strings.ToLower(vars["slug"]), c.ID)
+	if err != nil {
+		if err == ErrCollectionPageNotFound {
+			return ErrPostNotFound
+		}
+		return err
+	}
+	if (p.Content == "" && p.Title.String == "") || p.IsScheduled() {
+		return ErrPostNotFound
+	}
+	p.Collection = &CollectionObj{Collection: *c}
+
+	b, hash, err := shareCard(app, p)
+	if err != nil {
+		log.Error("Unable to render share card for %s: %v", p.ID, err)
+		return impart.HTTPError{http.StatusInternalServerError, "Unable to render image."}
+	}
+
+	w.Header().Set("Content-Type", "image/png")
+	w.Header().Set("ETag", `"`+hash+`"`)
+	w.Header().Set("Cache-Control", "public, max-age=86400")
+	http.ServeContent(w, r, "card.png", time.Time{}, bytes.NewReader(b))
+	return nil
+}
+
+// cardFont is a 5x7 pixel font for printable ASCII characters, starting with
+// space. Each byte is a column of the glyph, with its lowest bit at the top.
+var cardFont = [95][5]byte{
+	{0x00, 0x00, 0x00, 0x00, 0x00}, // space
+	{0x00, 0x00, 0x5f, 0x00, 0x00}, // !
+	{0x00, 0x07, 0x00, 0x07, 0x00}, // "
+	{0x14, 0x7f, 0x14, 0x7f, 0x14}, // #
+	{0x24, 0x2a, 0x7f, 0x2a, 0x12}, // $
+	{0x23, 0x13, 0x08, 0x64, 0x62}, // %
+	{0x36, 0x49, 0x55, 0x22, 0x50}, // &
+	{0x00, 0x05, 0x03, 0x00, 0x00}, // '
+	{0x00, 0x1c, 0x22, 0x41, 0x00}, // (
+	{0x00, 0x41, 0x22, 0x1c, 0x00}, // )
+	{0x08, 0x2a, 0x1c, 0x2a, 0x08}, // *
+	{0x08, 0x08, 0x3e, 0x08, 0x08}, // +
+	{0x00, 0x50, 0x30, 0x00, 0x00}, // ,
+	{0x08, 0x08, 0x08, 0x08, 0x08}, // -
+	{0x00, 0x60, 0x60, 0x00, 0x00}, // .
+	{0x20, 0x10, 0x08, 0x04, 0x02}, // /
+	{0x3e, 0x51, 0x49, 0x45, 0x3e}, // 0
+	{0x00, 0x42, 0x7f, 0x40, 0x00}, // 1
+	{0x42, 0x61, 0x51, 0x49, 0x46}, // 2
+	{0x21, 0x41, 0x45, 0x4b, 0x31}, // 3
+	{0x18, 0x14, 0x12, 0x7f, 0x10}, // 4
+	{0x27, 0x45, 0x45, 0x45, 0x39}, // 5
+	{0x3c, 0x4a, 0x49, 0x49, 0x30}, // 6
+	{0x01, 0x71, 0x09, 0x05, 0x03}, // 7
+	{0x36, 0x49, 0x49, 0x49, 0x36}, // 8
+	{0x06, 0x49, 0x49, 0x29, 0x1e}, // 9
+	{0x00, 0x36, 0x36, 0x00, 0x00}, // :
+	{0x00, 0x56, 0x36, 0x00, 0x00}, // ;
+	{0x08, 0x14, 0x22, 0x41, 0x00}, // <
+	{0x14, 0x14, 0x14, 0x14, 0x14}, // =
+	{0x00, 0x41, 0x22, 0x14, 0x08}, // >
+	{0x02, 0x01, 0x51, 0x09, 0x06}, // ?
+	{0x32, 0x49, 0x79, 0x41, 0x3e}, // @
+	{0x7e, 0x11, 0x11, 0x11, 0x7e}, // A
+	{0x7f, 0x49, 0x49, 0x49, 0x36}, // B
+	{0x3e, 0x41, 0x41, 0x41, 0x22}, // C
+	{0x7f, 0x41, 0x41, 0x22, 0x1c}, // D
+	{0x7f, 0x49, 0x49, 0x49, 0x41}, // E
+	{0x7f, 0x09, 0x09, 0x09, 0x01}, // F
+	{0x3e, 0x41, 0x49, 0x49, 0x7a}, // G
+	{0x7f, 0x08, 0x08, 0x08, 0x7f}, // H
+	{0x00, 0x41, 0x7f, 0x41, 0x00}, // I
+	{0x20, 0x40, 0x41, 0x3f, 0x01}, // J
+	{0x7f, 0x08, 0x14, 0x22, 0x41}, // K
+	{0x7f, 0x40, 0x40, 0x40, 0x40}, // L
+	{0x7f, 0x02, 0x0c, 0x02, 0x7f}, // M
+	{0x7f, 0x04, 0x08, 0x10, 0x7f}, // N
+	{0x3e, 0x41, 0x41, 0x41, 0x3e}, // O
+	{0x7f, 0x09, 0x09, 0x09, 0x06}, // P
+	{0x3e, 0x41, 0x51, 0x21, 0x5e}, // Q
+	{0x7f, 0x09, 0x19, 0x29, 0x46}, // R
+	{0x46, 0x49, 0x49, 0x49, 0x31}, // S
+	{0x01, 0x01, 0x7f, 0x01, 0x01}, // T
+	{0x3f, 0x40, 0x40, 0x40, 0x3f}, // U
+	{0x1f, 0x20, 0x40, 0x20, 0x1f}, // V
+	{0x3f, 0x40, 0x38, 0x40, 0x3f}, // W
+	{0x63, 0x14, 0x08, 0x14, 0x63}, // X
+	{0x07, 0x08, 0x70, 0x08, 0x07}, // Y
+	{0x61, 0x51, 0x49, 0x45, 0x43}, // Z
+	{0x00, 0x7f, 0x41, 0x41, 0x00}, // [
+	{0x02, 0x04, 0x08, 0x10, 0x20}, // backslash
+	{0x00, 0x41, 0x41, 0x7f, 0x00}, // ]
+	{0x04, 0x02, 0x01, 0x02, 0x04}, // ^
+	{0x40, 0x40, 0x40, 0x40, 0x40}, // _
+	{0x00, 0x01, 0x02, 0x04, 0x00}, // `
+	{0x20, 0x54, 0x54, 0x54, 0x78}, // a
+	{0x7f, 0x48, 0x44, 0x44, 0x38}, // b
+	{0x38, 0x44, 0x44, 0x44, 0x20}, // c
+	{0x38, 0x44, 0x44, 0x48, 0x7f}, // d
+	{0x38, 0x54, 0x54, 0x54, 0x18}, // e
+	{0x08, 0x7e, 0x09, 0x01, 0x02}, // f
+	{0x0c, 0x52, 0x52, 0x52, 0x3e}, // g
+	{0x7f, 0x08, 0x04, 0x04, 0x78}, // h
+	{0x00, 0x44, 0x7d, 0x40, 0x00}, // i
+	{0x20, 0x40, 0x44, 0x3d, 0x00}, // j
+	{0x7f, 0x10, 0x28, 0x44, 0x00}, // k
+	{0x00, 0x41, 0x7f, 0x40, 0x00}, // l
+	{0x7c, 0x04, 0x18, 0x04, 0x78}, // m
+	{0x7c, 0x08, 0x04, 0x04, 0x78}, // n
+	{0x38, 0x44, 0x44, 0x44, 0x38}, // o
+	{0x7c, 0x14, 0x14, 0x14, 0x08}, // p
+	{0x08, 0x14, 0x14, 0x18, 0x7c}, // q
+	{0x7c, 0x08, 0x04, 0x04, 0x08}, // r
+	{0x48, 0x54, 0x54, 0x54, 0x20}, // s
+	{0x04, 0x3f, 0x44, 0x40, 0x20}, // t
+	{0x3c, 0x40, 0x40, 0x20, 0x7c}, // u
+	{0x1c, 0x20, 0x40, 0x20, 0x1c}, // v
+	{0x3c, 0x40, 0x30, 0x40, 0x3c}, // w
+	{0x44, 0x28, 0x10, 0x28, 0x44}, // x
+	{0x0c, 0x50, 0x50, 0x50, 0x3c}, // y
+	{0x44, 0x64, 0x54, 0x4c, 0x44}, // z
+	{0x00, 0x08, 0x36, 0x41, 0x00}, // {
+	{0x00, 0x00, 0x7f, 0x00, 0x00}, // |
+	{0x00, 0x41, 0x36, 0x08, 0x00}, // }
+	{0x08, 0x04, 0x08, 0x10, 0x08}, // ~
+}
@@ -0,0 +1,54 @@
+/*
+ * Copyright © 2021 A Bunch Tell LLC.
+ *
+ * This file is part of WriteFreely.
+ *
+ * WriteFreely is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License, included
+ * in the LICENSE file in this source code package.
+ */
+
+package writefreely
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestWrapCardText(t *testing.T) {
+	tests := []struct {
+		name     string
+		text     string
+		cols     int
+		maxLines int
+		want     []string
+	}{
+		{"empty", "  ", 10, 2, nil},
+		{"fits", "Hello world", 20, 2, []string{"Hello world"}},
+		{"wraps", "Hello there world", 11, 2, []string{"Hello there", "world"}},
+		{"long word", "Supercalifragilistic", 8, 3, []string{"Supercal", "ifragili", "stic"}},
+		{"overflow", "one two three four", 9, 2, []string{"one two", "three..."}},
+		{"overflow full line", "abcdefgh ij", 8, 1, []string{"abcde..."}},
+		{"transliterated", "Café über", 20, 1, []string{"Cafe uber"}},
+	}
+	for _, test := range tests {
+		if got := wrapCardText(test.text, test.cols, test.maxLines); !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%s: got %q, want %q", test.name, got, test.want)
+		}
+	}
+}
+
+func TestRenderShareCard(t *testing.T) {
+	bg := shareCardBackgrounds[0]
+	img := renderShareCard("A title", "A blog", bg)
+	if b := img.Bounds(); b.Dx() != shareCardWidth || b.Dy() != shareCardHeight {
+		t.Fatalf("got %dx%d card", b.Dx(), b.Dy())
+	}
+	if got := img.RGBAAt(shareCardWidth-1, shareCardHeight-1); got != bg {
+		t.Errorf("got background %v, want %v", got, bg)
+	}
+
+	if shareCardHash("A title", "A blog") == shareCardHash("A title", "Another blog") {
+		t.Error("cards with different text have the same hash")
+	}
+}
@@ -60,7 +60,7 @@ func handleViewSitemap(app *App, w http.ResponseWriter, r *http.Request) error {
 	}
 	c.hostName = app.cfg.App.Host
 
-	if !isSubdomain {
+	if !isSubdomain && c.Domain() == "" {
 		pre += alias + "/"
 	}
 	host = c.CanonicalURL()
@@ -94,6 +94,19 @@ func handleViewSitemap(app *App, w http.ResponseWriter, r *http.Request) error {
 		}
 		sm.Add(u)
 	}
+	pages, err := app.db.GetCollectionPages(app.cfg, c, false)
+	if err != nil {
+		log.Error("Error getting pages: %v", err)
+		return err
+	}
+	for _, p := range *pages {
+		sm.Add(stm.URL{
+			{"loc", p.Slug.String},
+			{"changefreq", "monthly"},
+			{"mobile", true},
+			{"lastmod", p.Updated},
+		})
+	}
 
 	// Add top URL
 	sm.Add(stm.URL{
@@ -0,0 +1,175 @@
+/*
+ * Copyright © 2021 A Bunch Tell LLC.
+ *
+ * This file is part of WriteFreely.
+ *
+ * WriteFreely is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License, included
+ * in the LICENSE file in this source code package.
+ */
+
+package writefreely
+
+import (
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"time"
+
+	"github.com/writeas/web-core/log"
+)
+
+const (
+	schemaContext = "https://schema.org"
+
+	// maxSchemaHeadline is the longest headline search engines will show for
+	// an article.
+	maxSchemaHeadline = 110
+)
+
+type (
+	// schemaThing holds the schema.org properties WriteFreely describes its
+	// posts and collections with, as JSON-LD.
+	schemaThing struct {
+		Context       string        `json:"@context,omitempty"`
+		Type          string        `json:"@type"`
+		ID            string        `json:"@id,omitempty"`
+		URL           string        `json:"url,omitempty"`
+		MainEntity    string        `json:"mainEntityOfPage,omitempty"`
+		Name          string        `json:"name,omitempty"`
+		Headline      string        `json:"headline,omitempty"`
+		Description   string        `json:"description,omitempty"`
+		Image         []string      `json:"image,omitempty"`
+		Language      string        `json:"inLanguage,omitempty"`
+		DatePublished string        `json:"datePublished,omitempty"`
+		DateModified  string        `json:"dateModified,omitempty"`
+		Keywords      []string      `json:"keywords,omitempty"`
+		WordCount     int           `json:"wordCount,omitempty"`
+		TimeRequired  string        `json:"timeRequired,omitempty"`
+		Author        *schemaThing  `json:"author,omitempty"`
+		IsPartOf      *schemaThing  `json:"isPartOf,omitempty"`
+		BlogPosts     []schemaThing `json:"blogPost,omitempty"`
+	}
+)
+
+func schemaDate(t time.Time) string {
+	return t.UTC().Format(time.RFC3339)
+}
+
+// jsonLD renders the given schema.org data for a
+// <script type="application/ld+json"> element. json.Marshal escapes <, > and
+// &, so the result can't close the element early.
+func jsonLD(v *schemaThing) template.JS {
+	b, err := json.Marshal(v)
+	if err != nil {
+		log.Error("Unable to marshal JSON-LD: %v", err)
+		return ""
+	}
+	return template.JS(b)
+}
+
+// schemaBlog describes the collection as a schema.org Blog.
+func (c *Collection) schemaBlog() *schemaThing {
+	return &schemaThing{
+		Type:        "Blog",
+		ID:          c.CanonicalURL(),
+		URL:         c.CanonicalURL(),
+		Name:        c.DisplayTitle(),
+		Description: c.Description,
+	}
+}
+
+// JSONLD returns the collection's schema.org Blog data, along with the posts
+// shown on the page.
+func (c *DisplayCollection) JSONLD() template.JS {
+	b := c.schemaBlog()
+	b.Context = schemaContext
+	b.Language = c.Language
+	if img := c.AvatarURL(); img != "" {
+		b.Image = []string{img}
+	}
+	if c.Posts != nil {
+		for _, p := range *c.Posts {
+			b.BlogPosts = append(b.BlogPosts, schemaThing{
+				Type:          "BlogPosting",
+				URL:           c.CanonicalURL() + p.Slug.String,
+				Headline:      schemaHeadline(p.PlainDisplayTitle()),
+				DatePublished: schemaDate(p.Created),
+			})
+		}
+	}
+	return jsonLD(b)
+}
+
+// JSONLD returns the post's schema.org BlogPosting data, or WebPage data for
+// a collection's static pages.
+func (p *PublicPost) JSONLD() template.JS {
+	u := p.CanonicalURL(p.Collection.hostName)
+	d := &schemaThing{
+		Context:       schemaContext,
+		Type:          "BlogPosting",
+		URL:           u,
+		MainEntity:    u,
+		Headline:      schemaHeadline(p.PlainDisplayTitle()),
+		Description:   p.Summary(),
+		Language:      p.Language.String,
+		DatePublished: schemaDate(p.Created),
+		DateModified:  schemaDate(p.Updated),
+		Keywords:      p.Tags,
+		WordCount:     p.WordCount,
+		IsPartOf:      p.Collection.schemaBlog(),
+	}
+	if p.IsPage {
+		d.Type = "WebPage"
+		d.DatePublished = ""
+	}
+	if p.ReadingTime > 0 {
+		d.TimeRequired = fmt.Sprintf("PT%dM", p.ReadingTime)
+	}
+	if img := p.ShareImage(); img != "" {
+		d.Image = []string{img}
+		if len(p.Images) > 1 {
+			d.Image = p.Images
+		}
+	}
+	d.Author = &schemaThing{Type: "Person", Name: p.Collection.DisplayTitle(), URL: p.Collection.CanonicalURL()}
+	if p.Author != nil {
+		d.Author.Name = p.Author.Username
+		d.Author.URL = ""
+	}
+	return jsonLD(d)
+}
+
+func schemaHeadline(s string) string {
+	r := []rune(s)
+	if len(r) <= maxSchemaHeadline {
+		return s
+	}
+	return string(r[:maxSchemaHeadline-1]) + "…"
+}
+
+// ShareImage returns the image that represents the post when it's shared: the
+// first image in it, or else a share card rendered for the post.
+func (p *PublicPost) ShareImage() string {
+	if len(p.Images) > 0 {
+		return p.Images[0]
+	}
+	if p.HasShareCard() {
+		return p.shareCardURL()
+	}
+	return p.Collection.AvatarURL()
+}
+
+// HasShareCard returns whether the post is shared with a rendered card, since
+// it doesn't have any images of its own.
+func (p *PublicPost) HasShareCard() bool {
+	return len(p.Images) == 0 && p.Collection != nil && p.Collection.IsPublic() && p.Slug.String != ""
+}
+
+// TwitterCard returns the kind of Twitter card to show for the post.
+func (p *PublicPost) TwitterCard() string {
+	if len(p.Images) > 0 || p.HasShareCard() {
+		return "summary_large_image"
+	}
+	return "summary"
+}
@@ -0,0 +1,62 @@
+/*
+ * Copyright © 2021 A Bunch Tell LLC.
+ *
+ * This file is part of WriteFreely.
+ *
+ * WriteFreely is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License, included
+ * in the LICENSE file in this source code package.
+ */
+
+package writefreely
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/guregu/null"
+	"github.com/guregu/null/zero"
+)
+
+func TestPostJSONLD(t *testing.T) {
+	created := time.Date(2021, 6, 1, 12, 0, 0, 0, time.UTC)
+	p := &PublicPost{
+		Post: &Post{
+			ID:      "abcdefghij",
+			Slug:    null.NewString("hello", true),
+			Title:   zero.NewString("Hello </script> world", true),
+			Content: "Some words here.",
+			Created: created,
+			Updated: created.Add(time.Hour),
+		},
+		Collection: &CollectionObj{Collection: Collection{Alias: "blog", Title: "My Blog", Visibility: CollPublic, hostName: "https://example.com"}},
+	}
+
+	ld := string(p.JSONLD())
+	if strings.Contains(ld, "</script>") {
+		t.Errorf("JSON-LD isn't escaped: %s", ld)
+	}
+	var d map[string]interface{}
+	if err := json.Unmarshal([]byte(ld), &d); err != nil {
+		t.Fatalf("invalid JSON-LD: %v", err)
+	}
+	if d["@type"] != "BlogPosting" || d["headline"] != "Hello </script> world" || d["url"] != "https://example.com/blog/hello" {
+		t.Errorf("unexpected JSON-LD: %s", ld)
+	}
+	if d["dateModified"] != "2021-06-01T13:00:00Z" {
+		t.Errorf("got dateModified %v", d["dateModified"])
+	}
+	if imgs, ok := d["image"].([]interface{}); !ok || len(imgs) != 1 || !strings.HasPrefix(imgs[0].(string), "https://example.com/blog/hello/card.png?v=") {
+		t.Errorf("expected share card image, got %v", d["image"])
+	}
+	if p.TwitterCard() != "summary_large_image" {
+		t.Errorf("got Twitter card %s", p.TwitterCard())
+	}
+
+	p.Images = []string{"https://example.com/a.png"}
+	if p.ShareImage() != "https://example.com/a.png" || p.HasShareCard() {
+		t.Errorf("expected post's own image, got %s", p.ShareImage())
+	}
+}
@@ -0,0 +1,479 @@
+/*
+ * Copyright © 2021 A Bunch Tell LLC.
+ *
+ * This file is part of WriteFreely.
+ *
+ * WriteFreely is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License, included
+ * in the LICENSE file in this source code package.
+ */
+
+package writefreely
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha1"
+	"database/sql"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/writeas/web-core/converter"
+	"github.com/writeas/web-core/log"
+)
+
+const (
+	syncFileExt       = ".md"
+	syncConflictExt   = ".remote"
+	frontMatterDelim  = "---"
+	syncTimeFormat    = time.RFC3339
+	syncCreatedFormat = "2006-01-02T15:04:05Z"
+)
+
+// syncedPost is a post as stored in a synced directory: a Markdown file with
+// a front matter block holding the post's metadata.
+type syncedPost struct {
+	ID       string
+	Slug     string
+	Title    string
+	Language string
+	RTL      bool
+	Created  time.Time
+	Updated  time.Time
+	Content  string
+	// Checksum is the checksum of the post as it was when the file was last
+	// synced, so local edits can be told apart.
+	Checksum string
+}
+
+// syncAction is what a sync does with a post that exists both locally and on
+// the server.
+type syncAction int
+
+const (
+	syncSkip syncAction = iota
+	syncPush
+	syncPull
+	syncConflict
+)
+
+// syncResult summarizes the changes made by a sync.
+type syncResult struct {
+	Created   int
+	Updated   int
+	Pulled    int
+	Removed   int
+	Conflicts []string
+}
+
+func newSyncedPost(p *PublicPost) *syncedPost {
+	return &syncedPost{
+		ID:       p.ID,
+		Slug:     p.Slug.String,
+		Title:    p.Title.String,
+		Language: p.Language.String,
+		RTL:      p.RTL.Bool,
+		Created:  p.Created,
+		Updated:  p.Updated,
+		Content:  p.Content,
+	}
+}
+
+// parseSyncedPost parses a Markdown file with optional front matter. Files
+// without front matter are treated as new posts.
+func parseSyncedPost(data []byte) (*syncedPost, error) {
+	sp := &syncedPost{}
+	s := strings.Replace(string(data), "\r\n", "\n", -1)
+	if !strings.HasPrefix(s, frontMatterDelim+"\n") {
+		sp.Content = s
+		return sp, nil
+	}
+
+	end := strings.Index(s[len(frontMatterDelim)+1:], "\n"+frontMatterDelim+"\n")
+	if end == -1 {
+		return nil, fmt.Errorf("front matter isn't closed")
+	}
+	meta := s[len(frontMatterDelim)+1 : len(frontMatterDelim)+1+end]
+	sp.Content = strings.TrimPrefix(s[len(frontMatterDelim)+1+end+len(frontMatterDelim)+2:], "\n")
+
+	sc := bufio.NewScanner(strings.NewReader(meta))
+	for sc.Scan() {
+		line := strings.TrimSpace(sc.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		parts := strings.SplitN(line, ":", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("invalid front matter line: %s", line)
+		}
+		k, v := strings.TrimSpace(parts[0]), strings.TrimSpace(parts[1])
+		if strings.HasPrefix(v, `"`) {
+			uv, err := strconv.Unquote(v)
+			if err != nil {
+				return nil, fmt.Errorf("invalid %s: %s", k, err)
+			}
+			v = uv
+		}
+
+		var err error
+		switch k {
+		case "id":
+			sp.ID = v
+		case "slug":
+			sp.Slug = v
+		case "title":
+			sp.Title = v
+		case "lang":
+			sp.Language = v
+		case "rtl":
+			sp.RTL, err = strconv.ParseBool(v)
+		case "created":
+			sp.Created, err = time.Parse(syncTimeFormat, v)
+		case "updated":
+			sp.Updated, err = time.Parse(syncTimeFormat, v)
+		case "checksum":
+			sp.Checksum = v
+		}
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s: %s", k, err)
+		}
+	}
+	return sp, nil
+}
+
+// Bytes returns the file contents for the post.
+func (sp *syncedPost) Bytes() []byte {
+	var b bytes.Buffer
+	b.WriteString(frontMatterDelim + "\n")
+	if sp.ID != "" {
+		fmt.Fprintf(&b, "id: %s\n", sp.ID)
+	}
+	if sp.Slug != "" {
+		fmt.Fprintf(&b, "slug: %s\n", sp.Slug)
+	}
+	if sp.Title != "" {
+		fmt.Fprintf(&b, "title: %s\n", strconv.Quote(sp.Title))
+	}
+	if sp.Language != "" {
+		fmt.Fprintf(&b, "lang: %s\n", sp.Language)
+	}
+	if sp.RTL {
+		b.WriteString("rtl: true\n")
+	}
+	if !sp.Created.IsZero() {
+		fmt.Fprintf(&b, "created: %s\n", sp.Created.UTC().Format(syncTimeFormat))
+	}
+	if !sp.Updated.IsZero() {
+		fmt.Fprintf(&b, "updated: %s\n", sp.Updated.UTC().Format(syncTimeFormat))
+	}
+	if sp.ID != "" {
+		fmt.Fprintf(&b, "checksum: %s\n", sp.checksum())
+	}
+	b.WriteString(frontMatterDelim + "\n\n")
+	b.WriteString(sp.Content)
+	return b.Bytes()
+}
+
+// checksum returns a checksum of the parts of the post that can be edited
+// locally.
+func (sp *syncedPost) checksum() string {
+	h := sha1.New()
+	fmt.Fprintf(h, "%s\x00%s\x00%s\x00%t\x00%d\x00%s", sp.Slug, sp.Title, sp.Language, sp.RTL, sp.Created.Unix(), sp.Content)
+	return hex.EncodeToString(h.Sum(nil))[:16]
+}
+
+// changedLocally returns whether the post was edited since its file was last
+// synced. Files synced before checksums were kept fall back to whether git
+// reports them changed.
+func (sp *syncedPost) changedLocally(gitChanged bool) bool {
+	if sp.Checksum == "" {
+		return gitChanged
+	}
+	return sp.Checksum != sp.checksum()
+}
+
+// syncDecision returns what to do with a local post and its version on the
+// server. Edits on either side are kept; only edits on both are a conflict.
+func syncDecision(sp *syncedPost, changedLocally bool, sv *syncedPost) syncAction {
+	changedOnServer := sv.Updated.Unix() > sp.Updated.Unix()
+	switch {
+	case !changedLocally && changedOnServer:
+		return syncPull
+	case !changedLocally:
+		return syncSkip
+	case !sp.differsFrom(sv):
+		// The file already matches the server, so only its sync state needs
+		// updating
+		return syncPull
+	case changedOnServer:
+		return syncConflict
+	}
+	return syncPush
+}
+
+// differsFrom returns whether the local post has changes that aren't on the
+// given server post.
+func (sp *syncedPost) differsFrom(p *syncedPost) bool {
+	return sp.Content != p.Content || sp.Title != p.Title ||
+		(sp.Slug != "" && sp.Slug != p.Slug) ||
+		sp.Language != p.Language || sp.RTL != p.RTL ||
+		(!sp.Created.IsZero() && sp.Created.Unix() != p.Created.Unix())
+}
+
+// submittedPost returns the post as it'd be submitted to the datastore. The
+// Created date is formatted for CreatePost when forCreate is true, and for
+// UpdateOwnedPost otherwise.
+func (sp *syncedPost) submittedPost(forCreate bool) *SubmittedPost {
+	title, content := sp.Title, sp.Content
+	p := &SubmittedPost{
+		Title:    &title,
+		Content:  &content,
+		IsRTL:    converter.NullJSONBool{sql.NullBool{Bool: sp.RTL, Valid: true}},
+		Language: converter.NullJSONString{sql.NullString{String: sp.Language, Valid: sp.Language != ""}},
+	}
+	if sp.Slug != "" {
+		slug := sp.Slug
+		p.Slug = &slug
+	}
+	if !sp.Created.IsZero() {
+		var created string
+		if forCreate {
+			created = sp.Created.UTC().Format(syncCreatedFormat)
+		} else {
+			created = sp.Created.UTC().Format(postMetaDateFormat)
+		}
+		p.Created = &created
+	}
+	return p
+}
+
+// syncCollection mirrors the given collection to dir, a directory of Markdown
+// files. Files without an ID become new posts. For the rest, edits made on
+// only one side since the file was last synced are copied to the other: a
+// file edited locally updates its post, and a post updated on the server is
+// written over its unedited file. When both changed, the file is left alone
+// and the server's version written alongside it with a .remote extension.
+// Posts without a file are then written to dir, and unedited files for posts
+// that no longer exist are removed.
+func syncCollection(app *App, c *Collection, dir string, commit bool) (*syncResult, error) {
+	err := os.MkdirAll(dir, 0755)
+	if err != nil {
+		return nil, err
+	}
+	res := &syncResult{}
+
+	isRepo := gitRun(dir, "rev-parse", "--is-inside-work-tree") == nil
+	changed, err := syncChangedFiles(dir, isRepo)
+	if err != nil {
+		return nil, err
+	}
+
+	// Load local files
+	files, err := filepath.Glob(filepath.Join(dir, "*"+syncFileExt))
+	if err != nil {
+		return nil, err
+	}
+	local := map[string]*syncedPost{}
+	localIDs := map[string]string{}
+	for _, f := range files {
+		data, err := ioutil.ReadFile(f)
+		if err != nil {
+			return nil, err
+		}
+		name := filepath.Base(f)
+		sp, err := parseSyncedPost(data)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %s", name, err)
+		}
+		local[name] = sp
+		if sp.ID != "" {
+			localIDs[sp.ID] = name
+		}
+	}
+
+	// Load server posts, with their raw content
+	posts, err := app.db.GetPosts(app.cfg, c, 0, true, false, true)
+	if err != nil {
+		return nil, err
+	}
+	server := map[string]*syncedPost{}
+	for _, p := range *posts {
+		op, err := app.db.GetOwnedPost(p.ID, c.OwnerID)
+		if err != nil {
+			if err == ErrPostUnpublished {
+				continue
+			}
+			return nil, err
+		}
+		server[p.ID] = newSyncedPost(op)
+	}
+
+	// Sync posts that have a local file
+	for name, sp := range local {
+		if sp.ID == "" {
+			p, err := app.db.CreatePost(c.OwnerID, c.ID, sp.submittedPost(true))
+			if err != nil {
+				return nil, fmt.Errorf("%s: %s", name, err)
+			}
+			err = syncPostFile(app, c, dir, name, p.ID)
+			if err != nil {
+				return nil, err
+			}
+			log.Info("Created %s from %s", p.ID, name)
+			res.Created++
+			continue
+		}
+
+		changedLocally := sp.changedLocally(changed[name])
+		sv, ok := server[sp.ID]
+		if !ok {
+			if changedLocally {
+				res.Conflicts = append(res.Conflicts, fmt.Sprintf("%s: post %s no longer exists", name, sp.ID))
+				continue
+			}
+			// The post was deleted on the server
+			err = os.Remove(filepath.Join(dir, name))
+			if err != nil {
+				return nil, err
+			}
+			res.Removed++
+			continue
+		}
+
+		switch syncDecision(sp, changedLocally, sv) {
+		case syncPush:
+			err = app.db.UpdateOwnedPost(&AuthenticatedPost{ID: sp.ID, SubmittedPost: sp.submittedPost(false)}, c.OwnerID)
+			if err != nil {
+				return nil, fmt.Errorf("%s: %s", name, err)
+			}
+			err = syncPostFile(app, c, dir, name, sp.ID)
+			if err != nil {
+				return nil, err
+			}
+			log.Info("Updated %s from %s", sp.ID, name)
+			res.Updated++
+		case syncPull:
+			err = ioutil.WriteFile(filepath.Join(dir, name), sv.Bytes(), 0644)
+			if err != nil {
+				return nil, err
+			}
+			res.Pulled++
+		case syncConflict:
+			err = ioutil.WriteFile(filepath.Join(dir, name+syncConflictExt), sv.Bytes(), 0644)
+			if err != nil {
+				return nil, err
+			}
+			res.Conflicts = append(res.Conflicts, fmt.Sprintf("%s: post %s was changed both here and on the server; server version saved to %s", name, sp.ID, name+syncConflictExt))
+		}
+	}
+
+	if res.Created+res.Updated > 0 {
+		app.pages.invalidate(c.ID)
+		app.related.queue(c.ID)
+	}
+
+	// Write server posts that don't have a file yet
+	for id, sv := range server {
+		if _, ok := localIDs[id]; ok {
+			continue
+		}
+		name := sv.Slug + syncFileExt
+		if sv.Slug == "" {
+			name = id + syncFileExt
+		} else if _, exists := local[name]; exists {
+			name = sv.Slug + "-" + id + syncFileExt
+		}
+		err = ioutil.WriteFile(filepath.Join(dir, name), sv.Bytes(), 0644)
+		if err != nil {
+			return nil, err
+		}
+		res.Pulled++
+	}
+
+	if commit && isRepo {
+		err = syncCommit(dir, c)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return res, nil
+}
+
+// syncPostFile rewrites the given file with the post as it's now stored on
+// the server.
+func syncPostFile(app *App, c *Collection, dir, name, id string) error {
+	p, err := app.db.GetOwnedPost(id, c.OwnerID)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(filepath.Join(dir, name), newSyncedPost(p).Bytes(), 0644)
+}
+
+// syncChangedFiles returns the names of files in dir that have changed since
+// the last commit. Outside of a git working tree, or before the first commit,
+// every file is considered changed.
+func syncChangedFiles(dir string, isRepo bool) (map[string]bool, error) {
+	changed := map[string]bool{}
+	if !isRepo || gitRun(dir, "rev-parse", "--verify", "-q", "HEAD") != nil {
+		files, err := filepath.Glob(filepath.Join(dir, "*"+syncFileExt))
+		if err != nil {
+			return nil, err
+		}
+		for _, f := range files {
+			changed[filepath.Base(f)] = true
+		}
+		return changed, nil
+	}
+
+	for _, args := range [][]string{
+		{"diff", "--name-only", "--relative", "-z", "HEAD", "--", "."},
+		{"ls-files", "--others", "--exclude-standard", "-z", "--", "."},
+	} {
+		out, err := gitOutput(dir, args...)
+		if err != nil {
+			return nil, err
+		}
+		for _, f := range strings.Split(string(out), "\x00") {
+			if f != "" && filepath.Dir(f) == "." {
+				changed[f] = true
+			}
+		}
+	}
+	return changed, nil
+}
+
+// syncCommit commits any changes to dir.
+func syncCommit(dir string, c *Collection) error {
+	err := gitRun(dir, "add", "-A", "--", ".")
+	if err != nil {
+		return err
+	}
+	if gitRun(dir, "diff", "--cached", "--quiet", "--", ".") == nil {
+		// Nothing to commit
+		return nil
+	}
+	return gitRun(dir, "commit", "-q", "-m", fmt.Sprintf("Sync %s", c.Alias), "--", ".")
+}
+
+func gitOutput(dir string, args ...string) ([]byte, error) {
+	cmd := exec.Command("git", append([]string{"-C", dir}, args...)...)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("git %s: %s", args[0], strings.TrimSpace(stderr.String()))
+	}
+	return out, nil
+}
+
+func gitRun(dir string, args ...string) error {
+	_, err := gitOutput(dir, args...)
+	return err
+}
@@ -0,0 +1,94 @@
+/*
+ * Copyright © 2021 A Bunch Tell LLC.
+ *
+ * This file is part of WriteFreely.
+ *
+ * WriteFreely is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License, included
+ * in the LICENSE file in this source code package.
+ */
+
+package writefreely
+
+import (
+	"testing"
+	"time"
+)
+
+func TestSyncedPostRoundTrip(t *testing.T) {
+	sp := &syncedPost{
+		ID:       "abc123",
+		Slug:     "hello-world",
+		Title:    `Hello: "World"`,
+		Language: "en",
+		RTL:      true,
+		Created:  time.Date(2021, 3, 4, 5, 6, 7, 0, time.UTC),
+		Updated:  time.Date(2021, 3, 5, 5, 6, 7, 0, time.UTC),
+		Content:  "First line.\n\n---\n\nAfter a rule.\n",
+	}
+
+	res, err := parseSyncedPost(sp.Bytes())
+	if err != nil {
+		t.Fatalf("parse: %v", err)
+	}
+	sp.Checksum = sp.checksum()
+	if *res != *sp {
+		t.Errorf("round trip = %+v, want %+v", res, sp)
+	}
+}
+
+func TestParseSyncedPostWithoutFrontMatter(t *testing.T) {
+	res, err := parseSyncedPost([]byte("Just a body.\n"))
+	if err != nil {
+		t.Fatalf("parse: %v", err)
+	}
+	if res.ID != "" || res.Content != "Just a body.\n" {
+		t.Errorf("got %+v", res)
+	}
+
+	_, err = parseSyncedPost([]byte("---\nid: abc\nNo closing delimiter.\n"))
+	if err == nil {
+		t.Error("expected error for unclosed front matter")
+	}
+}
+
+func TestSyncedPostChangedLocally(t *testing.T) {
+	sp, err := parseSyncedPost((&syncedPost{ID: "abc123", Title: "Hello", Content: "Hi.\n"}).Bytes())
+	if err != nil {
+		t.Fatalf("parse: %v", err)
+	}
+	if sp.changedLocally(true) {
+		t.Error("expected a freshly synced file to be unchanged, even if git says otherwise")
+	}
+	sp.Content = "Hi there.\n"
+	if !sp.changedLocally(false) {
+		t.Error("expected an edited file to be changed")
+	}
+
+	old := &syncedPost{ID: "abc123", Content: "Hi.\n"}
+	if !old.changedLocally(true) || old.changedLocally(false) {
+		t.Error("expected files without a checksum to rely on git")
+	}
+}
+
+func TestSyncDecision(t *testing.T) {
+	synced := time.Date(2021, 3, 5, 5, 6, 7, 0, time.UTC)
+	local := &syncedPost{ID: "abc123", Content: "Local.\n", Updated: synced}
+	tests := []struct {
+		name           string
+		changedLocally bool
+		server         *syncedPost
+		want           syncAction
+	}{
+		{"nothing changed", false, &syncedPost{ID: "abc123", Content: "Local.\n", Updated: synced}, syncSkip},
+		{"server changed", false, &syncedPost{ID: "abc123", Content: "Server.\n", Updated: synced.Add(time.Hour)}, syncPull},
+		{"local changed", true, &syncedPost{ID: "abc123", Content: "Before.\n", Updated: synced}, syncPush},
+		{"both changed", true, &syncedPost{ID: "abc123", Content: "Server.\n", Updated: synced.Add(time.Hour)}, syncConflict},
+		{"both made the same change", true, &syncedPost{ID: "abc123", Content: "Local.\n", Updated: synced.Add(time.Hour)}, syncPull},
+	}
+	for _, test := range tests {
+		if got := syncDecision(local, test.changedLocally, test.server); got != test.want {
+			t.Errorf("%s: got %d, want %d", test.name, got, test.want)
+		}
+	}
+}
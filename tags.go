@@ -0,0 +1,277 @@
+/*
+ * Copyright © 2021 A Bunch Tell LLC.
+ *
+ * This file is part of WriteFreely.
+ *
+ * WriteFreely is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License, included
+ * in the LICENSE file in this source code package.
+ */
+
+package writefreely
+
+import (
+	"fmt"
+	"net/http"
+	"regexp"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/gorilla/mux"
+	"github.com/writeas/impart"
+	"github.com/writeas/web-core/log"
+	"github.com/writeas/web-core/tags"
+)
+
+// maxTagLen is the longest tag, in bytes, that gets stored for a post.
+const maxTagLen = 100
+
+// CollectionTag is a tag used on a collection's posts.
+type CollectionTag struct {
+	Name        string `json:"name"`
+	Posts       int64  `json:"posts"`
+	Description string `json:"description,omitempty"`
+	Category    bool   `json:"category"`
+}
+
+// postTags returns the normalized tags in the given post content, which are
+// the hashtags in it, lowercased and without duplicates.
+func postTags(content string) []string {
+	found := []string{}
+	added := map[string]bool{}
+	for _, t := range tags.Extract(content) {
+		t = strings.ToLower(t)
+		if added[t] || len(t) > maxTagLen {
+			continue
+		}
+		added[t] = true
+		found = append(found, t)
+	}
+	return found
+}
+
+// isValidTag returns whether the given tag, without a leading #, would be
+// found as a hashtag in a post.
+func isValidTag(tag string) bool {
+	t := postTags("#" + tag)
+	return len(t) == 1 && t[0] == strings.ToLower(tag)
+}
+
+// replaceHashtag replaces every use of the hashtag from in the given content
+// with the hashtag to, ignoring case.
+func replaceHashtag(content, from, to string) string {
+	re := regexp.MustCompile(`(?i)#` + regexp.QuoteMeta(from))
+	var b strings.Builder
+	last := 0
+	for _, m := range re.FindAllStringIndex(content, -1) {
+		if m[0] > 0 {
+			// Only replace hashtags that start a word, and not e.g. URL
+			// fragments
+			if r, _ := utf8.DecodeLastRuneInString(content[:m[0]]); !unicode.IsSpace(r) {
+				continue
+			}
+		}
+		if m[1] < len(content) {
+			// ...and that aren't the start of a longer tag
+			if r, _ := utf8.DecodeRuneInString(content[m[1]:]); unicode.IsLetter(r) || unicode.IsDigit(r) || unicode.IsMark(r) || r == '_' {
+				continue
+			}
+		}
+		b.WriteString(content[last:m[0]])
+		b.WriteString("#" + to)
+		last = m[1]
+	}
+	b.WriteString(content[last:])
+	return b.String()
+}
+
+// handleViewCollectionTagIndex shows all tags used on a collection.
+func handleViewCollectionTagIndex(app *App, w http.ResponseWriter, r *http.Request) error {
+	vars := mux.Vars(r)
+
+	cr := &collectionReq{}
+	err := processCollectionRequest(cr, vars, w, r)
+	if err != nil {
+		return err
+	}
+
+	u, err := checkUserForCollection(app, cr, r, false)
+	if err != nil {
+		return err
+	}
+
+	c, err := processCollectionPermissions(app, cr, u, w, r)
+	if c == nil || err != nil {
+		return err
+	}
+
+	coll := newDisplayCollection(c, cr, 1)
+	displayPage := struct {
+		CollectionPage
+		Tags []CollectionTag
+	}{
+		CollectionPage: CollectionPage{
+			DisplayCollection: coll,
+			StaticPage:        pageForReq(app, r),
+			IsCustomDomain:    cr.isCustomDomain,
+		},
+	}
+	displayPage.Tags, err = app.db.GetCollectionTags(c.ID, cr.isCollOwner)
+	if err != nil {
+		return err
+	}
+
+	var owner *User
+	if u != nil {
+		displayPage.Username = u.Username
+		displayPage.IsOwner = u.ID == coll.OwnerID
+		if displayPage.IsOwner {
+			owner = u
+		}
+	}
+	isOwner := owner != nil
+	if !isOwner {
+		owner, err = app.db.GetUserByID(coll.OwnerID)
+		if err != nil {
+			// Log the error and just continue
+			log.Error("Error getting user for collection: %v", err)
+		}
+		if owner.IsSilenced() {
+			return ErrCollectionNotFound
+		}
+	}
+	displayPage.Silenced = owner != nil && owner.IsSilenced()
+	displayPage.Owner = owner
+	coll.Owner = displayPage.Owner
+	displayPage.PinnedPosts, _ = app.db.GetPinnedPosts(coll.CollectionObj, isOwner)
+	coll.Menu = getCollectionMenu(app, c)
+
+	err = templates["collection-tag-index"].ExecuteTemplate(w, "collection-tag-index", displayPage)
+	if err != nil {
+		log.Error("Unable to render collection tag index: %v", err)
+	}
+
+	return nil
+}
+
+// fetchCollectionTags returns all tags used on a collection's published
+// posts.
+func fetchCollectionTags(app *App, w http.ResponseWriter, r *http.Request) error {
+	c, err := app.db.GetCollection(mux.Vars(r)["alias"])
+	if err != nil {
+		return err
+	}
+	c.hostName = app.cfg.App.Host
+
+	userID, err := apiCheckCollectionPermissions(app, r, c)
+	if err != nil {
+		return err
+	}
+
+	t, err := app.db.GetCollectionTags(c.ID, userID == c.OwnerID)
+	if err != nil {
+		return err
+	}
+	return impart.WriteSuccess(w, t, http.StatusOK)
+}
+
+// getTaggableCollection returns the collection with the alias in the request,
+// if the given user can manage its tags. Since renaming a tag changes every
+// post that uses it, only editors can.
+func getTaggableCollection(app *App, u *User, r *http.Request) (*Collection, error) {
+	c, err := app.db.GetCollection(mux.Vars(r)["collection"])
+	if err != nil {
+		return nil, err
+	}
+	if !app.db.collectionRole(c, u.ID).CanEditAll() {
+		return nil, ErrCollectionNotFound
+	}
+	c.hostName = app.cfg.App.Host
+	return c, nil
+}
+
+func viewCollectionTags(app *App, u *User, w http.ResponseWriter, r *http.Request) error {
+	c, err := getTaggableCollection(app, u, r)
+	if err != nil {
+		return err
+	}
+
+	flashes, _ := getSessionFlashes(app, w, r, nil)
+	p := struct {
+		*UserPage
+		Collection *Collection
+		IsOwner    bool
+		Tags       []CollectionTag
+		Silenced   bool
+	}{
+		UserPage:   NewUserPage(app, r, u, "Tags", flashes),
+		Collection: c,
+		IsOwner:    c.OwnerID == u.ID,
+	}
+	p.Silenced, err = app.db.IsUserSilenced(u.ID)
+	if err != nil {
+		log.Error("view collection tags: %v", err)
+	}
+	p.Tags, err = app.db.GetCollectionTags(c.ID, true)
+	if err != nil {
+		return err
+	}
+
+	showUserPage(w, "tags", p)
+	return nil
+}
+
+// handleUpdateCollectionTag renames a tag, merges it into another one,
+// changes its description, or makes it a category.
+func handleUpdateCollectionTag(app *App, u *User, w http.ResponseWriter, r *http.Request) error {
+	if u.IsSilenced() {
+		return ErrUserSilenced
+	}
+	c, err := getTaggableCollection(app, u, r)
+	if err != nil {
+		return err
+	}
+	tag := strings.ToLower(mux.Vars(r)["tag"])
+
+	redirect := "/me/c/" + c.Alias + "/tags"
+	switch r.FormValue("action") {
+	case "rename":
+		name := strings.ToLower(strings.TrimPrefix(strings.TrimSpace(r.FormValue("name")), "#"))
+		if name == tag {
+			return impart.HTTPError{http.StatusFound, redirect}
+		}
+		if !isValidTag(name) {
+			addSessionFlash(app, w, r, fmt.Sprintf("#%s isn't a valid tag. Tags can only have letters and numbers.", name), nil)
+			return impart.HTTPError{http.StatusFound, redirect}
+		}
+		n, err := app.db.RenameCollectionTag(c.ID, tag, name)
+		if err != nil {
+			return err
+		}
+		app.related.queue(c.ID)
+		addSessionFlash(app, w, r, fmt.Sprintf("Changed #%s to #%s on %d posts.", tag, name, n), nil)
+	case "describe":
+		err = app.db.SetCollectionTagDescription(c.ID, tag, strings.TrimSpace(r.FormValue("description")))
+		if err != nil {
+			return err
+		}
+		addSessionFlash(app, w, r, fmt.Sprintf("Updated #%s.", tag), nil)
+	case "category":
+		category := r.FormValue("category") == "true"
+		err = app.db.SetCollectionTagCategory(c.ID, tag, category)
+		if err != nil {
+			return err
+		}
+		if category {
+			addSessionFlash(app, w, r, fmt.Sprintf("#%s is now a category.", tag), nil)
+		} else {
+			addSessionFlash(app, w, r, fmt.Sprintf("#%s is no longer a category.", tag), nil)
+		}
+	default:
+		return impart.HTTPError{http.StatusBadRequest, "Invalid tag action."}
+	}
+	app.pages.invalidate(c.ID)
+
+	return impart.HTTPError{http.StatusFound, redirect}
+}
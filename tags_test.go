@@ -0,0 +1,32 @@
+/*
+ * Copyright © 2021 A Bunch Tell LLC.
+ *
+ * This file is part of WriteFreely.
+ *
+ * WriteFreely is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License, included
+ * in the LICENSE file in this source code package.
+ */
+
+package writefreely
+
+import "testing"
+
+func TestReplaceHashtag(t *testing.T) {
+	tests := []struct {
+		in, want string
+	}{
+		{"#go", "#golang"},
+		{"Notes on #Go.", "Notes on #golang."},
+		{"#go #go\n#go", "#golang #golang\n#golang"},
+		{"#gopher and #go_tips", "#gopher and #go_tips"},
+		{"See https://example.com/#go", "See https://example.com/#go"},
+		{"Read ##go or a#go", "Read ##go or a#go"},
+		{"Über #go!", "Über #golang!"},
+	}
+	for _, test := range tests {
+		if got := replaceHashtag(test.in, "go", "golang"); got != test.want {
+			t.Errorf("replaceHashtag(%q) = %q, want %q", test.in, got, test.want)
+		}
+	}
+}
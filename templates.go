@@ -37,6 +37,7 @@ var (
 		"isLTR":       isLTR,
 		"localstr":    localStr,
 		"localhtml":   localHTML,
+		"localnstr":   localNStr,
 		"tolower":     strings.ToLower,
 		"title":       strings.Title,
 		"hasPrefix":   strings.HasPrefix,
@@ -60,28 +61,34 @@ func showUserPage(w http.ResponseWriter, name string, obj interface{}) {
 	}
 }
 
-func initTemplate(parentDir, name string) {
-	if debugging {
-		log.Info("  " + filepath.Join(parentDir, templatesDir, name+".tmpl"))
-	}
-
+// templateFiles returns the files the given template is parsed from: its own
+// file first, followed by the templates it includes.
+func templateFiles(parentDir, name string) []string {
 	files := []string{
 		filepath.Join(parentDir, templatesDir, name+".tmpl"),
 		filepath.Join(parentDir, templatesDir, "include", "footer.tmpl"),
 		filepath.Join(parentDir, templatesDir, "base.tmpl"),
 		filepath.Join(parentDir, templatesDir, "user", "include", "silenced.tmpl"),
 	}
-	if name == "collection" || name == "collection-tags" || name == "chorus-collection" || name == "read" {
+	if name == "collection" || name == "collection-tags" || name == "collection-series" || name == "chorus-collection" || name == "read" {
 		// These pages list out collection posts, so we also parse templatesDir + "include/posts.tmpl"
 		files = append(files, filepath.Join(parentDir, templatesDir, "include", "posts.tmpl"))
 	}
 	if name == "chorus-collection" || name == "chorus-collection-post" {
 		files = append(files, filepath.Join(parentDir, templatesDir, "user", "include", "header.tmpl"))
 	}
-	if name == "collection" || name == "collection-tags" || name == "collection-post" || name == "post" || name == "chorus-collection" || name == "chorus-collection-post" {
+	if name == "collection" || name == "collection-tags" || name == "collection-tag-index" || name == "collection-series" || name == "collection-post" || name == "post" || name == "chorus-collection" || name == "chorus-collection-post" {
 		files = append(files, filepath.Join(parentDir, templatesDir, "include", "post-render.tmpl"))
 	}
-	templates[name] = template.Must(template.New("").Funcs(funcMap).ParseFiles(files...))
+	return files
+}
+
+func initTemplate(parentDir, name string) {
+	if debugging {
+		log.Info("  " + filepath.Join(parentDir, templatesDir, name+".tmpl"))
+	}
+
+	templates[name] = template.Must(template.New("").Funcs(funcMap).ParseFiles(templateFiles(parentDir, name)...))
 }
 
 func initPage(parentDir, path, key string) {
@@ -114,6 +121,7 @@ func initUserPage(parentDir, path, key string) {
 		filepath.Join(parentDir, templatesDir, "user", "include", "footer.tmpl"),
 		filepath.Join(parentDir, templatesDir, "user", "include", "silenced.tmpl"),
 		filepath.Join(parentDir, templatesDir, "user", "include", "nav.tmpl"),
+		filepath.Join(parentDir, templatesDir, "user", "include", "jobs.tmpl"),
 	))
 }
 
@@ -195,19 +203,34 @@ func isLTR(d string) bool {
 	return d == "ltr" || d == "auto"
 }
 
+// localStr returns the given message in the given language. Interface
+// messages come from the locales catalogs, and fall back to their English
+// text.
 func localStr(term, lang string) string {
+	if s, ok := locales.String(lang, term); ok {
+		return s
+	}
 	s := l10n.Strings(lang)[term]
 	if s == "" {
 		s = l10n.Strings("")[term]
 	}
+	if s == "" {
+		s = term
+	}
 	return s
 }
 
 func localHTML(term, lang string) template.HTML {
+	if s, ok := locales.String(lang, term); ok {
+		return template.HTML(s)
+	}
 	s := l10n.Strings(lang)[term]
 	if s == "" {
 		s = l10n.Strings("")[term]
 	}
+	if s == "" {
+		return template.HTML(term)
+	}
 	s = strings.Replace(s, "write.as", "<a href=\"https://writefreely.org\">writefreely</a>", 1)
 	return template.HTML(s)
 }
@@ -0,0 +1,600 @@
+/*
+ * Copyright © 2021 A Bunch Tell LLC.
+ *
+ * This file is part of WriteFreely.
+ *
+ * WriteFreely is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License, included
+ * in the LICENSE file in this source code package.
+ */
+
+package writefreely
+
+import (
+	"archive/zip"
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"text/template/parse"
+
+	"github.com/gorilla/mux"
+	"github.com/writeas/impart"
+	"github.com/writeas/web-core/log"
+	"github.com/writefreely/writefreely/config"
+)
+
+// Themes are packages that change how collections look. A theme is a zip
+// file with a theme.json manifest, and any of: a style.css stylesheet,
+// templates/collection.tmpl and templates/collection-post.tmpl overriding the
+// collection and post pages, and files under assets/ that the stylesheet and
+// templates can link to.
+const (
+	themesDir         = "themes"
+	themeManifestFile = "theme.json"
+	themeStyleFile    = "style.css"
+	themeTemplatesDir = "templates"
+	themeAssetsDir    = "assets"
+
+	// maxThemeSize is how large an uploaded theme can be, and how much it can
+	// hold once unzipped.
+	maxThemeSize = 10 << 20
+)
+
+var (
+	validThemeID = regexp.MustCompile("^[a-z0-9]+(-[a-z0-9]+)*$")
+
+	// themeTemplates are the templates a theme can override, and the name of
+	// the template each one must define, which pages are rendered with.
+	themeTemplates = map[string]string{
+		"collection":      "collection",
+		"collection-post": "post",
+	}
+
+	// themeAssetTypes are the kinds of files a theme can include as assets.
+	themeAssetTypes = map[string]bool{
+		".css":   true,
+		".gif":   true,
+		".ico":   true,
+		".jpeg":  true,
+		".jpg":   true,
+		".otf":   true,
+		".png":   true,
+		".svg":   true,
+		".ttf":   true,
+		".webp":  true,
+		".woff":  true,
+		".woff2": true,
+	}
+
+	// themeBuiltins are the template package's built-in functions that theme
+	// templates can use, along with funcMap. Notably, `call` isn't one of
+	// them.
+	themeBuiltins = map[string]bool{
+		"and":      true,
+		"or":       true,
+		"not":      true,
+		"len":      true,
+		"index":    true,
+		"slice":    true,
+		"eq":       true,
+		"ne":       true,
+		"lt":       true,
+		"le":       true,
+		"gt":       true,
+		"ge":       true,
+		"print":    true,
+		"printf":   true,
+		"println":  true,
+		"html":     true,
+		"js":       true,
+		"urlquery": true,
+	}
+
+	themes = struct {
+		sync.RWMutex
+		m map[string]*Theme
+	}{
+		m: map[string]*Theme{},
+	}
+)
+
+type (
+	// ThemeManifest describes a theme, as read from its theme.json file.
+	ThemeManifest struct {
+		ID          string `json:"id"`
+		Name        string `json:"name"`
+		Version     string `json:"version,omitempty"`
+		Author      string `json:"author,omitempty"`
+		Description string `json:"description,omitempty"`
+		License     string `json:"license,omitempty"`
+		URL         string `json:"url,omitempty"`
+	}
+
+	// Theme is an installed theme.
+	Theme struct {
+		ThemeManifest
+		HasStyleSheet bool
+
+		templates map[string]*template.Template
+	}
+)
+
+// Overrides returns the names of the templates the theme overrides.
+func (t *Theme) Overrides() []string {
+	var names []string
+	for n := range t.templates {
+		names = append(names, n)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func themesPath(cfg *config.Config) string {
+	return filepath.Join(cfg.Server.ThemesParentDir, themesDir)
+}
+
+// getTheme returns the installed theme with the given ID, or nil if there
+// isn't one.
+func getTheme(id string) *Theme {
+	if id == "" {
+		return nil
+	}
+	themes.RLock()
+	defer themes.RUnlock()
+	return themes.m[id]
+}
+
+// installedThemes returns all installed themes, sorted by name.
+func installedThemes() []*Theme {
+	themes.RLock()
+	ts := make([]*Theme, 0, len(themes.m))
+	for _, t := range themes.m {
+		ts = append(ts, t)
+	}
+	themes.RUnlock()
+	sort.Slice(ts, func(i, j int) bool {
+		return strings.ToLower(ts[i].Name) < strings.ToLower(ts[j].Name)
+	})
+	return ts
+}
+
+// InitThemes loads all themes installed in the configured parent dir. Themes
+// that fail to load are logged and skipped.
+func InitThemes(cfg *config.Config) error {
+	dirs, err := ioutil.ReadDir(themesPath(cfg))
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	log.Info("Loading themes...")
+	m := map[string]*Theme{}
+	for _, d := range dirs {
+		if !d.IsDir() || strings.HasPrefix(d.Name(), ".") {
+			continue
+		}
+		t, err := loadTheme(cfg, filepath.Join(themesPath(cfg), d.Name()))
+		if err != nil {
+			log.Error("Unable to load theme %s: %v", d.Name(), err)
+			continue
+		}
+		if t.ID != d.Name() {
+			log.Error("Unable to load theme %s: its ID is %s", d.Name(), t.ID)
+			continue
+		}
+		m[t.ID] = t
+	}
+
+	themes.Lock()
+	themes.m = m
+	themes.Unlock()
+	return nil
+}
+
+// loadTheme reads and validates the theme in the given directory.
+func loadTheme(cfg *config.Config, dir string) (*Theme, error) {
+	b, err := ioutil.ReadFile(filepath.Join(dir, themeManifestFile))
+	if err != nil {
+		return nil, fmt.Errorf("Missing %s.", themeManifestFile)
+	}
+	t := &Theme{templates: map[string]*template.Template{}}
+	if err = json.Unmarshal(b, &t.ThemeManifest); err != nil {
+		return nil, fmt.Errorf("Invalid %s: %v", themeManifestFile, err)
+	}
+	if len(t.ID) > 40 || !validThemeID.MatchString(t.ID) {
+		return nil, fmt.Errorf("Theme ID must be made of lowercase letters, numbers, and hyphens.")
+	}
+	if strings.TrimSpace(t.Name) == "" {
+		return nil, fmt.Errorf("Theme needs a name.")
+	}
+
+	if _, err = os.Stat(filepath.Join(dir, themeStyleFile)); err == nil {
+		t.HasStyleSheet = true
+	}
+	for name := range themeTemplates {
+		src, err := ioutil.ReadFile(filepath.Join(dir, themeTemplatesDir, name+".tmpl"))
+		if os.IsNotExist(err) {
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		t.templates[name], err = parseThemeTemplate(cfg.Server.TemplatesParentDir, name, string(src))
+		if err != nil {
+			return nil, err
+		}
+	}
+	return t, nil
+}
+
+// parseThemeTemplate parses a theme's version of the given template, along
+// with the core templates it includes, so it can use them too.
+func parseThemeTemplate(parentDir, name, src string) (*template.Template, error) {
+	t, err := template.New(name).Funcs(funcMap).Parse(src)
+	if err != nil {
+		return nil, fmt.Errorf("%s.tmpl: %v", name, err)
+	}
+	if t.Lookup(themeTemplates[name]) == nil {
+		return nil, fmt.Errorf("%s.tmpl must define a %q template.", name, themeTemplates[name])
+	}
+	for _, tt := range t.Templates() {
+		if tt.Tree == nil {
+			continue
+		}
+		if err = checkThemeNode(tt.Tree.Root); err != nil {
+			return nil, fmt.Errorf("%s.tmpl: %v", name, err)
+		}
+	}
+
+	set, err := template.New("").Funcs(funcMap).ParseFiles(templateFiles(parentDir, name)[1:]...)
+	if err != nil {
+		return nil, err
+	}
+	for _, tt := range t.Templates() {
+		if tt.Tree == nil {
+			continue
+		}
+		if _, err = set.AddParseTree(tt.Name(), tt.Tree); err != nil {
+			return nil, fmt.Errorf("%s.tmpl: %v", name, err)
+		}
+	}
+	return set, nil
+}
+
+// checkThemeNode returns an error if the given part of a theme template calls
+// a function outside of those themes are allowed.
+func checkThemeNode(n parse.Node) error {
+	switch n := n.(type) {
+	case *parse.ListNode:
+		if n == nil {
+			return nil
+		}
+		for _, c := range n.Nodes {
+			if err := checkThemeNode(c); err != nil {
+				return err
+			}
+		}
+	case *parse.ActionNode:
+		return checkThemeNode(n.Pipe)
+	case *parse.PipeNode:
+		if n == nil {
+			return nil
+		}
+		for _, c := range n.Cmds {
+			if err := checkThemeNode(c); err != nil {
+				return err
+			}
+		}
+	case *parse.CommandNode:
+		for _, a := range n.Args {
+			if err := checkThemeNode(a); err != nil {
+				return err
+			}
+		}
+	case *parse.ChainNode:
+		return checkThemeNode(n.Node)
+	case *parse.IdentifierNode:
+		if _, ok := funcMap[n.Ident]; !ok && !themeBuiltins[n.Ident] {
+			return fmt.Errorf("function %q isn't available to themes", n.Ident)
+		}
+	case *parse.IfNode:
+		return checkThemeBranch(&n.BranchNode)
+	case *parse.RangeNode:
+		return checkThemeBranch(&n.BranchNode)
+	case *parse.WithNode:
+		return checkThemeBranch(&n.BranchNode)
+	case *parse.TemplateNode:
+		return checkThemeNode(n.Pipe)
+	}
+	return nil
+}
+
+func checkThemeBranch(n *parse.BranchNode) error {
+	if err := checkThemeNode(n.Pipe); err != nil {
+		return err
+	}
+	if err := checkThemeNode(n.List); err != nil {
+		return err
+	}
+	return checkThemeNode(n.ElseList)
+}
+
+// themeFilePath returns where the given file from a theme package is stored
+// once installed, or "" if it isn't a file themes can include.
+func themeFilePath(name string) string {
+	name = path.Clean(strings.TrimPrefix(name, "/"))
+	if strings.HasPrefix(name, "../") || name == ".." {
+		return ""
+	}
+	switch {
+	case name == themeManifestFile, name == themeStyleFile:
+		return name
+	case strings.HasPrefix(name, themeTemplatesDir+"/"):
+		n := strings.TrimSuffix(strings.TrimPrefix(name, themeTemplatesDir+"/"), ".tmpl")
+		if _, ok := themeTemplates[n]; ok && strings.HasSuffix(name, ".tmpl") {
+			return name
+		}
+	case strings.HasPrefix(name, themeAssetsDir+"/"):
+		for _, part := range strings.Split(name, "/") {
+			if strings.HasPrefix(part, ".") {
+				return ""
+			}
+		}
+		if themeAssetTypes[strings.ToLower(path.Ext(name))] {
+			return name
+		}
+	}
+	return ""
+}
+
+// installTheme unpacks the given theme package and loads it, replacing any
+// installed theme with the same ID.
+func installTheme(app *App, r io.ReaderAt, size int64) (*Theme, error) {
+	zr, err := zip.NewReader(r, size)
+	if err != nil {
+		return nil, fmt.Errorf("Theme must be a zip file.")
+	}
+
+	// Packages can keep everything in a single top-level folder, like the
+	// zip files code hosts generate
+	prefix := ""
+	for _, f := range zr.File {
+		if path.Base(f.Name) == themeManifestFile && strings.Count(strings.Trim(f.Name, "/"), "/") <= 1 {
+			prefix = strings.TrimSuffix(f.Name, themeManifestFile)
+			break
+		}
+	}
+
+	err = os.MkdirAll(themesPath(app.cfg), 0755)
+	if err != nil {
+		return nil, err
+	}
+	tmpDir, err := ioutil.TempDir(themesPath(app.cfg), ".install-")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(tmpDir)
+
+	var total int64
+	for _, f := range zr.File {
+		if f.FileInfo().IsDir() || !strings.HasPrefix(f.Name, prefix) {
+			continue
+		}
+		name := themeFilePath(strings.TrimPrefix(f.Name, prefix))
+		if name == "" {
+			// Skip anything else, like READMEs and licenses
+			continue
+		}
+		n, err := extractThemeFile(f, filepath.Join(tmpDir, filepath.FromSlash(name)), maxThemeSize-total)
+		if err != nil {
+			return nil, err
+		}
+		total += n
+	}
+
+	t, err := loadTheme(app.cfg, tmpDir)
+	if err != nil {
+		return nil, err
+	}
+
+	themes.Lock()
+	defer themes.Unlock()
+	dir := filepath.Join(themesPath(app.cfg), t.ID)
+	if err = os.RemoveAll(dir); err != nil {
+		return nil, err
+	}
+	if err = os.Rename(tmpDir, dir); err != nil {
+		return nil, err
+	}
+	themes.m[t.ID] = t
+	return t, nil
+}
+
+// extractThemeFile writes the given file from a theme package to dst,
+// failing if it's larger than the given limit.
+func extractThemeFile(f *zip.File, dst string, limit int64) (int64, error) {
+	rc, err := f.Open()
+	if err != nil {
+		return 0, fmt.Errorf("Unable to read %s.", f.Name)
+	}
+	defer rc.Close()
+
+	if err = os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+		return 0, err
+	}
+	out, err := os.Create(dst)
+	if err != nil {
+		return 0, err
+	}
+	defer out.Close()
+
+	n, err := io.Copy(out, io.LimitReader(rc, limit+1))
+	if err != nil {
+		return n, fmt.Errorf("Unable to read %s.", f.Name)
+	}
+	if n > limit {
+		return n, fmt.Errorf("Theme is too large. It can be at most %d MB unzipped.", maxThemeSize>>20)
+	}
+	return n, nil
+}
+
+// uninstallTheme removes the theme with the given ID. Collections using it go
+// back to the default look.
+func uninstallTheme(app *App, id string) error {
+	themes.Lock()
+	defer themes.Unlock()
+	if _, ok := themes.m[id]; !ok {
+		return impart.HTTPError{http.StatusNotFound, "Theme not found."}
+	}
+	if err := os.RemoveAll(filepath.Join(themesPath(app.cfg), id)); err != nil {
+		return err
+	}
+	delete(themes.m, id)
+	return nil
+}
+
+// invalidateThemeCollections clears cached pages for collections using the
+// given theme.
+func invalidateThemeCollections(app *App, id string) {
+	rows, err := app.db.Query("SELECT collection_id FROM collectionattributes WHERE attribute = ? AND value = ?", "theme", id)
+	if err != nil {
+		log.Error("Unable to get collections using theme %s: %v", id, err)
+		return
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var collID int64
+		if err = rows.Scan(&collID); err != nil {
+			log.Error("Unable to scan collection ID: %v", err)
+			continue
+		}
+		app.pages.invalidate(collID)
+	}
+}
+
+// ThemeName returns the ID of the collection's theme, or "" if it uses the
+// default one.
+func (c *Collection) ThemeName() string {
+	id := c.db.GetCollectionAttribute(c.ID, "theme")
+	if getTheme(id) == nil {
+		return ""
+	}
+	return id
+}
+
+// ThemeStyleSheet returns the URL of the stylesheet of the collection's theme,
+// if it has one.
+func (c *Collection) ThemeStyleSheet() string {
+	t := getTheme(c.ThemeName())
+	if t == nil || !t.HasStyleSheet {
+		return ""
+	}
+	return "/" + themesDir + "/" + t.ID + "/" + themeStyleFile
+}
+
+// collectionTemplate returns the template that the given page of the
+// collection is rendered with: its theme's version, if it overrides it, or
+// otherwise the core one.
+func collectionTemplate(c *Collection, name string) *template.Template {
+	if t := getTheme(c.ThemeName()); t != nil {
+		if tmpl, ok := t.templates[name]; ok {
+			return tmpl
+		}
+	}
+	return templates[name]
+}
+
+// handleViewThemeFile serves the stylesheet and assets of installed themes.
+func handleViewThemeFile(app *App, w http.ResponseWriter, r *http.Request) error {
+	vars := mux.Vars(r)
+	t := getTheme(vars["theme"])
+	name := themeFilePath(vars["file"])
+	if t == nil || (name != themeStyleFile && !strings.HasPrefix(name, themeAssetsDir+"/")) {
+		return impart.HTTPError{http.StatusNotFound, "File not found."}
+	}
+
+	// Assets can't run scripts of their own, e.g. in SVG images
+	w.Header().Set("Content-Security-Policy", "default-src 'none'; style-src 'unsafe-inline'; img-src 'self' data:; font-src 'self'; sandbox")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.Header().Set("Cache-Control", "public, max-age=86400")
+	http.ServeFile(w, r, filepath.Join(themesPath(app.cfg), t.ID, filepath.FromSlash(name)))
+	return nil
+}
+
+func handleViewAdminThemes(app *App, u *User, w http.ResponseWriter, r *http.Request) error {
+	p := struct {
+		*UserPage
+		*AdminPage
+		Config  config.AppCfg
+		Message string
+		Errors  []string
+
+		Themes []*Theme
+	}{
+		UserPage:  NewUserPage(app, r, u, "Themes", nil),
+		AdminPage: NewAdminPage(app),
+		Config:    app.cfg.App,
+		Themes:    installedThemes(),
+	}
+
+	flashes, _ := getSessionFlashes(app, w, r, nil)
+	for _, flash := range flashes {
+		if strings.HasPrefix(flash, "SUCCESS: ") {
+			p.Message = strings.TrimPrefix(flash, "SUCCESS: ")
+		} else {
+			p.Errors = append(p.Errors, flash)
+		}
+	}
+
+	showUserPage(w, "themes", p)
+	return nil
+}
+
+func handleAdminInstallTheme(app *App, u *User, w http.ResponseWriter, r *http.Request) error {
+	r.Body = http.MaxBytesReader(w, r.Body, maxThemeSize+(1<<20))
+	r.ParseMultipartForm(maxThemeSize)
+
+	file, fh, err := r.FormFile("theme")
+	if err != nil {
+		_ = addSessionFlash(app, w, r, "Select a theme (.zip) file to install.", nil)
+		return impart.HTTPError{http.StatusFound, "/admin/themes"}
+	}
+	defer file.Close()
+
+	t, err := installTheme(app, file, fh.Size)
+	if err != nil {
+		log.Error("install theme: %v", err)
+		_ = addSessionFlash(app, w, r, "Unable to install theme: "+err.Error(), nil)
+		return impart.HTTPError{http.StatusFound, "/admin/themes"}
+	}
+	invalidateThemeCollections(app, t.ID)
+
+	_ = addSessionFlash(app, w, r, fmt.Sprintf("SUCCESS: Installed %s.", t.Name), nil)
+	return impart.HTTPError{http.StatusFound, "/admin/themes"}
+}
+
+func handleAdminDeleteTheme(app *App, u *User, w http.ResponseWriter, r *http.Request) error {
+	id := mux.Vars(r)["theme"]
+	err := uninstallTheme(app, id)
+	if err != nil {
+		if herr, ok := err.(impart.HTTPError); ok {
+			return herr
+		}
+		log.Error("uninstall theme %s: %v", id, err)
+		return impart.HTTPError{http.StatusInternalServerError, "Unable to remove theme."}
+	}
+	invalidateThemeCollections(app, id)
+
+	_ = addSessionFlash(app, w, r, "SUCCESS: Removed theme.", nil)
+	return impart.HTTPError{http.StatusFound, "/admin/themes"}
+}
@@ -0,0 +1,123 @@
+/*
+ * Copyright © 2021 A Bunch Tell LLC.
+ *
+ * This file is part of WriteFreely.
+ *
+ * WriteFreely is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License, included
+ * in the LICENSE file in this source code package.
+ */
+
+package writefreely
+
+import (
+	"archive/zip"
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/writefreely/writefreely/author"
+	"github.com/writefreely/writefreely/config"
+)
+
+func TestParseThemeTemplate(t *testing.T) {
+	tests := []struct {
+		name string
+		src  string
+		ok   bool
+	}{
+		{"plain", `{{define "post"}}<h1>{{.PlainDisplayTitle}}</h1>{{end}}`, true},
+		{"funcMap", `{{define "post"}}{{if gt .Views 1}}{{largeNumFmt .Views}}{{end}}{{template "collection-meta" .}}{{end}}`, true},
+		{"nested", `{{define "post"}}{{range .Tags}}{{with .}}{{printf "%s" (tolower .)}}{{end}}{{end}}{{end}}`, true},
+		{"missing entry", `{{define "collection"}}{{end}}`, false},
+		{"call", `{{define "post"}}{{call .Something}}{{end}}`, false},
+		{"call in branch", `{{define "post"}}{{if .Title}}{{else}}{{with call .Something}}{{end}}{{end}}{{end}}`, false},
+		{"unknown func", `{{define "post"}}{{readFile "/etc/passwd"}}{{end}}`, false},
+	}
+	for _, test := range tests {
+		_, err := parseThemeTemplate("", "collection-post", test.src)
+		if (err == nil) != test.ok {
+			t.Errorf("%s: got error %v", test.name, err)
+		}
+	}
+}
+
+func TestThemeFilePath(t *testing.T) {
+	tests := map[string]string{
+		"theme.json":                    "theme.json",
+		"/style.css":                    "style.css",
+		"templates/collection.tmpl":     "templates/collection.tmpl",
+		"templates/base.tmpl":           "",
+		"assets/img/bg.PNG":             "assets/img/bg.PNG",
+		"assets/../../../etc/passwd":    "",
+		"assets/.hidden.png":            "",
+		"assets/script.js":              "",
+		"../theme.json":                 "",
+		"README.md":                     "",
+		"assets/../templates/post.tmpl": "",
+	}
+	for name, want := range tests {
+		if got := themeFilePath(name); got != want {
+			t.Errorf("%s: got %q, want %q", name, got, want)
+		}
+	}
+}
+
+func TestThemesPathReserved(t *testing.T) {
+	// Theme files are served from /themes/, so no user or blog can take it
+	cfg := config.New()
+	cfg.Server.PagesParentDir = "."
+	for _, name := range []string{"themes", "theme"} {
+		if author.IsValidUsername(cfg, name) {
+			t.Errorf("Expected %q to be reserved", name)
+		}
+	}
+}
+
+func TestInstallTheme(t *testing.T) {
+	dir, err := ioutil.TempDir("", "wf-themes")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	app := &App{cfg: &config.Config{}}
+	app.cfg.Server.ThemesParentDir = dir
+
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	files := map[string]string{
+		"paper-main/theme.json":                     `{"id": "paper", "name": "Paper", "version": "1.0"}`,
+		"paper-main/style.css":                      `body { background: white; }`,
+		"paper-main/templates/collection-post.tmpl": `{{define "post"}}{{.PlainDisplayTitle}}{{end}}`,
+		"paper-main/assets/bg.png":                  "png",
+		"paper-main/README.md":                      "# Paper",
+	}
+	for name, content := range files {
+		f, err := zw.Create(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		f.Write([]byte(content))
+	}
+	zw.Close()
+
+	th, err := installTheme(app, bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+	if err != nil {
+		t.Fatalf("install: %v", err)
+	}
+	defer uninstallTheme(app, th.ID)
+	if th.ID != "paper" || !th.HasStyleSheet || len(th.Overrides()) != 1 {
+		t.Errorf("unexpected theme: %+v", th)
+	}
+	if getTheme("paper") != th {
+		t.Error("theme wasn't registered")
+	}
+	if _, err := os.Stat(filepath.Join(dir, themesDir, "paper", "assets", "bg.png")); err != nil {
+		t.Errorf("asset wasn't installed: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, themesDir, "paper", "README.md")); !os.IsNotExist(err) {
+		t.Error("unexpected file was installed")
+	}
+}
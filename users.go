@@ -81,8 +81,8 @@ type (
 
 	ExportUser struct {
 		*User
-		Collections    *[]CollectionObj `json:"collections"`
-		AnonymousPosts []PublicPost     `json:"posts"`
+		Collections    *[]exportCollection `json:"collections"`
+		AnonymousPosts []PublicPost        `json:"posts"`
 	}
 
 	PublicUser struct {
@@ -0,0 +1,293 @@
+/*
+ * Copyright © 2021 A Bunch Tell LLC.
+ *
+ * This file is part of WriteFreely.
+ *
+ * WriteFreely is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License, included
+ * in the LICENSE file in this source code package.
+ */
+
+package writefreely
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/writeas/web-core/log"
+)
+
+const (
+	// viewFlushInterval is how often counted views are written to the
+	// database.
+	viewFlushInterval = 30 * time.Second
+	// viewWindow is how long repeat views by the same visitor are ignored.
+	viewWindow = 30 * time.Minute
+)
+
+// viewKey identifies a post's daily view stats for a single source and
+// referrer.
+type viewKey struct {
+	PostID   string
+	Day      time.Time
+	Source   viewSource
+	Referrer string
+}
+
+// viewBatch holds view counts that haven't been written to the database yet.
+type viewBatch struct {
+	Posts       map[string]int64
+	Collections map[int64]int64
+	PostStats   map[viewKey]int64
+}
+
+func newViewBatch() *viewBatch {
+	return &viewBatch{
+		Posts:       map[string]int64{},
+		Collections: map[int64]int64{},
+		PostStats:   map[viewKey]int64{},
+	}
+}
+
+func (b *viewBatch) empty() bool {
+	return len(b.Posts) == 0 && len(b.Collections) == 0 && len(b.PostStats) == 0
+}
+
+// merge adds the counts in o to the batch.
+func (b *viewBatch) merge(o *viewBatch) {
+	for k, n := range o.Posts {
+		b.Posts[k] += n
+	}
+	for k, n := range o.Collections {
+		b.Collections[k] += n
+	}
+	for k, n := range o.PostStats {
+		b.PostStats[k] += n
+	}
+}
+
+// viewStore saves batches of view counts.
+type viewStore interface {
+	AddViews(b *viewBatch) error
+	IsFediverseHost(host string) bool
+}
+
+// viewCounter counts post and collection views in memory, and writes them to
+// the database in batches, instead of updating it on every view.
+//
+// Repeat views by the same visitor within viewWindow are only counted once.
+// Visitors are told apart by a hash of their IP address and user agent, salted
+// with a random value that's replaced every window, and none of this leaves
+// memory.
+type viewCounter struct {
+	store    viewStore
+	interval time.Duration
+	window   time.Duration
+
+	// trustProxy is whether to take visitors' IP addresses from the headers
+	// set by a reverse proxy.
+	trustProxy bool
+	// federation is whether to tell views from fediverse instances apart
+	// from other web referrers.
+	federation bool
+
+	mu          sync.Mutex
+	batch       *viewBatch
+	seen        map[[sha256.Size]byte]struct{}
+	salt        []byte
+	windowStart time.Time
+
+	quit chan struct{}
+	wg   sync.WaitGroup
+}
+
+func newViewCounter(store viewStore, interval, window time.Duration) *viewCounter {
+	vc := &viewCounter{
+		store:    store,
+		interval: interval,
+		window:   window,
+		batch:    newViewBatch(),
+		quit:     make(chan struct{}),
+	}
+	vc.resetWindow(time.Now())
+	return vc
+}
+
+func initViewCounter(app *App) {
+	app.views = newViewCounter(app.db, viewFlushInterval, viewWindow)
+	app.views.trustProxy = app.cfg.Server.TrustProxy
+	app.views.federation = app.cfg.App.Federation
+	app.views.start()
+}
+
+// start periodically flushes counted views until the counter is stopped.
+func (vc *viewCounter) start() {
+	vc.wg.Add(1)
+	go func() {
+		defer vc.wg.Done()
+		t := time.NewTicker(vc.interval)
+		defer t.Stop()
+		for {
+			select {
+			case <-vc.quit:
+				return
+			case <-t.C:
+				vc.flush()
+			}
+		}
+	}()
+}
+
+// stop ends periodic flushing and writes any remaining views.
+func (vc *viewCounter) stop() {
+	log.Info("Saving view counts...")
+	close(vc.quit)
+	vc.wg.Wait()
+	vc.flush()
+}
+
+// flush writes all counted views to the store. If that fails, the views are
+// kept for the next flush.
+func (vc *viewCounter) flush() error {
+	vc.mu.Lock()
+	b := vc.batch
+	vc.batch = newViewBatch()
+	vc.mu.Unlock()
+
+	if b.empty() {
+		return nil
+	}
+	if vc.federation {
+		vc.classifyReferrers(b)
+	}
+	err := vc.store.AddViews(b)
+	if err != nil {
+		log.Error("Unable to save view counts: %v", err)
+		vc.mu.Lock()
+		vc.batch.merge(b)
+		vc.mu.Unlock()
+	}
+	return err
+}
+
+// classifyReferrers moves the web views in the batch that came from fediverse
+// instances to sourceFediverse. Each referring domain is only looked up once
+// per batch, instead of on every view.
+func (vc *viewCounter) classifyReferrers(b *viewBatch) {
+	fediverse := map[string]bool{}
+	for k, n := range b.PostStats {
+		if k.Source != sourceWeb || k.Referrer == "" {
+			continue
+		}
+		isFedi, ok := fediverse[k.Referrer]
+		if !ok {
+			isFedi = vc.store.IsFediverseHost(k.Referrer)
+			fediverse[k.Referrer] = isFedi
+		}
+		if isFedi {
+			delete(b.PostStats, k)
+			k.Source = sourceFediverse
+			b.PostStats[k] += n
+		}
+	}
+}
+
+// resetWindow starts a new window for telling repeat views apart. Callers
+// must hold vc.mu, or be the constructor.
+func (vc *viewCounter) resetWindow(now time.Time) {
+	vc.seen = map[[sha256.Size]byte]struct{}{}
+	vc.salt = make([]byte, 16)
+	rand.Read(vc.salt)
+	vc.windowStart = now
+}
+
+// firstView returns whether this is the first time the visitor making the
+// given request has viewed the target in the current window. Callers must hold
+// vc.mu.
+func (vc *viewCounter) firstView(r *http.Request, target string) bool {
+	now := time.Now()
+	if now.Sub(vc.windowStart) >= vc.window {
+		vc.resetWindow(now)
+	}
+
+	h := sha256.New()
+	h.Write(vc.salt)
+	h.Write([]byte(visitorIP(r, vc.trustProxy)))
+	h.Write([]byte{0})
+	h.Write([]byte(r.UserAgent()))
+	h.Write([]byte{0})
+	h.Write([]byte(target))
+	var k [sha256.Size]byte
+	copy(k[:], h.Sum(nil))
+
+	if _, ok := vc.seen[k]; ok {
+		return false
+	}
+	vc.seen[k] = struct{}{}
+	return true
+}
+
+// addPostView counts a view of the given post, and returns whether it was
+// counted.
+func (vc *viewCounter) addPostView(r *http.Request, postID string) bool {
+	vc.mu.Lock()
+	defer vc.mu.Unlock()
+	if !vc.firstView(r, "p:"+postID) {
+		return false
+	}
+	vc.batch.Posts[postID]++
+	return true
+}
+
+// addPostStats adds a view to the post's daily stats.
+func (vc *viewCounter) addPostStats(postID string, t time.Time, src viewSource, referrer string) {
+	k := viewKey{
+		PostID:   postID,
+		Day:      t.UTC().Truncate(24 * time.Hour),
+		Source:   src,
+		Referrer: referrer,
+	}
+	vc.mu.Lock()
+	vc.batch.PostStats[k]++
+	vc.mu.Unlock()
+}
+
+// addCollectionView counts a view of the given collection, and returns whether
+// it was counted.
+func (vc *viewCounter) addCollectionView(r *http.Request, collID int64) bool {
+	vc.mu.Lock()
+	defer vc.mu.Unlock()
+	if !vc.firstView(r, "c:"+strconv.FormatInt(collID, 10)) {
+		return false
+	}
+	vc.batch.Collections[collID]++
+	return true
+}
+
+// visitorIP returns the IP address of the client making the request. The
+// headers set by a reverse proxy are only used when trustProxy is set, since
+// anyone can send them otherwise. Even then, only the address the proxy itself
+// saw is used: X-Real-IP, or the last entry it appended to X-Forwarded-For,
+// as the ones before it come from the client.
+func visitorIP(r *http.Request, trustProxy bool) string {
+	if trustProxy {
+		if ip := strings.TrimSpace(r.Header.Get("X-Real-IP")); ip != "" {
+			return ip
+		}
+		if fwd := r.Header.Get("X-Forwarded-For"); fwd != "" {
+			hops := strings.Split(fwd, ",")
+			return strings.TrimSpace(hops[len(hops)-1])
+		}
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
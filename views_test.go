@@ -0,0 +1,241 @@
+/*
+ * Copyright © 2021 A Bunch Tell LLC.
+ *
+ * This file is part of WriteFreely.
+ *
+ * WriteFreely is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License, included
+ * in the LICENSE file in this source code package.
+ */
+
+package writefreely
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+// memViewStore is a viewStore that keeps view counts in memory, and can be
+// made to fail.
+type memViewStore struct {
+	mu      sync.Mutex
+	fail    bool
+	flushes int
+	views   *viewBatch
+
+	fediHosts   map[string]bool
+	hostLookups int
+}
+
+func (s *memViewStore) AddViews(b *viewBatch) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.fail {
+		return errors.New("database is locked")
+	}
+	s.flushes++
+	s.views.merge(b)
+	return nil
+}
+
+func (s *memViewStore) IsFediverseHost(host string) bool {
+	s.hostLookups++
+	return s.fediHosts[host]
+}
+
+func newTestViewCounter() (*viewCounter, *memViewStore) {
+	s := &memViewStore{views: newViewBatch()}
+	return newViewCounter(s, time.Hour, time.Hour), s
+}
+
+func viewRequest(ip, ua string) *http.Request {
+	r := httptest.NewRequest("GET", "/blog/post", nil)
+	r.RemoteAddr = ip + ":1234"
+	r.Header.Set("User-Agent", ua)
+	return r
+}
+
+func TestViewCounterDeduplicatesVisitors(t *testing.T) {
+	vc, s := newTestViewCounter()
+
+	alice := viewRequest("10.0.0.1", "Firefox")
+	bob := viewRequest("10.0.0.2", "Firefox")
+	for i := 0; i < 3; i++ {
+		vc.addPostView(alice, "post1")
+	}
+	vc.addPostView(bob, "post1")
+	vc.addPostView(alice, "post2")
+	vc.addCollectionView(alice, 1)
+	vc.addCollectionView(alice, 1)
+
+	if err := vc.flush(); err != nil {
+		t.Fatalf("flush: %v", err)
+	}
+	if n := s.views.Posts["post1"]; n != 2 {
+		t.Errorf("post1 views = %d, want 2", n)
+	}
+	if n := s.views.Posts["post2"]; n != 1 {
+		t.Errorf("post2 views = %d, want 1", n)
+	}
+	if n := s.views.Collections[1]; n != 1 {
+		t.Errorf("collection views = %d, want 1", n)
+	}
+}
+
+func TestViewCounterCountsAgainAfterWindow(t *testing.T) {
+	vc, s := newTestViewCounter()
+	r := viewRequest("10.0.0.1", "Firefox")
+
+	vc.addPostView(r, "post1")
+	vc.windowStart = vc.windowStart.Add(-2 * vc.window)
+	vc.addPostView(r, "post1")
+
+	vc.flush()
+	if n := s.views.Posts["post1"]; n != 2 {
+		t.Errorf("post1 views = %d, want 2", n)
+	}
+}
+
+func TestViewCounterConcurrentViews(t *testing.T) {
+	vc, s := newTestViewCounter()
+
+	const visitors = 50
+	var wg sync.WaitGroup
+	for i := 0; i < visitors; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			r := viewRequest(fmt.Sprintf("10.0.1.%d", i), "Firefox")
+			if vc.addPostView(r, "post1") {
+				vc.addPostStats("post1", time.Now(), sourceDirect, "")
+			}
+			if i%10 == 0 {
+				vc.flush()
+			}
+		}(i)
+	}
+	wg.Wait()
+	vc.flush()
+
+	if n := s.views.Posts["post1"]; n != visitors {
+		t.Errorf("post1 views = %d, want %d", n, visitors)
+	}
+	var stats int64
+	for k, n := range s.views.PostStats {
+		if k.PostID == "post1" {
+			stats += n
+		}
+	}
+	if stats != visitors {
+		t.Errorf("post1 daily stats = %d, want %d", stats, visitors)
+	}
+}
+
+func TestViewCounterKeepsViewsWhenFlushFails(t *testing.T) {
+	vc, s := newTestViewCounter()
+
+	s.fail = true
+	vc.addPostView(viewRequest("10.0.0.1", "Firefox"), "post1")
+	if err := vc.flush(); err == nil {
+		t.Fatal("expected flush to fail")
+	}
+	vc.addPostView(viewRequest("10.0.0.2", "Firefox"), "post1")
+
+	s.fail = false
+	if err := vc.flush(); err != nil {
+		t.Fatalf("flush: %v", err)
+	}
+	if n := s.views.Posts["post1"]; n != 2 {
+		t.Errorf("post1 views = %d, want 2", n)
+	}
+}
+
+func TestViewCounterFlushesOnStop(t *testing.T) {
+	vc, s := newTestViewCounter()
+	vc.start()
+
+	vc.addPostView(viewRequest("10.0.0.1", "Firefox"), "post1")
+	vc.addCollectionView(viewRequest("10.0.0.1", "Firefox"), 7)
+	vc.stop()
+
+	if s.flushes != 1 {
+		t.Errorf("flushes = %d, want 1", s.flushes)
+	}
+	if n := s.views.Posts["post1"]; n != 1 {
+		t.Errorf("post1 views = %d, want 1", n)
+	}
+	if n := s.views.Collections[7]; n != 1 {
+		t.Errorf("collection views = %d, want 1", n)
+	}
+}
+
+func TestViewCounterClassifiesFediverseReferrers(t *testing.T) {
+	vc, s := newTestViewCounter()
+	s.fediHosts = map[string]bool{"mastodon.example": true}
+	now := time.Now()
+
+	vc.addPostStats("post1", now, sourceWeb, "mastodon.example")
+	vc.addPostStats("post1", now, sourceWeb, "mastodon.example")
+	vc.addPostStats("post2", now, sourceWeb, "mastodon.example")
+	vc.addPostStats("post1", now, sourceWeb, "news.example")
+	vc.addPostStats("post1", now, sourceDirect, "")
+
+	// Without federation, referrers are left alone
+	vc.flush()
+	if s.hostLookups != 0 {
+		t.Errorf("host lookups without federation = %d, want 0", s.hostLookups)
+	}
+
+	vc.federation = true
+	vc.addPostStats("post1", now, sourceWeb, "mastodon.example")
+	vc.addPostStats("post1", now, sourceWeb, "mastodon.example")
+	vc.addPostStats("post2", now, sourceWeb, "mastodon.example")
+	vc.addPostStats("post1", now, sourceWeb, "news.example")
+	vc.addPostStats("post1", now, sourceReader, "")
+	vc.flush()
+	if s.hostLookups != 2 {
+		t.Errorf("host lookups = %d, want one per domain", s.hostLookups)
+	}
+
+	day := now.UTC().Truncate(24 * time.Hour)
+	tests := []struct {
+		k    viewKey
+		want int64
+	}{
+		{viewKey{"post1", day, sourceWeb, "mastodon.example"}, 2},
+		{viewKey{"post1", day, sourceFediverse, "mastodon.example"}, 2},
+		{viewKey{"post2", day, sourceFediverse, "mastodon.example"}, 1},
+		{viewKey{"post1", day, sourceWeb, "news.example"}, 2},
+		{viewKey{"post1", day, sourceReader, ""}, 1},
+	}
+	for _, test := range tests {
+		if n := s.views.PostStats[test.k]; n != test.want {
+			t.Errorf("%+v views = %d, want %d", test.k, n, test.want)
+		}
+	}
+}
+
+func TestVisitorIP(t *testing.T) {
+	r := viewRequest("10.0.0.1", "Firefox")
+	if ip := visitorIP(r, false); ip != "10.0.0.1" {
+		t.Errorf("visitorIP = %q, want 10.0.0.1", ip)
+	}
+	// The first entry is whatever the client sent; the proxy appends the
+	// address it saw
+	r.Header.Set("X-Forwarded-For", "203.0.113.9, 192.0.2.5")
+	if ip := visitorIP(r, false); ip != "10.0.0.1" {
+		t.Errorf("visitorIP without trusted proxy = %q, want 10.0.0.1", ip)
+	}
+	if ip := visitorIP(r, true); ip != "192.0.2.5" {
+		t.Errorf("visitorIP = %q, want 192.0.2.5", ip)
+	}
+	r.Header.Set("X-Real-IP", "192.0.2.7")
+	if ip := visitorIP(r, true); ip != "192.0.2.7" {
+		t.Errorf("visitorIP with X-Real-IP = %q, want 192.0.2.7", ip)
+	}
+}